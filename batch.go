@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// levelBatch is a batch of writes over a LevelDB database, written atomically
+// with a single call to Write once committed. Reads see the writes pending in
+// the batch over the current state of the database.
+//
+// Unlike a leveldb.Transaction, which flushes its writes to a new table when
+// committed, a batch is written through the journal and memtable, making it
+// far cheaper for the small writes of a single operation. It is not isolated
+// from other writers however, so the store's lock must be held for its life.
+type levelBatch struct {
+	db      *leveldb.DB
+	batch   *leveldb.Batch
+	pending map[string]pendingWrite
+}
+
+// pendingWrite is a write to a key which has not yet been committed.
+type pendingWrite struct {
+	value   []byte
+	deleted bool
+}
+
+func (db levelDB) OpenBatch() (transaction, error) {
+	return &levelBatch{
+		db:      db.DB,
+		batch:   new(leveldb.Batch),
+		pending: map[string]pendingWrite{},
+	}, nil
+}
+
+func (b *levelBatch) Has(key []byte, ro *opt.ReadOptions) (bool, error) {
+	if w, ok := b.pending[string(key)]; ok {
+		return !w.deleted, nil
+	}
+
+	return b.db.Has(key, ro)
+}
+
+func (b *levelBatch) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	if w, ok := b.pending[string(key)]; ok {
+		if w.deleted {
+			return nil, leveldb.ErrNotFound
+		}
+
+		return append([]byte{}, w.value...), nil
+	}
+
+	return b.db.Get(key, ro)
+}
+
+func (b *levelBatch) Put(key, value []byte, _ *opt.WriteOptions) error {
+	b.batch.Put(key, value)
+	b.pending[string(key)] = pendingWrite{value: append([]byte{}, value...)}
+
+	return nil
+}
+
+func (b *levelBatch) Delete(key []byte, _ *opt.WriteOptions) error {
+	b.batch.Delete(key)
+	b.pending[string(key)] = pendingWrite{deleted: true}
+
+	return nil
+}
+
+// NewIterator returns an iterator over the keys within the range. Once writes
+// are pending, the range is read eagerly with the pending writes merged in,
+// so the iterator is unaffected by later writes in the batch.
+func (b *levelBatch) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	if len(b.pending) == 0 {
+		return b.db.NewIterator(slice, ro)
+	}
+
+	merged := map[string][]byte{}
+
+	iter := b.db.NewIterator(slice, ro)
+	for iter.Next() {
+		merged[string(iter.Key())] = append([]byte{}, iter.Value()...)
+	}
+
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return iterator.NewEmptyIterator(err)
+	}
+
+	for k, w := range b.pending {
+		if !inRange(slice, []byte(k)) {
+			continue
+		}
+
+		if w.deleted {
+			delete(merged, k)
+			continue
+		}
+
+		merged[k] = w.value
+	}
+
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	var arr kvArray
+	for _, k := range keys {
+		arr.keys = append(arr.keys, []byte(k))
+		arr.values = append(arr.values, merged[k])
+	}
+
+	return iterator.NewArrayIterator(arr)
+}
+
+// Commit writes the batch to the database. An empty batch writes nothing.
+func (b *levelBatch) Commit() error {
+	if b.batch.Len() == 0 {
+		return nil
+	}
+
+	return b.db.Write(b.batch, nil)
+}
+
+// Discard drops the pending writes of the batch, of which nothing has been
+// written. As with a transaction, discarding a committed batch is a no-op.
+func (b *levelBatch) Discard() {}
+
+// inRange returns whether the key falls within the range, which includes every
+// key if nil.
+func inRange(slice *util.Range, key []byte) bool {
+	if slice == nil {
+		return true
+	}
+
+	if slice.Start != nil && bytes.Compare(key, slice.Start) < 0 {
+		return false
+	}
+
+	return slice.Limit == nil || bytes.Compare(key, slice.Limit) < 0
+}
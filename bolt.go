@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket is the single bucket holding every key of the store, keeping the
+// same flat keyspace as LevelDB.
+var boltBucket = []byte("miniqueue")
+
+// boltDB is a database backed by bbolt. Reads and writes made directly on the
+// database each run in their own transaction.
+type boltDB struct {
+	db *bolt.DB
+}
+
+func openBoltDB(path string) (*boltDB, error) {
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating bucket: %v", err)
+	}
+
+	return &boltDB{db: db}, nil
+}
+
+func (b *boltDB) Has(key []byte, _ *opt.ReadOptions) (bool, error) {
+	var exists bool
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(boltBucket).Get(key) != nil
+		return nil
+	})
+
+	return exists, err
+}
+
+func (b *boltDB) Get(key []byte, _ *opt.ReadOptions) ([]byte, error) {
+	var val []byte
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		val, err = boltGet(tx.Bucket(boltBucket), key)
+		return err
+	})
+
+	return val, err
+}
+
+func (b *boltDB) Put(key, value []byte, _ *opt.WriteOptions) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(key, value)
+	})
+}
+
+func (b *boltDB) Delete(key []byte, _ *opt.WriteOptions) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete(key)
+	})
+}
+
+// NewIterator returns an iterator over a snapshot of the keys within the
+// range, read lazily from a cursor of a read transaction. The transaction is
+// held open until the iterator is released, so the iterator must be released
+// before committing a write, which may otherwise deadlock should bbolt need to
+// grow the database.
+func (b *boltDB) NewIterator(slice *util.Range, _ *opt.ReadOptions) iterator.Iterator {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return iterator.NewEmptyIterator(err)
+	}
+
+	if slice == nil {
+		slice = &util.Range{}
+	}
+
+	return &boltIterator{
+		tx:     tx,
+		cursor: tx.Bucket(boltBucket).Cursor(),
+		slice:  slice,
+	}
+}
+
+func (b *boltDB) OpenTransaction() (transaction, error) {
+	tx, err := b.db.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltTx{tx: tx, bucket: tx.Bucket(boltBucket)}, nil
+}
+
+// OpenBatch opens a read-write transaction, as a single bbolt transaction is
+// already committed with one write, just as Update does.
+func (b *boltDB) OpenBatch() (transaction, error) {
+	return b.OpenTransaction()
+}
+
+func (b *boltDB) Close() error {
+	return b.db.Close()
+}
+
+// boltTx is a read-write bbolt transaction.
+type boltTx struct {
+	tx     *bolt.Tx
+	bucket *bolt.Bucket
+}
+
+func (t *boltTx) Has(key []byte, _ *opt.ReadOptions) (bool, error) {
+	return t.bucket.Get(key) != nil, nil
+}
+
+func (t *boltTx) Get(key []byte, _ *opt.ReadOptions) ([]byte, error) {
+	return boltGet(t.bucket, key)
+}
+
+func (t *boltTx) Put(key, value []byte, _ *opt.WriteOptions) error {
+	return t.bucket.Put(key, value)
+}
+
+func (t *boltTx) Delete(key []byte, _ *opt.WriteOptions) error {
+	return t.bucket.Delete(key)
+}
+
+// NewIterator returns an iterator over a snapshot of the keys within the
+// range, which is unaffected by later writes in the transaction. The snapshot
+// is read eagerly, as writes in the transaction would invalidate a cursor.
+func (t *boltTx) NewIterator(slice *util.Range, _ *opt.ReadOptions) iterator.Iterator {
+	return iterator.NewArrayIterator(boltRange(t.bucket, slice))
+}
+
+func (t *boltTx) Commit() error {
+	return t.tx.Commit()
+}
+
+// Discard rolls back the transaction. As with LevelDB, discarding a
+// transaction which has already been committed is a no-op.
+func (t *boltTx) Discard() {
+	_ = t.tx.Rollback()
+}
+
+// boltGet returns a copy of the value of a key, as values returned by bbolt
+// are only valid for the life of the transaction.
+func boltGet(bucket *bolt.Bucket, key []byte) ([]byte, error) {
+	val := bucket.Get(key)
+	if val == nil {
+		return nil, leveldb.ErrNotFound
+	}
+
+	return append([]byte{}, val...), nil
+}
+
+// boltRange copies every key value pair of the bucket within the range, which
+// includes every key if nil.
+func boltRange(bucket *bolt.Bucket, slice *util.Range) kvArray {
+	var (
+		arr kvArray
+		c   = bucket.Cursor()
+		k   []byte
+		v   []byte
+	)
+
+	if slice == nil || slice.Start == nil {
+		k, v = c.First()
+	} else {
+		k, v = c.Seek(slice.Start)
+	}
+
+	for ; k != nil; k, v = c.Next() {
+		if slice != nil && slice.Limit != nil && bytes.Compare(k, slice.Limit) >= 0 {
+			break
+		}
+
+		arr.keys = append(arr.keys, append([]byte{}, k...))
+		arr.values = append(arr.values, append([]byte{}, v...))
+	}
+
+	return arr
+}
+
+// boltIterator iterates lazily over the keys of a bucket within a range. Keys
+// and values are only valid until the iterator is moved or released.
+type boltIterator struct {
+	tx     *bolt.Tx
+	cursor *bolt.Cursor
+	slice  *util.Range
+
+	key, value []byte
+	pos        boltIterPos
+	err        error
+	releaser   util.Releaser
+}
+
+// boltIterPos is the position of an iterator, either before the first key of
+// its range, at a key, or after the last key.
+type boltIterPos int
+
+const (
+	boltIterStart boltIterPos = iota
+	boltIterValid
+	boltIterEnd
+)
+
+func (i *boltIterator) First() bool {
+	if i.released() {
+		return false
+	}
+
+	if i.slice.Start == nil {
+		return i.set(i.cursor.First())
+	}
+
+	return i.set(i.cursor.Seek(i.slice.Start))
+}
+
+func (i *boltIterator) Last() bool {
+	if i.released() {
+		return false
+	}
+
+	if i.slice.Limit == nil {
+		return i.setBackward(i.cursor.Last())
+	}
+
+	// Seek to the first key past the range, stepping back from it or from the
+	// end of the bucket if there is none.
+	if k, _ := i.cursor.Seek(i.slice.Limit); k == nil {
+		return i.setBackward(i.cursor.Last())
+	}
+
+	return i.setBackward(i.cursor.Prev())
+}
+
+func (i *boltIterator) Seek(key []byte) bool {
+	if i.released() {
+		return false
+	}
+
+	if i.slice.Start != nil && bytes.Compare(key, i.slice.Start) < 0 {
+		key = i.slice.Start
+	}
+
+	return i.set(i.cursor.Seek(key))
+}
+
+func (i *boltIterator) Next() bool {
+	if i.released() {
+		return false
+	}
+
+	switch i.pos {
+	case boltIterStart:
+		return i.First()
+	case boltIterEnd:
+		return false
+	}
+
+	return i.set(i.cursor.Next())
+}
+
+func (i *boltIterator) Prev() bool {
+	if i.released() {
+		return false
+	}
+
+	switch i.pos {
+	case boltIterStart:
+		return false
+	case boltIterEnd:
+		return i.Last()
+	}
+
+	return i.setBackward(i.cursor.Prev())
+}
+
+// set positions the iterator at a key reached moving forward, or at the end
+// once past the range.
+func (i *boltIterator) set(k, v []byte) bool {
+	if k == nil || (i.slice.Limit != nil && bytes.Compare(k, i.slice.Limit) >= 0) {
+		i.key, i.value, i.pos = nil, nil, boltIterEnd
+		return false
+	}
+
+	i.key, i.value, i.pos = k, v, boltIterValid
+	return true
+}
+
+// setBackward positions the iterator at a key reached moving backward, or at
+// the start once before the range.
+func (i *boltIterator) setBackward(k, v []byte) bool {
+	if k == nil || (i.slice.Start != nil && bytes.Compare(k, i.slice.Start) < 0) {
+		i.key, i.value, i.pos = nil, nil, boltIterStart
+		return false
+	}
+
+	i.key, i.value, i.pos = k, v, boltIterValid
+	return true
+}
+
+func (i *boltIterator) released() bool {
+	if i.tx == nil {
+		i.err = iterator.ErrIterReleased
+		return true
+	}
+
+	return false
+}
+
+func (i *boltIterator) Key() []byte {
+	return i.key
+}
+
+func (i *boltIterator) Value() []byte {
+	return i.value
+}
+
+func (i *boltIterator) Valid() bool {
+	return i.pos == boltIterValid
+}
+
+func (i *boltIterator) Error() error {
+	return i.err
+}
+
+// Release rolls back the read transaction of the iterator. It is safe to call
+// multiple times.
+func (i *boltIterator) Release() {
+	if i.tx == nil {
+		return
+	}
+
+	_ = i.tx.Rollback()
+	i.tx, i.cursor = nil, nil
+	i.key, i.value, i.pos = nil, nil, boltIterEnd
+
+	if i.releaser != nil {
+		i.releaser.Release()
+		i.releaser = nil
+	}
+}
+
+func (i *boltIterator) SetReleaser(releaser util.Releaser) {
+	if i.tx != nil {
+		i.releaser = releaser
+	}
+}
+
+// kvArray is a sorted array of key value pairs, implementing
+// iterator.Array.
+type kvArray struct {
+	keys   [][]byte
+	values [][]byte
+}
+
+func (a kvArray) Len() int {
+	return len(a.keys)
+}
+
+func (a kvArray) Search(key []byte) int {
+	return sort.Search(len(a.keys), func(i int) bool {
+		return bytes.Compare(a.keys[i], key) >= 0
+	})
+}
+
+func (a kvArray) Index(i int) (key, value []byte) {
+	return a.keys[i], a.values[i]
+}
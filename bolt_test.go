@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestBoltIterator(t *testing.T) {
+	db, err := openBoltDB(t.TempDir() + "/data.bolt")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	for _, key := range []string{"a-1", "b-1", "b-2", "b-3", "c-1"} {
+		require.NoError(t, db.Put([]byte(key), []byte("v"+key), nil))
+	}
+
+	keys := func(iter iterator.Iterator) []string {
+		var keys []string
+		for iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		return keys
+	}
+
+	t.Run("iterates over every key without a range", func(t *testing.T) {
+		iter := db.NewIterator(nil, nil)
+		defer iter.Release()
+
+		assert.Equal(t, []string{"a-1", "b-1", "b-2", "b-3", "c-1"}, keys(iter))
+		assert.NoError(t, iter.Error())
+	})
+
+	t.Run("iterates over the keys within the range", func(t *testing.T) {
+		iter := db.NewIterator(util.BytesPrefix([]byte("b-")), nil)
+		defer iter.Release()
+
+		assert.Equal(t, []string{"b-1", "b-2", "b-3"}, keys(iter))
+		assert.False(t, iter.Valid())
+
+		// Stepping back from the end returns to the last key of the range.
+		assert.True(t, iter.Prev())
+		assert.Equal(t, "b-3", string(iter.Key()))
+		assert.Equal(t, "vb-3", string(iter.Value()))
+	})
+
+	t.Run("moves within the range", func(t *testing.T) {
+		iter := db.NewIterator(util.BytesPrefix([]byte("b-")), nil)
+		defer iter.Release()
+
+		assert.True(t, iter.Last())
+		assert.Equal(t, "b-3", string(iter.Key()))
+
+		assert.True(t, iter.Seek([]byte("b-2")))
+		assert.Equal(t, "b-2", string(iter.Key()))
+
+		assert.True(t, iter.Seek([]byte("a")))
+		assert.Equal(t, "b-1", string(iter.Key()))
+		assert.False(t, iter.Prev())
+
+		assert.False(t, iter.Seek([]byte("c")))
+		assert.True(t, iter.First())
+		assert.Equal(t, "b-1", string(iter.Key()))
+	})
+
+	t.Run("stops once released", func(t *testing.T) {
+		iter := db.NewIterator(nil, nil)
+		assert.True(t, iter.Next())
+
+		iter.Release()
+		assert.NoError(t, iter.Error())
+		iter.Release()
+
+		assert.False(t, iter.Next())
+		assert.Equal(t, iterator.ErrIterReleased, iter.Error())
+
+		// The read transaction is closed, so writes may be committed.
+		require.NoError(t, db.Put([]byte("d-1"), []byte("vd-1"), nil))
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -12,16 +13,70 @@ import (
 
 //go:generate mockgen -source=$GOFILE -destination=broker_mock.go -package=main
 type brokerer interface {
-	Publish(topic string, value *value) error
-	Subscribe(topic string) *consumer
+	Publish(ctx context.Context, topic string, value *value) error
+	PublishBatch(ctx context.Context, topic string, values []*value) ([]int, error)
+	PublishIdempotent(ctx context.Context, topic, key string, value *value) (*dedupEntry, bool, error)
+	PublishAt(ctx context.Context, topic string, value *value, dueAt time.Time) error
+	Subscribe(topic string, opts consumerOpts) (*consumer, error)
 	Unsubscribe(topic, id string) error
+	Settle(topic, token, cmd string) error
 	Purge(topic string) error
 	Topics() ([]string, error)
+	Stats(topic string) (*topicStats, error)
+	Browse(topic, queue string, priority, from, limit int) ([]*browsedValue, error)
+	ReleaseDelayed(topic, id string) (int, error)
+	RescheduleDelayed(topic, id string, dueAt time.Time) error
+	DeleteDelayed(topic, id string) error
+	Config(topic string) (*topicConfig, error)
+	SetConfig(topic string, cfg *topicConfig) error
+	Redrive(topic string) (int, error)
 }
 
+// The queues of a topic which may be browsed.
+const (
+	queueMain    = "main"
+	queueAck     = "ack"
+	queueDelayed = "delayed"
+)
+
+// maxBrowseLimit is the maximum number of messages returned by a single
+// browse.
+const maxBrowseLimit = 1000
+
+// minDelayWait is the minimum wait between runs processing delayed messages.
+const minDelayWait = time.Millisecond
+
+// overflowPollInterval is the interval at which a publish blocked by a full
+// topic retries.
+const overflowPollInterval = 50 * time.Millisecond
+
+// defaultBlockTimeout is the time a publish blocked by a full topic waits for
+// space, unless the topic configures its own.
+const defaultBlockTimeout = 5 * time.Second
+
+// drainPollInterval is the interval at which a draining broker checks whether
+// its consumers have acknowledged their outstanding messages.
+const drainPollInterval = 50 * time.Millisecond
+
 type broker struct {
 	store     storer
 	consumers map[string][]*consumer
+	draining  chan struct{} // closed once the broker begins draining
+
+	// lease is the default duration a consumer may hold a message before it is
+	// returned to the queue. A zero lease never expires.
+	lease time.Duration
+
+	// metrics records the duration of each run processing delayed messages,
+	// nil if metrics are disabled.
+	metrics *metrics
+
+	// wake wakes the delay processing loop before its next scheduled run at
+	// nextRun, once a message is delayed until before then.
+	wake    chan struct{}
+	nextRun time.Time
+	runMu   sync.Mutex
+
 	sync.RWMutex
 }
 
@@ -29,6 +84,8 @@ func newBroker(store storer) *broker {
 	return &broker{
 		store:     store,
 		consumers: map[string][]*consumer{},
+		draining:  make(chan struct{}),
+		wake:      make(chan struct{}, 1),
 	}
 }
 
@@ -38,31 +95,217 @@ func (b *broker) Topics() ([]string, error) {
 	return meta.topics, err
 }
 
+// Stats returns the statistics of a topic, including the number of consumers
+// subscribed to it.
+func (b *broker) Stats(topic string) (*topicStats, error) {
+	stats, err := b.store.Stats(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	b.RLock()
+	stats.Consumers = len(b.consumers[topic])
+	b.RUnlock()
+
+	return stats, nil
+}
+
+// Browse returns up to limit messages on one of the queues of a topic without
+// consuming them. For the main queue, messages are returned from the given
+// offset of the given priority level onwards, and for the ack queue from the
+// given offset onwards, whereas for the delay queue, the given number of
+// messages are first skipped.
+func (b *broker) Browse(topic, queue string, priority, from, limit int) ([]*browsedValue, error) {
+	if limit < 1 || limit > maxBrowseLimit {
+		return nil, errInvalidBrowse
+	}
+
+	switch queue {
+	case queueMain:
+		return b.store.Browse(topic, priority, from, limit)
+	case queueAck:
+		return b.store.BrowseAcks(topic, from, limit)
+	case queueDelayed:
+		return b.browseDelayed(topic, from, limit)
+	default:
+		return nil, errInvalidBrowse
+	}
+}
+
+// browseDelayed returns up to limit messages on the delay queue of a topic in
+// the order they're due, skipping the first messages up to the given position.
+func (b *broker) browseDelayed(topic string, from, limit int) ([]*browsedValue, error) {
+	iter, closer := b.store.GetDelayed(topic)
+
+	var vals []*browsedValue
+	for pos := 0; len(vals) < limit && iter.Next(); pos++ {
+		if pos < from {
+			continue
+		}
+
+		dueAt, err := timeFromDelayKey(string(iter.Key()))
+		if err != nil {
+			_ = closer()
+			return nil, err
+		}
+
+		val, err := decodeValue(iter.Value())
+		if err != nil {
+			_ = closer()
+			return nil, err
+		}
+
+		vals = append(vals, &browsedValue{value: val, Offset: pos, DueAt: dueAt})
+	}
+
+	if err := closer(); err != nil {
+		return nil, fmt.Errorf("iterating over delayed messages of topic %s: %v", topic, err)
+	}
+
+	return vals, nil
+}
+
+// releaseAllBefore is later than the due time of every delayed message.
+var releaseAllBefore = time.Unix(1<<62, 0)
+
+// ReleaseDelayed returns the delayed message with the given ID to the front of
+// the topic immediately, or every delayed message of the topic if the ID is
+// empty. It returns the number of messages released.
+func (b *broker) ReleaseDelayed(topic, id string) (int, error) {
+	count := 1
+
+	if id == "" {
+		var err error
+		if count, err = b.store.ReturnDelayed(topic, releaseAllBefore); err != nil {
+			return 0, fmt.Errorf("returning delayed messages in store: %v", err)
+		}
+	} else if err := b.store.ReleaseDelayed(topic, id); err != nil {
+		return 0, err
+	}
+
+	if count >= 1 {
+		b.NotifyConsumer(topic, eventTypeMsgReturned)
+	}
+
+	return count, nil
+}
+
+// RescheduleDelayed changes the time the delayed message with the given ID is
+// due to be returned to the topic.
+func (b *broker) RescheduleDelayed(topic, id string, dueAt time.Time) error {
+	if err := b.store.RescheduleDelayed(topic, id, dueAt); err != nil {
+		return err
+	}
+
+	b.NotifyDelayed(dueAt)
+
+	return nil
+}
+
+// DeleteDelayed deletes the delayed message with the given ID.
+func (b *broker) DeleteDelayed(topic, id string) error {
+	return b.store.DeleteDelayed(topic, id)
+}
+
 // ProcessDelays is a blocking function which starts a loop to check and return
 // delayed messages which have completed their designated delay back to the main
-// queue.
+// queue. Outstanding messages with expired leases are also returned to the
+// queue on each run.
+//
+// Runs occur at least once per period, or sooner when a delayed message is due
+// before then.
 func (b *broker) ProcessDelays(ctx context.Context, period time.Duration) {
 	log.Debug().Msg("starting delay queue processing")
 
 	for {
+		start := time.Now()
+
+		b.expireLeases(start)
+
+		wait := period
+
 		meta, err := b.store.Meta()
 		if err != nil {
-			continue
-		}
+			log.Err(err).Msg("failed to get topics")
+		} else {
+			if err := processTopics(b, meta.topics); err != nil {
+				log.Err(err).Msg("failed to process topics")
+			}
 
-		if err := processTopics(b, meta.topics); err != nil {
-			log.Err(err).Msg("failed to process topics")
+			if due, ok := b.nextDue(meta.topics); ok && time.Until(due) < wait {
+				// Messages which remain due, such as those failing to be returned,
+				// are retried without spinning.
+				wait = time.Until(due)
+				if wait < minDelayWait {
+					wait = minDelayWait
+				}
+			}
 		}
 
+		b.metrics.observeDelayRun(time.Since(start))
+
+		b.runMu.Lock()
+		b.nextRun = time.Now().Add(wait)
+		b.runMu.Unlock()
+
+		timer := time.NewTimer(wait)
+
 		select {
-		case <-time.After(period):
+		case <-timer.C:
+		case <-b.wake:
+			timer.Stop()
 		case <-ctx.Done():
+			timer.Stop()
 			log.Debug().Msg("stopping delay queue processing, context cancelled")
 			return
 		}
 	}
 }
 
+// nextDue returns the earliest time a delayed message of the given topics is
+// due, reporting false if there are none.
+func (b *broker) nextDue(topics []string) (time.Time, bool) {
+	var (
+		next  time.Time
+		found bool
+	)
+
+	for _, t := range topics {
+		iter, closer := b.store.GetDelayed(t)
+
+		if iter.Next() {
+			due, err := timeFromDelayKey(string(iter.Key()))
+			if err == nil && (!found || due.Before(next)) {
+				next, found = due, true
+			}
+		}
+
+		if err := closer(); err != nil {
+			log.Err(err).Str("topic", t).Msg("failed to get next delayed message")
+		}
+	}
+
+	return next, found
+}
+
+// NotifyDelayed wakes the delay processing loop if a message has been delayed
+// until before its next scheduled run.
+func (b *broker) NotifyDelayed(dueAt time.Time) {
+	b.runMu.Lock()
+	defer b.runMu.Unlock()
+
+	if !dueAt.Before(b.nextRun) {
+		return
+	}
+
+	b.nextRun = dueAt
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
 func processTopics(b *broker, topics []string) error {
 	now := time.Now()
 
@@ -86,9 +329,132 @@ func processTopics(b *broker, topics []string) error {
 	return nil
 }
 
-// Publish a message to a topic.
-func (b *broker) Publish(topic string, val *value) error {
-	if err := b.store.Insert(topic, val); err != nil {
+// ProcessExpired is a blocking function which starts a loop removing expired
+// messages from every topic once per period, reclaiming the space of messages
+// which would otherwise wait to be skipped by a consumer.
+func (b *broker) ProcessExpired(ctx context.Context, period time.Duration) {
+	log.Debug().Msg("starting expired message processing")
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Debug().Msg("stopping expired message processing, context cancelled")
+			return
+		}
+
+		meta, err := b.store.Meta()
+		if err != nil {
+			log.Err(err).Msg("failed to get topics")
+			continue
+		}
+
+		b.removeExpired(meta.topics, time.Now())
+	}
+}
+
+// removeExpired removes the messages of the given topics which have expired
+// at the given time.
+func (b *broker) removeExpired(topics []string, now time.Time) {
+	for _, t := range topics {
+		count, err := b.store.RemoveExpired(t, now)
+		if err != nil {
+			log.Err(err).Str("topic", t).Msg("failed to remove expired messages")
+			continue
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		log.Debug().
+			Str("topic", t).
+			Int("count", count).
+			Msg("removed expired messages")
+
+		cfg, err := b.store.Config(t)
+		if err != nil {
+			log.Err(err).Str("topic", t).Msg("failed to get topic config")
+			continue
+		}
+
+		if cfg.ExpiredTopic != "" {
+			b.NotifyConsumer(cfg.ExpiredTopic, eventTypePublish)
+		}
+	}
+}
+
+// expireLeases returns the outstanding messages of consumers whose leases have
+// passed the given time to the front of their topics.
+func (b *broker) expireLeases(now time.Time) {
+	b.RLock()
+	var consumers []*consumer
+	for _, cs := range b.consumers {
+		consumers = append(consumers, cs...)
+	}
+	b.RUnlock()
+
+	for _, c := range consumers {
+		expired, err := c.expireLease(now)
+		if err != nil {
+			log.Err(err).Str("id", c.id).Msg("failed to expire lease")
+			continue
+		}
+
+		if expired {
+			log.Debug().
+				Str("id", c.id).
+				Str("topic", c.topic).
+				Msg("lease expired, returned message to queue")
+		}
+	}
+}
+
+// Recover returns any messages left awaiting acknowledgement, such as by a
+// previous process which crashed, to the front of their topics. It returns the
+// number of messages recovered for each topic, and must be called before any
+// consumers have subscribed.
+func (b *broker) Recover() (map[string]int, error) {
+	meta, err := b.store.Meta()
+	if err != nil {
+		return nil, fmt.Errorf("getting store metadata: %v", err)
+	}
+
+	recovered := map[string]int{}
+
+	for _, t := range meta.topics {
+		count, err := b.store.Recover(t)
+		if err != nil {
+			return recovered, fmt.Errorf("recovering topic %s: %v", t, err)
+		}
+
+		if count >= 1 {
+			log.Info().
+				Str("topic", t).
+				Int("count", count).
+				Msg("recovered unacknowledged messages")
+
+			recovered[t] = count
+		}
+	}
+
+	return recovered, nil
+}
+
+// Publish a message to a topic. A publish blocked by a full topic gives up once
+// the context is done.
+func (b *broker) Publish(ctx context.Context, topic string, val *value) error {
+	if b.isDraining() {
+		return errShuttingDown
+	}
+
+	err := b.insertBlocking(ctx, topic, func() error {
+		return b.store.Insert(topic, val)
+	})
+	if err != nil {
 		return err
 	}
 
@@ -97,27 +463,164 @@ func (b *broker) Publish(topic string, val *value) error {
 	return nil
 }
 
+// PublishBatch publishes messages to a topic atomically, in order, returning
+// the offset of each within the topic.
+func (b *broker) PublishBatch(ctx context.Context, topic string, vals []*value) ([]int, error) {
+	if b.isDraining() {
+		return nil, errShuttingDown
+	}
+
+	var offsets []int
+
+	err := b.insertBlocking(ctx, topic, func() (err error) {
+		offsets, err = b.store.InsertBatch(topic, vals)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for range vals {
+		b.NotifyConsumer(topic, eventTypePublish)
+	}
+
+	return offsets, nil
+}
+
+// PublishIdempotent publishes a message to a topic unless a message was already
+// published with the same idempotency key within the dedup window of the
+// topic. It returns the ID and offset of the message published with the key,
+// reporting whether the publish was a duplicate.
+func (b *broker) PublishIdempotent(ctx context.Context, topic, key string, val *value) (*dedupEntry, bool, error) {
+	if b.isDraining() {
+		return nil, false, errShuttingDown
+	}
+
+	var (
+		entry     *dedupEntry
+		duplicate bool
+	)
+
+	err := b.insertBlocking(ctx, topic, func() (err error) {
+		entry, duplicate, err = b.store.InsertIdempotent(topic, key, val)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !duplicate {
+		b.NotifyConsumer(topic, eventTypePublish)
+	}
+
+	return entry, duplicate, nil
+}
+
+// insertBlocking calls insert, retrying while the topic is full if its overflow
+// policy blocks publishers, until space frees up, the block timeout passes or
+// the context is done.
+func (b *broker) insertBlocking(ctx context.Context, topic string, insert func() error) error {
+	err := insert()
+	if !errors.Is(err, errTopicFull) {
+		return err
+	}
+
+	cfg, cerr := b.store.Config(topic)
+	if cerr != nil {
+		return fmt.Errorf("getting topic config from store: %v", cerr)
+	}
+
+	if cfg.OverflowPolicy != overflowBlock {
+		return err
+	}
+
+	timeout := defaultBlockTimeout
+	if cfg.BlockTimeoutMs > 0 {
+		timeout = time.Duration(cfg.BlockTimeoutMs) * time.Millisecond
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	ticker := time.NewTicker(overflowPollInterval)
+	defer ticker.Stop()
+
+	for errors.Is(err, errTopicFull) {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return err
+		case <-b.draining:
+			return errShuttingDown
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		err = insert()
+	}
+
+	return err
+}
+
+// PublishAt publishes a message to a topic, to be delivered once the given time
+// is due. Messages due in the past are published immediately.
+func (b *broker) PublishAt(ctx context.Context, topic string, val *value, dueAt time.Time) error {
+	if !dueAt.After(time.Now()) {
+		return b.Publish(ctx, topic, val)
+	}
+
+	if b.isDraining() {
+		return errShuttingDown
+	}
+
+	if err := b.store.InsertDelayed(topic, val, dueAt); err != nil {
+		return err
+	}
+
+	b.NotifyDelayed(dueAt)
+
+	return nil
+}
+
 // Subscribe to a topic and return a consumer for the topic.
-func (b *broker) Subscribe(topic string) *consumer {
+func (b *broker) Subscribe(topic string, opts consumerOpts) (*consumer, error) {
+	if b.isDraining() {
+		return nil, errShuttingDown
+	}
+
+	lease := opts.lease
+	if lease == 0 {
+		lease = b.lease
+	}
+
+	prefetch := opts.prefetch
+	if prefetch == 0 {
+		prefetch = 1
+	}
+
 	cons := &consumer{
-		id:          xid.New().String(),
-		topic:       topic,
-		ackOffset:   0,
-		store:       b.store,
-		eventChan:   make(chan eventType),
-		notifier:    b,
-		outstanding: false,
+		id:        xid.New().String(),
+		topic:     topic,
+		store:     b.store,
+		eventChan: make(chan eventType),
+		notifier:  b,
+		draining:  b.draining,
+		prefetch:  prefetch,
+		batch:     opts.batch,
+		linger:    opts.linger,
+		lease:     lease,
 	}
 
 	b.Lock()
 	b.consumers[topic] = append(b.consumers[topic], cons)
 	b.Unlock()
 
-	return cons
+	return cons, nil
 }
 
 // Unsubscribe removes the consumer from the available pool for the topic and
-// returns any messages with outstanding acknowledgements to the queue.
+// returns any messages with outstanding acknowledgements to the queue, in the
+// order they were delivered.
 func (b *broker) Unsubscribe(topic, id string) error {
 	b.RLock()
 	consumers := b.consumers[topic]
@@ -125,9 +628,12 @@ func (b *broker) Unsubscribe(topic, id string) error {
 
 	for i, c := range consumers {
 		if c.id == id {
-			if c.outstanding {
-				log.Debug().Str("id", c.id).Msg("nacking outstanding message")
-				_ = c.Nack()
+			if c.Outstanding() {
+				log.Debug().Str("id", c.id).Msg("releasing outstanding messages")
+
+				if err := c.Release(); err != nil {
+					log.Err(err).Str("id", c.id).Msg("failed to release outstanding messages")
+				}
 			}
 
 			log.Debug().Str("id", c.id).Msg("unsubscribing consumer")
@@ -145,6 +651,39 @@ func (b *broker) Unsubscribe(topic, id string) error {
 	return fmt.Errorf("consumer ID %s not found for topic %s", id, topic)
 }
 
+// Settle acknowledges the outstanding message with the given delivery token on
+// behalf of the consumer of the topic holding it, such as from a connection
+// other than the one it was delivered on. The command is one of CmdAck, CmdNack
+// or CmdBack.
+func (b *broker) Settle(topic, token, cmd string) error {
+	if token == "" {
+		return errUnknownToken
+	}
+
+	b.RLock()
+	consumers := append([]*consumer(nil), b.consumers[topic]...)
+	b.RUnlock()
+
+	for _, c := range consumers {
+		if !c.holds(token) {
+			continue
+		}
+
+		switch cmd {
+		case CmdAck:
+			return c.Ack(token)
+		case CmdNack:
+			return c.Nack(token)
+		case CmdBack:
+			return c.Back(token)
+		default:
+			return fmt.Errorf("unsupported command %s", cmd)
+		}
+	}
+
+	return errUnknownToken
+}
+
 // Purge removes the topic from the broker.
 func (b *broker) Purge(topic string) error {
 	if err := b.store.Purge(topic); err != nil {
@@ -154,6 +693,129 @@ func (b *broker) Purge(topic string) error {
 	return nil
 }
 
+// Drain stops the broker from accepting new publishes and subscriptions, and
+// stops delivering messages to existing consumers. It then waits for the
+// consumers to acknowledge their outstanding messages until the context is
+// done, after which any messages still outstanding are NACK'ed back onto
+// their topics.
+func (b *broker) Drain(ctx context.Context) {
+	b.Lock()
+	if !b.isDraining() {
+		close(b.draining)
+	}
+	b.Unlock()
+
+	log.Debug().Msg("draining broker")
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+wait:
+	for len(b.outstanding()) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	for _, c := range b.outstanding() {
+		log.Debug().Str("id", c.id).Msg("releasing outstanding messages on drain")
+
+		if err := c.Release(); err != nil {
+			log.Err(err).Str("id", c.id).Msg("failed to release outstanding messages on drain")
+		}
+	}
+}
+
+// consumerCounts returns the number of consumers subscribed to each topic.
+func (b *broker) consumerCounts() map[string]int {
+	b.RLock()
+	defer b.RUnlock()
+
+	counts := map[string]int{}
+	for topic, consumers := range b.consumers {
+		if len(consumers) > 0 {
+			counts[topic] = len(consumers)
+		}
+	}
+
+	return counts
+}
+
+// outstanding returns the consumers currently holding unacknowledged
+// messages.
+func (b *broker) outstanding() []*consumer {
+	b.RLock()
+	defer b.RUnlock()
+
+	var out []*consumer
+	for _, consumers := range b.consumers {
+		for _, c := range consumers {
+			if c.Outstanding() {
+				out = append(out, c)
+			}
+		}
+	}
+
+	return out
+}
+
+func (b *broker) isDraining() bool {
+	select {
+	case <-b.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Config returns the configuration of a topic.
+func (b *broker) Config(topic string) (*topicConfig, error) {
+	cfg, err := b.store.Config(topic)
+	if err != nil {
+		return nil, fmt.Errorf("getting topic config from store: %v", err)
+	}
+
+	return cfg, nil
+}
+
+// SetConfig sets the configuration of a topic.
+func (b *broker) SetConfig(topic string, cfg *topicConfig) error {
+	if cfg.MaxDeliveries < 0 || cfg.TTLMs < 0 || cfg.ExpiredTopic == topic {
+		return errInvalidConfig
+	}
+
+	if cfg.MaxLength < 0 || cfg.MaxBytes < 0 || cfg.BlockTimeoutMs < 0 || !validOverflowPolicy(cfg.OverflowPolicy) {
+		return errInvalidConfig
+	}
+
+	if cfg.DedupWindowMs < 0 {
+		return errInvalidConfig
+	}
+
+	if err := b.store.SetConfig(topic, cfg); err != nil {
+		return fmt.Errorf("setting topic config in store: %v", err)
+	}
+
+	return nil
+}
+
+// Redrive returns the messages on the dead letter topic of a topic to the back
+// of the topic, returning the number of messages redriven.
+func (b *broker) Redrive(topic string) (int, error) {
+	count, err := b.store.Redrive(topic)
+	if err != nil {
+		return 0, fmt.Errorf("redriving topic in store: %v", err)
+	}
+
+	if count >= 1 {
+		b.NotifyConsumer(topic, eventTypeMsgReturned)
+	}
+
+	return count, nil
+}
+
 // Shutdown the broker.
 func (b *broker) Shutdown() error {
 	return b.store.Close()
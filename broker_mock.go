@@ -5,7 +5,9 @@
 package main
 
 import (
+	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 )
@@ -33,18 +35,107 @@ func (m *Mockbrokerer) EXPECT() *MockbrokererMockRecorder {
 	return m.recorder
 }
 
+// Browse mocks base method.
+func (m *Mockbrokerer) Browse(topic, queue string, priority, from, limit int) ([]*browsedValue, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Browse", topic, queue, priority, from, limit)
+	ret0, _ := ret[0].([]*browsedValue)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Browse indicates an expected call of Browse.
+func (mr *MockbrokererMockRecorder) Browse(topic, queue, priority, from, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Browse", reflect.TypeOf((*Mockbrokerer)(nil).Browse), topic, queue, priority, from, limit)
+}
+
+// Config mocks base method.
+func (m *Mockbrokerer) Config(topic string) (*topicConfig, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Config", topic)
+	ret0, _ := ret[0].(*topicConfig)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Config indicates an expected call of Config.
+func (mr *MockbrokererMockRecorder) Config(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Config", reflect.TypeOf((*Mockbrokerer)(nil).Config), topic)
+}
+
+// DeleteDelayed mocks base method.
+func (m *Mockbrokerer) DeleteDelayed(topic, id string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteDelayed", topic, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteDelayed indicates an expected call of DeleteDelayed.
+func (mr *MockbrokererMockRecorder) DeleteDelayed(topic, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteDelayed", reflect.TypeOf((*Mockbrokerer)(nil).DeleteDelayed), topic, id)
+}
+
 // Publish mocks base method.
-func (m *Mockbrokerer) Publish(topic string, value *value) error {
+func (m *Mockbrokerer) Publish(ctx context.Context, topic string, value *value) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Publish", topic, value)
+	ret := m.ctrl.Call(m, "Publish", ctx, topic, value)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Publish indicates an expected call of Publish.
-func (mr *MockbrokererMockRecorder) Publish(topic, value interface{}) *gomock.Call {
+func (mr *MockbrokererMockRecorder) Publish(ctx, topic, value interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Publish", reflect.TypeOf((*Mockbrokerer)(nil).Publish), topic, value)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Publish", reflect.TypeOf((*Mockbrokerer)(nil).Publish), ctx, topic, value)
+}
+
+// PublishAt mocks base method.
+func (m *Mockbrokerer) PublishAt(ctx context.Context, topic string, value *value, dueAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PublishAt", ctx, topic, value, dueAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PublishAt indicates an expected call of PublishAt.
+func (mr *MockbrokererMockRecorder) PublishAt(ctx, topic, value, dueAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublishAt", reflect.TypeOf((*Mockbrokerer)(nil).PublishAt), ctx, topic, value, dueAt)
+}
+
+// PublishBatch mocks base method.
+func (m *Mockbrokerer) PublishBatch(ctx context.Context, topic string, values []*value) ([]int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PublishBatch", ctx, topic, values)
+	ret0, _ := ret[0].([]int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PublishBatch indicates an expected call of PublishBatch.
+func (mr *MockbrokererMockRecorder) PublishBatch(ctx, topic, values interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublishBatch", reflect.TypeOf((*Mockbrokerer)(nil).PublishBatch), ctx, topic, values)
+}
+
+// PublishIdempotent mocks base method.
+func (m *Mockbrokerer) PublishIdempotent(ctx context.Context, topic, key string, value *value) (*dedupEntry, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PublishIdempotent", ctx, topic, key, value)
+	ret0, _ := ret[0].(*dedupEntry)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// PublishIdempotent indicates an expected call of PublishIdempotent.
+func (mr *MockbrokererMockRecorder) PublishIdempotent(ctx, topic, key, value interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublishIdempotent", reflect.TypeOf((*Mockbrokerer)(nil).PublishIdempotent), ctx, topic, key, value)
 }
 
 // Purge mocks base method.
@@ -61,18 +152,106 @@ func (mr *MockbrokererMockRecorder) Purge(topic interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Purge", reflect.TypeOf((*Mockbrokerer)(nil).Purge), topic)
 }
 
+// Redrive mocks base method.
+func (m *Mockbrokerer) Redrive(topic string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Redrive", topic)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Redrive indicates an expected call of Redrive.
+func (mr *MockbrokererMockRecorder) Redrive(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Redrive", reflect.TypeOf((*Mockbrokerer)(nil).Redrive), topic)
+}
+
+// ReleaseDelayed mocks base method.
+func (m *Mockbrokerer) ReleaseDelayed(topic, id string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseDelayed", topic, id)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReleaseDelayed indicates an expected call of ReleaseDelayed.
+func (mr *MockbrokererMockRecorder) ReleaseDelayed(topic, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseDelayed", reflect.TypeOf((*Mockbrokerer)(nil).ReleaseDelayed), topic, id)
+}
+
+// RescheduleDelayed mocks base method.
+func (m *Mockbrokerer) RescheduleDelayed(topic, id string, dueAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RescheduleDelayed", topic, id, dueAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RescheduleDelayed indicates an expected call of RescheduleDelayed.
+func (mr *MockbrokererMockRecorder) RescheduleDelayed(topic, id, dueAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RescheduleDelayed", reflect.TypeOf((*Mockbrokerer)(nil).RescheduleDelayed), topic, id, dueAt)
+}
+
+// SetConfig mocks base method.
+func (m *Mockbrokerer) SetConfig(topic string, cfg *topicConfig) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetConfig", topic, cfg)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetConfig indicates an expected call of SetConfig.
+func (mr *MockbrokererMockRecorder) SetConfig(topic, cfg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetConfig", reflect.TypeOf((*Mockbrokerer)(nil).SetConfig), topic, cfg)
+}
+
+// Settle mocks base method.
+func (m *Mockbrokerer) Settle(topic, token, cmd string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Settle", topic, token, cmd)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Settle indicates an expected call of Settle.
+func (mr *MockbrokererMockRecorder) Settle(topic, token, cmd interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Settle", reflect.TypeOf((*Mockbrokerer)(nil).Settle), topic, token, cmd)
+}
+
+// Stats mocks base method.
+func (m *Mockbrokerer) Stats(topic string) (*topicStats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Stats", topic)
+	ret0, _ := ret[0].(*topicStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Stats indicates an expected call of Stats.
+func (mr *MockbrokererMockRecorder) Stats(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stats", reflect.TypeOf((*Mockbrokerer)(nil).Stats), topic)
+}
+
 // Subscribe mocks base method.
-func (m *Mockbrokerer) Subscribe(topic string) *consumer {
+func (m *Mockbrokerer) Subscribe(topic string, opts consumerOpts) (*consumer, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Subscribe", topic)
+	ret := m.ctrl.Call(m, "Subscribe", topic, opts)
 	ret0, _ := ret[0].(*consumer)
-	return ret0
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // Subscribe indicates an expected call of Subscribe.
-func (mr *MockbrokererMockRecorder) Subscribe(topic interface{}) *gomock.Call {
+func (mr *MockbrokererMockRecorder) Subscribe(topic, opts interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Subscribe", reflect.TypeOf((*Mockbrokerer)(nil).Subscribe), topic)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Subscribe", reflect.TypeOf((*Mockbrokerer)(nil).Subscribe), topic, opts)
 }
 
 // Topics mocks base method.
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"testing"
+	"time"
 
 	gomock "github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
@@ -22,7 +24,139 @@ func TestBroker_Publish(t *testing.T) {
 
 	b := newBroker(mockStore)
 
-	require.NoError(t, b.Publish(topic, value))
+	require.NoError(t, b.Publish(context.Background(), topic, value))
+}
+
+func TestBroker_PublishBatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		topic  = "test_topic"
+		values = []*value{newValue([]byte("test_value_1")), newValue([]byte("test_value_2"))}
+	)
+
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().InsertBatch(topic, values).Return([]int{4, 5}, nil)
+
+	b := newBroker(mockStore)
+
+	offsets, err := b.PublishBatch(context.Background(), topic, values)
+	require.NoError(t, err)
+	require.Equal(t, []int{4, 5}, offsets)
+}
+
+func TestBroker_PublishAt(t *testing.T) {
+	t.Run("delays messages due in the future", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		var (
+			topic = "test_topic"
+			value = newValue([]byte("test_value"))
+			dueAt = time.Now().Add(time.Minute)
+		)
+
+		mockStore := NewMockstorer(ctrl)
+		mockStore.EXPECT().InsertDelayed(topic, value, dueAt)
+
+		b := newBroker(mockStore)
+
+		require.NoError(t, b.PublishAt(context.Background(), topic, value, dueAt))
+	})
+
+	t.Run("publishes messages due in the past immediately", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		var (
+			topic = "test_topic"
+			value = newValue([]byte("test_value"))
+		)
+
+		mockStore := NewMockstorer(ctrl)
+		mockStore.EXPECT().Insert(topic, value)
+
+		b := newBroker(mockStore)
+
+		require.NoError(t, b.PublishAt(context.Background(), topic, value, time.Now().Add(-time.Minute)))
+	})
+}
+
+func TestBroker_SetConfig(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	topic := "test_topic"
+
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().SetConfig(topic, &topicConfig{TTLMs: 1000, ExpiredTopic: "test_topic.expired"})
+
+	b := newBroker(mockStore)
+
+	require.NoError(t, b.SetConfig(topic, &topicConfig{TTLMs: 1000, ExpiredTopic: "test_topic.expired"}))
+	require.Equal(t, errInvalidConfig, b.SetConfig(topic, &topicConfig{MaxDeliveries: -1}))
+	require.Equal(t, errInvalidConfig, b.SetConfig(topic, &topicConfig{TTLMs: -1}))
+	require.Equal(t, errInvalidConfig, b.SetConfig(topic, &topicConfig{ExpiredTopic: topic}))
+	require.Equal(t, errInvalidConfig, b.SetConfig(topic, &topicConfig{MaxLength: -1}))
+	require.Equal(t, errInvalidConfig, b.SetConfig(topic, &topicConfig{MaxLength: 1, OverflowPolicy: "drop-newest"}))
+}
+
+func TestBroker_Publish_Block(t *testing.T) {
+	topic := "test_topic"
+
+	s := newMemStore()
+	defer s.Destroy()
+
+	b := newBroker(s)
+
+	require.NoError(t, b.SetConfig(topic, &topicConfig{MaxLength: 1, OverflowPolicy: overflowBlock, BlockTimeoutMs: 200}))
+	require.NoError(t, b.Publish(context.Background(), topic, newValue([]byte("test_value_1"))))
+
+	t.Run("rejects once the timeout passes", func(t *testing.T) {
+		require.Equal(t, errTopicFull, b.Publish(context.Background(), topic, newValue([]byte("test_value_2"))))
+	})
+
+	t.Run("gives up once the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		require.Equal(t, context.DeadlineExceeded, b.Publish(ctx, topic, newValue([]byte("test_value_2"))))
+		require.Less(t, time.Since(start), 200*time.Millisecond)
+	})
+
+	t.Run("publishes once space frees up", func(t *testing.T) {
+		c, err := b.Subscribe(topic, consumerOpts{})
+		require.NoError(t, err)
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			_, err := c.Next(context.Background())
+			require.NoError(t, err)
+		}()
+
+		require.NoError(t, b.Publish(context.Background(), topic, newValue([]byte("test_value_2"))))
+	})
+}
+
+func TestBroker_Stats(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	topic := "test_topic"
+
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().Stats(topic).Return(&topicStats{Depth: 3}, nil)
+
+	b := newBroker(mockStore)
+
+	_, err := b.Subscribe(topic, consumerOpts{})
+	require.NoError(t, err)
+	_, err = b.Subscribe(topic, consumerOpts{})
+	require.NoError(t, err)
+
+	stats, err := b.Stats(topic)
+	require.NoError(t, err)
+	require.Equal(t, &topicStats{Depth: 3, Consumers: 2}, stats)
 }
 
 func TestBroker_Subscribe(t *testing.T) {
@@ -36,7 +170,8 @@ func TestBroker_Subscribe(t *testing.T) {
 	mockStore := NewMockstorer(ctrl)
 
 	b := newBroker(mockStore)
-	c := b.Subscribe(topic)
+	c, err := b.Subscribe(topic, consumerOpts{})
+	require.NoError(t, err)
 
 	require.IsType(t, &consumer{}, c)
 }
@@ -49,8 +184,9 @@ func TestBroker_Unsubscribe(t *testing.T) {
 
 		topic := "test_topic"
 
-		c := b.Subscribe(topic)
-		err := b.Unsubscribe(topic, c.id)
+		c, err := b.Subscribe(topic, consumerOpts{})
+		require.NoError(t, err)
+		err = b.Unsubscribe(topic, c.id)
 		require.NoError(t, err)
 		require.Len(t, b.consumers[topic], 0)
 	})
@@ -62,9 +198,11 @@ func TestBroker_Unsubscribe(t *testing.T) {
 
 		topic := "test_topic"
 
-		c1 := b.Subscribe(topic)
-		c2 := b.Subscribe(topic)
-		err := b.Unsubscribe(topic, c1.id)
+		c1, err := b.Subscribe(topic, consumerOpts{})
+		require.NoError(t, err)
+		c2, err := b.Subscribe(topic, consumerOpts{})
+		require.NoError(t, err)
+		err = b.Unsubscribe(topic, c1.id)
 		require.NoError(t, err)
 		require.Len(t, b.consumers[topic], 1)
 		require.Equal(t, c2.id, b.consumers[topic][0].id)
@@ -81,25 +219,258 @@ func TestBroker_Unsubscribe(t *testing.T) {
 		require.Error(t, err)
 	})
 
-	t.Run("nacks outstanding messages on consumer", func(t *testing.T) {
+	t.Run("releases outstanding messages on consumer", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 
 		topic := "test_topic"
 
 		mockStorer := NewMockstorer(ctrl)
-		mockStorer.EXPECT().GetNext(topic).Return(nil, 0, nil)
-		mockStorer.EXPECT().Nack(topic, 0).Return(nil)
+		mockStorer.EXPECT().GetNext(topic).Return(newValue([]byte("test_value")), 0, nil)
+		mockStorer.EXPECT().Release(topic, []int{0}).Return(nil)
 
 		b := broker{
 			consumers: map[string][]*consumer{},
 			store:     mockStorer,
 		}
 
-		c := b.Subscribe(topic)
-		_, err := c.Next(context.Background())
+		c, err := b.Subscribe(topic, consumerOpts{})
+		require.NoError(t, err)
+		_, err = c.Next(context.Background())
 		require.NoError(t, err)
 
 		err = b.Unsubscribe(topic, c.id)
 		require.NoError(t, err)
 	})
+
+	t.Run("does not count disconnects as failures", func(t *testing.T) {
+		topic := "test_topic"
+
+		s := newMemStore()
+		defer s.Destroy()
+
+		b := newBroker(s)
+		require.NoError(t, b.SetConfig(topic, &topicConfig{MaxDeliveries: 2}))
+		require.NoError(t, b.Publish(context.Background(), topic, newValue([]byte("test_value"))))
+
+		for i := 0; i < 2; i++ {
+			c, err := b.Subscribe(topic, consumerOpts{})
+			require.NoError(t, err)
+			_, err = c.Next(context.Background())
+			require.NoError(t, err)
+			require.NoError(t, b.Unsubscribe(topic, c.id))
+		}
+
+		// The message remains on the topic rather than its dead letter topic.
+		stats, err := b.Stats(topic)
+		require.NoError(t, err)
+		require.Equal(t, 1, stats.Depth)
+		require.Equal(t, 0, stats.InFlight)
+
+		val, _, err := s.GetNext(topic)
+		require.NoError(t, err)
+		require.Equal(t, 0, val.FailureCount)
+	})
+}
+
+func TestBroker_Recover(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().Meta().Return(&metadata{topics: []string{"topic_1", "topic_2"}}, nil)
+	mockStore.EXPECT().Recover("topic_1").Return(2, nil)
+	mockStore.EXPECT().Recover("topic_2").Return(0, nil)
+
+	b := newBroker(mockStore)
+
+	recovered, err := b.Recover()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"topic_1": 2}, recovered)
+}
+
+func TestBroker_Drain(t *testing.T) {
+	t.Run("rejects publishes, subscribes and deliveries once draining", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		topic := "test_topic"
+
+		b := newBroker(NewMockstorer(ctrl))
+
+		c, err := b.Subscribe(topic, consumerOpts{})
+		require.NoError(t, err)
+
+		b.Drain(context.Background())
+
+		require.Equal(t, errShuttingDown, b.Publish(context.Background(), topic, newValue([]byte("test_value"))))
+
+		_, err = b.Subscribe(topic, consumerOpts{})
+		require.Equal(t, errShuttingDown, err)
+
+		_, err = c.Next(context.Background())
+		require.Equal(t, errShuttingDown, err)
+	})
+
+	t.Run("waits for outstanding messages to be acked", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		topic := "test_topic"
+
+		mockStorer := NewMockstorer(ctrl)
+		mockStorer.EXPECT().GetNext(topic).Return(newValue([]byte("test_value")), 0, nil)
+		mockStorer.EXPECT().Ack(topic, 0).Return(nil)
+
+		b := newBroker(mockStorer)
+
+		c, err := b.Subscribe(topic, consumerOpts{})
+		require.NoError(t, err)
+		_, err = c.Next(context.Background())
+		require.NoError(t, err)
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			require.NoError(t, c.Ack(""))
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		b.Drain(ctx)
+		require.NoError(t, ctx.Err())
+		require.False(t, c.Outstanding())
+	})
+
+	t.Run("releases outstanding messages once the grace period ends", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		topic := "test_topic"
+
+		mockStorer := NewMockstorer(ctrl)
+		mockStorer.EXPECT().GetNext(topic).Return(newValue([]byte("test_value")), 0, nil)
+		mockStorer.EXPECT().Release(topic, []int{0}).Return(nil)
+
+		b := newBroker(mockStorer)
+
+		c, err := b.Subscribe(topic, consumerOpts{})
+		require.NoError(t, err)
+		_, err = c.Next(context.Background())
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		b.Drain(ctx)
+		require.False(t, c.Outstanding())
+	})
+}
+
+func TestBroker_Browse(t *testing.T) {
+	topic := "test_topic"
+
+	s := newMemStore()
+	defer s.Destroy()
+
+	b := newBroker(s)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.Publish(context.Background(), topic, newValue([]byte(fmt.Sprintf("test_value_%d", i)))))
+	}
+
+	c, err := b.Subscribe(topic, consumerOpts{})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = c.Next(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, c.Dack("", time.Duration(3-i)*time.Minute))
+	}
+
+	t.Run("browses delayed messages in due order", func(t *testing.T) {
+		vals, err := b.Browse(topic, queueDelayed, maxPriority, 1, 10)
+		require.NoError(t, err)
+		require.Len(t, vals, 2)
+
+		require.Equal(t, 1, vals[0].Offset)
+		require.Equal(t, "test_value_1", string(vals[0].Raw))
+		require.Equal(t, 2, vals[1].Offset)
+		require.Equal(t, "test_value_0", string(vals[1].Raw))
+		require.True(t, vals[0].DueAt.Before(vals[1].DueAt))
+	})
+
+	t.Run("rejects invalid options", func(t *testing.T) {
+		_, err := b.Browse(topic, "unknown", maxPriority, 0, 10)
+		require.Equal(t, errInvalidBrowse, err)
+
+		_, err = b.Browse(topic, queueMain, maxPriority, 0, 0)
+		require.Equal(t, errInvalidBrowse, err)
+
+		_, err = b.Browse(topic, queueMain, maxPriority, 0, maxBrowseLimit+1)
+		require.Equal(t, errInvalidBrowse, err)
+	})
+}
+
+func TestBroker_ReleaseDelayed(t *testing.T) {
+	topic := "test_topic"
+
+	s := newMemStore()
+	defer s.Destroy()
+
+	b := newBroker(s)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.Publish(context.Background(), topic, newValue([]byte(fmt.Sprintf("test_value_%d", i)))))
+	}
+
+	c, err := b.Subscribe(topic, consumerOpts{})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = c.Next(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, c.Dack("", time.Hour))
+	}
+
+	count, err := b.ReleaseDelayed(topic, "")
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	stats, err := b.Stats(topic)
+	require.NoError(t, err)
+	require.Equal(t, 3, stats.Depth)
+	require.Equal(t, 0, stats.Delayed)
+
+	// Expect the released messages to be delivered in the order they were due.
+	for i := 0; i < 3; i++ {
+		val, err := c.Next(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("test_value_%d", i), string(val.Raw))
+		require.NoError(t, c.Ack(""))
+	}
+}
+
+func TestBroker_ProcessDelays_WakesWhenDue(t *testing.T) {
+	topic := "test_topic"
+
+	s := newMemStore()
+	defer s.Destroy()
+
+	b := newBroker(s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go b.ProcessDelays(ctx, time.Hour)
+
+	require.NoError(t, b.Publish(context.Background(), topic, newValue([]byte("test_value"))))
+
+	c, err := b.Subscribe(topic, consumerOpts{})
+	require.NoError(t, err)
+	_, err = c.Next(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, c.Dack("", 100*time.Millisecond))
+
+	require.Eventually(t, func() bool {
+		stats, err := b.Stats(topic)
+		require.NoError(t, err)
+		return stats.Depth == 1
+	}, 2*time.Second, 10*time.Millisecond)
 }
@@ -4,6 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
 )
 
 const (
@@ -11,24 +16,107 @@ const (
 	eventTypeNack
 	eventTypeBack
 	eventTypeMsgReturned
+	eventTypeLeaseExpired
 )
 
 type eventType int
 
 type notifier interface {
 	NotifyConsumer(topic string, ev eventType)
+
+	// NotifyDelayed notifies that a message has been delayed until the given
+	// time, so that it may be returned promptly once due.
+	NotifyDelayed(dueAt time.Time)
+}
+
+// errPrefetchFull is returned when a consumer is asked for a message while it
+// already holds as many outstanding messages as its prefetch window allows.
+var errPrefetchFull = errors.New("prefetch window full")
+
+// maxBatchSize is the maximum number of messages delivered in a single batch.
+const maxBatchSize = 1000
+
+// maxExpiredTokens is the number of delivery tokens whose leases expired that a
+// consumer remembers, so that their late acknowledgements are rejected as
+// expired rather than unknown.
+const maxExpiredTokens = 1000
+
+// delivery is a message delivered to a consumer which is awaiting
+// acknowledgement.
+type delivery struct {
+	// token is the opaque token identifying this delivery of the message, used
+	// to acknowledge it. A redelivered message is given a new token.
+	token     string
+	val       *value
+	ackOffset int
+
+	// leaseDeadline is the time the message is returned to the queue if it has
+	// not been acknowledged, zero if the lease never expires.
+	leaseDeadline time.Time
+}
+
+// tokenSet names a set of outstanding messages by their delivery tokens, or
+// every message delivered up to and including the message with the token upTo.
+type tokenSet struct {
+	tokens []string
+	upTo   string
 }
 
-// consumer handles providing values iteratively to a single consumer. Methods
-// on a consumer are not thread safe as operations should occur serially.
+// consumer handles providing values iteratively to a single consumer.
+// Operations should occur serially, however the outstanding state is guarded
+// so that the broker may inspect and return a consumer's outstanding messages
+// when shutting down.
 type consumer struct {
-	id          string
-	topic       string
-	ackOffset   int
-	store       storer
-	eventChan   chan eventType
-	notifier    notifier
-	outstanding bool // indicates whether the consumer has an outstanding message to ack
+	id        string
+	topic     string
+	store     storer
+	eventChan chan eventType
+	notifier  notifier
+	draining  <-chan struct{} // closed once the broker stops delivering messages
+
+	// prefetch is the number of messages the consumer may hold outstanding at
+	// once.
+	prefetch int
+	// batch is the number of messages delivered to the consumer at once, zero
+	// if messages are delivered individually. linger is the time waited for a
+	// batch to fill once a message is available.
+	batch  int
+	linger time.Duration
+	// outstanding holds the messages awaiting acknowledgement, in the order
+	// they were delivered.
+	outstanding []*delivery
+
+	// lease is the duration the consumer may hold an outstanding message before
+	// it is returned to the queue. A zero lease never expires.
+	lease time.Duration
+	// expired holds the tokens of the deliveries whose leases expired before
+	// they were acknowledged, oldest first in expiredOrder.
+	expired      map[string]bool
+	expiredOrder []string
+	// lastToken is the token of the most recent delivery.
+	lastToken string
+
+	sync.Mutex
+}
+
+// consumerOpts configures a consumer when subscribing to a topic.
+type consumerOpts struct {
+	// lease is the duration the consumer may hold a message before it is
+	// returned to the queue. If zero, the broker's default lease is used.
+	lease time.Duration
+
+	// prefetch is the number of messages the consumer may hold outstanding at
+	// once. If zero, a single message is delivered at a time.
+	prefetch int
+
+	// batch is the number of messages delivered to the consumer at once, once
+	// it has acknowledged its previous batch. If zero, messages are delivered
+	// individually.
+	batch int
+
+	// linger is the time waited for a batch to fill once a message is
+	// available. If zero, a batch holds the messages immediately available.
+	linger time.Duration
 }
 
 func (c *consumer) String() string {
@@ -38,85 +126,550 @@ func (c *consumer) String() string {
 // Next will attempt to retrieve the next value on the topic, or it will
 // block waiting for a msg indicating there is a new value available.
 func (c *consumer) Next(ctx context.Context) (val *value, err error) {
-	// Prevent Next from being called if the consumer already has one outstanding
-	// unacknowledged message.
-	if c.outstanding {
-		return nil, errors.New("unacknowledged message outstanding")
+	d, err := c.next(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.val, nil
+}
+
+// Fill delivers messages to the consumer until its prefetch window is full. If
+// the consumer has no outstanding messages, it blocks waiting for a message as
+// Next does, otherwise only the messages immediately available are delivered.
+// A consumer receiving batches is instead delivered its next batch once it has
+// no outstanding messages.
+func (c *consumer) Fill(ctx context.Context) ([]*delivery, error) {
+	if c.batch > 0 {
+		if c.Outstanding() {
+			return nil, nil
+		}
+
+		return c.Batch(ctx, c.batch, c.linger)
+	}
+
+	var ds []*delivery
+
+	if !c.Outstanding() {
+		d, err := c.next(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+
+		ds = append(ds, d)
+	}
+
+	for {
+		d, err := c.next(ctx, false)
+		if errors.Is(err, errPrefetchFull) || errors.Is(err, errTopicEmpty) ||
+			errors.Is(err, errTopicNotExist) || errors.Is(err, errShuttingDown) {
+			return ds, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ds = append(ds, d)
 	}
+}
+
+// Batch delivers up to n messages to the consumer at once, moving them to the
+// ack queue in a single transaction. It blocks waiting for a message as Next
+// does, then waits up to the linger duration for the batch to fill. The
+// prefetch window of the consumer does not apply to batches.
+func (c *consumer) Batch(ctx context.Context, n int, linger time.Duration) ([]*delivery, error) {
+	var (
+		lingerC  <-chan time.Time
+		lingered = false
+	)
+
+	for {
+		c.Lock()
+
+		select {
+		case <-c.draining:
+			c.Unlock()
+			return nil, errShuttingDown
+		default:
+		}
+
+		length, err := c.store.Length(c.topic)
+		if err != nil {
+			c.Unlock()
+			return nil, fmt.Errorf("getting length from store: %v", err)
+		}
+
+		if length > 0 && (length >= n || linger == 0 || lingered) {
+			vals, aos, err := c.store.GetNextBatch(c.topic, n)
+			if err == nil {
+				ds := make([]*delivery, len(vals))
+				for i, val := range vals {
+					ds[i] = c.deliver(val, aos[i])
+				}
+				c.Unlock()
+
+				return ds, nil
+			}
+
+			if !errors.Is(err, errTopicEmpty) && !errors.Is(err, errTopicNotExist) {
+				c.Unlock()
+				return nil, fmt.Errorf("getting next batch from store: %v", err)
+			}
+		}
+		c.Unlock()
+
+		// Start lingering once the first message of the batch is available.
+		if length > 0 && lingerC == nil {
+			timer := time.NewTimer(linger)
+			defer timer.Stop()
+
+			lingerC = timer.C
+		}
 
-	var ao int
+		select {
+		case <-c.eventChan:
+		case <-lingerC:
+			lingered = true
+		case <-c.draining:
+			return nil, errShuttingDown
+		case <-ctx.Done():
+			return nil, errRequestCancelled
+		}
+	}
+}
 
+// next retrieves the next value on the topic, recording its delivery. If wait
+// is set, it blocks while the topic is empty, otherwise the error of the empty
+// topic is returned.
+func (c *consumer) next(ctx context.Context, wait bool) (*delivery, error) {
 	// Repeat trying to get the next value while the topic is either empty or not
 	// created yet. It may exist sometime in the future.
 	for {
-		val, ao, err = c.store.GetNext(c.topic)
+		c.Lock()
+
+		// Prevent delivery if the consumer already holds as many unacknowledged
+		// messages as it may.
+		if len(c.outstanding) >= c.prefetch {
+			c.Unlock()
+			return nil, errPrefetchFull
+		}
+
+		// Checked while holding the lock so that a draining broker is guaranteed
+		// to observe any message delivered before draining began.
+		select {
+		case <-c.draining:
+			c.Unlock()
+			return nil, errShuttingDown
+		default:
+		}
+
+		val, ao, err := c.store.GetNext(c.topic)
+		if err == nil {
+			d := c.deliver(val, ao)
+			c.Unlock()
+
+			return d, nil
+		}
+		c.Unlock()
+
 		if !errors.Is(err, errTopicEmpty) && !errors.Is(err, errTopicNotExist) {
-			break
+			return nil, fmt.Errorf("getting next from store: %v", err)
+		}
+
+		if !wait {
+			return nil, err
 		}
 
 		select {
 		case <-c.eventChan:
+		case <-c.draining:
+			return nil, errShuttingDown
 		case <-ctx.Done():
 			return nil, errRequestCancelled
 		}
 	}
+}
+
+// deliver records the delivery of a value at the given ack offset, returning
+// the delivery. The lock must be held.
+func (c *consumer) deliver(val *value, ackOffset int) *delivery {
+	d := &delivery{token: xid.New().String(), val: val, ackOffset: ackOffset}
+	if c.lease > 0 {
+		d.leaseDeadline = time.Now().Add(c.lease)
+	}
+
+	c.outstanding = append(c.outstanding, d)
+	c.lastToken = d.token
+
+	return d
+}
+
+// Outstanding reports whether the consumer holds a message which has not yet
+// been acknowledged.
+func (c *consumer) Outstanding() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return len(c.outstanding) > 0
+}
+
+// find returns the index of the outstanding message with the given delivery
+// token. An empty token names the only outstanding message, which is ambiguous
+// if more than one message is outstanding. The lock must be held.
+func (c *consumer) find(token string) (int, error) {
+	if token == "" {
+		switch len(c.outstanding) {
+		case 0:
+			if c.expired[c.lastToken] {
+				return 0, errLeaseExpired
+			}
+
+			return 0, errMsgNotOutstanding
+		case 1:
+			return 0, nil
+		default:
+			return 0, errMsgNotNamed
+		}
+	}
+
+	for i, d := range c.outstanding {
+		if d.token == token {
+			return i, nil
+		}
+	}
+
+	if c.expired[token] {
+		return 0, errLeaseExpired
+	}
+
+	return 0, errUnknownToken
+}
+
+// holds reports whether the consumer holds the outstanding message with the
+// given delivery token, or held it until its lease expired.
+func (c *consumer) holds(token string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	_, err := c.find(token)
+	return err == nil || errors.Is(err, errLeaseExpired)
+}
+
+// expire records that the lease of the delivery with the given token expired,
+// forgetting the oldest expired token once too many are held. The lock must be
+// held.
+func (c *consumer) expire(token string) {
+	if c.expired == nil {
+		c.expired = map[string]bool{}
+	}
+
+	c.expired[token] = true
+	c.expiredOrder = append(c.expiredOrder, token)
+
+	if len(c.expiredOrder) > maxExpiredTokens {
+		delete(c.expired, c.expiredOrder[0])
+		c.expiredOrder = c.expiredOrder[1:]
+	}
+}
+
+// remove removes the outstanding message at the given index. The lock must be
+// held.
+func (c *consumer) remove(i int) {
+	c.outstanding = append(c.outstanding[:i], c.outstanding[i+1:]...)
+}
+
+// findSet returns the indexes of the outstanding messages named by the set, in
+// the order they were delivered. The lock must be held.
+func (c *consumer) findSet(set tokenSet) ([]int, error) {
+	if set.upTo != "" {
+		last, err := c.find(set.upTo)
+		if err != nil {
+			return nil, err
+		}
+
+		idxs := make([]int, last+1)
+		for i := range idxs {
+			idxs[i] = i
+		}
+
+		return idxs, nil
+	}
+
+	seen := map[int]bool{}
+
+	var idxs []int
+	for _, token := range set.tokens {
+		i, err := c.find(token)
+		if err != nil {
+			return nil, err
+		}
+
+		if !seen[i] {
+			seen[i] = true
+			idxs = append(idxs, i)
+		}
+	}
+
+	sort.Ints(idxs)
+
+	return idxs, nil
+}
+
+// settleSet applies a batch operation of the store to the outstanding messages
+// named by the set, removing them once it succeeds. The verb describes the
+// operation in errors. The lock must be held.
+func (c *consumer) settleSet(set tokenSet, verb string, op func(topic string, ackOffsets []int) error) error {
+	idxs, err := c.findSet(set)
 	if err != nil {
-		return nil, fmt.Errorf("getting next from store: %v", err)
+		return err
+	}
+
+	aos := make([]int, len(idxs))
+	for i, idx := range idxs {
+		aos[i] = c.outstanding[idx].ackOffset
+	}
+
+	if err := op(c.topic, aos); err != nil {
+		return fmt.Errorf("%s topic %s with offsets %v: %w", verb, c.topic, aos, err)
 	}
 
-	c.ackOffset = ao
-	c.outstanding = true
+	// Remove in reverse so that the remaining indexes are unaffected.
+	for i := len(idxs) - 1; i >= 0; i-- {
+		c.remove(idxs[i])
+	}
 
-	return val, err
+	return nil
 }
 
-// Ack acknowledges the previously consumed value.
-func (c *consumer) Ack() error {
-	if err := c.store.Ack(c.topic, c.ackOffset); err != nil {
-		return fmt.Errorf("acking topic %s with offset %d: %v", c.topic, c.ackOffset, err)
+// Ack acknowledges the outstanding message with the given delivery token, or
+// the only outstanding message if the token is empty.
+func (c *consumer) Ack(token string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	i, err := c.find(token)
+	if err != nil {
+		return err
+	}
+
+	ao := c.outstanding[i].ackOffset
+	if err := c.store.Ack(c.topic, ao); err != nil {
+		return fmt.Errorf("acking topic %s with offset %d: %v", c.topic, ao, err)
 	}
 
-	c.outstanding = false
+	c.remove(i)
 
 	return nil
 }
 
+// AckBatch acknowledges the outstanding messages named by the set in a single
+// store transaction.
+func (c *consumer) AckBatch(set tokenSet) error {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.settleSet(set, "acking", c.store.AckBatch)
+}
+
 // Nack negatively acknowledges a message, returning it for consumption by other
 // consumers.
-func (c *consumer) Nack() error {
-	if err := c.store.Nack(c.topic, c.ackOffset); err != nil {
-		return fmt.Errorf("nacking topic %s with offset %d: %w", c.topic, c.ackOffset, err)
+func (c *consumer) Nack(token string) error {
+	c.Lock()
+	i, err := c.find(token)
+	if err != nil {
+		c.Unlock()
+		return err
+	}
+
+	ao := c.outstanding[i].ackOffset
+	if err := c.store.Nack(c.topic, ao); err != nil {
+		c.Unlock()
+		return fmt.Errorf("nacking topic %s with offset %d: %w", c.topic, ao, err)
+	}
+
+	c.remove(i)
+	c.Unlock()
+
+	c.notifier.NotifyConsumer(c.topic, eventTypeNack)
+	c.notifyDeadLetter()
+
+	return nil
+}
+
+// NackBatch negatively acknowledges the outstanding messages named by the set in
+// a single store transaction, returning them to the front of the queue in the
+// order they were delivered.
+func (c *consumer) NackBatch(set tokenSet) error {
+	c.Lock()
+	if err := c.settleSet(set, "nacking", c.store.NackBatch); err != nil {
+		c.Unlock()
+		return err
 	}
+	c.Unlock()
 
-	c.outstanding = false
 	c.notifier.NotifyConsumer(c.topic, eventTypeNack)
+	c.notifyDeadLetter()
 
 	return nil
 }
 
 // Back negatively acknowledges a message, returning it to the back of the queue
 // for consumption.
-func (c *consumer) Back() error {
-	if err := c.store.Back(c.topic, c.ackOffset); err != nil {
-		return fmt.Errorf("backing topic %s with offset %d: %v", c.topic, c.ackOffset, err)
+func (c *consumer) Back(token string) error {
+	c.Lock()
+	i, err := c.find(token)
+	if err != nil {
+		c.Unlock()
+		return err
+	}
+
+	ao := c.outstanding[i].ackOffset
+	if err := c.store.Back(c.topic, ao); err != nil {
+		c.Unlock()
+		return fmt.Errorf("backing topic %s with offset %d: %v", c.topic, ao, err)
 	}
 
-	c.outstanding = false
+	c.remove(i)
+	c.Unlock()
+
+	c.notifier.NotifyConsumer(c.topic, eventTypeBack)
+	c.notifyDeadLetter()
+
+	return nil
+}
+
+// BackBatch negatively acknowledges the outstanding messages named by the set in
+// a single store transaction, returning them to the back of the queue in the
+// order they were delivered.
+func (c *consumer) BackBatch(set tokenSet) error {
+	c.Lock()
+	if err := c.settleSet(set, "backing", c.store.BackBatch); err != nil {
+		c.Unlock()
+		return err
+	}
+	c.Unlock()
+
 	c.notifier.NotifyConsumer(c.topic, eventTypeBack)
+	c.notifyDeadLetter()
+
+	return nil
+}
+
+// Dack negatively acknowledges a message, placing it on the delay queue of the
+// topic until the delay has passed.
+func (c *consumer) Dack(token string, delay time.Duration) error {
+	c.Lock()
+	i, err := c.find(token)
+	if err != nil {
+		c.Unlock()
+		return err
+	}
+
+	ao := c.outstanding[i].ackOffset
+	if err := c.store.Dack(c.topic, ao, delay); err != nil {
+		c.Unlock()
+		return fmt.Errorf("dacking topic %s with offset %d and delay %s: %v", c.topic, ao, delay, err)
+	}
+
+	c.remove(i)
+	c.Unlock()
+
+	c.notifier.NotifyDelayed(time.Now().Add(delay))
+	c.notifyDeadLetter()
 
 	return nil
 }
 
-func (c *consumer) Dack(delaySeconds int) error {
-	if err := c.store.Dack(c.topic, c.ackOffset, delaySeconds); err != nil {
-		return fmt.Errorf("dacking topic %s with offset %d and delay %ds: %v", c.topic, c.ackOffset, delaySeconds, err)
+// Release returns every outstanding message to the front of the queue, in the
+// order they were delivered, such as once the consumer has disconnected. The
+// messages are not counted as having failed.
+func (c *consumer) Release() error {
+	c.Lock()
+	if len(c.outstanding) == 0 {
+		c.Unlock()
+		return nil
 	}
 
-	c.outstanding = false
+	aos := make([]int, len(c.outstanding))
+	for i, d := range c.outstanding {
+		aos[i] = d.ackOffset
+	}
+
+	if err := c.store.Release(c.topic, aos); err != nil {
+		c.Unlock()
+		return fmt.Errorf("releasing topic %s: %w", c.topic, err)
+	}
+
+	c.outstanding = nil
+	c.Unlock()
+
+	c.notifier.NotifyConsumer(c.topic, eventTypeNack)
 
 	return nil
 }
 
+// notifyDeadLetter notifies consumers of the topic's dead letter topic, as a
+// failed delivery may have moved the message there.
+func (c *consumer) notifyDeadLetter() {
+	c.notifier.NotifyConsumer(fmt.Sprintf(deadLetterTopicFmt, c.topic), eventTypePublish)
+}
+
+// Touch extends the lease on an outstanding message to the given duration from
+// now, returning the new deadline. If the duration is zero, the consumer's
+// lease duration is used.
+func (c *consumer) Touch(token string, d time.Duration) (time.Time, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	i, err := c.find(token)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if d == 0 {
+		d = c.lease
+	}
+
+	if d > 0 {
+		c.outstanding[i].leaseDeadline = time.Now().Add(d)
+	}
+
+	return c.outstanding[i].leaseDeadline, nil
+}
+
+// expireLease returns the outstanding messages whose leases have passed the
+// given time to the front of the queue, in the order they were delivered,
+// reporting whether any were returned. Subsequent acknowledgements of the
+// messages by the consumer are rejected.
+func (c *consumer) expireLease(now time.Time) (bool, error) {
+	c.Lock()
+
+	expired := false
+	for i := len(c.outstanding) - 1; i >= 0; i-- {
+		d := c.outstanding[i]
+		if d.leaseDeadline.IsZero() || now.Before(d.leaseDeadline) {
+			continue
+		}
+
+		if err := c.store.Expire(c.topic, d.ackOffset); err != nil {
+			c.Unlock()
+			return false, fmt.Errorf("expiring topic %s with offset %d: %w", c.topic, d.ackOffset, err)
+		}
+
+		c.expire(d.token)
+		c.remove(i)
+		expired = true
+	}
+	c.Unlock()
+
+	if expired {
+		c.notifier.NotifyConsumer(c.topic, eventTypeLeaseExpired)
+		c.notifyDeadLetter()
+	}
+
+	return expired, nil
+}
+
 // EventChan returns a channel to notify the consumer of events occurring on the
 // topic.
 func (c *consumer) EventChan() <-chan eventType {
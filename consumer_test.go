@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"testing"
+	"time"
 
 	gomock "github.com/golang/mock/gomock"
 	assert "github.com/stretchr/testify/require"
@@ -26,19 +27,20 @@ func TestConsumerNext(t *testing.T) {
 		mockStore.EXPECT().GetNext(topic).Return(msg2, 1, nil)
 
 		b := newBroker(mockStore)
-		c := b.Subscribe(topic)
+		c, err := b.Subscribe(topic, consumerOpts{})
+		assert.NoError(err)
 
 		msg, err := c.Next(context.Background())
 		assert.NoError(err)
 		assert.Equal(msg1, msg)
-		assert.Equal(c.ackOffset, 0)
+		assert.Equal(0, c.outstanding[0].ackOffset)
 
-		assert.NoError(c.Ack())
+		assert.NoError(c.Ack(""))
 
 		msg, err = c.Next(context.Background())
 		assert.NoError(err)
 		assert.Equal(msg2, msg)
-		assert.Equal(c.ackOffset, 1)
+		assert.Equal(1, c.outstanding[0].ackOffset)
 	})
 
 	t.Run("next next, fails due to outstanding ack", func(t *testing.T) {
@@ -55,14 +57,221 @@ func TestConsumerNext(t *testing.T) {
 		mockStore.EXPECT().GetNext(topic).Return(msg1, 0, nil)
 
 		b := newBroker(mockStore)
-		c := b.Subscribe(topic)
+		c, err := b.Subscribe(topic, consumerOpts{})
+		assert.NoError(err)
 
 		msg, err := c.Next(context.Background())
 		assert.NoError(err)
 		assert.Equal(msg1, msg)
-		assert.Equal(c.ackOffset, 0)
+		assert.Equal(0, c.outstanding[0].ackOffset)
 
 		msg, err = c.Next(context.Background())
 		assert.Error(err)
 	})
+	t.Run("lease expires, rejecting ack", func(t *testing.T) {
+		assert := assert.New(t)
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			topic = "test_topic"
+			msg1  = newValue([]byte("message1"))
+		)
+
+		mockStore := NewMockstorer(ctrl)
+		mockStore.EXPECT().GetNext(topic).Return(msg1, 0, nil)
+		mockStore.EXPECT().Expire(topic, 0).Return(nil)
+
+		b := newBroker(mockStore)
+		c, err := b.Subscribe(topic, consumerOpts{lease: time.Minute})
+		assert.NoError(err)
+
+		_, err = c.Next(context.Background())
+		assert.NoError(err)
+
+		// Not yet expired
+		expired, err := c.expireLease(time.Now())
+		assert.NoError(err)
+		assert.False(expired)
+
+		expired, err = c.expireLease(time.Now().Add(2 * time.Minute))
+		assert.NoError(err)
+		assert.True(expired)
+		assert.False(c.Outstanding())
+
+		assert.Equal(errLeaseExpired, c.Ack(""))
+	})
+
+	t.Run("prefetch holds multiple messages", func(t *testing.T) {
+		assert := assert.New(t)
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			topic = "test_topic"
+			msg1  = newValue([]byte("message1"))
+			msg2  = newValue([]byte("message2"))
+			msg3  = newValue([]byte("message3"))
+		)
+
+		mockStore := NewMockstorer(ctrl)
+		gomock.InOrder(
+			mockStore.EXPECT().GetNext(topic).Return(msg1, 0, nil),
+			mockStore.EXPECT().GetNext(topic).Return(msg2, 1, nil),
+			mockStore.EXPECT().Ack(topic, 0).Return(nil),
+			mockStore.EXPECT().GetNext(topic).Return(msg3, 2, nil),
+			mockStore.EXPECT().Release(topic, []int{1, 2}).Return(nil),
+		)
+
+		b := newBroker(mockStore)
+		c, err := b.Subscribe(topic, consumerOpts{prefetch: 2})
+		assert.NoError(err)
+
+		ds, err := c.Fill(context.Background())
+		assert.NoError(err)
+		assert.Len(ds, 2)
+		assert.Equal(msg1, ds[0].val)
+		assert.Equal(msg2, ds[1].val)
+		assert.NotEqual(ds[0].token, ds[1].token)
+
+		// Acks must give a delivery token while more than one is outstanding.
+		assert.Equal(errMsgNotNamed, c.Ack(""))
+		assert.Equal(errUnknownToken, c.Ack("unknown"))
+		assert.NoError(c.Ack(ds[0].token))
+
+		// A duplicated ack of the same token is rejected.
+		assert.Equal(errUnknownToken, c.Ack(ds[0].token))
+
+		// Filling stops once the window is full again.
+		ds, err = c.Fill(context.Background())
+		assert.NoError(err)
+		assert.Len(ds, 1)
+		assert.Equal(msg3, ds[0].val)
+
+		// Released in the order they were delivered.
+		assert.NoError(c.Release())
+		assert.False(c.Outstanding())
+	})
+
+	t.Run("batch delivers up to n messages at once", func(t *testing.T) {
+		assert := assert.New(t)
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			topic = "test_topic"
+			msg1  = newValue([]byte("message1"))
+			msg2  = newValue([]byte("message2"))
+			msg3  = newValue([]byte("message3"))
+		)
+
+		mockStore := NewMockstorer(ctrl)
+		gomock.InOrder(
+			mockStore.EXPECT().Length(topic).Return(3, nil),
+			mockStore.EXPECT().GetNextBatch(topic, 2).Return([]*value{msg1, msg2}, []int{0, 1}, nil),
+			mockStore.EXPECT().Ack(topic, 0).Return(nil),
+			mockStore.EXPECT().Ack(topic, 1).Return(nil),
+			// The last message lingers for the batch to fill.
+			mockStore.EXPECT().Length(topic).Return(1, nil),
+			mockStore.EXPECT().Length(topic).Return(1, nil),
+			mockStore.EXPECT().GetNextBatch(topic, 2).Return([]*value{msg3}, []int{2}, nil),
+		)
+
+		b := newBroker(mockStore)
+		c, err := b.Subscribe(topic, consumerOpts{batch: 2, linger: 10 * time.Millisecond})
+		assert.NoError(err)
+
+		ds, err := c.Fill(context.Background())
+		assert.NoError(err)
+		assert.Len(ds, 2)
+		assert.Equal(msg1, ds[0].val)
+		assert.Equal(msg2, ds[1].val)
+
+		// The next batch is only delivered once the whole batch is acked.
+		assert.NoError(c.Ack(ds[0].token))
+
+		next, err := c.Fill(context.Background())
+		assert.NoError(err)
+		assert.Empty(next)
+
+		assert.NoError(c.Ack(ds[1].token))
+
+		ds, err = c.Fill(context.Background())
+		assert.NoError(err)
+		assert.Len(ds, 1)
+		assert.Equal(msg3, ds[0].val)
+	})
+
+	t.Run("acks a set of messages at once", func(t *testing.T) {
+		assert := assert.New(t)
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			topic = "test_topic"
+			msgs  = []*value{
+				newValue([]byte("message1")),
+				newValue([]byte("message2")),
+				newValue([]byte("message3")),
+				newValue([]byte("message4")),
+			}
+		)
+
+		mockStore := NewMockstorer(ctrl)
+		gomock.InOrder(
+			mockStore.EXPECT().Length(topic).Return(4, nil),
+			mockStore.EXPECT().GetNextBatch(topic, 4).Return(msgs, []int{0, 1, 2, 3}, nil),
+			mockStore.EXPECT().AckBatch(topic, []int{0, 2}).Return(nil),
+			mockStore.EXPECT().NackBatch(topic, []int{1, 3}).Return(nil),
+		)
+
+		b := newBroker(mockStore)
+		c, err := b.Subscribe(topic, consumerOpts{batch: 4})
+		assert.NoError(err)
+
+		ds, err := c.Fill(context.Background())
+		assert.NoError(err)
+		assert.Len(ds, 4)
+
+		// Tokens are applied in the order they were delivered.
+		assert.NoError(c.AckBatch(tokenSet{tokens: []string{ds[2].token, ds[0].token}}))
+
+		// A set with an unknown token is rejected as a whole.
+		assert.Equal(errUnknownToken, c.NackBatch(tokenSet{tokens: []string{ds[1].token, ds[0].token}}))
+
+		assert.NoError(c.NackBatch(tokenSet{upTo: ds[3].token}))
+		assert.False(c.Outstanding())
+	})
+
+	t.Run("touch extends the lease", func(t *testing.T) {
+		assert := assert.New(t)
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			topic = "test_topic"
+			msg1  = newValue([]byte("message1"))
+		)
+
+		mockStore := NewMockstorer(ctrl)
+		mockStore.EXPECT().GetNext(topic).Return(msg1, 0, nil)
+		mockStore.EXPECT().Ack(topic, 0).Return(nil)
+
+		b := newBroker(mockStore)
+		c, err := b.Subscribe(topic, consumerOpts{lease: time.Minute})
+		assert.NoError(err)
+
+		_, err = c.Next(context.Background())
+		assert.NoError(err)
+
+		deadline, err := c.Touch("", time.Hour)
+		assert.NoError(err)
+		assert.True(deadline.After(time.Now().Add(time.Minute)))
+
+		expired, err := c.expireLease(time.Now().Add(2 * time.Minute))
+		assert.NoError(err)
+		assert.False(expired)
+
+		assert.NoError(c.Ack(""))
+	})
 }
@@ -16,6 +16,7 @@ var (
 	url   = "https://localhost:8080"
 
 	duration = flag.Duration("duration", 10*time.Second, "duration of the benchmark")
+	prefetch = flag.Int("prefetch", 1, "number of messages to hold outstanding at once")
 )
 
 func main() {
@@ -33,7 +34,7 @@ func main() {
 		_ = enc.Encode("INIT")
 	}()
 
-	res, err := http.Post(fmt.Sprintf("%s/subscribe/%s", url, topic), "application/json", reader)
+	res, err := http.Post(fmt.Sprintf("%s/subscribe/%s?prefetch=%d", url, topic, *prefetch), "application/json", reader)
 	if err != nil {
 		log.Fatalf("failed to consume: %v", err)
 	}
@@ -56,6 +57,7 @@ func main() {
 		}
 
 		var out struct {
+			Token string `json:"token"`
 			Msg   string `json:"msg"`
 			Error string `json:"error"`
 		}
@@ -67,7 +69,7 @@ func main() {
 			log.Fatalf("received error: %s\n", out.Error)
 		}
 
-		if err := enc.Encode("ACK"); err != nil {
+		if err := enc.Encode("ACK " + out.Token); err != nil {
 			log.Fatalf("ACK failed: %v\n", err)
 		}
 
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/xid"
@@ -16,8 +23,18 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-const topicVarKey = "topic"
+const (
+	topicVarKey = "topic"
+	idVarKey    = "id"
+	tokenVarKey = "token"
+)
 
+// The acknowledgement commands apply to the outstanding message whose delivery
+// token is given as their final argument, e.g. "ACK cdpd7n4l0s4ri1d1kfeg" or
+// "DACK 30s cdpd7n4l0s4ri1d1kfeg". The token may be omitted while a single
+// message is outstanding. ACK, NACK and BACK also accept a list of tokens, or
+// UPTO followed by a token to apply to every message delivered up to and
+// including it, e.g. "ACK UPTO cdpd7n4l0s4ri1d1kfeg".
 const (
 	// CmdInit is the command to be sent with the initial subscribe request to
 	// indicate a new consumer should be initialised.
@@ -35,11 +52,58 @@ const (
 	// processed.
 	CmdBack = "BACK"
 	// CmdDack notifies the server that the outstanding message was not processed
-	// successfully and that it should be delayed by t seconds before being
-	// prepended to the front of the queue for reprocessing.
+	// successfully and that it should be delayed before being prepended to the
+	// front of the queue for reprocessing. The delay is given as a duration,
+	// e.g. 250ms or 1m30s, or an integer number of seconds.
 	CmdDack = "DACK"
+	// CmdTouch notifies the server that the outstanding message is still being
+	// processed, extending its lease by the subscription's lease duration, or by
+	// an optional duration argument.
+	CmdTouch = "TOUCH"
+	// CmdNext requests a batch of up to the given number of messages, or of the
+	// subscription's batch size if none is given, e.g. "NEXT 50".
+	CmdNext = "NEXT"
+)
+
+// leaseQueryKey is the query parameter used to set the lease duration of a
+// subscription.
+const leaseQueryKey = "lease"
+
+// prefetchQueryKey is the query parameter used to set the number of messages a
+// subscription may hold outstanding at once.
+const prefetchQueryKey = "prefetch"
+
+// The query parameters used to deliver messages to a subscription in batches of
+// a size, waiting up to a linger duration for each batch to fill.
+const (
+	batchQueryKey  = "batch"
+	lingerQueryKey = "linger"
 )
 
+// The query parameters used to schedule a published message, either after a
+// delay or at an RFC3339 time.
+const (
+	delayQueryKey     = "delay"
+	deliverAtQueryKey = "deliverAt"
+)
+
+// ttlQueryKey is the query parameter used to set the time to live of published
+// messages.
+const ttlQueryKey = "ttl"
+
+// priorityQueryKey is the query parameter used to set the priority of published
+// messages.
+const priorityQueryKey = "priority"
+
+// idempotencyKeyHeader is the request header used to set the idempotency key of
+// a published message, deduplicating retried publishes.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// msgHeaderPrefix is the prefix of the request headers which are set as
+// headers of a published message, i.e. X-Miniqueue-Header-Foo sets the header
+// Foo.
+const msgHeaderPrefix = "X-Miniqueue-Header-"
+
 const (
 	errInvalidTopicValue = serverError("invalid topic value")
 	errReadBody          = serverError("error reading the request body")
@@ -48,11 +112,191 @@ const (
 	errAck               = serverError("error ACKing message")
 	errNack              = serverError("error NACKing message")
 	errBack              = serverError("error BACKing message")
+	errDack              = serverError("error DACKing message")
 	errDecodingCmd       = serverError("error decoding command")
 	errRequestCancelled  = serverError("request context cancelled")
 	errPurge             = serverError("failed to purge topic")
+	errShuttingDown      = serverError("server is shutting down")
+	errLeaseExpired      = serverError("message lease expired")
+	errInvalidLease      = serverError("invalid lease duration")
+	errInvalidPrefetch   = serverError("invalid prefetch window")
+	errInvalidBatchSize  = serverError("invalid batch size")
+	errInvalidLinger     = serverError("invalid linger duration")
+	errMsgNotOutstanding = serverError("message is not outstanding")
+	errMsgNotNamed       = serverError("more than one message is outstanding, give its delivery token")
+	errUnknownToken      = serverError("unknown delivery token")
+	errInvalidConfig     = serverError("invalid topic config")
+	errConfig            = serverError("error getting topic config")
+	errStats             = serverError("error getting topic stats")
+	errInvalidBrowse     = serverError("invalid browse options")
+	errBrowse            = serverError("error browsing topic")
+	errInvalidDueAt      = serverError("invalid due time")
+	errInvalidSchedule   = serverError("invalid publish schedule")
+	errInvalidTTL        = serverError("invalid time to live")
+	errInvalidPriority   = serverError("invalid priority")
+	errScheduledDedup    = serverError("idempotency keys are not supported for scheduled messages")
+	errDelayed           = serverError("error updating delayed messages")
+	errRedrive           = serverError("error redriving dead letter topic")
+	errTouch             = serverError("error extending message lease")
+	errInvalidBatch      = serverError("invalid batch body")
+	errEmptyBatch        = serverError("batch contains no messages")
 )
 
+// parseDelay parses the delay argument of a DACK command or scheduled publish,
+// either a duration such as 250ms or 1m30s, or an integer number of seconds.
+func parseDelay(arg string) (time.Duration, error) {
+	d, err := time.ParseDuration(arg)
+	if seconds, serr := strconv.Atoi(arg); serr == nil {
+		d, err = time.Duration(seconds)*time.Second, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, errors.New("negative delay")
+	}
+
+	return d, nil
+}
+
+// uptoArg is the argument of the ACK, NACK and BACK commands applying them to
+// every message delivered up to and including the message of the following
+// token.
+const uptoArg = "UPTO"
+
+// parseTokenSet parses the arguments of an ACK, NACK or BACK command, reporting
+// whether they name more than one message, either as a list of delivery tokens
+// or as UPTO followed by a single token.
+func parseTokenSet(args []string) (tokenSet, bool, error) {
+	if len(args) > 0 && strings.ToUpper(args[0]) == uptoArg {
+		if len(args) != 2 || args[1] == "" {
+			return tokenSet{}, false, errors.New("UPTO takes a single token")
+		}
+
+		return tokenSet{upTo: args[1]}, true, nil
+	}
+
+	if len(args) <= 1 {
+		return tokenSet{}, false, nil
+	}
+
+	var set tokenSet
+	for _, arg := range args {
+		if arg == "" || strings.ToUpper(arg) == uptoArg {
+			return tokenSet{}, false, fmt.Errorf("invalid token %q", arg)
+		}
+
+		set.tokens = append(set.tokens, arg)
+	}
+
+	return set, true, nil
+}
+
+// parseBatchSize parses the number of messages of a batch delivered to a
+// consumer, between one and maxBatchSize.
+func parseBatchSize(arg string) (int, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 || n > maxBatchSize {
+		return 0, errors.New("batch size out of range")
+	}
+
+	return n, nil
+}
+
+// parseTTL parses the time to live of a published message, given in the same
+// form as a delay. A message must live for a positive duration.
+func parseTTL(arg string) (time.Duration, error) {
+	ttl, err := parseDelay(arg)
+	if err != nil {
+		return 0, err
+	}
+	if ttl == 0 {
+		return 0, errors.New("zero time to live")
+	}
+
+	return ttl, nil
+}
+
+// setTTLs sets the time to live of published values from the query of a
+// publish request, if given.
+func setTTLs(q url.Values, vals ...*value) error {
+	arg := q.Get(ttlQueryKey)
+	if arg == "" {
+		return nil
+	}
+
+	ttl, err := parseTTL(arg)
+	if err != nil {
+		return err
+	}
+
+	for _, val := range vals {
+		val.setTTL(ttl)
+	}
+
+	return nil
+}
+
+// parsePriority parses the priority of a published message, an integer from 0
+// to maxPriority.
+func parsePriority(arg string) (int, error) {
+	priority, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, err
+	}
+	if priority < 0 || priority > maxPriority {
+		return 0, errors.New("priority out of range")
+	}
+
+	return priority, nil
+}
+
+// setPriorities sets the priority of published values from the query of a
+// publish request, if given.
+func setPriorities(q url.Values, vals ...*value) error {
+	arg := q.Get(priorityQueryKey)
+	if arg == "" {
+		return nil
+	}
+
+	priority, err := parsePriority(arg)
+	if err != nil {
+		return err
+	}
+
+	for _, val := range vals {
+		val.Priority = priority
+	}
+
+	return nil
+}
+
+// parseSchedule parses the time a published message is due to be delivered from
+// the query of a publish request. It returns the zero time if the message is
+// to be delivered immediately.
+func parseSchedule(q url.Values) (time.Time, error) {
+	delay, deliverAt := q.Get(delayQueryKey), q.Get(deliverAtQueryKey)
+
+	switch {
+	case delay != "" && deliverAt != "":
+		return time.Time{}, errors.New("both delay and deliver at given")
+	case delay != "":
+		d, err := parseDelay(delay)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return time.Now().Add(d), nil
+	case deliverAt != "":
+		return time.Parse(time.RFC3339Nano, deliverAt)
+	}
+
+	return time.Time{}, nil
+}
+
 type serverError string
 
 func (e serverError) Error() string {
@@ -60,23 +304,40 @@ func (e serverError) Error() string {
 }
 
 type httpServer struct {
-	broker brokerer
+	route *mux.Router
 }
 
+// newHTTPServer returns a server routing requests to their handlers. The
+// router is built once up front, as compiling the patterns of every route on
+// each request would dominate the cost of small requests.
 func newHTTPServer(broker brokerer) *httpServer {
+	route := mux.NewRouter()
+
+	route.HandleFunc("/{topic}", deleteHandler(broker)).Methods(http.MethodDelete)
+	route.HandleFunc("/publish/{topic}", publishHandler(broker)).Methods(http.MethodPost)
+	route.HandleFunc("/publish/{topic}/batch", publishBatchHandler(broker)).Methods(http.MethodPost)
+	route.HandleFunc("/subscribe/{topic}", subscribeHandler(broker)).Methods(http.MethodPost)
+	route.HandleFunc("/topics", topicsHandler(broker)).Methods(http.MethodGet)
+	route.HandleFunc("/topics/{topic}", topicHandler(broker)).Methods(http.MethodGet)
+	route.HandleFunc("/topics/{topic}/messages", browseHandler(broker)).Methods(http.MethodGet)
+	route.HandleFunc("/topics/{topic}/delayed/release", releaseDelayedHandler(broker)).Methods(http.MethodPost)
+	route.HandleFunc("/topics/{topic}/delayed/{id}/release", releaseDelayedHandler(broker)).Methods(http.MethodPost)
+	route.HandleFunc("/topics/{topic}/delayed/{id}", rescheduleDelayedHandler(broker)).Methods(http.MethodPut)
+	route.HandleFunc("/topics/{topic}/delayed/{id}", deleteDelayedHandler(broker)).Methods(http.MethodDelete)
+	route.HandleFunc("/topics/{topic}/config", getConfigHandler(broker)).Methods(http.MethodGet)
+	route.HandleFunc("/topics/{topic}/config", putConfigHandler(broker)).Methods(http.MethodPut)
+	route.HandleFunc("/topics/{topic}/redrive", redriveHandler(broker)).Methods(http.MethodPost)
+	route.HandleFunc("/topics/{topic}/deliveries/{token}/ack", settleHandler(broker, CmdAck, errAck)).Methods(http.MethodPost)
+	route.HandleFunc("/topics/{topic}/deliveries/{token}/nack", settleHandler(broker, CmdNack, errNack)).Methods(http.MethodPost)
+	route.HandleFunc("/topics/{topic}/deliveries/{token}/back", settleHandler(broker, CmdBack, errBack)).Methods(http.MethodPost)
+
 	return &httpServer{
-		broker: broker,
+		route: route,
 	}
 }
 
 func (s httpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	route := mux.NewRouter()
-
-	route.HandleFunc("/{topic}", deleteHandler(s.broker)).Methods(http.MethodDelete)
-	route.HandleFunc("/publish/{topic}", publishHandler(s.broker)).Methods(http.MethodPost)
-	route.HandleFunc("/subscribe/{topic}", subscribeHandler(s.broker)).Methods(http.MethodPost)
-
-	route.ServeHTTP(w, r)
+	s.route.ServeHTTP(w, r)
 }
 
 func deleteHandler(broker brokerer) http.HandlerFunc {
@@ -86,77 +347,725 @@ func deleteHandler(broker brokerer) http.HandlerFunc {
 			Str("handler", "delete").
 			Logger()
 
-		// Read topic
-		vars := mux.Vars(r)
-		topic, ok := vars[topicVarKey]
-		if !ok {
-			log.Debug().Msg("invalid topic in path")
+		// Read topic
+		vars := mux.Vars(r)
+		topic, ok := vars[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		log.Info().Msg("deleting topic")
+
+		if err := broker.Purge(topic); err != nil {
+			log.Err(err).Msg("failed purging topic")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errPurge.Error())
+
+			return
+		}
+
+		log.Info().Msg("topic deleted")
+	}
+}
+
+func topicsHandler(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "topics").
+			Logger()
+
+		topics, err := broker.Topics()
+		if err != nil {
+			log.Err(err).Msg("failed getting topics")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errStats.Error())
+
+			return
+		}
+
+		now := time.Now()
+
+		res := make([]topicStatsResponse, 0, len(topics))
+		for _, topic := range topics {
+			stats, err := broker.Stats(topic)
+			if errors.Is(err, errTopicNotExist) {
+				// Purged since the topics were listed.
+				continue
+			}
+			if err != nil {
+				log.Err(err).Str("topic", topic).Msg("failed getting topic stats")
+
+				w.WriteHeader(http.StatusInternalServerError)
+				respondError(log, json.NewEncoder(w), errStats.Error())
+
+				return
+			}
+
+			res = append(res, newTopicStatsResponse(topic, stats, now))
+		}
+
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+func topicHandler(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "topic").
+			Logger()
+
+		topic := mux.Vars(r)[topicVarKey]
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		stats, err := broker.Stats(topic)
+		if errors.Is(err, errTopicNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			respondError(log, json.NewEncoder(w), errTopicNotExist.Error())
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed getting topic stats")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errStats.Error())
+
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(newTopicStatsResponse(topic, stats, time.Now())); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+// defaultBrowseLimit is the number of messages returned by a browse if no
+// limit is given.
+const defaultBrowseLimit = 10
+
+func browseHandler(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "browse").
+			Logger()
+
+		topic := mux.Vars(r)[topicVarKey]
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		var (
+			query    = r.URL.Query()
+			queue    = queueMain
+			priority = maxPriority
+			from     = 0
+			limit    = defaultBrowseLimit
+			err      error
+		)
+
+		if q := query.Get("queue"); q != "" {
+			queue = q
+		}
+		if p := query.Get(priorityQueryKey); p != "" {
+			priority, err = parsePriority(p)
+		}
+		if f := query.Get("from"); f != "" && err == nil {
+			from, err = strconv.Atoi(f)
+		}
+		if l := query.Get("limit"); l != "" && err == nil {
+			limit, err = strconv.Atoi(l)
+		}
+		if err != nil {
+			log.Debug().Err(err).Msg("invalid browse options")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidBrowse.Error())
+
+			return
+		}
+
+		vals, err := broker.Browse(topic, queue, priority, from, limit)
+		if errors.Is(err, errInvalidBrowse) {
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidBrowse.Error())
+
+			return
+		}
+		if errors.Is(err, errTopicNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			respondError(log, json.NewEncoder(w), errTopicNotExist.Error())
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed browsing topic")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errBrowse.Error())
+
+			return
+		}
+
+		res := make([]browsedMsg, 0, len(vals))
+		for _, val := range vals {
+			res = append(res, newBrowsedMsg(val))
+		}
+
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+// releaseDelayedHandler releases the delayed message with the ID given in the
+// path, or every delayed message of the topic if no ID is given.
+func releaseDelayedHandler(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "release_delayed").
+			Logger()
+
+		var (
+			topic = mux.Vars(r)[topicVarKey]
+			id    = mux.Vars(r)[idVarKey]
+		)
+
+		log = log.With().
+			Str("topic", topic).
+			Str("msg_id", id).
+			Logger()
+
+		count, err := broker.ReleaseDelayed(topic, id)
+		if errors.Is(err, errDelayedMsgNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			respondError(log, json.NewEncoder(w), errDelayedMsgNotExist.Error())
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed releasing delayed messages")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errDelayed.Error())
+
+			return
+		}
+
+		log.Info().
+			Int("count", count).
+			Msg("released delayed messages")
+
+		if err := json.NewEncoder(w).Encode(countResponse{Count: count}); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+// rescheduleRequest is the request to change the due time of a delayed
+// message.
+type rescheduleRequest struct {
+	DueAt time.Time `json:"dueAt"`
+}
+
+func rescheduleDelayedHandler(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "reschedule_delayed").
+			Logger()
+
+		var (
+			topic = mux.Vars(r)[topicVarKey]
+			id    = mux.Vars(r)[idVarKey]
+		)
+
+		log = log.With().
+			Str("topic", topic).
+			Str("msg_id", id).
+			Logger()
+
+		var req rescheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.DueAt.IsZero() {
+			log.Debug().Err(err).Msg("failed decoding reschedule request")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidDueAt.Error())
+
+			return
+		}
+
+		err := broker.RescheduleDelayed(topic, id, req.DueAt)
+		if errors.Is(err, errDelayedMsgNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			respondError(log, json.NewEncoder(w), errDelayedMsgNotExist.Error())
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed rescheduling delayed message")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errDelayed.Error())
+
+			return
+		}
+
+		log.Info().
+			Time("due_at", req.DueAt).
+			Msg("rescheduled delayed message")
+	}
+}
+
+func deleteDelayedHandler(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "delete_delayed").
+			Logger()
+
+		var (
+			topic = mux.Vars(r)[topicVarKey]
+			id    = mux.Vars(r)[idVarKey]
+		)
+
+		log = log.With().
+			Str("topic", topic).
+			Str("msg_id", id).
+			Logger()
+
+		err := broker.DeleteDelayed(topic, id)
+		if errors.Is(err, errDelayedMsgNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			respondError(log, json.NewEncoder(w), errDelayedMsgNotExist.Error())
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed deleting delayed message")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errDelayed.Error())
+
+			return
+		}
+
+		log.Info().Msg("deleted delayed message")
+	}
+}
+
+func getConfigHandler(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "get_config").
+			Logger()
+
+		topic := mux.Vars(r)[topicVarKey]
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		cfg, err := broker.Config(topic)
+		if err != nil {
+			log.Err(err).Msg("failed getting topic config")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errConfig.Error())
+
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(cfg); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+func putConfigHandler(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "put_config").
+			Logger()
+
+		topic := mux.Vars(r)[topicVarKey]
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		var cfg topicConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			log.Debug().Err(err).Msg("failed decoding topic config")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidConfig.Error())
+
+			return
+		}
+		defer r.Body.Close()
+
+		err := broker.SetConfig(topic, &cfg)
+		if errors.Is(err, errInvalidConfig) {
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidConfig.Error())
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed setting topic config")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errConfig.Error())
+
+			return
+		}
+
+		log.Info().
+			Int("max_deliveries", cfg.MaxDeliveries).
+			Msg("topic configured")
+
+		if err := json.NewEncoder(w).Encode(cfg); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+func redriveHandler(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "redrive").
+			Logger()
+
+		topic := mux.Vars(r)[topicVarKey]
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		count, err := broker.Redrive(topic)
+		if err != nil {
+			log.Err(err).Msg("failed redriving topic")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errRedrive.Error())
+
+			return
+		}
+
+		log.Info().
+			Int("count", count).
+			Msg("redrove dead letter topic")
+
+		if err := json.NewEncoder(w).Encode(countResponse{Count: count}); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+// settleHandler acknowledges the outstanding message with the delivery token
+// given in the path using the given command, on behalf of the consumer holding
+// it.
+func settleHandler(broker brokerer, cmd string, fallback serverError) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "settle").
+			Logger()
+
+		var (
+			topic = mux.Vars(r)[topicVarKey]
+			token = mux.Vars(r)[tokenVarKey]
+		)
+
+		log = log.With().
+			Str("topic", topic).
+			Str("token", token).
+			Str("cmd", cmd).
+			Logger()
+
+		err := broker.Settle(topic, token, cmd)
+		switch {
+		case errors.Is(err, errUnknownToken):
+			w.WriteHeader(http.StatusNotFound)
+			respondError(log, json.NewEncoder(w), errUnknownToken.Error())
+
+			return
+		case errors.Is(err, errLeaseExpired):
+			w.WriteHeader(http.StatusGone)
+			respondError(log, json.NewEncoder(w), errLeaseExpired.Error())
+
+			return
+		case err != nil:
+			log.Err(err).Msg("failed settling message")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), fallback.Error())
+
+			return
+		}
+
+		log.Info().Msg("settled message")
+	}
+}
+
+func publishHandler(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "publish").
+			Logger()
+
+		// Read topic
+		vars := mux.Vars(r)
+		topic, ok := vars[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		dueAt, err := parseSchedule(r.URL.Query())
+		if err != nil {
+			log.Debug().Err(err).Msg("invalid publish schedule")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidSchedule.Error())
+
+			return
+		}
+
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key != "" && !dueAt.IsZero() {
+			log.Debug().Msg("scheduled publish with idempotency key")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errScheduledDedup.Error())
+
+			return
+		}
+
+		log.Info().Msg("publishing to topic")
+
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Err(err).Msg("failed reading request body")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errReadBody.Error())
+
+			return
+		}
+		defer r.Body.Close()
+
+		newValue := newValue(b)
+		newValue.Headers = msgHeaders(r.Header)
+
+		if err := setTTLs(r.URL.Query(), newValue); err != nil {
+			log.Debug().Err(err).Msg("invalid time to live")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTTL.Error())
+
+			return
+		}
+
+		if err := setPriorities(r.URL.Query(), newValue); err != nil {
+			log.Debug().Err(err).Msg("invalid priority")
 
 			w.WriteHeader(http.StatusBadRequest)
-			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+			respondError(log, json.NewEncoder(w), errInvalidPriority.Error())
 
 			return
 		}
 
 		log = log.With().
-			Str("topic", topic).
+			Str("msg_id", newValue.ID).
 			Logger()
 
-		log.Info().Msg("deleting topic")
+		var (
+			status = http.StatusCreated
+			res    interface{}
+		)
+
+		switch {
+		case key != "":
+			log = log.With().
+				Str("idempotency_key", key).
+				Logger()
+
+			var (
+				entry     *dedupEntry
+				duplicate bool
+			)
+
+			entry, duplicate, err = broker.PublishIdempotent(r.Context(), topic, key, newValue)
+			if err == nil {
+				// A duplicate responds with the message originally published.
+				res = publishedMsg{ID: entry.ID, Offset: entry.Offset}
+				if duplicate {
+					status = http.StatusOK
+				}
+			}
+		case dueAt.IsZero():
+			res = publishResponse{ID: newValue.ID}
+			err = broker.Publish(r.Context(), topic, newValue)
+		default:
+			log = log.With().
+				Time("due_at", dueAt).
+				Logger()
+
+			res = publishResponse{ID: newValue.ID}
+			err = broker.PublishAt(r.Context(), topic, newValue, dueAt)
+		}
+		if errors.Is(err, errShuttingDown) {
+			log.Info().Msg("rejecting publish, server is shutting down")
 
-		if err := broker.Purge(topic); err != nil {
-			log.Err(err).Msg("failed purging topic")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			respondError(log, json.NewEncoder(w), errShuttingDown.Error())
+
+			return
+		}
+		if errors.Is(err, errTopicFull) {
+			log.Info().Msg("rejecting publish, topic is full")
+
+			w.WriteHeader(http.StatusInsufficientStorage)
+			respondError(log, json.NewEncoder(w), errTopicFull.Error())
+
+			return
+		}
+		if err != nil && r.Context().Err() != nil {
+			log.Info().Msg("publisher disconnected while blocked by a full topic")
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed to publish to broker")
 
 			w.WriteHeader(http.StatusInternalServerError)
-			respondError(log, json.NewEncoder(w), errPurge.Error())
+			respondError(log, json.NewEncoder(w), errPublish.Error())
 
 			return
 		}
 
-		log.Info().Msg("topic deleted")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.Err(err).Msg("writing response to client")
+		}
+
+		log.Debug().
+			Str("body", string(b)).
+			Msg("successfully published to topic")
 	}
 }
 
-func publishHandler(broker brokerer) http.HandlerFunc {
+func publishBatchHandler(broker brokerer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log := log.With().
 			Str("request_id", xid.New().String()).
-			Str("handler", "publish").
+			Str("handler", "publish_batch").
 			Logger()
 
-		// Read topic
-		vars := mux.Vars(r)
-		topic, ok := vars[topicVarKey]
-		if !ok {
-			log.Debug().Msg("invalid topic in path")
+		topic := mux.Vars(r)[topicVarKey]
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		defer r.Body.Close()
+
+		vals, err := readBatch(r)
+		if err != nil {
+			log.Err(err).Msg("failed reading batch")
 
 			w.WriteHeader(http.StatusBadRequest)
-			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+			respondError(log, json.NewEncoder(w), errInvalidBatch.Error())
 
 			return
 		}
+		if len(vals) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errEmptyBatch.Error())
 
-		log = log.With().
-			Str("topic", topic).
-			Logger()
+			return
+		}
 
-		log.Info().Msg("publishing to topic")
+		if err := setTTLs(r.URL.Query(), vals...); err != nil {
+			log.Debug().Err(err).Msg("invalid time to live")
 
-		b, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			log.Err(err).Msg("failed reading request body")
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTTL.Error())
 
-			w.WriteHeader(http.StatusInternalServerError)
-			respondError(log, json.NewEncoder(w), errReadBody.Error())
+			return
+		}
+
+		if err := setPriorities(r.URL.Query(), vals...); err != nil {
+			log.Debug().Err(err).Msg("invalid priority")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidPriority.Error())
 
 			return
 		}
-		defer r.Body.Close()
 
-		newValue := newValue(b)
+		log.Info().
+			Int("count", len(vals)).
+			Msg("publishing batch to topic")
 
-		if err := broker.Publish(topic, newValue); err != nil {
-			log.Err(err).Msg("failed to publish to broker")
+		offsets, err := broker.PublishBatch(r.Context(), topic, vals)
+		if errors.Is(err, errShuttingDown) {
+			log.Info().Msg("rejecting publish, server is shutting down")
+
+			w.WriteHeader(http.StatusServiceUnavailable)
+			respondError(log, json.NewEncoder(w), errShuttingDown.Error())
+
+			return
+		}
+		if errors.Is(err, errTopicFull) {
+			log.Info().Msg("rejecting publish, topic is full")
+
+			w.WriteHeader(http.StatusInsufficientStorage)
+			respondError(log, json.NewEncoder(w), errTopicFull.Error())
+
+			return
+		}
+		if err != nil && r.Context().Err() != nil {
+			log.Info().Msg("publisher disconnected while blocked by a full topic")
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed to publish batch to broker")
 
 			w.WriteHeader(http.StatusInternalServerError)
 			respondError(log, json.NewEncoder(w), errPublish.Error())
@@ -164,12 +1073,109 @@ func publishHandler(broker brokerer) http.HandlerFunc {
 			return
 		}
 
+		res := make(batchPublishResponse, len(vals))
+		for i, val := range vals {
+			res[i] = publishedMsg{ID: val.ID, Offset: offsets[i]}
+		}
+
 		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.Err(err).Msg("writing response to client")
+		}
+	}
+}
 
-		log.Debug().
-			Str("body", string(b)).
-			Msg("successfully published to topic")
+// readBatch reads the messages of a batch publish from the request body. A
+// multipart body contains a message in each part, with headers given by the
+// part's headers. Otherwise, the body contains a message on each line, with
+// empty lines ignored. Headers given in the request apply to every message.
+func readBatch(r *http.Request) ([]*value, error) {
+	headers := msgHeaders(r.Header)
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		return readMultipartBatch(multipart.NewReader(r.Body, params["boundary"]), headers)
+	}
+
+	var (
+		vals []*value
+		br   = bufio.NewReader(r.Body)
+	)
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		if line := bytes.TrimRight(line, "\r\n"); len(line) > 0 {
+			vals = append(vals, newBatchValue(line, headers, nil))
+		}
+
+		if errors.Is(err, io.EOF) {
+			return vals, nil
+		}
+	}
+}
+
+func readMultipartBatch(mr *multipart.Reader, headers map[string]string) ([]*value, error) {
+	var vals []*value
+
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return vals, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+
+		vals = append(vals, newBatchValue(b, headers, msgHeaders(http.Header(part.Header))))
+	}
+}
+
+// newBatchValue returns a new value with the headers of the batch, overridden
+// by the message's own headers.
+func newBatchValue(b []byte, batchHeaders, msgHeaders map[string]string) *value {
+	val := newValue(b)
+
+	for _, headers := range []map[string]string{batchHeaders, msgHeaders} {
+		for k, v := range headers {
+			if val.Headers == nil {
+				val.Headers = map[string]string{}
+			}
+
+			val.Headers[k] = v
+		}
+	}
+
+	return val
+}
+
+// msgHeaders returns the message headers set in the request headers, or nil if
+// there are none.
+func msgHeaders(h http.Header) map[string]string {
+	var headers map[string]string
+
+	for k, v := range h {
+		name := strings.TrimPrefix(k, msgHeaderPrefix)
+		if name == k || name == "" || len(v) == 0 {
+			continue
+		}
+
+		if headers == nil {
+			headers = map[string]string{}
+		}
+
+		headers[name] = v[0]
 	}
+
+	return headers
 }
 
 func subscribeHandler(broker brokerer) http.HandlerFunc {
@@ -195,12 +1201,85 @@ func subscribeHandler(broker brokerer) http.HandlerFunc {
 
 		log = log.With().Str("topic", topic).Logger()
 
+		var opts consumerOpts
+
+		if lease := r.URL.Query().Get(leaseQueryKey); lease != "" {
+			d, err := time.ParseDuration(lease)
+			if err != nil || d < 0 {
+				log.Debug().Str("lease", lease).Msg("invalid lease duration")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidLease.Error())
+
+				return
+			}
+
+			opts.lease = d
+		}
+
+		if prefetch := r.URL.Query().Get(prefetchQueryKey); prefetch != "" {
+			n, err := strconv.Atoi(prefetch)
+			if err != nil || n < 1 {
+				log.Debug().Str("prefetch", prefetch).Msg("invalid prefetch window")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidPrefetch.Error())
+
+				return
+			}
+
+			opts.prefetch = n
+		}
+
+		if batch := r.URL.Query().Get(batchQueryKey); batch != "" {
+			n, err := parseBatchSize(batch)
+			if err != nil {
+				log.Debug().Str("batch", batch).Msg("invalid batch size")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidBatchSize.Error())
+
+				return
+			}
+
+			opts.batch = n
+		}
+
+		if linger := r.URL.Query().Get(lingerQueryKey); linger != "" {
+			d, err := time.ParseDuration(linger)
+			if err != nil || d < 0 {
+				log.Debug().Str("linger", linger).Msg("invalid linger duration")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidLinger.Error())
+
+				return
+			}
+
+			opts.linger = d
+		}
+
 		log.Info().
 			Msg("subscribing to topic")
 
+		cons, err := broker.Subscribe(topic, opts)
+		if errors.Is(err, errShuttingDown) {
+			log.Info().Msg("rejecting subscribe, server is shutting down")
+
+			w.WriteHeader(http.StatusServiceUnavailable)
+			respondError(log, json.NewEncoder(w), errShuttingDown.Error())
+
+			return
+		}
+
+		defer func() {
+			if err := broker.Unsubscribe(cons.topic, cons.id); err != nil {
+				log.Err(err).Msg("unsubscribing consumer")
+			}
+		}()
+
 		// Wrap the writer in a flushWriter in order to immediately flush each write
 		// to the client.
-		cons := broker.Subscribe(topic)
 		enc := json.NewEncoder(newFlushWriter(w))
 		dec := json.NewDecoder(r.Body)
 
@@ -211,12 +1290,8 @@ func subscribeHandler(broker brokerer) http.HandlerFunc {
 			if err := dec.Decode(&cmd); isDisconnect(err) {
 				log.Warn().Msg("client disconnected")
 
-				if err := cons.Nack(); !errors.Is(err, errNackMsgNotExist) && err != nil {
-					log.Err(err).Msg("nacking on disconnect")
-				}
-
-				if err := broker.Unsubscribe(cons.topic, cons.id); err != nil {
-					log.Err(err).Msg("unsubscribing consumer")
+				if err := cons.Release(); err != nil {
+					log.Err(err).Msg("releasing on disconnect")
 				}
 
 				return
@@ -231,72 +1306,186 @@ func subscribeHandler(broker brokerer) http.HandlerFunc {
 
 			cmdArgs := strings.Split(cmd, " ")
 
+			// The argument of the command, such as the delay of a DACK, and the
+			// delivery token of the message it applies to, if given.
+			arg, token := splitCmdArgs(cmdArgs[0], cmdArgs[1:])
+
 			switch cmdArgs[0] {
 			case CmdInit:
 				log.Debug().Msg("initialising consumer")
 
-				handleConsumerNext(ctx, log, enc, cons)
+				if !handleConsumerNext(ctx, log, enc, cons) {
+					return
+				}
 
 			case CmdAck:
 				log.Debug().Msg("ACKing message")
 
-				if err := cons.Ack(); err != nil {
+				set, isSet, err := parseTokenSet(cmdArgs[1:])
+				if err != nil {
+					respondError(log, enc, "invalid ACK tokens")
+
+					return
+				}
+
+				if isSet {
+					err = cons.AckBatch(set)
+				} else {
+					err = cons.Ack(token)
+				}
+				if err != nil {
 					log.Err(err).Msg("failed to ACK")
-					respondError(log, enc, errAck.Error())
+					respondError(log, enc, ackError(err, errAck))
+
+					if isTokenError(err) {
+						continue
+					}
 
 					return
 				}
 
-				handleConsumerNext(ctx, log, enc, cons)
+				if !handleConsumerNext(ctx, log, enc, cons) {
+					return
+				}
 
 			case CmdNack:
 				log.Debug().Msg("NACKing message")
 
-				if err := cons.Nack(); err != nil {
+				set, isSet, err := parseTokenSet(cmdArgs[1:])
+				if err != nil {
+					respondError(log, enc, "invalid NACK tokens")
+
+					return
+				}
+
+				if isSet {
+					err = cons.NackBatch(set)
+				} else {
+					err = cons.Nack(token)
+				}
+				if err != nil {
 					log.Err(err).Msg("failed to NACK")
-					respondError(log, enc, errNack.Error())
+					respondError(log, enc, ackError(err, errNack))
+
+					if isTokenError(err) {
+						continue
+					}
 
 					return
 				}
 
-				handleConsumerNext(ctx, log, enc, cons)
+				if !handleConsumerNext(ctx, log, enc, cons) {
+					return
+				}
 
 			case CmdBack:
 				log.Debug().Msg("BACKing message")
 
-				if err := cons.Back(); err != nil {
+				set, isSet, err := parseTokenSet(cmdArgs[1:])
+				if err != nil {
+					respondError(log, enc, "invalid BACK tokens")
+
+					return
+				}
+
+				if isSet {
+					err = cons.BackBatch(set)
+				} else {
+					err = cons.Back(token)
+				}
+				if err != nil {
 					log.Err(err).Msg("failed to BACK")
-					respondError(log, enc, errBack.Error())
+					respondError(log, enc, ackError(err, errBack))
+
+					if isTokenError(err) {
+						continue
+					}
 
 					return
 				}
 
-				handleConsumerNext(ctx, log, enc, cons)
+				if !handleConsumerNext(ctx, log, enc, cons) {
+					return
+				}
 
 			case CmdDack:
 				log.Debug().Msg("DACKing message")
 
-				if len(cmdArgs) < 2 {
+				if arg == "" {
 					respondError(log, enc, "too few arguments provided to DACK")
 
 					return
 				}
 
-				seconds, err := strconv.Atoi(cmdArgs[1])
+				delay, err := parseDelay(arg)
 				if err != nil {
 					respondError(log, enc, "invalid DACK duration argument at position [1]")
 
 					return
 				}
 
-				if err := cons.Dack(seconds); err != nil {
-					log.Err(err).Msg("failed to BACK")
-					respondError(log, enc, errBack.Error())
+				if err := cons.Dack(token, delay); err != nil {
+					log.Err(err).Msg("failed to DACK")
+					respondError(log, enc, ackError(err, errDack))
+
+					if isTokenError(err) {
+						continue
+					}
+
+					return
+				}
+
+				if !handleConsumerNext(ctx, log, enc, cons) {
+					return
+				}
+
+			case CmdTouch:
+				log.Debug().Msg("TOUCHing message")
+
+				var d time.Duration
+				if arg != "" {
+					d, err = time.ParseDuration(arg)
+					if err != nil || d < 0 {
+						respondError(log, enc, "invalid TOUCH duration argument at position [1]")
+
+						return
+					}
+				}
+
+				deadline, err := cons.Touch(token, d)
+				if err != nil {
+					log.Err(err).Msg("failed to TOUCH")
+					respondError(log, enc, ackError(err, errTouch))
+
+					if isTokenError(err) {
+						continue
+					}
 
 					return
 				}
 
-				handleConsumerNext(ctx, log, enc, cons)
+				respondLease(log, enc, deadline)
+
+			case CmdNext:
+				log.Debug().Msg("delivering batch")
+
+				n := cons.batch
+				if arg != "" {
+					n, err = parseBatchSize(arg)
+					if err != nil {
+						respondError(log, enc, "invalid NEXT size argument at position [1]")
+
+						return
+					}
+				}
+				if n == 0 {
+					n = 1
+				}
+
+				ds, err := cons.Batch(ctx, n, cons.linger)
+				if !handleDeliveries(log, enc, ds, err, true) {
+					return
+				}
 
 			default:
 				log.Warn().Msg("unrecognised command received")
@@ -307,27 +1496,115 @@ func subscribeHandler(broker brokerer) http.HandlerFunc {
 	}
 }
 
-// handleConsumerNext attempts to retrieve the next value from the consumer,
-// handling any errors that may occur and responding to the client accordingly.
-func handleConsumerNext(ctx context.Context, log zerolog.Logger, enc *json.Encoder, cons *consumer) {
-	val, err := cons.Next(ctx)
+// handleConsumerNext delivers messages to the consumer until its prefetch
+// window is full, reporting whether the subscription should continue.
+func handleConsumerNext(ctx context.Context, log zerolog.Logger, enc *json.Encoder, cons *consumer) bool {
+	ds, err := cons.Fill(ctx)
+
+	return handleDeliveries(log, enc, ds, err, cons.batch > 0)
+}
+
+// handleDeliveries responds with the messages delivered to a consumer, as a
+// single array if delivered as a batch, or with the error delivering them. It
+// reports whether the subscription should continue.
+func handleDeliveries(log zerolog.Logger, enc *json.Encoder, ds []*delivery, err error, batch bool) bool {
 	switch {
 	case errors.Is(err, errRequestCancelled):
 		log.Info().Msg("client disconnected while waiting for message")
 
-		return
+		return true
+	case errors.Is(err, errShuttingDown):
+		log.Info().Msg("ending subscription, server is shutting down")
+		respondError(log, enc, errShuttingDown.Error())
+
+		return false
 	case err != nil:
 		log.Err(err).Msg("failed to get next value for topic")
 		respondError(log, enc, errNextValue.Error())
 
-		return
+		return true
+	case batch:
+		if len(ds) > 0 {
+			respondBatch(log, enc, ds)
+
+			log.Debug().
+				Int("count", len(ds)).
+				Msg("written batch to client")
+		}
+
+		return true
 	default:
-		respondMsg(log, enc, val)
+		for _, d := range ds {
+			respondDelivery(log, enc, d)
 
-		log.Debug().
-			Str("msg", string(val.Raw)).
-			Msg("written message to client")
+			log.Debug().
+				Str("msg_id", d.val.ID).
+				Str("msg", string(d.val.Raw)).
+				Msg("written message to client")
+		}
+
+		return true
+	}
+}
+
+// tokenErrors are the errors acknowledging a message which could not be found
+// by its delivery token, leaving the consumer unchanged.
+var tokenErrors = []serverError{errLeaseExpired, errMsgNotOutstanding, errMsgNotNamed, errUnknownToken}
+
+// ackError returns the error message to respond with when acknowledging a
+// message fails, informing the client if it was due to the lease expiring.
+func ackError(err error, fallback serverError) string {
+	for _, known := range tokenErrors {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+
+	return fallback.Error()
+}
+
+// isTokenError reports whether acknowledging a message failed with one of the
+// tokenErrors, after which the subscription continues, keeping the messages
+// still outstanding.
+func isTokenError(err error) bool {
+	for _, known := range tokenErrors {
+		if errors.Is(err, known) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitCmdArgs splits the arguments following a command into the argument of
+// the command, such as the delay of a DACK, and the delivery token of the
+// message it applies to, either of which may be empty. A lone argument of TOUCH
+// is taken as its duration if it parses as one, and as the token otherwise.
+func splitCmdArgs(cmd string, args []string) (arg, token string) {
+	switch strings.ToUpper(cmd) {
+	case CmdDack, CmdTouch, CmdNext:
+	default:
+		if len(args) > 0 {
+			token = args[len(args)-1]
+		}
+
+		return "", token
+	}
+
+	switch {
+	case len(args) == 0:
+		return "", ""
+	case len(args) > 1:
+		return args[0], args[len(args)-1]
 	}
+
+	if strings.ToUpper(cmd) == CmdTouch {
+		if _, err := time.ParseDuration(args[0]); err != nil {
+			return "", args[0]
+		}
+	}
+
+	return args[0], ""
 }
 
 func isDisconnect(err error) bool {
@@ -6,8 +6,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"strings"
 	"testing"
 	"time"
@@ -16,8 +18,6 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
 const defaultTopic = "test_topic"
@@ -27,27 +27,313 @@ func TestPublishSingleMessage(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	msg := newValue([]byte("test_value"))
+	msg := []byte("test_value")
+
+	var published *value
 
 	mockBroker := NewMockbrokerer(ctrl)
-	mockBroker.EXPECT().Publish(defaultTopic, msg)
+	mockBroker.EXPECT().Publish(gomock.Any(), defaultTopic, gomock.Any()).DoAndReturn(func(_ context.Context, _ string, val *value) error {
+		published = val
+		return nil
+	})
 
 	rec := NewRecorder()
-	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s", defaultTopic), bytes.NewReader(msg.Raw))
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s", defaultTopic), bytes.NewReader(msg))
 
 	srv := newHTTPServer(mockBroker)
 	srv.ServeHTTP(rec, req)
 
 	assert.Equal(http.StatusCreated, rec.Code)
+	assert.Equal(msg, published.Raw)
+	assert.Nil(published.Headers)
+
+	// Expect the assigned ID to be returned to the publisher
+	var res publishResponse
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(published.ID, res.ID)
+	assert.NotEmpty(res.ID)
 }
 
-func TestSubscribeSingleMessage(t *testing.T) {
+func TestPublishHeaders(t *testing.T) {
 	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
 
-	db, err := leveldb.Open(storage.NewMemStorage(), nil)
-	assert.NoError(err)
+	var published *value
+
+	mockBroker := NewMockbrokerer(ctrl)
+	mockBroker.EXPECT().Publish(gomock.Any(), defaultTopic, gomock.Any()).DoAndReturn(func(_ context.Context, _ string, val *value) error {
+		published = val
+		return nil
+	})
+
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s", defaultTopic), strings.NewReader("test_value"))
+	req.Header.Set("X-Miniqueue-Header-Trace-Id", "abc")
+	req.Header.Set("X-Miniqueue-Header-Source", "test")
+	req.Header.Set("X-Other", "ignored")
+
+	srv := newHTTPServer(mockBroker)
+	srv.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusCreated, rec.Code)
+	assert.Equal(map[string]string{"Trace-Id": "abc", "Source": "test"}, published.Headers)
+}
+
+func TestPublishScheduled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	deliverAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	mockBroker := NewMockbrokerer(ctrl)
+	mockBroker.EXPECT().PublishAt(gomock.Any(), defaultTopic, gomock.Any(), deliverAt)
+	mockBroker.EXPECT().PublishAt(gomock.Any(), defaultTopic, gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, _ string, _ *value, dueAt time.Time) error {
+		assert.WithinDuration(t, time.Now().Add(90*time.Second), dueAt, time.Second)
+		return nil
+	})
+
+	srv := newHTTPServer(mockBroker)
+
+	for _, tc := range []struct {
+		query string
+		code  int
+	}{
+		{query: "deliverAt=2030-01-02T03:04:05Z", code: http.StatusCreated},
+		{query: "delay=1m30s", code: http.StatusCreated},
+		{query: "delay=soon", code: http.StatusBadRequest},
+		{query: "deliverAt=tomorrow", code: http.StatusBadRequest},
+		{query: "delay=1m&deliverAt=2030-01-02T03:04:05Z", code: http.StatusBadRequest},
+	} {
+		rec := NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s?%s", defaultTopic, tc.query), strings.NewReader("test_value"))
+
+		srv.ServeHTTP(rec, req)
+
+		assert.Equal(t, tc.code, rec.Code, tc.query)
+	}
+}
+
+func TestPublishTTL(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var published *value
+
+	mockBroker := NewMockbrokerer(ctrl)
+	mockBroker.EXPECT().Publish(gomock.Any(), defaultTopic, gomock.Any()).DoAndReturn(func(_ context.Context, _ string, val *value) error {
+		published = val
+		return nil
+	})
+
+	srv := newHTTPServer(mockBroker)
+
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s?ttl=30s", defaultTopic), strings.NewReader("test_value"))
+	srv.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, published.PublishedAt.Add(30*time.Second), published.ExpiresAt)
+
+	for _, ttl := range []string{"0s", "-1m", "soon"} {
+		rec := NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s?ttl=%s", defaultTopic, ttl), strings.NewReader("test_value"))
+		srv.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code, ttl)
+	}
+}
+
+func TestPublishPriority(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var published *value
+
+	mockBroker := NewMockbrokerer(ctrl)
+	mockBroker.EXPECT().Publish(gomock.Any(), defaultTopic, gomock.Any()).DoAndReturn(func(_ context.Context, _ string, val *value) error {
+		published = val
+		return nil
+	})
+
+	srv := newHTTPServer(mockBroker)
+
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s?priority=7", defaultTopic), strings.NewReader("test_value"))
+	srv.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, 7, published.Priority)
+
+	for _, priority := range []string{"-1", "10", "high"} {
+		rec := NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s?priority=%s", defaultTopic, priority), strings.NewReader("test_value"))
+		srv.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code, priority)
+	}
+}
+
+func TestPublishIdempotent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockBroker := NewMockbrokerer(ctrl)
+	gomock.InOrder(
+		mockBroker.EXPECT().PublishIdempotent(gomock.Any(), defaultTopic, "abc", gomock.Any()).Return(&dedupEntry{ID: "msg_id", Offset: 3}, false, nil),
+		mockBroker.EXPECT().PublishIdempotent(gomock.Any(), defaultTopic, "abc", gomock.Any()).Return(&dedupEntry{ID: "msg_id", Offset: 3}, true, nil),
+	)
+
+	srv := newHTTPServer(mockBroker)
+
+	for _, code := range []int{http.StatusCreated, http.StatusOK} {
+		rec := NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s", defaultTopic), strings.NewReader("test_value"))
+		req.Header.Set(idempotencyKeyHeader, "abc")
+		srv.ServeHTTP(rec, req)
+
+		assert.Equal(t, code, rec.Code)
+
+		var res publishedMsg
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+		assert.Equal(t, publishedMsg{ID: "msg_id", Offset: 3}, res)
+	}
+
+	// Scheduled messages can't be deduplicated.
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s?delay=1m", defaultTopic), strings.NewReader("test_value"))
+	req.Header.Set(idempotencyKeyHeader, "abc")
+	srv.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestPublishTopicFull(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockBroker := NewMockbrokerer(ctrl)
+	mockBroker.EXPECT().Publish(gomock.Any(), defaultTopic, gomock.Any()).Return(errTopicFull)
+
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s", defaultTopic), strings.NewReader("test_value"))
+
+	newHTTPServer(mockBroker).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInsufficientStorage, rec.Code)
+	assert.Contains(t, rec.Body.String(), errTopicFull.Error())
+}
+
+func TestServerPublishBatch(t *testing.T) {
+	t.Run("newline delimited", func(t *testing.T) {
+		assert := assert.New(t)
+
+		srv, _, srvCloser := helperNewTestHTTPServer(t)
+		t.Cleanup(srvCloser)
+
+		helperPublishMessage(t, srv, defaultTopic, "test_msg_0")
+
+		req, _ := http.NewRequest(
+			http.MethodPost,
+			fmt.Sprintf("%s/publish/%s/batch", srv.URL, defaultTopic),
+			strings.NewReader("test_msg_1\ntest_msg_2\r\n\ntest_msg_3"),
+		)
+		req.Header.Set("X-Miniqueue-Header-Source", "test")
+
+		res, err := srv.Client().Do(req)
+		assert.NoError(err)
+		defer res.Body.Close()
+		assert.Equal(http.StatusCreated, res.StatusCode)
+
+		var published batchPublishResponse
+		assert.NoError(json.NewDecoder(res.Body).Decode(&published))
+		assert.Len(published, 3)
+
+		enc, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+		defer closeSub()
+
+		var out subResponse
+		assert.NoError(decoder.Decode(&out))
+		assert.Equal("test_msg_0", string(out.Msg))
+
+		for i, p := range published {
+			assert.Equal(i+1, p.Offset)
+
+			assert.NoError(enc.Encode(CmdAck))
+
+			out = subResponse{}
+			assert.NoError(decoder.Decode(&out))
+			assert.Equal(fmt.Sprintf("test_msg_%d", i+1), string(out.Msg))
+			assert.Equal(p.ID, out.ID)
+			assert.Equal(map[string]string{"Source": "test"}, out.Headers)
+		}
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		assert := assert.New(t)
+
+		srv, _, srvCloser := helperNewTestHTTPServer(t)
+		t.Cleanup(srvCloser)
+
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+
+		part, err := mw.CreatePart(textproto.MIMEHeader{"X-Miniqueue-Header-Trace-Id": {"abc"}})
+		assert.NoError(err)
+		_, _ = part.Write([]byte("test_msg_1\nwith a newline"))
+
+		part, err = mw.CreatePart(textproto.MIMEHeader{})
+		assert.NoError(err)
+		_, _ = part.Write([]byte("test_msg_2"))
+
+		assert.NoError(mw.Close())
+
+		res, err := srv.Client().Post(
+			fmt.Sprintf("%s/publish/%s/batch", srv.URL, defaultTopic),
+			mw.FormDataContentType(),
+			&body,
+		)
+		assert.NoError(err)
+		defer res.Body.Close()
+		assert.Equal(http.StatusCreated, res.StatusCode)
+
+		var published batchPublishResponse
+		assert.NoError(json.NewDecoder(res.Body).Decode(&published))
+		assert.Len(published, 2)
+
+		enc, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+		defer closeSub()
+
+		var out subResponse
+		assert.NoError(decoder.Decode(&out))
+		assert.Equal("test_msg_1\nwith a newline", string(out.Msg))
+		assert.Equal(map[string]string{"Trace-Id": "abc"}, out.Headers)
+
+		assert.NoError(enc.Encode(CmdAck))
 
-	b := newBroker(&store{db: db})
+		out = subResponse{}
+		assert.NoError(decoder.Decode(&out))
+		assert.Equal("test_msg_2", string(out.Msg))
+		assert.Nil(out.Headers)
+	})
+
+	t.Run("empty batch", func(t *testing.T) {
+		assert := assert.New(t)
+
+		srv, _, srvCloser := helperNewTestHTTPServer(t)
+		t.Cleanup(srvCloser)
+
+		res, err := srv.Client().Post(fmt.Sprintf("%s/publish/%s/batch", srv.URL, defaultTopic), "", strings.NewReader("\n"))
+		assert.NoError(err)
+		defer res.Body.Close()
+		assert.Equal(http.StatusBadRequest, res.StatusCode)
+	})
+}
+
+func TestSubscribeSingleMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(newMemStore())
 
 	// Publish to the topic
 	pubW := NewRecorder()
@@ -77,10 +363,7 @@ func TestSubscribeSingleMessage(t *testing.T) {
 func TestSubscribeAck(t *testing.T) {
 	assert := assert.New(t)
 
-	db, err := leveldb.Open(storage.NewMemStorage(), nil)
-	assert.NoError(err)
-
-	b := newBroker(&store{db: db})
+	b := newBroker(newMemStore())
 
 	// Publish to the topic
 	msg1 := "test_message_1"
@@ -281,6 +564,279 @@ func TestServerDack(t *testing.T) {
 	assert.Equal(1, out.DackCount)
 }
 
+func TestServerLeaseExpired(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	srv, hooks, srvCloser := helperNewTestHTTPServer(t)
+	defer srvCloser()
+	go hooks.b.ProcessDelays(ctx, 50*time.Millisecond)
+
+	msg1 := "test_msg_1"
+	helperPublishMessage(t, srv, defaultTopic, msg1)
+
+	enc1, decoder1, closeSub1 := helperSubscribeTopic(t, srv, defaultTopic+"?lease=200ms")
+	defer closeSub1()
+
+	var out subResponse
+	assert.NoError(decoder1.Decode(&out))
+	assert.Equal(msg1, string(out.Msg))
+	assert.Equal(0, out.ExpiredCount)
+
+	// A second consumer receives the message once the lease of the first expires
+	_, decoder2, closeSub2 := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub2()
+
+	out = subResponse{}
+	assert.NoError(decoder2.Decode(&out))
+	assert.Equal(msg1, string(out.Msg))
+	assert.Equal(1, out.ExpiredCount)
+
+	// The late ACK from the first consumer is rejected
+	assert.NoError(enc1.Encode(CmdAck))
+
+	out = subResponse{}
+	assert.NoError(decoder1.Decode(&out))
+	assert.Equal(errLeaseExpired.Error(), out.Error)
+}
+
+func TestServerTouch(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, _, srvCloser := helperNewTestHTTPServer(t)
+	defer srvCloser()
+
+	msg1 := "test_msg_1"
+	helperPublishMessage(t, srv, defaultTopic, msg1)
+
+	enc, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic+"?lease=1m")
+	defer closeSub()
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(msg1, string(out.Msg))
+
+	// The delivery carries the deadline of its lease.
+	assert.NotNil(out.LeaseDeadline)
+	assert.WithinDuration(time.Now().Add(time.Minute), *out.LeaseDeadline, 5*time.Second)
+
+	assert.NoError(enc.Encode("TOUCH 1h"))
+
+	out = subResponse{}
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal("", out.Error)
+	assert.NotNil(out.LeaseDeadline)
+	assert.True(out.LeaseDeadline.After(time.Now().Add(time.Minute)))
+}
+
+func TestServerTouch_Token(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, _, srvCloser := helperNewTestHTTPServer(t)
+	defer srvCloser()
+
+	msg1 := "test_msg_1"
+	helperPublishMessage(t, srv, defaultTopic, msg1)
+
+	msg2 := "test_msg_2"
+	helperPublishMessage(t, srv, defaultTopic, msg2)
+
+	enc, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic+"?lease=1m")
+	defer closeSub()
+
+	var msg subResponse
+	assert.NoError(decoder.Decode(&msg))
+	assert.Equal(msg1, string(msg.Msg))
+
+	// A lone token is taken as the token rather than a duration.
+	assert.NoError(enc.Encode(fmt.Sprintf("%s %s", CmdTouch, msg.Token)))
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal("", out.Error)
+	assert.NotNil(out.LeaseDeadline)
+
+	// An unknown token is rejected, keeping the subscription open.
+	assert.NoError(enc.Encode(fmt.Sprintf("%s %s", CmdTouch, "unknown")))
+
+	out = subResponse{}
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(errUnknownToken.Error(), out.Error)
+
+	assert.NoError(enc.Encode(fmt.Sprintf("%s %s", CmdAck, "unknown")))
+
+	out = subResponse{}
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(errUnknownToken.Error(), out.Error)
+
+	assert.NoError(enc.Encode(fmt.Sprintf("%s %s", CmdAck, msg.Token)))
+
+	out = subResponse{}
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(msg2, string(out.Msg))
+}
+
+func TestServerPrefetch(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, _, srvCloser := helperNewTestHTTPServer(t)
+	defer srvCloser()
+
+	for _, msg := range []string{"test_msg_1", "test_msg_2", "test_msg_3"} {
+		helperPublishMessage(t, srv, defaultTopic, msg)
+	}
+
+	enc, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic+"?prefetch=2")
+
+	// The first messages are delivered up to the prefetch window.
+	var msgs []subResponse
+	for _, msg := range []string{"test_msg_1", "test_msg_2"} {
+		var out subResponse
+		assert.NoError(decoder.Decode(&out))
+		assert.Equal(msg, string(out.Msg))
+
+		msgs = append(msgs, out)
+	}
+
+	// Acknowledging a message out of order makes room for the next.
+	assert.NoError(enc.Encode(fmt.Sprintf("%s %s", CmdAck, msgs[1].Token)))
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal("test_msg_3", string(out.Msg))
+
+	// The outstanding messages are returned in order on disconnect.
+	closeSub()
+	time.Sleep(100 * time.Millisecond)
+
+	_, decoder, closeSub = helperSubscribeTopic(t, srv, defaultTopic+"?prefetch=2")
+	defer closeSub()
+
+	for _, msg := range []string{"test_msg_1", "test_msg_3"} {
+		var out subResponse
+		assert.NoError(decoder.Decode(&out))
+		assert.Equal(msg, string(out.Msg))
+	}
+}
+
+func TestServerSettle(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, _, srvCloser := helperNewTestHTTPServer(t)
+	defer srvCloser()
+
+	msg1 := "test_msg_1"
+	helperPublishMessage(t, srv, defaultTopic, msg1)
+
+	msg2 := "test_msg_2"
+	helperPublishMessage(t, srv, defaultTopic, msg2)
+
+	enc, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(msg1, string(out.Msg))
+	assert.NotEmpty(out.Token)
+
+	// The message is acked from another connection using its delivery token.
+	ackPath := fmt.Sprintf("%s/topics/%s/deliveries/%s/ack", srv.URL, defaultTopic, out.Token)
+
+	res, err := srv.Client().Post(ackPath, "", nil)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	// The token is no longer known once the message has been acked.
+	res, err = srv.Client().Post(ackPath, "", nil)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusNotFound, res.StatusCode)
+
+	// Acking with the stale token on the subscription is also rejected.
+	assert.NoError(enc.Encode(fmt.Sprintf("%s %s", CmdAck, out.Token)))
+
+	out = subResponse{}
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(errUnknownToken.Error(), out.Error)
+}
+
+func TestServerBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, _, srvCloser := helperNewTestHTTPServer(t)
+	defer srvCloser()
+
+	for _, msg := range []string{"test_msg_1", "test_msg_2", "test_msg_3"} {
+		helperPublishMessage(t, srv, defaultTopic, msg)
+	}
+
+	enc, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic+"?batch=2&linger=10ms")
+	defer closeSub()
+
+	// The first batch is delivered as a single array.
+	var batch []subResponse
+	assert.NoError(decoder.Decode(&batch))
+	assert.Len(batch, 2)
+	assert.Equal("test_msg_1", string(batch[0].Msg))
+	assert.Equal("test_msg_2", string(batch[1].Msg))
+
+	for _, msg := range batch {
+		assert.NoError(enc.Encode(fmt.Sprintf("%s %s", CmdAck, msg.Token)))
+	}
+
+	// The remainder of the topic is delivered once the linger passes.
+	batch = nil
+	assert.NoError(decoder.Decode(&batch))
+	assert.Len(batch, 1)
+	assert.Equal("test_msg_3", string(batch[0].Msg))
+
+	// A larger batch may be requested explicitly.
+	for _, msg := range []string{"test_msg_4", "test_msg_5", "test_msg_6"} {
+		helperPublishMessage(t, srv, defaultTopic, msg)
+	}
+
+	assert.NoError(enc.Encode(CmdNext + " 3"))
+
+	batch = nil
+	assert.NoError(decoder.Decode(&batch))
+	assert.Len(batch, 3)
+	assert.Equal("test_msg_4", string(batch[0].Msg))
+}
+
+func TestServerBatchAck(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, _, srvCloser := helperNewTestHTTPServer(t)
+	defer srvCloser()
+
+	for _, msg := range []string{"test_msg_1", "test_msg_2", "test_msg_3", "test_msg_4"} {
+		helperPublishMessage(t, srv, defaultTopic, msg)
+	}
+
+	enc, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic+"?batch=4")
+	defer closeSub()
+
+	var batch []subResponse
+	assert.NoError(decoder.Decode(&batch))
+	assert.Len(batch, 4)
+
+	// Back the first two messages, then ack the rest up to the last.
+	assert.NoError(enc.Encode(fmt.Sprintf("%s %s %s", CmdBack, batch[0].Token, batch[1].Token)))
+	assert.NoError(enc.Encode(fmt.Sprintf("%s %s %s", CmdAck, uptoArg, batch[3].Token)))
+
+	// Once the whole batch is acknowledged, the backed messages are delivered
+	// again.
+	batch = nil
+	assert.NoError(decoder.Decode(&batch))
+	assert.Len(batch, 2)
+	assert.Equal("test_msg_1", string(batch[0].Msg))
+	assert.Equal("test_msg_2", string(batch[1].Msg))
+	assert.Equal(failureBack, batch[0].LastFailure)
+}
+
 func TestServerConnectionLost(t *testing.T) {
 	assert := assert.New(t)
 
@@ -461,6 +1017,107 @@ func TestServerDelete(t *testing.T) {
 	time.Sleep(time.Second)
 }
 
+func TestServerDeadLetterRedrive(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, _, srvCloser := helperNewTestHTTPServer(t)
+	t.Cleanup(srvCloser)
+
+	// Configure the topic to dead letter after a single failure
+	configPath := fmt.Sprintf("%s/topics/%s/config", srv.URL, defaultTopic)
+	req, _ := http.NewRequest(http.MethodPut, configPath, strings.NewReader(`{"maxDeliveries": 1}`))
+	res, err := srv.Client().Do(req)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	res, err = srv.Client().Get(configPath)
+	assert.NoError(err)
+	var cfg topicConfig
+	assert.NoError(json.NewDecoder(res.Body).Decode(&cfg))
+	res.Body.Close()
+	assert.Equal(1, cfg.MaxDeliveries)
+
+	msg1 := "test_msg_1"
+	helperPublishMessage(t, srv, defaultTopic, msg1)
+
+	// NACK the message, moving it to the dead letter topic
+	enc, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(msg1, string(out.Msg))
+	assert.NoError(enc.Encode(CmdNack))
+
+	_, dlqDecoder, closeDLQSub := helperSubscribeTopic(t, srv, fmt.Sprintf(deadLetterTopicFmt, defaultTopic))
+
+	out = subResponse{}
+	assert.NoError(dlqDecoder.Decode(&out))
+	assert.Equal(msg1, string(out.Msg))
+	assert.Equal(1, out.FailureCount)
+	assert.Equal(failureNack, out.LastFailure)
+
+	// Closing the dead letter subscription returns the message to the dead
+	// letter topic, from which it is redriven.
+	closeDLQSub()
+	time.Sleep(100 * time.Millisecond)
+
+	res, err = srv.Client().Post(fmt.Sprintf("%s/topics/%s/redrive", srv.URL, defaultTopic), "", nil)
+	assert.NoError(err)
+	var count countResponse
+	assert.NoError(json.NewDecoder(res.Body).Decode(&count))
+	res.Body.Close()
+	assert.Equal(1, count.Count)
+
+	out = subResponse{}
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(msg1, string(out.Msg))
+	assert.Equal(0, out.FailureCount)
+}
+
+func TestServerMessageMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, _, srvCloser := helperNewTestHTTPServer(t)
+	t.Cleanup(srvCloser)
+
+	publishPath := fmt.Sprintf("%s/publish/%s", srv.URL, defaultTopic)
+	req, _ := http.NewRequest(http.MethodPost, publishPath, strings.NewReader("test_msg_1"))
+	req.Header.Set("X-Miniqueue-Header-Trace-Id", "abc")
+
+	res, err := srv.Client().Do(req)
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, res.StatusCode)
+
+	var pub publishResponse
+	assert.NoError(json.NewDecoder(res.Body).Decode(&pub))
+	res.Body.Close()
+
+	enc, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(pub.ID, out.ID)
+	assert.Equal(1, out.DeliveryCount)
+	assert.Equal(map[string]string{"Trace-Id": "abc"}, out.Headers)
+	assert.NotNil(out.PublishedAt)
+	assert.NotNil(out.FirstDeliveredAt)
+	assert.Nil(out.LeaseDeadline)
+
+	firstDeliveredAt := *out.FirstDeliveredAt
+
+	// Expect a redelivery to increment the delivery count only
+	assert.NoError(enc.Encode(CmdNack))
+
+	out = subResponse{}
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(pub.ID, out.ID)
+	assert.Equal(2, out.DeliveryCount)
+	assert.True(firstDeliveredAt.Equal(*out.FirstDeliveredAt))
+}
+
 // Benchmarking
 
 func BenchmarkPublish(b *testing.B) {
@@ -471,10 +1128,7 @@ func BenchmarkPublish(b *testing.B) {
 		msg   = "test_value"
 	)
 
-	db, err := leveldb.Open(storage.NewMemStorage(), nil)
-	assert.NoError(b, err)
-
-	srv := httptest.NewUnstartedServer(newHTTPServer(newBroker(&store{db: db})))
+	srv := httptest.NewUnstartedServer(newHTTPServer(newBroker(newMemStore())))
 	srv.EnableHTTP2 = true
 	srv.StartTLS()
 
@@ -504,10 +1158,7 @@ type hooks struct {
 func helperNewTestHTTPServer(t *testing.T) (*httptest.Server, hooks, func()) {
 	t.Helper()
 
-	db, err := leveldb.Open(storage.NewMemStorage(), nil)
-	assert.NoError(t, err)
-
-	b := newBroker(&store{path: "", db: db})
+	b := newBroker(newMemStore())
 	srv := httptest.NewUnstartedServer(newHTTPServer(b))
 
 	srv.EnableHTTP2 = true
@@ -572,3 +1223,190 @@ func helperMustEncodeString(str string) io.Reader {
 
 	return &buf
 }
+
+func TestServerTopicStats(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, _, srvCloser := helperNewTestHTTPServer(t)
+	t.Cleanup(srvCloser)
+
+	res, err := srv.Client().Get(fmt.Sprintf("%s/topics/%s", srv.URL, defaultTopic))
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusNotFound, res.StatusCode)
+
+	for _, topic := range []string{defaultTopic, "other_topic"} {
+		res, err := srv.Client().Post(fmt.Sprintf("%s/publish/%s", srv.URL, topic), "", strings.NewReader("test_msg"))
+		assert.NoError(err)
+		res.Body.Close()
+	}
+
+	_, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+
+	res, err = srv.Client().Get(fmt.Sprintf("%s/topics/%s", srv.URL, defaultTopic))
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	var stats topicStatsResponse
+	assert.NoError(json.NewDecoder(res.Body).Decode(&stats))
+	res.Body.Close()
+
+	assert.Equal(defaultTopic, stats.Topic)
+	assert.Equal(0, stats.Depth)
+	assert.Equal(1, stats.InFlight)
+	assert.Equal(1, stats.Consumers)
+	assert.Equal(1, stats.Published)
+
+	res, err = srv.Client().Get(fmt.Sprintf("%s/topics", srv.URL))
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	var all []topicStatsResponse
+	assert.NoError(json.NewDecoder(res.Body).Decode(&all))
+	res.Body.Close()
+
+	assert.Len(all, 2)
+	assert.Equal("other_topic", all[1].Topic)
+	assert.Equal(1, all[1].Depth)
+	assert.Equal(0, all[1].Consumers)
+}
+
+func TestServerBrowse(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, _, srvCloser := helperNewTestHTTPServer(t)
+	t.Cleanup(srvCloser)
+
+	browsePath := fmt.Sprintf("%s/topics/%s/messages", srv.URL, defaultTopic)
+
+	res, err := srv.Client().Get(browsePath)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusNotFound, res.StatusCode)
+
+	for _, msg := range []string{"test_msg_1", "test_msg_2", "test_msg_3"} {
+		res, err := srv.Client().Post(fmt.Sprintf("%s/publish/%s", srv.URL, defaultTopic), "", strings.NewReader(msg))
+		assert.NoError(err)
+		res.Body.Close()
+	}
+
+	res, err = srv.Client().Get(browsePath + "?from=1&limit=1")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	var msgs []browsedMsg
+	assert.NoError(json.NewDecoder(res.Body).Decode(&msgs))
+	res.Body.Close()
+
+	assert.Len(msgs, 1)
+	assert.Equal(1, msgs[0].Offset)
+	assert.Equal("test_msg_2", string(msgs[0].Msg))
+	assert.NotEmpty(msgs[0].ID)
+	assert.Nil(msgs[0].DueAt)
+
+	res, err = srv.Client().Get(browsePath + "?queue=ack")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	msgs = nil
+	assert.NoError(json.NewDecoder(res.Body).Decode(&msgs))
+	res.Body.Close()
+	assert.Empty(msgs)
+
+	res, err = srv.Client().Get(browsePath + "?queue=unknown")
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+
+	// Expect the browsed messages to still be delivered in order
+	_, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal("test_msg_1", string(out.Msg))
+}
+
+func TestServerDelayedAdmin(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, _, srvCloser := helperNewTestHTTPServer(t)
+	t.Cleanup(srvCloser)
+
+	var ids []string
+	for _, msg := range []string{"test_msg_1", "test_msg_2", "test_msg_3"} {
+		res, err := srv.Client().Post(fmt.Sprintf("%s/publish/%s", srv.URL, defaultTopic), "", strings.NewReader(msg))
+		assert.NoError(err)
+
+		var pub publishResponse
+		assert.NoError(json.NewDecoder(res.Body).Decode(&pub))
+		res.Body.Close()
+
+		ids = append(ids, pub.ID)
+	}
+
+	// Delay every message for an hour
+	enc, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	for range ids {
+		var out subResponse
+		assert.NoError(decoder.Decode(&out))
+		assert.NoError(enc.Encode(CmdDack + " 3600"))
+		assert.NoError(enc.Encode(CmdInit))
+	}
+
+	delayedPath := fmt.Sprintf("%s/topics/%s/delayed", srv.URL, defaultTopic)
+
+	// Delete the first, reschedule the second and release the third
+	req, _ := http.NewRequest(http.MethodDelete, delayedPath+"/"+ids[0], nil)
+	res, err := srv.Client().Do(req)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	dueAt := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	req, _ = http.NewRequest(http.MethodPut, delayedPath+"/"+ids[1], strings.NewReader(fmt.Sprintf(`{"dueAt": %q}`, dueAt.Format(time.RFC3339))))
+	res, err = srv.Client().Do(req)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	res, err = srv.Client().Post(delayedPath+"/"+ids[2]+"/release", "", nil)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(ids[2], out.ID)
+
+	res, err = srv.Client().Post(delayedPath+"/"+ids[0]+"/release", "", nil)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusNotFound, res.StatusCode)
+
+	res, err = srv.Client().Get(fmt.Sprintf("%s/topics/%s/messages?queue=delayed", srv.URL, defaultTopic))
+	assert.NoError(err)
+
+	var msgs []browsedMsg
+	assert.NoError(json.NewDecoder(res.Body).Decode(&msgs))
+	res.Body.Close()
+
+	assert.Len(msgs, 1)
+	assert.Equal(ids[1], msgs[0].ID)
+	assert.Equal(dueAt, msgs[0].DueAt.UTC())
+
+	// Release every remaining delayed message
+	res, err = srv.Client().Post(delayedPath+"/release", "", nil)
+	assert.NoError(err)
+
+	var count countResponse
+	assert.NoError(json.NewDecoder(res.Body).Decode(&count))
+	res.Body.Close()
+	assert.Equal(1, count.Count)
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	_ "embed"
 	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -27,17 +30,49 @@ const (
 	defaultKeyPath       = "./testdata/localhost-key.pem"
 	defaultDBPath        = "./data"
 	defaultLogLevel      = "debug"
+	defaultRedisAddr     = "localhost:6379"
+	defaultMetricsAddr   = ":9090"
+	defaultGracePeriod   = 10 * time.Second
+	defaultSweepPeriod   = time.Minute
+	defaultStore         = storeLevelDB
 )
 
+// The backends available to store messages.
+const (
+	storeLevelDB = "leveldb"
+	storeMemory  = "memory"
+	storeBolt    = "bolt"
+)
+
+// serverShutdownTimeout is the time given to each server to close its active
+// connections once the broker has drained.
+const serverShutdownTimeout = 5 * time.Second
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+
 	var (
-		humanReadable = flag.Bool("human", defaultHumanReadable, "human readable logging output")
-		port          = flag.Int("port", defaultPort, "port used to run the server")
-		tlsCertPath   = flag.String("cert", defaultCertPath, "path to TLS certificate")
-		tlsKeyPath    = flag.String("key", defaultKeyPath, "path to TLS key")
-		dbPath        = flag.String("db", defaultDBPath, "path to the db file")
-		logLevel      = flag.String("level", defaultLogLevel, "(disabled|debug|info)")
-		delayPeriod   = flag.Duration("period", time.Second, "period between runs to check and restore delayed messages")
+		humanReadable  = flag.Bool("human", defaultHumanReadable, "human readable logging output")
+		httpEnabled    = flag.Bool("http", true, "serve the HTTP/2 frontend")
+		port           = flag.Int("port", defaultPort, "port used to run the HTTP/2 server")
+		tlsCertPath    = flag.String("cert", defaultCertPath, "path to TLS certificate")
+		tlsKeyPath     = flag.String("key", defaultKeyPath, "path to TLS key")
+		redisEnabled   = flag.Bool("redis", false, "serve the Redis protocol frontend")
+		redisAddr      = flag.String("redis-addr", defaultRedisAddr, "address used to run the Redis server")
+		redisCertPath  = flag.String("redis-cert", "", "path to TLS certificate for the Redis server, TLS is disabled if empty")
+		redisKeyPath   = flag.String("redis-key", "", "path to TLS key for the Redis server")
+		metricsEnabled = flag.Bool("metrics", false, "serve Prometheus metrics over HTTP")
+		metricsAddr    = flag.String("metrics-addr", defaultMetricsAddr, "address used to serve Prometheus metrics on /metrics")
+		storeBackend   = flag.String("store", defaultStore, "(leveldb|bolt|memory) backend used to store messages, memory is not durable")
+		dbPath         = flag.String("db", defaultDBPath, "path to the db directory, or file for bolt")
+		logLevel       = flag.String("level", defaultLogLevel, "(disabled|debug|info)")
+		delayPeriod    = flag.Duration("period", time.Second, "maximum period between runs to check and restore delayed messages")
+		sweepPeriod    = flag.Duration("sweep-period", defaultSweepPeriod, "period between runs removing expired messages")
+		leaseDuration  = flag.Duration("lease", 0, "default duration a consumer may hold a message before it is returned to the queue, 0 never expires")
+		gracePeriod    = flag.Duration("grace", defaultGracePeriod, "period to wait on shutdown for outstanding messages to be acknowledged before returning them to the queue")
 	)
 
 	flag.Parse()
@@ -57,60 +92,268 @@ func main() {
 		log.Fatal().Msg("invalid log level, see -h")
 	}
 
-	if *dbPath == defaultDBPath {
+	if *storeBackend != storeMemory && *dbPath == defaultDBPath {
 		log.Warn().
 			Msgf("no DB path specified, using default %s", defaultDBPath)
 	}
 
-	if *tlsCertPath == defaultCertPath {
+	var s storer
+
+	switch *storeBackend {
+	case storeLevelDB:
+		s = newStore(*dbPath)
+	case storeBolt:
+		s = newBoltStore(*dbPath)
+	case storeMemory:
+		log.Warn().Msg("using in-memory store, messages will be lost on shutdown")
+
+		s = newMemStore()
+	default:
+		log.Fatal().Msg("invalid store, see -h")
+	}
+
+	if !*httpEnabled && !*redisEnabled {
+		log.Fatal().Msg("no server enabled, at least one of -http or -redis is required")
+	}
+
+	if *httpEnabled && *tlsCertPath == defaultCertPath {
 		log.Warn().
 			Msgf("no TLS certificate path specified, using default %s", defaultCertPath)
 	}
 
-	if *tlsKeyPath == defaultKeyPath {
+	if *httpEnabled && *tlsKeyPath == defaultKeyPath {
 		log.Warn().
 			Msgf("no TLS key path specified, using default %s", defaultKeyPath)
 	}
 
-	ctx := context.Background()
+	if (*redisCertPath == "") != (*redisKeyPath == "") {
+		log.Fatal().Msg("both -redis-cert and -redis-key must be specified to enable TLS for Redis")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	delayCtx, stopDelays := context.WithCancel(context.Background())
+	defer stopDelays()
+
+	var m *metrics
+	if *metricsEnabled {
+		m = newMetrics()
+		s = m.instrumentStore(s)
+	}
+
+	b := newBroker(s)
+	b.lease = *leaseDuration
+	b.metrics = m
+
+	recovered, err := b.Recover()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to recover unacknowledged messages")
+	}
+
+	log.Info().
+		Int("topics", len(recovered)).
+		Msg("recovery complete")
+
+	go b.ProcessDelays(delayCtx, *delayPeriod)
+	go b.ProcessExpired(delayCtx, *sweepPeriod)
+
+	// Both frontends share the same broker, and therefore the same underlying
+	// store.
+	var frontends []frontend
+
+	if *httpEnabled {
+		frontends = append(frontends, newHTTPFrontend(b, *port, *tlsCertPath, *tlsKeyPath))
+	}
+
+	if *redisEnabled {
+		f, err := newRedisFrontend(b, *redisAddr, *redisCertPath, *redisKeyPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create redis server")
+		}
+
+		frontends = append(frontends, f)
+	}
+
+	if *metricsEnabled {
+		m.register(b)
+		frontends = append(frontends, newMetricsFrontend(m, *metricsAddr))
+	}
+
+	errs := make(chan error, len(frontends))
+	for _, f := range frontends {
+		go func(f frontend) {
+			errs <- f.ListenAndServe()
+		}(f)
+	}
+
+	var serveErr error
+
+	select {
+	case serveErr = <-errs:
+		log.Err(serveErr).Msg("server closed unexpectedly, shutting down")
+	case <-ctx.Done():
+		log.Info().Msg("received signal, shutting down")
+	}
+
+	stop()
+
+	// Stop accepting new work, giving consumers the grace period to acknowledge
+	// their outstanding messages before the remainder are returned to the
+	// queue.
+	graceCtx, cancel := context.WithTimeout(context.Background(), *gracePeriod)
+	b.Drain(graceCtx)
+	cancel()
+
+	stopDelays()
+
+	for _, f := range frontends {
+		ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+		if err := f.Shutdown(ctx); err != nil {
+			log.Err(err).Msg("failed to shutdown server cleanly")
+		}
+		cancel()
+	}
+
+	if err := b.Shutdown(); err != nil {
+		log.Fatal().Err(err).Msg("failed to close store")
+	}
 
-	b := newBroker(newStore(*dbPath))
-	go b.ProcessDelays(ctx, *delayPeriod)
+	if serveErr != nil {
+		log.Fatal().Err(serveErr).Msg("server closed")
+	}
 
-	switch {
-	case false:
-		runHTTP(b, port, tlsCertPath, tlsKeyPath)
+	log.Info().Msg("shutdown complete")
+}
 
-	case true:
-		runRedis(b, tlsCertPath, tlsKeyPath)
+// frontend serves the broker over a given protocol.
+type frontend interface {
+	// ListenAndServe blocks serving clients until the frontend is shut down.
+	ListenAndServe() error
+
+	// Shutdown stops the frontend, waiting for active clients to finish until
+	// the context is done, after which they are forcibly closed.
+	Shutdown(ctx context.Context) error
+}
+
+type redisFrontend struct {
+	r   *redis
+	srv interface {
+		ListenAndServe() error
+		Close() error
 	}
 }
 
-func runRedis(b brokerer, tlsCertPath, tlsKeyPath *string) {
+func newRedisFrontend(b brokerer, addr, tlsCertPath, tlsKeyPath string) (*redisFrontend, error) {
 	log.Info().
+		Str("addr", addr).
+		Bool("tls", tlsCertPath != "").
 		Msg("starting miniqueue over redis")
 
 	r := newRedis(b)
 
-	err := redcon.ListenAndServe("localhost:6379", r.handleCmd, nil, nil)
+	if tlsCertPath == "" {
+		return &redisFrontend{
+			r:   r,
+			srv: redcon.NewServer(addr, r.handleCmd, nil, nil),
+		}, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(tlsCertPath, tlsKeyPath)
 	if err != nil {
-		log.Err(err).Msg("closing server")
+		return nil, fmt.Errorf("loading redis TLS key pair: %v", err)
 	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	return &redisFrontend{
+		r:   r,
+		srv: redcon.NewServerTLS(addr, r.handleCmd, nil, nil, config),
+	}, nil
+}
+
+func (f *redisFrontend) ListenAndServe() error {
+	return f.srv.ListenAndServe()
+}
+
+func (f *redisFrontend) Shutdown(ctx context.Context) error {
+	err := f.srv.Close()
+	f.r.Close()
+
+	return err
 }
 
-func runHTTP(b brokerer, port *int, tlsCertPath, tlsKeyPath *string) {
-	// Start the server
-	p := fmt.Sprintf(":%d", *port)
+type httpFrontend struct {
+	srv         *http.Server
+	tlsCertPath string
+	tlsKeyPath  string
+}
+
+func newHTTPFrontend(b brokerer, port int, tlsCertPath, tlsKeyPath string) *httpFrontend {
+	p := fmt.Sprintf(":%d", port)
 
 	log.Info().
 		Str("port", p).
 		Msg("starting miniqueue over HTTP")
 
-	srv := newHTTPServer(b)
+	return &httpFrontend{
+		srv: &http.Server{
+			Addr:    p,
+			Handler: newHTTPServer(b),
+		},
+		tlsCertPath: tlsCertPath,
+		tlsKeyPath:  tlsKeyPath,
+	}
+}
+
+func (f *httpFrontend) ListenAndServe() error {
+	if err := f.srv.ListenAndServeTLS(f.tlsCertPath, f.tlsKeyPath); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// metricsFrontend serves Prometheus metrics over plain HTTP, separately from
+// the HTTP/2 frontend.
+type metricsFrontend struct {
+	srv *http.Server
+}
+
+func newMetricsFrontend(m *metrics, addr string) *metricsFrontend {
+	log.Info().
+		Str("addr", addr).
+		Msg("serving metrics")
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.handler())
 
-	if err := http.ListenAndServeTLS(p, *tlsCertPath, *tlsKeyPath, srv); !errors.Is(err, http.ErrServerClosed) {
-		log.Fatal().
-			Err(err).
-			Msg("server closed")
+	return &metricsFrontend{
+		srv: &http.Server{
+			Addr:    addr,
+			Handler: mux,
+		},
 	}
 }
+
+func (f *metricsFrontend) ListenAndServe() error {
+	if err := f.srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (f *metricsFrontend) Shutdown(ctx context.Context) error {
+	return f.srv.Shutdown(ctx)
+}
+
+func (f *httpFrontend) Shutdown(ctx context.Context) error {
+	// Subscribers may remain blocked waiting on commands from their clients,
+	// in which case they're closed once the context is done.
+	if err := f.srv.Shutdown(ctx); err != nil {
+		return f.srv.Close()
+	}
+
+	return nil
+}
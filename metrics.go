@@ -0,0 +1,380 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+const metricsNamespace = "miniqueue"
+
+// metrics instruments a broker and its store, exposing them to Prometheus.
+type metrics struct {
+	registry *prometheus.Registry
+
+	published *prometheus.CounterVec
+	acked     *prometheus.CounterVec
+	nacked    *prometheus.CounterVec
+	backed    *prometheus.CounterVec
+	dacked    *prometheus.CounterVec
+
+	storeDuration *prometheus.HistogramVec
+	delayDuration prometheus.Histogram
+}
+
+func newMetrics() *metrics {
+	topicCounter := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      name,
+			Help:      help,
+		}, []string{"topic"})
+	}
+
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+
+		published: topicCounter("published_total", "Number of messages published to the topic."),
+		acked:     topicCounter("acked_total", "Number of messages ACK'ed on the topic."),
+		nacked:    topicCounter("nacked_total", "Number of messages NACK'ed on the topic."),
+		backed:    topicCounter("backed_total", "Number of messages BACK'ed on the topic."),
+		dacked:    topicCounter("dacked_total", "Number of messages DACK'ed on the topic."),
+
+		storeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "store_operation_duration_seconds",
+			Help:      "Duration of operations on the store.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"op"}),
+
+		delayDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "delay_processing_duration_seconds",
+			Help:      "Duration of each run returning delayed messages and expiring leases.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.published,
+		m.acked,
+		m.nacked,
+		m.backed,
+		m.dacked,
+		m.storeDuration,
+		m.delayDuration,
+	)
+
+	return m
+}
+
+// register registers the gauges describing the topics and consumers of a
+// broker, which are read on each scrape.
+func (m *metrics) register(b *broker) {
+	m.registry.MustRegister(newTopicCollector(b))
+}
+
+// handler returns the handler serving the metrics to Prometheus.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observeDelayRun records the duration of a run processing delayed messages.
+// It is safe to call on a nil metrics.
+func (m *metrics) observeDelayRun(d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.delayDuration.Observe(d.Seconds())
+}
+
+// topicCollector collects the number of messages on each queue of a topic, as
+// well as the number of consumers subscribed to it.
+type topicCollector struct {
+	b *broker
+
+	depth     *prometheus.Desc
+	bytes     *prometheus.Desc
+	inFlight  *prometheus.Desc
+	delayed   *prometheus.Desc
+	consumers *prometheus.Desc
+}
+
+func newTopicCollector(b *broker) *topicCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "topic", name), help, []string{"topic"}, nil)
+	}
+
+	return &topicCollector{
+		b:         b,
+		depth:     desc("depth", "Number of messages waiting to be consumed."),
+		bytes:     desc("bytes", "Total size of the bodies of the messages waiting to be consumed."),
+		inFlight:  desc("in_flight", "Number of messages awaiting acknowledgement."),
+		delayed:   desc("delayed", "Number of messages waiting on the delay queue."),
+		consumers: desc("consumers", "Number of consumers subscribed to the topic."),
+	}
+}
+
+func (c *topicCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.depth
+	ch <- c.bytes
+	ch <- c.inFlight
+	ch <- c.delayed
+	ch <- c.consumers
+}
+
+func (c *topicCollector) Collect(ch chan<- prometheus.Metric) {
+	topics, err := c.b.Topics()
+	if err != nil {
+		log.Err(err).Msg("failed to get topics for metrics")
+	}
+
+	for _, t := range topics {
+		stats, err := c.b.store.Stats(t)
+		if err != nil {
+			log.Err(err).Str("topic", t).Msg("failed to get topic stats for metrics")
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.depth, prometheus.GaugeValue, float64(stats.Depth), t)
+		ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(stats.Bytes), t)
+		ch <- prometheus.MustNewConstMetric(c.inFlight, prometheus.GaugeValue, float64(stats.InFlight), t)
+		ch <- prometheus.MustNewConstMetric(c.delayed, prometheus.GaugeValue, float64(stats.Delayed), t)
+	}
+
+	// Consumers may subscribe to topics which have yet to be published to.
+	for t, count := range c.b.consumerCounts() {
+		ch <- prometheus.MustNewConstMetric(c.consumers, prometheus.GaugeValue, float64(count), t)
+	}
+}
+
+// instrumentStore returns a store recording the duration of each operation
+// on the given store, and counting the messages published and acknowledged.
+func (m *metrics) instrumentStore(s storer) storer {
+	return &instrumentedStore{storer: s, m: m}
+}
+
+// instrumentedStore wraps a store to record metrics on its operations.
+type instrumentedStore struct {
+	storer
+	m *metrics
+}
+
+func (s *instrumentedStore) observe(op string, start time.Time) {
+	s.m.storeDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+func (s *instrumentedStore) Insert(topic string, val *value) error {
+	defer s.observe("insert", time.Now())
+
+	if err := s.storer.Insert(topic, val); err != nil {
+		return err
+	}
+
+	s.m.published.WithLabelValues(topic).Inc()
+
+	return nil
+}
+
+func (s *instrumentedStore) InsertBatch(topic string, vals []*value) ([]int, error) {
+	defer s.observe("insert_batch", time.Now())
+
+	offsets, err := s.storer.InsertBatch(topic, vals)
+	if err != nil {
+		return nil, err
+	}
+
+	s.m.published.WithLabelValues(topic).Add(float64(len(offsets)))
+
+	return offsets, nil
+}
+
+func (s *instrumentedStore) InsertIdempotent(topic, key string, val *value) (*dedupEntry, bool, error) {
+	defer s.observe("insert_idempotent", time.Now())
+
+	entry, duplicate, err := s.storer.InsertIdempotent(topic, key, val)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !duplicate {
+		s.m.published.WithLabelValues(topic).Inc()
+	}
+
+	return entry, duplicate, nil
+}
+
+func (s *instrumentedStore) InsertDelayed(topic string, val *value, dueAt time.Time) error {
+	defer s.observe("insert_delayed", time.Now())
+
+	if err := s.storer.InsertDelayed(topic, val, dueAt); err != nil {
+		return err
+	}
+
+	s.m.published.WithLabelValues(topic).Inc()
+
+	return nil
+}
+
+func (s *instrumentedStore) GetNext(topic string) (*value, int, error) {
+	defer s.observe("get_next", time.Now())
+
+	return s.storer.GetNext(topic)
+}
+
+func (s *instrumentedStore) GetNextBatch(topic string, n int) ([]*value, []int, error) {
+	defer s.observe("get_next_batch", time.Now())
+
+	return s.storer.GetNextBatch(topic, n)
+}
+
+func (s *instrumentedStore) Length(topic string) (int, error) {
+	defer s.observe("length", time.Now())
+
+	return s.storer.Length(topic)
+}
+
+func (s *instrumentedStore) Ack(topic string, ackOffset int) error {
+	defer s.observe("ack", time.Now())
+
+	if err := s.storer.Ack(topic, ackOffset); err != nil {
+		return err
+	}
+
+	s.m.acked.WithLabelValues(topic).Inc()
+
+	return nil
+}
+
+func (s *instrumentedStore) Nack(topic string, ackOffset int) error {
+	defer s.observe("nack", time.Now())
+
+	if err := s.storer.Nack(topic, ackOffset); err != nil {
+		return err
+	}
+
+	s.m.nacked.WithLabelValues(topic).Inc()
+
+	return nil
+}
+
+func (s *instrumentedStore) Back(topic string, ackOffset int) error {
+	defer s.observe("back", time.Now())
+
+	if err := s.storer.Back(topic, ackOffset); err != nil {
+		return err
+	}
+
+	s.m.backed.WithLabelValues(topic).Inc()
+
+	return nil
+}
+
+func (s *instrumentedStore) AckBatch(topic string, ackOffsets []int) error {
+	defer s.observe("ack_batch", time.Now())
+
+	if err := s.storer.AckBatch(topic, ackOffsets); err != nil {
+		return err
+	}
+
+	s.m.acked.WithLabelValues(topic).Add(float64(len(ackOffsets)))
+
+	return nil
+}
+
+func (s *instrumentedStore) NackBatch(topic string, ackOffsets []int) error {
+	defer s.observe("nack_batch", time.Now())
+
+	if err := s.storer.NackBatch(topic, ackOffsets); err != nil {
+		return err
+	}
+
+	s.m.nacked.WithLabelValues(topic).Add(float64(len(ackOffsets)))
+
+	return nil
+}
+
+func (s *instrumentedStore) BackBatch(topic string, ackOffsets []int) error {
+	defer s.observe("back_batch", time.Now())
+
+	if err := s.storer.BackBatch(topic, ackOffsets); err != nil {
+		return err
+	}
+
+	s.m.backed.WithLabelValues(topic).Add(float64(len(ackOffsets)))
+
+	return nil
+}
+
+func (s *instrumentedStore) Release(topic string, ackOffsets []int) error {
+	defer s.observe("release", time.Now())
+
+	return s.storer.Release(topic, ackOffsets)
+}
+
+func (s *instrumentedStore) Expire(topic string, ackOffset int) error {
+	defer s.observe("expire", time.Now())
+
+	return s.storer.Expire(topic, ackOffset)
+}
+
+func (s *instrumentedStore) Dack(topic string, ackOffset int, delay time.Duration) error {
+	defer s.observe("dack", time.Now())
+
+	if err := s.storer.Dack(topic, ackOffset, delay); err != nil {
+		return err
+	}
+
+	s.m.dacked.WithLabelValues(topic).Inc()
+
+	return nil
+}
+
+func (s *instrumentedStore) ReturnDelayed(topic string, before time.Time) (int, error) {
+	defer s.observe("return_delayed", time.Now())
+
+	return s.storer.ReturnDelayed(topic, before)
+}
+
+func (s *instrumentedStore) RemoveExpired(topic string, now time.Time) (int, error) {
+	defer s.observe("remove_expired", time.Now())
+
+	return s.storer.RemoveExpired(topic, now)
+}
+
+func (s *instrumentedStore) Recover(topic string) (int, error) {
+	defer s.observe("recover", time.Now())
+
+	return s.storer.Recover(topic)
+}
+
+func (s *instrumentedStore) Redrive(topic string) (int, error) {
+	defer s.observe("redrive", time.Now())
+
+	return s.storer.Redrive(topic)
+}
+
+func (s *instrumentedStore) Meta() (*metadata, error) {
+	defer s.observe("meta", time.Now())
+
+	return s.storer.Meta()
+}
+
+func (s *instrumentedStore) Stats(topic string) (*topicStats, error) {
+	defer s.observe("stats", time.Now())
+
+	return s.storer.Stats(topic)
+}
+
+func (s *instrumentedStore) Purge(topic string) error {
+	defer s.observe("purge", time.Now())
+
+	return s.storer.Purge(topic)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	const topic = "test_topic"
+
+	m := newMetrics()
+
+	s := m.instrumentStore(newMemStore())
+	defer s.Destroy()
+
+	b := newBroker(s)
+	b.metrics = m
+	m.register(b)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.Publish(context.Background(), topic, newValue([]byte("test_value"))))
+	}
+
+	c, err := b.Subscribe(topic, consumerOpts{})
+	require.NoError(t, err)
+
+	_, err = c.Next(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, c.Ack(""))
+
+	_, err = c.Next(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, c.Dack("", time.Minute))
+
+	_, err = c.Next(context.Background())
+	require.NoError(t, err)
+
+	expected := `
+# HELP miniqueue_published_total Number of messages published to the topic.
+# TYPE miniqueue_published_total counter
+miniqueue_published_total{topic="test_topic"} 3
+# HELP miniqueue_acked_total Number of messages ACK'ed on the topic.
+# TYPE miniqueue_acked_total counter
+miniqueue_acked_total{topic="test_topic"} 1
+# HELP miniqueue_dacked_total Number of messages DACK'ed on the topic.
+# TYPE miniqueue_dacked_total counter
+miniqueue_dacked_total{topic="test_topic"} 1
+# HELP miniqueue_topic_depth Number of messages waiting to be consumed.
+# TYPE miniqueue_topic_depth gauge
+miniqueue_topic_depth{topic="test_topic"} 0
+# HELP miniqueue_topic_bytes Total size of the bodies of the messages waiting to be consumed.
+# TYPE miniqueue_topic_bytes gauge
+miniqueue_topic_bytes{topic="test_topic"} 0
+# HELP miniqueue_topic_in_flight Number of messages awaiting acknowledgement.
+# TYPE miniqueue_topic_in_flight gauge
+miniqueue_topic_in_flight{topic="test_topic"} 1
+# HELP miniqueue_topic_delayed Number of messages waiting on the delay queue.
+# TYPE miniqueue_topic_delayed gauge
+miniqueue_topic_delayed{topic="test_topic"} 1
+# HELP miniqueue_topic_consumers Number of consumers subscribed to the topic.
+# TYPE miniqueue_topic_consumers gauge
+miniqueue_topic_consumers{topic="test_topic"} 1
+`
+
+	require.NoError(t, testutil.GatherAndCompare(m.registry, strings.NewReader(expected),
+		"miniqueue_published_total",
+		"miniqueue_acked_total",
+		"miniqueue_dacked_total",
+		"miniqueue_topic_depth",
+		"miniqueue_topic_bytes",
+		"miniqueue_topic_in_flight",
+		"miniqueue_topic_delayed",
+		"miniqueue_topic_consumers",
+	))
+
+	// Expect a latency histogram for each operation used, i.e. insert,
+	// get_next, ack, dack, meta and stats.
+	require.Equal(t, 6, testutil.CollectAndCount(m.storeDuration))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// migrateBatchSize is the number of keys copied within each transaction when
+// migrating between databases.
+const migrateBatchSize = 1000
+
+var errMigrateDstNotEmpty = errors.New("destination database is not empty")
+
+// runMigrate runs the migrate command, copying an existing LevelDB data
+// directory into a new bbolt database.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s migrate:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	var (
+		from = fs.String("from", defaultDBPath, "path to the existing LevelDB data directory")
+		to   = fs.String("to", "", "path to the bbolt database file to create")
+	)
+
+	_ = fs.Parse(args)
+
+	if *to == "" {
+		log.Fatal().Msg("no destination specified, -to is required")
+	}
+
+	src, err := leveldb.OpenFile(*from, &opt.Options{ErrorIfMissing: true, ReadOnly: true})
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open levelDB")
+	}
+	defer src.Close()
+
+	dst, err := openBoltDB(*to)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open bbolt")
+	}
+	defer dst.Close()
+
+	count, err := migrateDB(levelDB{src}, dst)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to migrate")
+	}
+
+	log.Info().
+		Str("from", *from).
+		Str("to", *to).
+		Int("keys", count).
+		Msg("migration complete")
+}
+
+// migrateDB copies every key from one database into another, which must be
+// empty, returning the number of keys copied. This includes the main, ack and
+// delay queues of every topic as well as the store's metadata, so the
+// destination may be used in place of the source once complete.
+func migrateDB(src, dst database) (int, error) {
+	dstIter := dst.NewIterator(nil, nil)
+	empty := !dstIter.First()
+	dstIter.Release()
+	if err := dstIter.Error(); err != nil {
+		return 0, fmt.Errorf("checking destination is empty: %v", err)
+	}
+	if !empty {
+		return 0, errMigrateDstNotEmpty
+	}
+
+	iter := src.NewIterator(nil, nil)
+	defer iter.Release()
+
+	count := 0
+
+	for {
+		tx, err := dst.OpenTransaction()
+		if err != nil {
+			return count, fmt.Errorf("opening transaction: %v", err)
+		}
+
+		n := 0
+		for ; n < migrateBatchSize && iter.Next(); n++ {
+			// The key and value are only valid until the next iteration.
+			key := append([]byte{}, iter.Key()...)
+			val := append([]byte{}, iter.Value()...)
+
+			if err := tx.Put(key, val, nil); err != nil {
+				tx.Discard()
+				return count, fmt.Errorf("putting key %s: %v", key, err)
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			tx.Discard()
+			return count, fmt.Errorf("committing migrate transaction: %v", err)
+		}
+
+		count += n
+
+		if n < migrateBatchSize {
+			break
+		}
+	}
+
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return count, fmt.Errorf("iterating over source database: %v", err)
+	}
+
+	return count, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateDB(t *testing.T) {
+	src := newStore(t.TempDir()).(*store)
+	t.Cleanup(src.Destroy)
+
+	var (
+		msg1 = newValue([]byte("test_value_1"))
+		msg2 = newValue([]byte("test_value_2"))
+		msg3 = newValue([]byte("test_value_3"))
+	)
+
+	require.NoError(t, src.SetConfig(defaultTopic, &topicConfig{MaxDeliveries: 3}))
+
+	// Leave a message on each of the main, ack and delay queues
+	require.NoError(t, src.Insert(defaultTopic, msg1))
+	require.NoError(t, src.Insert(defaultTopic, msg2))
+	require.NoError(t, src.Insert(defaultTopic, msg3))
+
+	_, offset, err := src.GetNext(defaultTopic)
+	require.NoError(t, err)
+	require.NoError(t, src.Dack(defaultTopic, offset, 0*time.Second))
+
+	_, _, err = src.GetNext(defaultTopic)
+	require.NoError(t, err)
+
+	dstPath := t.TempDir() + "/data.bolt"
+	dstDB, err := openBoltDB(dstPath)
+	require.NoError(t, err)
+
+	count, err := migrateDB(src.db, dstDB)
+	require.NoError(t, err)
+	assert.NotZero(t, count)
+
+	dst := initStore(dstPath, dstDB)
+	t.Cleanup(dst.Destroy)
+
+	meta, err := dst.Meta()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{defaultTopic}, meta.topics)
+
+	cfg, err := dst.Config(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, cfg.MaxDeliveries)
+
+	recovered, err := dst.Recover(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, recovered)
+
+	val, _, err := dst.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assertDelivered(t, msg2, 2, val)
+
+	val, _, err = dst.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assertDelivered(t, msg3, 1, val)
+
+	returned, err := dst.ReturnDelayed(defaultTopic, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, returned)
+
+	val, _, err = dst.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, msg1.Raw, val.Raw)
+	assert.Equal(t, 1, val.DackCount)
+}
+
+func TestMigrateDB_DestinationNotEmpty(t *testing.T) {
+	src := newMemStore().(*store)
+	t.Cleanup(src.Destroy)
+
+	dst := newMemStore().(*store)
+	t.Cleanup(dst.Destroy)
+
+	require.NoError(t, dst.Insert(defaultTopic, newValue([]byte("test_value"))))
+
+	_, err := migrateDB(src.db, dst.db)
+	assert.Equal(t, errMigrateDstNotEmpty, err)
+}
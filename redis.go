@@ -5,8 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/tidwall/redcon"
 )
@@ -15,16 +20,49 @@ const (
 	respOK = "OK"
 )
 
+// defaultRedisDackDelay is the delay of a DACK'ed message if the subscriber
+// doesn't give one.
+const defaultRedisDackDelay = time.Second
+
 type redis struct {
 	broker brokerer
+
+	// conns holds the connections detached by subscribers, which are no longer
+	// managed by the redcon server and must be closed separately on shutdown.
+	conns map[redcon.DetachedConn]struct{}
+	sync.Mutex
 }
 
 func newRedis(b brokerer) *redis {
 	return &redis{
 		broker: b,
+		conns:  map[redcon.DetachedConn]struct{}{},
+	}
+}
+
+// Close closes all connections currently detached by subscribers.
+func (r *redis) Close() {
+	r.Lock()
+	defer r.Unlock()
+
+	for c := range r.conns {
+		c.Close()
+		delete(r.conns, c)
 	}
 }
 
+func (r *redis) track(c redcon.DetachedConn) {
+	r.Lock()
+	r.conns[c] = struct{}{}
+	r.Unlock()
+}
+
+func (r *redis) untrack(c redcon.DetachedConn) {
+	r.Lock()
+	delete(r.conns, c)
+	r.Unlock()
+}
+
 func (r *redis) handleCmd(conn redcon.Conn, rcmd redcon.Command) {
 	cmd := string(rcmd.Args[0])
 	switch strings.ToLower(cmd) {
@@ -40,11 +78,35 @@ func (r *redis) handleCmd(conn redcon.Conn, rcmd redcon.Command) {
 	case "topics":
 		handleRedisTopics(r.broker)(conn, rcmd)
 
+	case "topicinfo":
+		handleRedisTopicInfo(r.broker)(conn, rcmd)
+
+	case "browse":
+		handleRedisBrowse(r.broker)(conn, rcmd)
+
+	case "delayed":
+		handleRedisDelayed(r.broker)(conn, rcmd)
+
 	case "publish":
 		handleRedisPublish(r.broker)(conn, rcmd)
 
+	case "mpublish":
+		handleRedisMPublish(r.broker)(conn, rcmd)
+
 	case "subscribe":
-		handleRedisSubscribe(r.broker)(conn, rcmd)
+		handleRedisSubscribe(r)(conn, rcmd)
+
+	case "redrive":
+		handleRedisRedrive(r.broker)(conn, rcmd)
+
+	case "ack":
+		handleRedisSettle(r.broker, CmdAck)(conn, rcmd)
+
+	case "nack":
+		handleRedisSettle(r.broker, CmdNack)(conn, rcmd)
+
+	case "back":
+		handleRedisSettle(r.broker, CmdBack)(conn, rcmd)
 	}
 }
 
@@ -57,14 +119,129 @@ func handleRedisTopics(broker brokerer) redcon.HandlerFunc {
 			return
 		}
 
-		conn.WriteString(fmt.Sprintf("%v", topics))
+		conn.WriteArray(len(topics))
+		for _, topic := range topics {
+			conn.WriteBulkString(topic)
+		}
+	}
+}
+
+// handleRedisTopicInfo replies with the statistics of a topic as an array of
+// field and value pairs.
+func handleRedisTopicInfo(broker brokerer) redcon.HandlerFunc {
+	return func(conn redcon.Conn, rcmd redcon.Command) {
+		if len(rcmd.Args) != 2 {
+			conn.WriteError("invalid number of args, want: 2")
+			return
+		}
+
+		topic := string(rcmd.Args[1])
+
+		stats, err := broker.Stats(topic)
+		if errors.Is(err, errTopicNotExist) {
+			conn.WriteError(errTopicNotExist.Error())
+			return
+		}
+		if err != nil {
+			log.Err(err).Str("topic", topic).Msg("failed to get topic stats")
+			conn.WriteError("failed to get topic stats")
+			return
+		}
+
+		conn.WriteArray(18)
+		conn.WriteBulkString("topic")
+		conn.WriteBulkString(topic)
+		conn.WriteBulkString("depth")
+		conn.WriteInt(stats.Depth)
+		conn.WriteBulkString("bytes")
+		conn.WriteInt(stats.Bytes)
+		conn.WriteBulkString("inFlight")
+		conn.WriteInt(stats.InFlight)
+		conn.WriteBulkString("delayed")
+		conn.WriteInt(stats.Delayed)
+		conn.WriteBulkString("oldestAgeMs")
+		conn.WriteInt64(oldestAge(stats, time.Now()).Milliseconds())
+		conn.WriteBulkString("consumers")
+		conn.WriteInt(stats.Consumers)
+		conn.WriteBulkString("published")
+		conn.WriteInt(stats.Published)
+		conn.WriteBulkString("acked")
+		conn.WriteInt(stats.Acked)
+	}
+}
+
+func handleRedisRedrive(broker brokerer) redcon.HandlerFunc {
+	return func(conn redcon.Conn, rcmd redcon.Command) {
+		if len(rcmd.Args) != 2 {
+			conn.WriteError("invalid number of args, want: 2")
+			return
+		}
+
+		topic := string(rcmd.Args[1])
+
+		count, err := broker.Redrive(topic)
+		if err != nil {
+			log.Err(err).Msg("failed to redrive")
+			conn.WriteError("failed to redrive")
+			return
+		}
+
+		log.Debug().
+			Str("topic", topic).
+			Int("count", count).
+			Msg("redrove dead letter topic")
+
+		conn.WriteInt(count)
+	}
+}
+
+// handleRedisSettle acknowledges an outstanding message by its delivery token
+// using the given command, on behalf of the consumer holding it, i.e.
+// ACK topic token.
+func handleRedisSettle(broker brokerer, cmd string) redcon.HandlerFunc {
+	return func(conn redcon.Conn, rcmd redcon.Command) {
+		if len(rcmd.Args) != 3 {
+			conn.WriteError("invalid number of args, want: 3")
+			return
+		}
+
+		var (
+			topic = string(rcmd.Args[1])
+			token = string(rcmd.Args[2])
+		)
+
+		if err := broker.Settle(topic, token, cmd); err != nil {
+			log.Err(err).Str("token", token).Msg("failed to settle")
+			conn.WriteError(ackError(err, serverError(fmt.Sprintf("failed to %s", strings.ToLower(cmd)))))
+			return
+		}
+
+		conn.WriteString(respOK)
 	}
 }
 
-func handleRedisSubscribe(broker brokerer) redcon.HandlerFunc {
+func handleRedisSubscribe(r *redis) redcon.HandlerFunc {
+	broker := r.broker
+
 	return func(conn redcon.Conn, rcmd redcon.Command) {
+		if len(rcmd.Args) < 2 {
+			conn.WriteError("invalid number of args, want: at least 2")
+			return
+		}
+
+		opts, meta, err := parseRedisSubscribeOpts(rcmd.Args[2:])
+		if err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+
 		topic := string(rcmd.Args[1])
-		c := broker.Subscribe(topic)
+		c, err := broker.Subscribe(topic, opts)
+		if err != nil {
+			log.Err(err).Msg("failed to subscribe")
+			conn.WriteError(err.Error())
+			return
+		}
 		defer func() {
 			if err := broker.Unsubscribe(topic, c.id); err != nil {
 				log.Err(err).Msg("failed to unsubscribe")
@@ -82,17 +259,14 @@ func handleRedisSubscribe(broker brokerer) redcon.HandlerFunc {
 		// lifecycle independently.
 		dconn := flushable{DetachedConn: conn.Detach()}
 		dconn.SetContext(ctx)
+		r.track(dconn.DetachedConn)
 		defer func() {
 			log.Debug().Msg("closing connection")
+			r.untrack(dconn.DetachedConn)
 			dconn.flush()
 			dconn.Close()
 		}()
 
-		if len(rcmd.Args) != 2 {
-			dconn.WriteError("invalid number of args, want: 2")
-			return
-		}
-
 		for {
 			select {
 			case <-ctx.Done():
@@ -100,17 +274,31 @@ func handleRedisSubscribe(broker brokerer) redcon.HandlerFunc {
 			default:
 			}
 
-			// Wait for a new value
-			val, err := c.Next(ctx)
+			// Wait for new values, up to the prefetch window of the consumer
+			ds, err := c.Fill(ctx)
+			if errors.Is(err, errShuttingDown) {
+				log.Debug().Msg("ending subscription, server is shutting down")
+				dconn.WriteError(errShuttingDown.Error())
+				return
+			}
 			if err != nil {
 				log.Err(err).Msg("getting next value")
 				dconn.WriteError("failed to get next value")
 				return
 			}
 
-			log.Debug().Str("msg", string(val.Raw)).Msg("sending msg")
+			if c.batch > 0 && len(ds) > 0 {
+				log.Debug().Int("count", len(ds)).Msg("sending batch")
+
+				writeRedisBatch(dconn, ds, meta)
+			} else {
+				for _, d := range ds {
+					log.Debug().Str("msg_id", d.val.ID).Str("msg", string(d.val.Raw)).Msg("sending msg")
+
+					writeRedisDelivery(dconn, d, meta)
+				}
+			}
 
-			dconn.WriteAny(val.Raw)
 			if err := dconn.flush(); err != nil {
 				log.Err(err).Msg("flushing msg")
 				return
@@ -118,87 +306,717 @@ func handleRedisSubscribe(broker brokerer) redcon.HandlerFunc {
 
 			log.Debug().Msg("awaiting ack")
 
-			cmd, err := dconn.ReadCommand()
-			if errors.Is(err, io.EOF) {
-				return
-			} else if err != nil {
-				log.Err(err).Msg("reading ack")
-				dconn.WriteError("failed to get next value")
+			if !awaitRedisAck(ctx, log, dconn, c, meta) {
 				return
 			}
 
-			if len(cmd.Args) != 1 {
+			dconn.WriteString(respOK)
+			iferr(dconn.flush(), cancel)
+		}
+	}
+}
+
+// awaitRedisAck reads commands from the subscriber until the outstanding message
+// is acknowledged, leaving the reply to the caller. Batches requested with NEXT
+// are written with their metadata if meta is set. It returns false if the
+// subscription should be ended.
+func awaitRedisAck(ctx context.Context, log zerolog.Logger, dconn flushable, c *consumer, meta bool) bool {
+	for {
+		cmd, err := dconn.ReadCommand()
+		if errors.Is(err, io.EOF) {
+			return false
+		} else if err != nil {
+			log.Err(err).Msg("reading ack")
+			dconn.WriteError("failed to get next value")
+			return false
+		}
+
+		if len(cmd.Args) < 1 {
+			log.Error().Str("cmd", string(cmd.Raw)).Int("len", len(cmd.Args)).Msg("invalid cmd length")
+			dconn.WriteError("invalid command")
+			return false
+		}
+
+		ackCmd := string(cmd.Args[0])
+
+		args := make([]string, len(cmd.Args)-1)
+		for i, arg := range cmd.Args[1:] {
+			args[i] = string(arg)
+		}
+
+		// ACK, NACK and BACK may name more than one message, other commands take
+		// at most two arguments.
+		var (
+			set   tokenSet
+			isSet bool
+		)
+		switch strings.ToUpper(ackCmd) {
+		case CmdAck, CmdNack, CmdBack:
+			set, isSet, err = parseTokenSet(args)
+			if err != nil {
+				dconn.WriteError("invalid tokens")
+				return false
+			}
+		default:
+			if len(args) > 2 {
 				log.Error().Str("cmd", string(cmd.Raw)).Int("len", len(cmd.Args)).Msg("invalid cmd length")
 				dconn.WriteError("invalid command")
-				return
+				return false
 			}
+		}
 
-			ackCmd := string(cmd.Args[0])
+		// The argument of the command, such as the delay of a DACK, and the
+		// delivery token of the message it applies to, if given.
+		arg, token := splitCmdArgs(ackCmd, args)
 
-			log.Debug().Str("cmd", ackCmd).Msg("received ack cmd")
+		log.Debug().Str("cmd", ackCmd).Msg("received ack cmd")
 
-			switch strings.ToUpper(ackCmd) {
-			case CmdAck:
-				if err := c.Ack(); err != nil {
-					log.Err(err).Msg("acking")
-					dconn.WriteError("failed to ack")
-					return
+		switch strings.ToUpper(ackCmd) {
+		case CmdAck:
+			if isSet {
+				err = c.AckBatch(set)
+			} else {
+				err = c.Ack(token)
+			}
+			if err != nil {
+				log.Err(err).Msg("acking")
+				if writeRedisAckError(dconn, err, "failed to ack") {
+					continue
 				}
-			case CmdBack:
-				if err := c.Back(); err != nil {
-					log.Err(err).Msg("backing")
-					dconn.WriteError("failed to back")
-					return
+				return false
+			}
+		case CmdBack:
+			if isSet {
+				err = c.BackBatch(set)
+			} else {
+				err = c.Back(token)
+			}
+			if err != nil {
+				log.Err(err).Msg("backing")
+				if writeRedisAckError(dconn, err, "failed to back") {
+					continue
 				}
-			case CmdNack:
-				if err := c.Nack(); err != nil {
-					log.Err(err).Msg("Nacking")
-					dconn.WriteError("failed to nack")
-					return
+				return false
+			}
+		case CmdNack:
+			if isSet {
+				err = c.NackBatch(set)
+			} else {
+				err = c.Nack(token)
+			}
+			if err != nil {
+				log.Err(err).Msg("Nacking")
+				if writeRedisAckError(dconn, err, "failed to nack") {
+					continue
 				}
-			case CmdDack:
-				// TODO read extra arg
-				if err := c.Dack(1); err != nil {
-					log.Err(err).Msg("Nacking")
-					dconn.WriteError("failed to nack")
-					return
+				return false
+			}
+		case CmdDack:
+			// The delay is optional, so a lone argument which is not a delay is
+			// the token.
+			if _, err := parseDelay(arg); err != nil && len(args) == 1 {
+				arg, token = "", arg
+			}
+
+			delay := defaultRedisDackDelay
+			if arg != "" {
+				delay, err = parseDelay(arg)
+				if err != nil {
+					dconn.WriteError("invalid DACK duration argument")
+					return false
 				}
-			default:
-				log.Error().Str("cmd", ackCmd).Msg("invalid ack command")
-				dconn.WriteError("invalid ack command")
-				return
 			}
 
+			if err := c.Dack(token, delay); err != nil {
+				log.Err(err).Msg("dacking")
+				if writeRedisAckError(dconn, err, "failed to dack") {
+					continue
+				}
+				return false
+			}
+		case CmdTouch:
+			var d time.Duration
+			if arg != "" {
+				d, err = time.ParseDuration(arg)
+				if err != nil || d < 0 {
+					dconn.WriteError("invalid TOUCH duration argument")
+					return false
+				}
+			}
+
+			if _, err := c.Touch(token, d); err != nil {
+				log.Err(err).Msg("touching")
+				if writeRedisAckError(dconn, err, "failed to touch") {
+					continue
+				}
+				return false
+			}
+
+			// The message remains outstanding, continue waiting for an ack.
 			dconn.WriteString(respOK)
-			iferr(dconn.flush(), cancel)
+			if err := dconn.flush(); err != nil {
+				return false
+			}
+
+			continue
+		case CmdNext:
+			// A batch can only be acknowledged by its tokens, which are only
+			// delivered with META.
+			if !meta {
+				dconn.WriteError("NEXT requires META")
+				if err := dconn.flush(); err != nil {
+					return false
+				}
+
+				continue
+			}
+
+			n := c.batch
+			if arg != "" {
+				n, err = parseBatchSize(arg)
+				if err != nil {
+					dconn.WriteError("invalid NEXT size argument")
+					return false
+				}
+			}
+			if n == 0 {
+				n = 1
+			}
+
+			ds, err := c.Batch(ctx, n, c.linger)
+			if errors.Is(err, errShuttingDown) {
+				dconn.WriteError(errShuttingDown.Error())
+				return false
+			}
+			if err != nil {
+				log.Err(err).Msg("getting next batch")
+				dconn.WriteError("failed to get next batch")
+				return false
+			}
+
+			// The batch is outstanding alongside any earlier messages, continue
+			// waiting for an ack.
+			writeRedisBatch(dconn, ds, meta)
+			if err := dconn.flush(); err != nil {
+				return false
+			}
+
+			continue
+		default:
+			log.Error().Str("cmd", ackCmd).Msg("invalid ack command")
+			dconn.WriteError("invalid ack command")
+			return false
 		}
+
+		return true
 	}
 }
 
-func handleRedisPublish(broker brokerer) redcon.HandlerFunc {
+// redisMsgFields is the number of fields and values written for a message.
+const redisMsgFields = 22
+
+// writeRedisDelivery writes a message to the subscriber as a bulk string of its
+// raw value. If meta is set, the message is instead written as an array of
+// field and value pairs, with the headers as a nested array of name and value
+// pairs, followed by its delivery token and the deadline of its lease.
+func writeRedisDelivery(dconn redcon.Conn, d *delivery, meta bool) {
+	if !meta {
+		dconn.WriteBulk(d.val.Raw)
+		return
+	}
+
+	dconn.WriteArray(redisMsgFields + 4)
+	writeRedisMsgFields(dconn, d.val)
+
+	dconn.WriteBulkString("token")
+	dconn.WriteBulkString(d.token)
+	dconn.WriteBulkString("leaseDeadline")
+	dconn.WriteBulkString(formatRedisTime(d.leaseDeadline))
+}
+
+// writeRedisBatch writes a batch of messages to the subscriber as an array of
+// messages.
+func writeRedisBatch(dconn redcon.Conn, ds []*delivery, meta bool) {
+	dconn.WriteArray(len(ds))
+	for _, d := range ds {
+		writeRedisDelivery(dconn, d, meta)
+	}
+}
+
+// writeRedisBrowsedMsg writes a browsed message as the fields of the message
+// followed by its offset and due time.
+func writeRedisBrowsedMsg(conn redcon.Conn, val *browsedValue) {
+	conn.WriteArray(redisMsgFields + 4)
+	writeRedisMsgFields(conn, val.value)
+
+	conn.WriteBulkString("offset")
+	conn.WriteInt(val.Offset)
+	conn.WriteBulkString("dueAt")
+	conn.WriteBulkString(formatRedisTime(val.DueAt))
+}
+
+func writeRedisMsgFields(dconn redcon.Conn, val *value) {
+	dconn.WriteBulkString("msg")
+	dconn.WriteBulk(val.Raw)
+	dconn.WriteBulkString("id")
+	dconn.WriteBulkString(val.ID)
+	dconn.WriteBulkString("publishedAt")
+	dconn.WriteBulkString(formatRedisTime(val.PublishedAt))
+	dconn.WriteBulkString("firstDeliveredAt")
+	dconn.WriteBulkString(formatRedisTime(val.FirstDeliveredAt))
+	dconn.WriteBulkString("deliveryCount")
+	dconn.WriteInt(val.DeliveryCount)
+	dconn.WriteBulkString("dackCount")
+	dconn.WriteInt(val.DackCount)
+	dconn.WriteBulkString("failureCount")
+	dconn.WriteInt(val.FailureCount)
+	dconn.WriteBulkString("lastFailure")
+	dconn.WriteBulkString(val.LastFailure)
+	dconn.WriteBulkString("expiresAt")
+	dconn.WriteBulkString(formatRedisTime(val.ExpiresAt))
+	dconn.WriteBulkString("priority")
+	dconn.WriteInt(val.Priority)
+
+	names := make([]string, 0, len(val.Headers))
+	for name := range val.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	dconn.WriteBulkString("headers")
+	dconn.WriteArray(len(names) * 2)
+	for _, name := range names {
+		dconn.WriteBulkString(name)
+		dconn.WriteBulkString(val.Headers[name])
+	}
+}
+
+// formatRedisTime formats a time for a Redis reply, returning an empty string
+// for the zero time.
+func formatRedisTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(time.RFC3339Nano)
+}
+
+// writeRedisAckError writes the error to the subscriber when acknowledging a
+// message fails, informing it if it was due to the lease expiring or the
+// message not being outstanding. It reports whether the subscriber should
+// continue to be awaited, flushing the error if so, which it should after one
+// of the tokenErrors.
+func writeRedisAckError(dconn flushable, err error, msg string) bool {
+	dconn.WriteError(ackError(err, serverError(msg)))
+
+	return isTokenError(err) && dconn.flush() == nil
+}
+
+// parseRedisSubscribeOpts parses the optional arguments of a subscribe command,
+// given as pairs of option name and value, i.e. [LEASE duration] [PREFETCH n]
+// [BATCH n] [LINGER duration], along with the META flag requesting messages be
+// delivered with their metadata.
+func parseRedisSubscribeOpts(args [][]byte) (opts consumerOpts, meta bool, err error) {
+	errInvalid := errors.New("invalid subscribe options, want: [LEASE duration] [PREFETCH n] [BATCH n] [LINGER duration] [META]")
+
+	for i := 0; i < len(args); i++ {
+		name := strings.ToUpper(string(args[i]))
+
+		if name == "META" {
+			meta = true
+			continue
+		}
+
+		if i+1 == len(args) {
+			return opts, false, errInvalid
+		}
+
+		i++
+		val := string(args[i])
+
+		switch name {
+		case "LEASE":
+			d, err := time.ParseDuration(val)
+			if err != nil || d < 0 {
+				return opts, false, fmt.Errorf("invalid lease duration '%s'", val)
+			}
+
+			opts.lease = d
+		case "PREFETCH":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return opts, false, fmt.Errorf("invalid prefetch window '%s'", val)
+			}
+
+			opts.prefetch = n
+		case "BATCH":
+			n, err := parseBatchSize(val)
+			if err != nil {
+				return opts, false, fmt.Errorf("invalid batch size '%s'", val)
+			}
+
+			opts.batch = n
+		case "LINGER":
+			d, err := time.ParseDuration(val)
+			if err != nil || d < 0 {
+				return opts, false, fmt.Errorf("invalid linger duration '%s'", val)
+			}
+
+			opts.linger = d
+		default:
+			return opts, false, fmt.Errorf("unknown subscribe option '%s'", name)
+		}
+	}
+
+	// Without META deliveries carry no token, which acknowledgements must give
+	// while more than one message is outstanding.
+	if !meta && (opts.prefetch > 1 || opts.batch > 0) {
+		return opts, false, errors.New("PREFETCH above 1 and BATCH require META")
+	}
+
+	return opts, meta, nil
+}
+
+// handleRedisBrowse replies with an array of the messages on one of the queues
+// of a topic, without consuming them.
+func handleRedisBrowse(broker brokerer) redcon.HandlerFunc {
 	return func(conn redcon.Conn, rcmd redcon.Command) {
-		if len(rcmd.Args) != 3 {
-			conn.WriteError("invalid number of args, want: 3")
+		if len(rcmd.Args) < 2 {
+			conn.WriteError("invalid number of args, want: at least 2")
+			return
+		}
+
+		topic := string(rcmd.Args[1])
+
+		opts, err := parseRedisBrowseOpts(rcmd.Args[2:])
+		if err != nil {
+			conn.WriteError(err.Error())
 			return
 		}
 
+		vals, err := broker.Browse(topic, opts.queue, opts.priority, opts.from, opts.limit)
+		if errors.Is(err, errInvalidBrowse) || errors.Is(err, errTopicNotExist) {
+			conn.WriteError(err.Error())
+			return
+		}
+		if err != nil {
+			log.Err(err).Str("topic", topic).Msg("failed to browse topic")
+			conn.WriteError("failed to browse topic")
+			return
+		}
+
+		conn.WriteArray(len(vals))
+		for _, val := range vals {
+			writeRedisBrowsedMsg(conn, val)
+		}
+	}
+}
+
+// redisBrowseOpts are the options of a browse command.
+type redisBrowseOpts struct {
+	queue    string
+	priority int
+	from     int
+	limit    int
+}
+
+// parseRedisBrowseOpts parses the optional arguments of a browse command, given
+// as pairs of option name and value, i.e. [QUEUE main|ack|delayed]
+// [PRIORITY p] [FROM n] [LIMIT n].
+func parseRedisBrowseOpts(args [][]byte) (redisBrowseOpts, error) {
+	opts := redisBrowseOpts{
+		queue:    queueMain,
+		priority: maxPriority,
+		limit:    defaultBrowseLimit,
+	}
+
+	if len(args)%2 != 0 {
+		return opts, errors.New("invalid browse options, want: [QUEUE main|ack|delayed] [PRIORITY p] [FROM n] [LIMIT n]")
+	}
+
+	for i := 0; i < len(args); i += 2 {
 		var (
-			topic = string(rcmd.Args[1])
-			value = newValue(rcmd.Args[2])
+			name, val = strings.ToUpper(string(args[i])), string(args[i+1])
+			err       error
 		)
 
-		if err := broker.Publish(topic, value); err != nil {
-			log.Err(err).Msg("failed to publish")
-			conn.WriteError("failed to publish")
+		switch name {
+		case "QUEUE":
+			opts.queue = strings.ToLower(val)
+		case "PRIORITY":
+			if opts.priority, err = parsePriority(val); err != nil {
+				return opts, fmt.Errorf("invalid priority '%s'", val)
+			}
+		case "FROM":
+			if opts.from, err = strconv.Atoi(val); err != nil {
+				return opts, fmt.Errorf("invalid from offset '%s'", val)
+			}
+		case "LIMIT":
+			if opts.limit, err = strconv.Atoi(val); err != nil {
+				return opts, fmt.Errorf("invalid limit '%s'", val)
+			}
+		default:
+			return opts, fmt.Errorf("unknown browse option '%s'", name)
+		}
+	}
+
+	return opts, nil
+}
+
+// handleRedisDelayed handles the administration of the delayed messages of a
+// topic, with the subcommands:
+//
+//	DELAYED RELEASE topic [id]
+//	DELAYED RESCHEDULE topic id dueAt
+//	DELAYED DELETE topic id
+func handleRedisDelayed(broker brokerer) redcon.HandlerFunc {
+	return func(conn redcon.Conn, rcmd redcon.Command) {
+		if len(rcmd.Args) < 3 {
+			conn.WriteError("invalid number of args, want: at least 3")
+			return
+		}
+
+		var (
+			subcmd = strings.ToUpper(string(rcmd.Args[1]))
+			topic  = string(rcmd.Args[2])
+			args   = rcmd.Args[3:]
+		)
+
+		var (
+			count int
+			err   error
+		)
+
+		switch {
+		case subcmd == "RELEASE" && len(args) <= 1:
+			var id string
+			if len(args) == 1 {
+				id = string(args[0])
+			}
+
+			count, err = broker.ReleaseDelayed(topic, id)
+		case subcmd == "RESCHEDULE" && len(args) == 2:
+			dueAt, perr := time.Parse(time.RFC3339Nano, string(args[1]))
+			if perr != nil {
+				conn.WriteError(errInvalidDueAt.Error())
+				return
+			}
+
+			err = broker.RescheduleDelayed(topic, string(args[0]), dueAt)
+		case subcmd == "DELETE" && len(args) == 1:
+			err = broker.DeleteDelayed(topic, string(args[0]))
+		default:
+			conn.WriteError("invalid delayed command, want: RELEASE topic [id], RESCHEDULE topic id dueAt or DELETE topic id")
+			return
+		}
+
+		if errors.Is(err, errDelayedMsgNotExist) {
+			conn.WriteError(errDelayedMsgNotExist.Error())
+			return
+		}
+		if err != nil {
+			log.Err(err).Str("topic", topic).Msg("failed to update delayed messages")
+			conn.WriteError("failed to update delayed messages")
+			return
+		}
+
+		if subcmd == "RELEASE" {
+			conn.WriteInt(count)
+			return
+		}
+
+		conn.WriteString(respOK)
+	}
+}
+
+// handleRedisPublish publishes a message, followed by pairs of option name and
+// value and pairs of header name and value in any order, i.e.
+// PUBLISH topic msg [IN delay | AT time] [TTL ttl] [PRIORITY p] [KEY key]
+// [header value ...]. Messages published with an idempotency key are replied
+// to with the ID and offset of the message published with the key.
+func handleRedisPublish(broker brokerer) redcon.HandlerFunc {
+	return func(conn redcon.Conn, rcmd redcon.Command) {
+		if len(rcmd.Args) < 3 || len(rcmd.Args)%2 != 1 {
+			conn.WriteError("invalid number of args, want: 3 followed by option or header pairs")
+			return
+		}
+
+		topic := string(rcmd.Args[1])
+
+		value, opts, err := parseRedisPublishArgs(rcmd.Args[2:])
+		if err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+
+		// A disconnect isn't noticed while a command is being handled, so a
+		// blocked publish ends only once space frees up or it times out.
+		ctx := context.Background()
+
+		switch {
+		case opts.key != "":
+			entry, duplicate, err := broker.PublishIdempotent(ctx, topic, opts.key, value)
+			if err != nil {
+				writeRedisPublishError(conn, err)
+				return
+			}
+
+			log.Debug().
+				Str("topic", topic).
+				Str("msg_id", entry.ID).
+				Bool("duplicate", duplicate).
+				Msg("idempotent msg published")
+
+			conn.WriteArray(2)
+			conn.WriteBulkString(entry.ID)
+			conn.WriteInt(entry.Offset)
+		case opts.dueAt.IsZero():
+			err = broker.Publish(ctx, topic, value)
+			writeRedisPublished(conn, topic, value, err)
+		default:
+			err = broker.PublishAt(ctx, topic, value, opts.dueAt)
+			writeRedisPublished(conn, topic, value, err)
+		}
+	}
+}
+
+// redisPublishOpts are the options of a publish command which don't apply to
+// the value itself.
+type redisPublishOpts struct {
+	dueAt time.Time
+	key   string
+}
+
+// parseRedisPublishArgs creates a value from the args of a publish command, the
+// message followed by pairs of either option or header name and value. The
+// names IN, AT, TTL, PRIORITY and KEY are taken as options in any case, and any
+// other name as a header.
+func parseRedisPublishArgs(args [][]byte) (*value, redisPublishOpts, error) {
+	var (
+		value     = newValue(args[0])
+		opts      redisPublishOpts
+		scheduled bool
+	)
+
+	for i := 1; i+1 < len(args); i += 2 {
+		name, arg := string(args[i]), string(args[i+1])
+
+		switch strings.ToUpper(name) {
+		case "IN":
+			delay, err := parseDelay(arg)
+			if err != nil || scheduled {
+				return nil, opts, errInvalidSchedule
+			}
+
+			opts.dueAt, scheduled = time.Now().Add(delay), true
+		case "AT":
+			dueAt, err := time.Parse(time.RFC3339Nano, arg)
+			if err != nil || scheduled {
+				return nil, opts, errInvalidSchedule
+			}
+
+			opts.dueAt, scheduled = dueAt, true
+		case "TTL":
+			ttl, err := parseTTL(arg)
+			if err != nil {
+				return nil, opts, errInvalidTTL
+			}
+
+			value.setTTL(ttl)
+		case "PRIORITY":
+			priority, err := parsePriority(arg)
+			if err != nil {
+				return nil, opts, errInvalidPriority
+			}
+
+			value.Priority = priority
+		case "KEY":
+			if arg == "" {
+				return nil, opts, errors.New("empty idempotency key")
+			}
+
+			opts.key = arg
+		default:
+			if value.Headers == nil {
+				value.Headers = map[string]string{}
+			}
+
+			value.Headers[name] = arg
+		}
+	}
+
+	if opts.key != "" && scheduled {
+		return nil, opts, errScheduledDedup
+	}
+
+	return value, opts, nil
+}
+
+// writeRedisPublished replies to a publish command given the result of
+// publishing the value.
+func writeRedisPublished(conn redcon.Conn, topic string, value *value, err error) {
+	if err != nil {
+		writeRedisPublishError(conn, err)
+		return
+	}
+
+	log.Debug().
+		Str("topic", topic).
+		Str("msg_id", value.ID).
+		Str("msg", string(value.Raw)).
+		Msg("msg published")
+
+	conn.WriteString(respOK)
+}
+
+// writeRedisPublishError replies to a publish command which failed.
+func writeRedisPublishError(conn redcon.Conn, err error) {
+	if errors.Is(err, errShuttingDown) {
+		conn.WriteError(errShuttingDown.Error())
+		return
+	}
+	if errors.Is(err, errTopicFull) {
+		conn.WriteError(errTopicFull.Error())
+		return
+	}
+
+	log.Err(err).Msg("failed to publish")
+	conn.WriteError("failed to publish")
+}
+
+func handleRedisMPublish(broker brokerer) redcon.HandlerFunc {
+	return func(conn redcon.Conn, rcmd redcon.Command) {
+		if len(rcmd.Args) < 3 {
+			conn.WriteError("invalid number of args, want: at least 3")
+			return
+		}
+
+		topic := string(rcmd.Args[1])
+
+		vals := make([]*value, 0, len(rcmd.Args)-2)
+		for _, arg := range rcmd.Args[2:] {
+			vals = append(vals, newValue(arg))
+		}
+
+		// As with PUBLISH, a blocked publish isn't ended by a disconnect.
+		offsets, err := broker.PublishBatch(context.Background(), topic, vals)
+		if err != nil {
+			writeRedisPublishError(conn, err)
 			return
 		}
 
 		log.Debug().
 			Str("topic", topic).
-			Str("msg", string(value.Raw)).
-			Msg("msg published")
+			Int("count", len(vals)).
+			Msg("msg batch published")
 
-		conn.WriteString(respOK)
+		// Reply with the ID and offset of each message, in order.
+		conn.WriteArray(len(vals))
+		for i, val := range vals {
+			conn.WriteArray(2)
+			conn.WriteBulkString(val.ID)
+			conn.WriteInt(offsets[i])
+		}
 	}
 }
 
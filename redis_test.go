@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -11,6 +13,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/golang/mock/gomock"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
 	redcon "github.com/tidwall/redcon"
 )
@@ -138,6 +142,448 @@ func TestRedisSubscribe(t *testing.T) {
 	})
 }
 
+func TestRedisDelivery(t *testing.T) {
+	d := &delivery{
+		token:         "token",
+		val:           newValue([]byte("value")),
+		leaseDeadline: time.Date(2022, 11, 20, 14, 4, 13, 0, time.UTC),
+	}
+
+	t.Run("delivers the raw message by default", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		conn := NewMockConn(ctrl)
+
+		conn.EXPECT().WriteBulk([]byte("value"))
+
+		writeRedisDelivery(conn, d, false)
+	})
+
+	t.Run("delivers the message with its metadata if requested", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		conn := NewMockConn(ctrl)
+
+		gomock.InOrder(
+			conn.EXPECT().WriteArray(redisMsgFields+4),
+			conn.EXPECT().WriteBulkString("msg"),
+			conn.EXPECT().WriteBulk([]byte("value")),
+		)
+		gomock.InOrder(
+			conn.EXPECT().WriteBulkString("token"),
+			conn.EXPECT().WriteBulkString("token"),
+			conn.EXPECT().WriteBulkString("leaseDeadline"),
+			conn.EXPECT().WriteBulkString("2022-11-20T14:04:13Z"),
+		)
+		conn.EXPECT().WriteBulkString(gomock.Any()).AnyTimes()
+		conn.EXPECT().WriteInt(gomock.Any()).AnyTimes()
+		conn.EXPECT().WriteArray(0)
+
+		writeRedisDelivery(conn, d, true)
+	})
+
+	t.Run("delivers a batch as an array of raw messages by default", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		conn := NewMockConn(ctrl)
+
+		gomock.InOrder(
+			conn.EXPECT().WriteArray(2),
+			conn.EXPECT().WriteBulk([]byte("value")).Times(2),
+		)
+
+		writeRedisBatch(conn, []*delivery{d, d}, false)
+	})
+}
+
+func TestParseRedisSubscribeOpts(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		opts consumerOpts
+		meta bool
+		err  string
+	}{
+		{args: nil},
+		{args: []string{"LEASE", "30s"}, opts: consumerOpts{lease: 30 * time.Second}},
+		{args: []string{"prefetch", "1"}, opts: consumerOpts{prefetch: 1}},
+		{args: []string{"prefetch", "5", "META"}, opts: consumerOpts{prefetch: 5}, meta: true},
+		{args: []string{"BATCH", "50", "LINGER", "100ms", "META"}, opts: consumerOpts{batch: 50, linger: 100 * time.Millisecond}, meta: true},
+		{args: []string{"PREFETCH", "2"}, err: "PREFETCH above 1 and BATCH require META"},
+		{args: []string{"BATCH", "50"}, err: "PREFETCH above 1 and BATCH require META"},
+		{args: []string{"META"}, meta: true},
+		{args: []string{"LEASE", "30s", "META", "PREFETCH", "5"}, opts: consumerOpts{lease: 30 * time.Second, prefetch: 5}, meta: true},
+		{args: []string{"LEASE", "-1s"}, err: "invalid lease duration '-1s'"},
+		{args: []string{"LEASE", "soon"}, err: "invalid lease duration 'soon'"},
+		{args: []string{"PREFETCH", "0"}, err: "invalid prefetch window '0'"},
+		{args: []string{"BATCH", "1001"}, err: "invalid batch size '1001'"},
+		{args: []string{"BATCH", "0"}, err: "invalid batch size '0'"},
+		{args: []string{"LINGER", "-1ms"}, err: "invalid linger duration '-1ms'"},
+		{args: []string{"META", "LEASE"}, err: "invalid subscribe options, want: [LEASE duration] [PREFETCH n] [BATCH n] [LINGER duration] [META]"},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			opts, meta, err := parseRedisSubscribeOpts(helperRedisCmd(tc.args...).Args)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.opts, opts)
+			require.Equal(t, tc.meta, meta)
+		})
+	}
+}
+
+func TestRedisCommandArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		err  string
+	}{
+		{args: []string{"unknown"}, err: "unknown command 'unknown'"},
+		{args: []string{"topicinfo"}, err: "invalid number of args, want: 2"},
+		{args: []string{"browse"}, err: "invalid number of args, want: at least 2"},
+		{args: []string{"browse", "topic", "LIMIT"}, err: "invalid browse options, want: [QUEUE main|ack|delayed] [PRIORITY p] [FROM n] [LIMIT n]"},
+		{args: []string{"browse", "topic", "FROM", "first"}, err: "invalid from offset 'first'"},
+		{args: []string{"browse", "topic", "LIMIT", "all"}, err: "invalid limit 'all'"},
+		{args: []string{"delayed", "RELEASE"}, err: "invalid number of args, want: at least 3"},
+		{args: []string{"delayed", "PAUSE", "topic"}, err: "invalid delayed command, want: RELEASE topic [id], RESCHEDULE topic id dueAt or DELETE topic id"},
+		{args: []string{"delayed", "DELETE", "topic"}, err: "invalid delayed command, want: RELEASE topic [id], RESCHEDULE topic id dueAt or DELETE topic id"},
+		{args: []string{"delayed", "RESCHEDULE", "topic", "id", "tomorrow"}, err: errInvalidDueAt.Error()},
+		{args: []string{"publish", "topic"}, err: "invalid number of args, want: 3 followed by option or header pairs"},
+		{args: []string{"publish", "topic", "msg", "trace-id"}, err: "invalid number of args, want: 3 followed by option or header pairs"},
+		{args: []string{"publish", "topic", "msg", "IN", "soon"}, err: errInvalidSchedule.Error()},
+		{args: []string{"publish", "topic", "msg", "AT", "tomorrow"}, err: errInvalidSchedule.Error()},
+		{args: []string{"publish", "topic", "msg", "IN", "1m", "AT", "2030-01-02T03:04:05Z"}, err: errInvalidSchedule.Error()},
+		{args: []string{"publish", "topic", "msg", "TTL", "0"}, err: errInvalidTTL.Error()},
+		{args: []string{"publish", "topic", "msg", "PRIORITY", "10"}, err: errInvalidPriority.Error()},
+		{args: []string{"publish", "topic", "msg", "KEY", ""}, err: "empty idempotency key"},
+		{args: []string{"publish", "topic", "msg", "KEY", "key", "IN", "1m"}, err: errScheduledDedup.Error()},
+		{args: []string{"mpublish", "topic"}, err: "invalid number of args, want: at least 3"},
+		{args: []string{"redrive"}, err: "invalid number of args, want: 2"},
+		{args: []string{"ack", "topic"}, err: "invalid number of args, want: 3"},
+		{args: []string{"nack", "topic", "token", "token"}, err: "invalid number of args, want: 3"},
+		{args: []string{"back"}, err: "invalid number of args, want: 3"},
+		{args: []string{"subscribe"}, err: "invalid number of args, want: at least 2"},
+		{args: []string{"subscribe", "topic", "LEASE"}, err: "invalid subscribe options, want: [LEASE duration] [PREFETCH n] [BATCH n] [LINGER duration] [META]"},
+		{args: []string{"subscribe", "topic", "TIMEOUT", "1s"}, err: "unknown subscribe option 'TIMEOUT'"},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			conn := NewMockConn(ctrl)
+			conn.EXPECT().WriteError(tc.err)
+
+			newRedis(NewMockbrokerer(ctrl)).handleCmd(conn, helperRedisCmd(tc.args...))
+		})
+	}
+}
+
+func TestRedisTopics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	broker := NewMockbrokerer(ctrl)
+	broker.EXPECT().Topics().Return([]string{"topic1", "topic2"}, nil)
+
+	conn := NewMockConn(ctrl)
+	gomock.InOrder(
+		conn.EXPECT().WriteArray(2),
+		conn.EXPECT().WriteBulkString("topic1"),
+		conn.EXPECT().WriteBulkString("topic2"),
+	)
+
+	newRedis(broker).handleCmd(conn, helperRedisCmd("TOPICS"))
+}
+
+func TestRedisTopicInfo(t *testing.T) {
+	t.Run("replies with the stats of the topic", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		broker := NewMockbrokerer(ctrl)
+		broker.EXPECT().Stats(defaultTopic).Return(&topicStats{Depth: 3, Published: 5}, nil)
+
+		conn := NewMockConn(ctrl)
+		conn.EXPECT().WriteArray(18)
+		gomock.InOrder(
+			conn.EXPECT().WriteBulkString("depth"),
+			conn.EXPECT().WriteInt(3),
+		)
+		gomock.InOrder(
+			conn.EXPECT().WriteBulkString("published"),
+			conn.EXPECT().WriteInt(5),
+		)
+		conn.EXPECT().WriteBulkString(gomock.Any()).AnyTimes()
+		conn.EXPECT().WriteInt(gomock.Any()).AnyTimes()
+		conn.EXPECT().WriteInt64(gomock.Any())
+
+		newRedis(broker).handleCmd(conn, helperRedisCmd("TOPICINFO", defaultTopic))
+	})
+
+	t.Run("unknown topic", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		broker := NewMockbrokerer(ctrl)
+		broker.EXPECT().Stats(defaultTopic).Return(nil, errTopicNotExist)
+
+		conn := NewMockConn(ctrl)
+		conn.EXPECT().WriteError(errTopicNotExist.Error())
+
+		newRedis(broker).handleCmd(conn, helperRedisCmd("TOPICINFO", defaultTopic))
+	})
+}
+
+func TestRedisBrowse(t *testing.T) {
+	t.Run("browses the main queue by default", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		broker := NewMockbrokerer(ctrl)
+		broker.EXPECT().Browse(defaultTopic, queueMain, maxPriority, 0, defaultBrowseLimit).Return(nil, nil)
+
+		conn := NewMockConn(ctrl)
+		conn.EXPECT().WriteArray(0)
+
+		newRedis(broker).handleCmd(conn, helperRedisCmd("BROWSE", defaultTopic))
+	})
+
+	t.Run("browses the given queue and range", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		val := &browsedValue{value: newValue([]byte("value")), Offset: 2}
+
+		broker := NewMockbrokerer(ctrl)
+		broker.EXPECT().Browse(defaultTopic, queueAck, maxPriority, 2, 1).Return([]*browsedValue{val}, nil)
+
+		conn := NewMockConn(ctrl)
+		conn.EXPECT().WriteArray(1)
+		conn.EXPECT().WriteArray(redisMsgFields + 4)
+		gomock.InOrder(
+			conn.EXPECT().WriteBulkString("offset"),
+			conn.EXPECT().WriteInt(2),
+		)
+		conn.EXPECT().WriteBulk([]byte("value"))
+		conn.EXPECT().WriteBulkString(gomock.Any()).AnyTimes()
+		conn.EXPECT().WriteInt(gomock.Any()).AnyTimes()
+		conn.EXPECT().WriteArray(0)
+
+		newRedis(broker).handleCmd(conn, helperRedisCmd("BROWSE", defaultTopic, "QUEUE", "ACK", "FROM", "2", "LIMIT", "1"))
+	})
+
+	t.Run("invalid queue", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		broker := NewMockbrokerer(ctrl)
+		broker.EXPECT().Browse(defaultTopic, "dead", maxPriority, 0, defaultBrowseLimit).Return(nil, errInvalidBrowse)
+
+		conn := NewMockConn(ctrl)
+		conn.EXPECT().WriteError(errInvalidBrowse.Error())
+
+		newRedis(broker).handleCmd(conn, helperRedisCmd("BROWSE", defaultTopic, "QUEUE", "dead"))
+	})
+}
+
+func TestRedisDelayed(t *testing.T) {
+	t.Run("release replies with the number of messages released", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		broker := NewMockbrokerer(ctrl)
+		broker.EXPECT().ReleaseDelayed(defaultTopic, "").Return(3, nil)
+		broker.EXPECT().ReleaseDelayed(defaultTopic, "id").Return(1, nil)
+
+		conn := NewMockConn(ctrl)
+		conn.EXPECT().WriteInt(3)
+		conn.EXPECT().WriteInt(1)
+
+		r := newRedis(broker)
+		r.handleCmd(conn, helperRedisCmd("DELAYED", "RELEASE", defaultTopic))
+		r.handleCmd(conn, helperRedisCmd("DELAYED", "release", defaultTopic, "id"))
+	})
+
+	t.Run("reschedule", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		dueAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+		broker := NewMockbrokerer(ctrl)
+		broker.EXPECT().RescheduleDelayed(defaultTopic, "id", dueAt)
+
+		conn := NewMockConn(ctrl)
+		conn.EXPECT().WriteString(respOK)
+
+		newRedis(broker).handleCmd(conn, helperRedisCmd("DELAYED", "RESCHEDULE", defaultTopic, "id", "2030-01-02T03:04:05Z"))
+	})
+
+	t.Run("delete unknown message", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		broker := NewMockbrokerer(ctrl)
+		broker.EXPECT().DeleteDelayed(defaultTopic, "id").Return(errDelayedMsgNotExist)
+
+		conn := NewMockConn(ctrl)
+		conn.EXPECT().WriteError(errDelayedMsgNotExist.Error())
+
+		newRedis(broker).handleCmd(conn, helperRedisCmd("DELAYED", "DELETE", defaultTopic, "id"))
+	})
+}
+
+func TestRedisPublishOptions(t *testing.T) {
+	t.Run("publishes with headers", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		broker := NewMockbrokerer(ctrl)
+		broker.EXPECT().Publish(gomock.Any(), defaultTopic, gomock.Any()).DoAndReturn(func(_ context.Context, _ string, val *value) error {
+			require.Equal(t, []byte("msg"), val.Raw)
+			require.Equal(t, map[string]string{"trace-id": "abc"}, val.Headers)
+			return nil
+		})
+
+		conn := NewMockConn(ctrl)
+		conn.EXPECT().WriteString(respOK)
+
+		newRedis(broker).handleCmd(conn, helperRedisCmd("PUBLISH", defaultTopic, "msg", "trace-id", "abc"))
+	})
+
+	t.Run("publishes at a time", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		dueAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+		broker := NewMockbrokerer(ctrl)
+		broker.EXPECT().PublishAt(gomock.Any(), defaultTopic, gomock.Any(), dueAt)
+
+		conn := NewMockConn(ctrl)
+		conn.EXPECT().WriteString(respOK)
+
+		newRedis(broker).handleCmd(conn, helperRedisCmd("PUBLISH", defaultTopic, "msg", "AT", "2030-01-02T03:04:05Z"))
+	})
+
+	t.Run("combines a schedule, time to live, priority and headers", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		broker := NewMockbrokerer(ctrl)
+		broker.EXPECT().PublishAt(gomock.Any(), defaultTopic, gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, _ string, val *value, dueAt time.Time) error {
+			require.WithinDuration(t, time.Now().Add(10*time.Minute), dueAt, time.Second)
+			require.Equal(t, val.PublishedAt.Add(time.Hour), val.ExpiresAt)
+			require.Equal(t, 5, val.Priority)
+			require.Equal(t, map[string]string{"trace-id": "abc"}, val.Headers)
+			return nil
+		})
+
+		conn := NewMockConn(ctrl)
+		conn.EXPECT().WriteString(respOK)
+
+		newRedis(broker).handleCmd(conn, helperRedisCmd("PUBLISH", defaultTopic, "msg", "in", "10m", "TTL", "1h", "trace-id", "abc", "PRIORITY", "5"))
+	})
+
+	t.Run("replies with the message published with an idempotency key", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		broker := NewMockbrokerer(ctrl)
+		broker.EXPECT().PublishIdempotent(gomock.Any(), defaultTopic, "key", gomock.Any()).DoAndReturn(func(_ context.Context, _, _ string, val *value) (*dedupEntry, bool, error) {
+			require.Equal(t, 9, val.Priority)
+			require.False(t, val.ExpiresAt.IsZero())
+			return &dedupEntry{ID: "id", Offset: 4}, true, nil
+		})
+
+		conn := NewMockConn(ctrl)
+		gomock.InOrder(
+			conn.EXPECT().WriteArray(2),
+			conn.EXPECT().WriteBulkString("id"),
+			conn.EXPECT().WriteInt(4),
+		)
+
+		newRedis(broker).handleCmd(conn, helperRedisCmd("PUBLISH", defaultTopic, "msg", "KEY", "key", "PRIORITY", "9", "TTL", "30"))
+	})
+
+	t.Run("topic full", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		broker := NewMockbrokerer(ctrl)
+		broker.EXPECT().Publish(gomock.Any(), defaultTopic, gomock.Any()).Return(errTopicFull)
+
+		conn := NewMockConn(ctrl)
+		conn.EXPECT().WriteError(errTopicFull.Error())
+
+		newRedis(broker).handleCmd(conn, helperRedisCmd("PUBLISH", defaultTopic, "msg"))
+	})
+}
+
+func TestRedisMPublish(t *testing.T) {
+	t.Run("replies with the ID and offset of each message", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		var published []*value
+
+		broker := NewMockbrokerer(ctrl)
+		broker.EXPECT().PublishBatch(gomock.Any(), defaultTopic, gomock.Any()).DoAndReturn(func(_ context.Context, _ string, vals []*value) ([]int, error) {
+			published = vals
+			return []int{0, 1}, nil
+		})
+
+		conn := NewMockConn(ctrl)
+		conn.EXPECT().WriteArray(2).Times(3)
+		conn.EXPECT().WriteBulkString(gomock.Any()).Times(2)
+		gomock.InOrder(
+			conn.EXPECT().WriteInt(0),
+			conn.EXPECT().WriteInt(1),
+		)
+
+		newRedis(broker).handleCmd(conn, helperRedisCmd("MPUBLISH", defaultTopic, "v1", "v2"))
+
+		require.Len(t, published, 2)
+		require.Equal(t, []byte("v1"), published[0].Raw)
+		require.Equal(t, []byte("v2"), published[1].Raw)
+	})
+
+	t.Run("topic full", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+
+		broker := NewMockbrokerer(ctrl)
+		broker.EXPECT().PublishBatch(gomock.Any(), defaultTopic, gomock.Any()).Return(nil, errTopicFull)
+
+		conn := NewMockConn(ctrl)
+		conn.EXPECT().WriteError(errTopicFull.Error())
+
+		newRedis(broker).handleCmd(conn, helperRedisCmd("MPUBLISH", defaultTopic, "v1"))
+	})
+}
+
+func TestRedisRedrive(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	broker := NewMockbrokerer(ctrl)
+	broker.EXPECT().Redrive(defaultTopic).Return(2, nil)
+	broker.EXPECT().Redrive("other").Return(0, errors.New("failed"))
+
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().WriteInt(2)
+	conn.EXPECT().WriteError("failed to redrive")
+
+	r := newRedis(broker)
+	r.handleCmd(conn, helperRedisCmd("REDRIVE", defaultTopic))
+	r.handleCmd(conn, helperRedisCmd("REDRIVE", "other"))
+}
+
+func TestRedisSettle(t *testing.T) {
+	for _, cmd := range []string{CmdAck, CmdNack, CmdBack} {
+		cmd := cmd
+
+		t.Run(cmd, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			broker := NewMockbrokerer(ctrl)
+			broker.EXPECT().Settle(defaultTopic, "token", cmd)
+			broker.EXPECT().Settle(defaultTopic, "unknown", cmd).Return(errUnknownToken)
+			broker.EXPECT().Settle(defaultTopic, "expired", cmd).Return(errLeaseExpired)
+
+			conn := NewMockConn(ctrl)
+			conn.EXPECT().WriteString(respOK)
+			conn.EXPECT().WriteError(errUnknownToken.Error())
+			conn.EXPECT().WriteError(errLeaseExpired.Error())
+
+			r := newRedis(broker)
+			r.handleCmd(conn, helperRedisCmd(strings.ToLower(cmd), defaultTopic, "token"))
+			r.handleCmd(conn, helperRedisCmd(cmd, defaultTopic, "unknown"))
+			r.handleCmd(conn, helperRedisCmd(cmd, defaultTopic, "expired"))
+		})
+	}
+}
+
 // Helpers
 
 func publishOne(t *testing.T, topic, value string) {
@@ -170,6 +616,156 @@ func consumeOne(t *testing.T, topic string) string {
 	return out
 }
 
+func TestRedisAwaitAck(t *testing.T) {
+	helperSubscribe := func(t *testing.T) (*consumer, *delivery, storer) {
+		dir, err := os.MkdirTemp("", "miniqueue_")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		s := newStore(dir)
+		b := newBroker(s)
+		for _, msg := range []string{"test_msg_1", "test_msg_2"} {
+			require.NoError(t, b.Publish(context.Background(), defaultTopic, newValue([]byte(msg))))
+		}
+
+		c, err := b.Subscribe(defaultTopic, consumerOpts{})
+		require.NoError(t, err)
+
+		ds, err := c.Fill(context.Background())
+		require.NoError(t, err)
+		require.Len(t, ds, 1)
+
+		return c, ds[0], s
+	}
+
+	t.Run("touches the message of a lone token", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		c, d, _ := helperSubscribe(t)
+
+		conn := NewMockDetachedConn(ctrl)
+		gomock.InOrder(
+			conn.EXPECT().ReadCommand().Return(helperRedisCmd(CmdTouch, d.token), nil),
+			conn.EXPECT().WriteString(respOK),
+			conn.EXPECT().Flush(),
+			conn.EXPECT().ReadCommand().Return(helperRedisCmd(CmdTouch, "1m", d.token), nil),
+			conn.EXPECT().WriteString(respOK),
+			conn.EXPECT().Flush(),
+			conn.EXPECT().ReadCommand().Return(helperRedisCmd(CmdAck, d.token), nil),
+		)
+
+		require.True(t, awaitRedisAck(context.Background(), zerolog.Nop(), flushable{DetachedConn: conn}, c, false))
+		require.False(t, c.Outstanding())
+	})
+
+	t.Run("rejects NEXT without META", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		c, d, _ := helperSubscribe(t)
+
+		conn := NewMockDetachedConn(ctrl)
+		gomock.InOrder(
+			conn.EXPECT().ReadCommand().Return(helperRedisCmd(CmdNext, "2"), nil),
+			conn.EXPECT().WriteError("NEXT requires META"),
+			conn.EXPECT().Flush(),
+			conn.EXPECT().ReadCommand().Return(helperRedisCmd(CmdAck, d.token), nil),
+		)
+
+		require.True(t, awaitRedisAck(context.Background(), zerolog.Nop(), flushable{DetachedConn: conn}, c, false))
+		require.False(t, c.Outstanding())
+	})
+
+	t.Run("delivers a batch with NEXT and META", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		c, d, _ := helperSubscribe(t)
+
+		conn := NewMockDetachedConn(ctrl)
+		gomock.InOrder(
+			conn.EXPECT().ReadCommand().Return(helperRedisCmd(CmdNext, "1"), nil),
+			conn.EXPECT().WriteArray(1),
+			conn.EXPECT().WriteArray(redisMsgFields+4),
+		)
+		conn.EXPECT().WriteBulk(gomock.Any()).AnyTimes()
+		conn.EXPECT().WriteBulkString(gomock.Any()).AnyTimes()
+		conn.EXPECT().WriteInt(gomock.Any()).AnyTimes()
+		conn.EXPECT().WriteArray(0)
+		gomock.InOrder(
+			conn.EXPECT().Flush(),
+			conn.EXPECT().ReadCommand().Return(helperRedisCmd(CmdAck, d.token), nil),
+		)
+
+		// The message of the batch remains outstanding.
+		require.True(t, awaitRedisAck(context.Background(), zerolog.Nop(), flushable{DetachedConn: conn}, c, true))
+		require.True(t, c.Outstanding())
+	})
+
+	t.Run("dacks the message of a lone token", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		c, d, _ := helperSubscribe(t)
+
+		conn := NewMockDetachedConn(ctrl)
+		conn.EXPECT().ReadCommand().Return(helperRedisCmd(CmdDack, d.token), nil)
+
+		require.True(t, awaitRedisAck(context.Background(), zerolog.Nop(), flushable{DetachedConn: conn}, c, false))
+		require.False(t, c.Outstanding())
+	})
+
+	t.Run("replies with a dack error when the message can't be delayed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		c, d, s := helperSubscribe(t)
+		require.NoError(t, s.Close())
+
+		conn := NewMockDetachedConn(ctrl)
+		gomock.InOrder(
+			conn.EXPECT().ReadCommand().Return(helperRedisCmd(CmdDack, "1m", d.token), nil),
+			conn.EXPECT().WriteError("failed to dack"),
+		)
+
+		require.False(t, awaitRedisAck(context.Background(), zerolog.Nop(), flushable{DetachedConn: conn}, c, false))
+	})
+
+	t.Run("keeps awaiting an ack after an unknown token", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		c, d, _ := helperSubscribe(t)
+
+		conn := NewMockDetachedConn(ctrl)
+		gomock.InOrder(
+			conn.EXPECT().ReadCommand().Return(helperRedisCmd(CmdTouch, "unknown"), nil),
+			conn.EXPECT().WriteError(errUnknownToken.Error()),
+			conn.EXPECT().Flush(),
+			conn.EXPECT().ReadCommand().Return(helperRedisCmd(CmdAck, "unknown"), nil),
+			conn.EXPECT().WriteError(errUnknownToken.Error()),
+			conn.EXPECT().Flush(),
+			conn.EXPECT().ReadCommand().Return(helperRedisCmd(CmdNack, d.token), nil),
+		)
+
+		require.True(t, awaitRedisAck(context.Background(), zerolog.Nop(), flushable{DetachedConn: conn}, c, false))
+		require.False(t, c.Outstanding())
+	})
+
+	t.Run("ends the subscription after an invalid duration", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		c, d, _ := helperSubscribe(t)
+
+		conn := NewMockDetachedConn(ctrl)
+		gomock.InOrder(
+			conn.EXPECT().ReadCommand().Return(helperRedisCmd(CmdTouch, "-1m", d.token), nil),
+			conn.EXPECT().WriteError("invalid TOUCH duration argument"),
+		)
+
+		require.False(t, awaitRedisAck(context.Background(), zerolog.Nop(), flushable{DetachedConn: conn}, c, false))
+		require.True(t, c.Outstanding())
+	})
+}
+
+// helperRedisCmd returns a Redis command of the given arguments.
+func helperRedisCmd(args ...string) redcon.Command {
+	var cmd redcon.Command
+	for _, arg := range args {
+		cmd.Args = append(cmd.Args, []byte(arg))
+	}
+
+	return cmd
+}
+
 func helperNewTestRedisServer(t *testing.T) *redis {
 	dir, err := os.MkdirTemp("", "miniqueue_")
 	require.NoError(t, err)
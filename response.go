@@ -2,20 +2,163 @@ package main
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/rs/zerolog"
 )
 
 type subResponse struct {
-	Msg       []byte `json:"msg,omitempty"`
-	DackCount int    `json:"dackCount,omitempty"`
-	Error     string `json:"error,omitempty"`
+	Msg              []byte            `json:"msg,omitempty"`
+	ID               string            `json:"id,omitempty"`
+	Token            string            `json:"token,omitempty"`
+	PublishedAt      *time.Time        `json:"publishedAt,omitempty"`
+	FirstDeliveredAt *time.Time        `json:"firstDeliveredAt,omitempty"`
+	DeliveryCount    int               `json:"deliveryCount,omitempty"`
+	Headers          map[string]string `json:"headers,omitempty"`
+	DackCount        int               `json:"dackCount,omitempty"`
+	ExpiredCount     int               `json:"expiredCount,omitempty"`
+	FailureCount     int               `json:"failureCount,omitempty"`
+	LastFailure      string            `json:"lastFailure,omitempty"`
+	ExpiresAt        *time.Time        `json:"expiresAt,omitempty"`
+	Priority         int               `json:"priority,omitempty"`
+	LeaseDeadline    *time.Time        `json:"leaseDeadline,omitempty"`
+	Error            string            `json:"error,omitempty"`
 }
 
-func respondMsg(log zerolog.Logger, e *json.Encoder, val *value) {
+// publishResponse is the response to a successful publish.
+type publishResponse struct {
+	ID string `json:"id"`
+}
+
+// batchPublishResponse is the response to a successful batch publish,
+// containing each message in the order they were published.
+type batchPublishResponse []publishedMsg
+
+type publishedMsg struct {
+	ID     string `json:"id"`
+	Offset int    `json:"offset"`
+}
+
+// topicStatsResponse is the response describing the statistics of a topic.
+type topicStatsResponse struct {
+	Topic     string `json:"topic"`
+	Depth     int    `json:"depth"`
+	Bytes     int    `json:"bytes"`
+	InFlight  int    `json:"inFlight"`
+	Delayed   int    `json:"delayed"`
+	OldestAge int64  `json:"oldestAgeMs"`
+	Consumers int    `json:"consumers"`
+	Published int    `json:"published"`
+	Acked     int    `json:"acked"`
+}
+
+func newTopicStatsResponse(topic string, stats *topicStats, now time.Time) topicStatsResponse {
+	return topicStatsResponse{
+		Topic:     topic,
+		Depth:     stats.Depth,
+		Bytes:     stats.Bytes,
+		InFlight:  stats.InFlight,
+		Delayed:   stats.Delayed,
+		OldestAge: oldestAge(stats, now).Milliseconds(),
+		Consumers: stats.Consumers,
+		Published: stats.Published,
+		Acked:     stats.Acked,
+	}
+}
+
+// oldestAge returns the age of the oldest message waiting on a topic, zero if
+// there are none or its publish time is unknown.
+func oldestAge(stats *topicStats, now time.Time) time.Duration {
+	if stats.Oldest.IsZero() {
+		return 0
+	}
+
+	return now.Sub(stats.Oldest)
+}
+
+// countResponse is the response of an operation affecting a number of
+// messages.
+type countResponse struct {
+	Count int `json:"count"`
+}
+
+// browsedMsg is a message read from one of the queues of a topic without
+// consuming it.
+type browsedMsg struct {
+	Offset int        `json:"offset"`
+	DueAt  *time.Time `json:"dueAt,omitempty"`
+	subResponse
+}
+
+func newBrowsedMsg(val *browsedValue) browsedMsg {
+	res := browsedMsg{
+		Offset:      val.Offset,
+		subResponse: newMsgResponse(val.value),
+	}
+
+	if !val.DueAt.IsZero() {
+		res.DueAt = &val.DueAt
+	}
+
+	return res
+}
+
+// respondDelivery responds with a message delivered to a consumer, along with
+// the token used to acknowledge it.
+func respondDelivery(log zerolog.Logger, e *json.Encoder, d *delivery) {
+	res := newDeliveryResponse(d)
+
+	if err := e.Encode(res); err != nil {
+		log.Err(err).Msg("failed to write response to client")
+	}
+}
+
+// newDeliveryResponse returns the response delivering a message to a consumer,
+// carrying its delivery token and the deadline of its lease, if any.
+func newDeliveryResponse(d *delivery) subResponse {
+	res := newMsgResponse(d.val)
+	res.Token = d.token
+
+	if !d.leaseDeadline.IsZero() {
+		res.LeaseDeadline = &d.leaseDeadline
+	}
+
+	return res
+}
+
+// newMsgResponse returns the response delivering a message.
+func newMsgResponse(val *value) subResponse {
 	res := subResponse{
-		Msg:       val.Raw,
-		DackCount: val.DackCount,
+		Msg:           val.Raw,
+		ID:            val.ID,
+		DeliveryCount: val.DeliveryCount,
+		Headers:       val.Headers,
+		DackCount:     val.DackCount,
+		ExpiredCount:  val.ExpiredCount,
+		FailureCount:  val.FailureCount,
+		LastFailure:   val.LastFailure,
+		Priority:      val.Priority,
+	}
+
+	if !val.PublishedAt.IsZero() {
+		res.PublishedAt = &val.PublishedAt
+	}
+	if !val.FirstDeliveredAt.IsZero() {
+		res.FirstDeliveredAt = &val.FirstDeliveredAt
+	}
+	if !val.ExpiresAt.IsZero() {
+		res.ExpiresAt = &val.ExpiresAt
+	}
+
+	return res
+}
+
+// respondBatch responds with a batch of messages delivered to a consumer, as a
+// single array.
+func respondBatch(log zerolog.Logger, e *json.Encoder, ds []*delivery) {
+	res := make([]subResponse, len(ds))
+	for i, d := range ds {
+		res[i] = newDeliveryResponse(d)
 	}
 
 	if err := e.Encode(res); err != nil {
@@ -23,6 +166,17 @@ func respondMsg(log zerolog.Logger, e *json.Encoder, val *value) {
 	}
 }
 
+func respondLease(log zerolog.Logger, e *json.Encoder, deadline time.Time) {
+	res := subResponse{}
+	if !deadline.IsZero() {
+		res.LeaseDeadline = &deadline
+	}
+
+	if err := e.Encode(res); err != nil {
+		log.Err(err).Msg("writing response to client")
+	}
+}
+
 func respondError(log zerolog.Logger, e *json.Encoder, errMsg string) {
 	res := subResponse{
 		Error: errMsg,
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// schemaMigrations upgrade a database from one schema version to the next, the
+// version of a database being the number of migrations applied to it. New
+// migrations must only ever be appended.
+var schemaMigrations = []func(db database, tx transaction) error{
+	// 1: re-encode gob values in the versioned binary format.
+	reencodeLegacyValues,
+	// 2: escape the topics within keys.
+	escapeTopicKeys,
+	// 3: rewrite delay keys with fixed width millisecond timestamps.
+	rewriteDelayKeys,
+	// 4: count the bytes waiting on the main queue of each topic.
+	countQueuedBytes,
+	// 5: record the priority levels created on each topic.
+	recordPriorityLevels,
+}
+
+// legacyTopicKeySuffix matches the remainder of a key following its topic,
+// prior to topics being escaped.
+var legacyTopicKeySuffix = regexp.MustCompile(`^(-?\d+|head|tail|ack-\d+|ack-tail|delay-\d+-\d+)$`)
+
+// migrateSchema applies each schema migration not yet applied to the database,
+// each within its own transaction. It returns the versions the database was
+// migrated from and to.
+func migrateSchema(db database) (from, to int, err error) {
+	from, err = getSchemaVersion(db)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if from > len(schemaMigrations) {
+		return from, from, fmt.Errorf("schema version %d is newer than supported version %d", from, len(schemaMigrations))
+	}
+
+	for version := from; version < len(schemaMigrations); version++ {
+		tx, err := db.OpenTransaction()
+		if err != nil {
+			return from, version, fmt.Errorf("opening transaction: %v", err)
+		}
+
+		if err := schemaMigrations[version](db, tx); err != nil {
+			tx.Discard()
+			return from, version, fmt.Errorf("migrating schema to version %d: %v", version+1, err)
+		}
+
+		if err := tx.Put([]byte(metaVersion), binary.AppendVarint(nil, int64(version+1)), nil); err != nil {
+			tx.Discard()
+			return from, version, fmt.Errorf("putting schema version: %v", err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			tx.Discard()
+			return from, version, fmt.Errorf("committing schema migration transaction: %v", err)
+		}
+	}
+
+	return from, len(schemaMigrations), nil
+}
+
+func getSchemaVersion(db leveldber) (int, error) {
+	val, err := db.Get([]byte(metaVersion), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("getting schema version: %v", err)
+	}
+
+	version, err := binary.ReadVarint(bytes.NewReader(val))
+	if err != nil {
+		return 0, fmt.Errorf("reading schema version varint: %v", err)
+	}
+
+	return int(version), nil
+}
+
+// reencodeLegacyValues re-encodes every value of every topic, including the ack
+// and delay queues, which is still encoded with gob. Values are otherwise only
+// upgraded as they are next written.
+func reencodeLegacyValues(db database, tx transaction) error {
+	iter := db.NewIterator(util.BytesPrefix([]byte("t-")), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+
+		// Skip the keys which aren't values, such as the head and tail positions,
+		// whose final segment isn't an offset or index.
+		if _, err := strconv.Atoi(string(key[bytes.LastIndexByte(key, '-')+1:])); err != nil {
+			continue
+		}
+
+		if !isLegacyValue(iter.Value()) {
+			continue
+		}
+
+		val, err := decodeValue(iter.Value())
+		if err != nil {
+			return fmt.Errorf("decoding value %s: %v", key, err)
+		}
+
+		b, err := val.Encode()
+		if err != nil {
+			return fmt.Errorf("encoding value %s: %v", key, err)
+		}
+
+		if err := tx.Put(append([]byte{}, key...), b, nil); err != nil {
+			return fmt.Errorf("putting value %s: %v", key, err)
+		}
+	}
+
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("iterating over values: %v", err)
+	}
+
+	return nil
+}
+
+// legacyDelayKey matches the keys of the delay queue, whose timestamps were
+// previously in seconds. Topics are already escaped.
+var legacyDelayKey = regexp.MustCompile(`^t-([^-]*)-delay-(\d+)-(\d+)$`)
+
+// delayKeyWidths are the widths of the timestamp and index of a delay key once
+// rewritten.
+const (
+	delayKeyTimestampWidth = 16
+	delayKeyIndexWidth     = 8
+)
+
+// rewriteDelayKeys rewrites the keys of every delayed message, which were
+// previously timestamped in seconds of varying width.
+func rewriteDelayKeys(db database, tx transaction) error {
+	iter := db.NewIterator(util.BytesPrefix([]byte("t-")), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		match := legacyDelayKey.FindSubmatch(iter.Key())
+		if match == nil {
+			continue
+		}
+
+		// Skip keys which have already been rewritten.
+		if len(match[2]) == delayKeyTimestampWidth && len(match[3]) == delayKeyIndexWidth {
+			continue
+		}
+
+		seconds, err := strconv.ParseInt(string(match[2]), 10, 64)
+		if err != nil {
+			return fmt.Errorf("parsing delay key %s timestamp: %v", iter.Key(), err)
+		}
+
+		index, err := strconv.Atoi(string(match[3]))
+		if err != nil {
+			return fmt.Errorf("parsing delay key %s index: %v", iter.Key(), err)
+		}
+
+		newKey := []byte(fmt.Sprintf(delayTopicFmt, match[1], seconds*1000, index))
+
+		if err := tx.Put(newKey, append([]byte{}, iter.Value()...), nil); err != nil {
+			return fmt.Errorf("putting key %s: %v", newKey, err)
+		}
+
+		if err := tx.Delete(append([]byte{}, iter.Key()...), nil); err != nil {
+			return fmt.Errorf("deleting key %s: %v", iter.Key(), err)
+		}
+	}
+
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("iterating over delay keys: %v", err)
+	}
+
+	return nil
+}
+
+// countQueuedBytes counts the total size of the bodies of the values waiting
+// on the main queue of every topic, which is otherwise only kept up to date as
+// values are added and removed.
+func countQueuedBytes(db database, tx transaction) error {
+	topics, err := getTopicMeta(db)
+	if err != nil {
+		return err
+	}
+
+	for _, topic := range topics {
+		head, err := getPos(db, headPosKeyFmt, topic)
+		if errors.Is(err, errTopicNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		tail, err := getPos(db, tailPosKeyFmt, topic)
+		if err != nil {
+			return err
+		}
+
+		total := 0
+		for offset := head; offset < tail; offset++ {
+			val, err := getValue(db, topicFmt, topic, offset)
+			if err != nil {
+				return fmt.Errorf("getting value of topic %s at offset %d: %v", topic, offset, err)
+			}
+
+			total += len(val.Raw)
+		}
+
+		counted, err := getCount(tx, queuedBytesKeyFmt, topic)
+		if err != nil {
+			return err
+		}
+
+		if err := addCount(tx, queuedBytesKeyFmt, topic, total-counted); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recordPriorityLevels records the priority levels above zero created on each
+// topic, which were previously found by reading the positions of every level.
+func recordPriorityLevels(db database, tx transaction) error {
+	topics, err := getTopicMeta(db)
+	if err != nil {
+		return err
+	}
+
+	for _, topic := range topics {
+		created := 0
+		for priority := 1; priority <= maxPriority; priority++ {
+			key := []byte(fmt.Sprintf(priorityKeys[priority].tailFmt, escapeTopic(topic)))
+
+			exists, err := db.Has(key, nil)
+			if err != nil {
+				return fmt.Errorf("checking has %s: %v", key, err)
+			}
+
+			if exists {
+				created |= 1 << priority
+			}
+		}
+
+		recorded, err := getCount(tx, levelsKeyFmt, topic)
+		if err != nil {
+			return err
+		}
+
+		if created == recorded {
+			continue
+		}
+
+		if err := addCount(tx, levelsKeyFmt, topic, created-recorded); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// escapeTopicKeys rewrites the keys of every topic in the metadata with the
+// topic escaped. Keys were previously ambiguous where one topic was a prefix of
+// another, such as "foo" and "foo-ack", in which case the key is assumed to
+// belong to the longest topic. Topics left in the metadata by earlier purges
+// are removed, along with any duplicates.
+func escapeTopicKeys(db database, tx transaction) error {
+	topics, err := getTopicMeta(db)
+	if err != nil {
+		return err
+	}
+
+	longestFirst := append([]string{}, topics...)
+	sort.Slice(longestFirst, func(i, j int) bool {
+		return len(longestFirst[i]) > len(longestFirst[j])
+	})
+
+	iter := db.NewIterator(util.BytesPrefix([]byte("t-")), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := string(iter.Key())
+
+		for _, topic := range longestFirst {
+			prefix := "t-" + topic + "-"
+			if !strings.HasPrefix(key, prefix) || !legacyTopicKeySuffix.MatchString(key[len(prefix):]) {
+				continue
+			}
+
+			escapedKey := fmt.Sprintf(topicPrefix, escapeTopic(topic)) + key[len(prefix):]
+			if escapedKey == key {
+				break
+			}
+
+			if err := tx.Put([]byte(escapedKey), append([]byte{}, iter.Value()...), nil); err != nil {
+				return fmt.Errorf("putting key %s: %v", escapedKey, err)
+			}
+
+			if err := tx.Delete([]byte(key), nil); err != nil {
+				return fmt.Errorf("deleting key %s: %v", key, err)
+			}
+
+			break
+		}
+	}
+
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("iterating over topic keys: %v", err)
+	}
+
+	// Rebuild the topics metadata without the topics which no longer exist, or
+	// which were added again after being purged.
+	var (
+		remaining = []string{}
+		seen      = map[string]bool{}
+	)
+
+	for _, topic := range topics {
+		if seen[topic] {
+			continue
+		}
+		seen[topic] = true
+
+		exists, err := tx.Has([]byte(fmt.Sprintf(headPosKeyFmt, escapeTopic(topic))), nil)
+		if err != nil {
+			return fmt.Errorf("checking has head position of topic %s: %v", topic, err)
+		}
+
+		if exists {
+			remaining = append(remaining, topic)
+		}
+	}
+
+	val, err := json.Marshal(remaining)
+	if err != nil {
+		return fmt.Errorf("marshalling topics meta: %v", err)
+	}
+
+	if err := tx.Put([]byte(metaTopics), val, nil); err != nil {
+		return fmt.Errorf("putting topics meta: %v", err)
+	}
+
+	return nil
+}
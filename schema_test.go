@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestMigrateSchema_ReencodesLegacyValues(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+
+	db := levelDB{ldb}
+
+	// Write a topic as an earlier release would, with a message on each of the
+	// main and ack queues.
+	s := &store{db: db}
+	require.NoError(t, s.Insert(defaultTopic, newValue([]byte("placeholder_1"))))
+	require.NoError(t, s.Insert(defaultTopic, newValue([]byte("placeholder_2"))))
+	_, _, err = s.GetNext(defaultTopic)
+	require.NoError(t, err)
+
+	var (
+		mainKey = []byte(fmt.Sprintf(topicFmt, defaultTopic, 1))
+		ackKey  = []byte(fmt.Sprintf(ackTopicFmt, defaultTopic, 0))
+	)
+
+	require.NoError(t, db.Put(mainKey, helperEncodeLegacyValue(t, legacyValue{Raw: []byte("test_value_2")}), nil))
+	require.NoError(t, db.Put(ackKey, helperEncodeLegacyValue(t, legacyValue{DackCount: 1, Raw: []byte("test_value_1")}), nil))
+
+	from, to, err := migrateSchema(db)
+	require.NoError(t, err)
+	assert.Equal(t, 0, from)
+	assert.Equal(t, len(schemaMigrations), to)
+
+	for _, key := range [][]byte{mainKey, ackKey} {
+		b, err := db.Get(key, nil)
+		require.NoError(t, err)
+		assert.False(t, isLegacyValue(b))
+	}
+
+	version, err := getSchemaVersion(db)
+	require.NoError(t, err)
+	assert.Equal(t, len(schemaMigrations), version)
+
+	// The store remains usable after the migration
+	count, err := s.Recover(defaultTopic)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	val, _, err := s.GetNext(defaultTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "test_value_1", string(val.Raw))
+	assert.Equal(t, 1, val.DackCount)
+
+	val, _, err = s.GetNext(defaultTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "test_value_2", string(val.Raw))
+
+	// Migrating again is a no-op
+	from, to, err = migrateSchema(db)
+	require.NoError(t, err)
+	assert.Equal(t, from, to)
+}
+
+func TestMigrateSchema_EscapesTopicKeys(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+
+	db := levelDB{ldb}
+
+	_, _, err = migrateSchema(db)
+	require.NoError(t, err)
+
+	s := &store{db: db}
+
+	// Write topics with messages on the main, ack and delay queues
+	for _, topic := range []string{"foo", "foo-bar", "gone"} {
+		require.NoError(t, s.Insert(topic, newValue([]byte(topic+"_1"))))
+		require.NoError(t, s.Insert(topic, newValue([]byte(topic+"_2"))))
+		require.NoError(t, s.Insert(topic, newValue([]byte(topic+"_3"))))
+
+		_, offset, err := s.GetNext(topic)
+		require.NoError(t, err)
+		require.NoError(t, s.Dack(topic, offset, 0))
+
+		_, _, err = s.GetNext(topic)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, s.Purge("gone"))
+
+	// Rewrite the keys as an earlier release would have, which didn't escape
+	// topics nor remove purged topics from the metadata.
+	iter := db.NewIterator(util.BytesPrefix([]byte("t-foo%2Dbar-")), nil)
+	for iter.Next() {
+		legacyKey := bytes.Replace(iter.Key(), []byte("foo%2Dbar"), []byte("foo-bar"), 1)
+		require.NoError(t, db.Put(legacyKey, append([]byte{}, iter.Value()...), nil))
+		require.NoError(t, db.Delete(iter.Key(), nil))
+	}
+	iter.Release()
+	require.NoError(t, iter.Error())
+
+	require.NoError(t, db.Put([]byte(metaTopics), []byte(`["foo","foo-bar","gone","foo"]`), nil))
+	require.NoError(t, db.Put([]byte(metaVersion), binary.AppendVarint(nil, 1), nil))
+
+	from, to, err := migrateSchema(db)
+	require.NoError(t, err)
+	assert.Equal(t, 1, from)
+	assert.Equal(t, len(schemaMigrations), to)
+
+	meta, err := s.Meta()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo", "foo-bar"}, meta.topics)
+
+	has, err := db.Has([]byte("t-foo-bar-head"), nil)
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	for _, topic := range []string{"foo", "foo-bar"} {
+		count, err := s.Recover(topic)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+
+		count, err = s.ReturnDelayed(topic, time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+
+		for _, want := range []string{"_1", "_2", "_3"} {
+			val, _, err := s.GetNext(topic)
+			require.NoError(t, err)
+			assert.Equal(t, topic+want, string(val.Raw))
+		}
+	}
+}
+
+func TestGetNext_LegacyValue(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s *store) {
+		require.NoError(t, s.Insert(defaultTopic, newValue([]byte("placeholder"))))
+
+		// Overwrite the message with one encoded by an earlier release
+		key := []byte(fmt.Sprintf(topicFmt, defaultTopic, 0))
+		require.NoError(t, s.db.Put(key, helperEncodeLegacyValue(t, legacyValue{Raw: []byte("test_value")}), nil))
+
+		_, offset, err := s.GetNext(defaultTopic)
+		require.NoError(t, err)
+
+		// Expect the value to have been upgraded once written to the ack queue
+		b, err := s.db.Get([]byte(fmt.Sprintf(ackTopicFmt, defaultTopic, offset)), nil)
+		require.NoError(t, err)
+		assert.False(t, isLegacyValue(b))
+
+		val, err := decodeValue(b)
+		require.NoError(t, err)
+		assert.Equal(t, "test_value", string(val.Raw))
+	})
+}
+
+func TestMigrateSchema_RewritesDelayKeys(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+
+	db := levelDB{ldb}
+
+	_, _, err = migrateSchema(db)
+	require.NoError(t, err)
+
+	s := &store{db: db}
+	require.NoError(t, s.Insert(defaultTopic, newValue([]byte("placeholder"))))
+
+	// Write delayed messages as an earlier release would have, keyed by their
+	// due time in seconds. The key of the latest sorts first bytewise.
+	now := time.Now().Unix()
+	for i, due := range []int64{now - 10, now + 60, now + 60, 999} {
+		b, err := newValue([]byte(fmt.Sprintf("test_value_%d", i))).Encode()
+		require.NoError(t, err)
+
+		localOffset := 0
+		if i == 2 {
+			localOffset = 1
+		}
+
+		key := fmt.Sprintf("t-%s-delay-%d-%d", defaultTopic, due, localOffset)
+		require.NoError(t, db.Put([]byte(key), b, nil))
+	}
+
+	require.NoError(t, db.Put([]byte(metaVersion), binary.AppendVarint(nil, 2), nil))
+
+	from, to, err := migrateSchema(db)
+	require.NoError(t, err)
+	assert.Equal(t, 2, from)
+	assert.Equal(t, len(schemaMigrations), to)
+
+	iter, closer := s.GetDelayed(defaultTopic)
+
+	var got []string
+	for iter.Next() {
+		due, err := timeFromDelayKey(string(iter.Key()))
+		require.NoError(t, err)
+
+		val, err := decodeValue(iter.Value())
+		require.NoError(t, err)
+
+		got = append(got, fmt.Sprintf("%d %s", due.Unix(), val.Raw))
+	}
+	require.NoError(t, closer())
+
+	assert.Equal(t, []string{
+		"999 test_value_3",
+		fmt.Sprintf("%d test_value_0", now-10),
+		fmt.Sprintf("%d test_value_1", now+60),
+		fmt.Sprintf("%d test_value_2", now+60),
+	}, got)
+
+	count, err := s.ReturnDelayed(defaultTopic, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestMigrateSchema_CountsQueuedBytes(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+
+	db := levelDB{ldb}
+
+	_, _, err = migrateSchema(db)
+	require.NoError(t, err)
+
+	s := &store{db: db}
+	for _, msg := range []string{"a", "bb", "ccc"} {
+		require.NoError(t, s.Insert(defaultTopic, newValue([]byte(msg))))
+	}
+
+	_, _, err = s.GetNext(defaultTopic)
+	require.NoError(t, err)
+
+	// Remove the count, as an earlier release wouldn't have kept it.
+	require.NoError(t, db.Delete([]byte(fmt.Sprintf(queuedBytesKeyFmt, defaultTopic)), nil))
+	require.NoError(t, db.Put([]byte(metaVersion), binary.AppendVarint(nil, 3), nil))
+
+	from, to, err := migrateSchema(db)
+	require.NoError(t, err)
+	assert.Equal(t, 3, from)
+	assert.Equal(t, len(schemaMigrations), to)
+
+	stats, err := s.Stats(defaultTopic)
+	require.NoError(t, err)
+	assert.Equal(t, 5, stats.Bytes)
+}
+
+func TestMigrateSchema_RecordsPriorityLevels(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+
+	db := levelDB{ldb}
+
+	_, _, err = migrateSchema(db)
+	require.NoError(t, err)
+
+	s := &store{db: db}
+	for _, priority := range []int{0, 3, 7} {
+		val := newValue([]byte(fmt.Sprintf("priority %d", priority)))
+		val.Priority = priority
+		require.NoError(t, s.Insert(defaultTopic, val))
+	}
+
+	// Remove the record, as an earlier release wouldn't have kept it.
+	require.NoError(t, db.Delete([]byte(fmt.Sprintf(levelsKeyFmt, defaultTopic)), nil))
+	require.NoError(t, db.Put([]byte(metaVersion), binary.AppendVarint(nil, 4), nil))
+
+	from, to, err := migrateSchema(db)
+	require.NoError(t, err)
+	assert.Equal(t, 4, from)
+	assert.Equal(t, len(schemaMigrations), to)
+
+	for _, priority := range []int{7, 3, 0} {
+		val, _, err := s.GetNext(defaultTopic)
+		require.NoError(t, err)
+		assert.Equal(t, priority, val.Priority)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,6 +19,7 @@ import (
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
@@ -24,15 +27,175 @@ type metadata struct {
 	topics []string
 }
 
+// topicConfig holds the configuration of a single topic.
+type topicConfig struct {
+	// MaxDeliveries is the number of failed deliveries of a message after which
+	// it is moved to the dead letter topic. A zero value disables dead lettering.
+	MaxDeliveries int `json:"maxDeliveries"`
+
+	// TTLMs is the default time to live in milliseconds of messages published
+	// to the topic without one. A zero value never expires messages.
+	TTLMs int64 `json:"ttlMs"`
+
+	// ExpiredTopic is the topic which expired messages are moved to. If empty,
+	// expired messages are discarded.
+	ExpiredTopic string `json:"expiredTopic"`
+
+	// MaxLength and MaxBytes limit the number of messages waiting on the topic,
+	// and the total size of their bodies. A zero value disables the limit.
+	MaxLength int `json:"maxLength"`
+	MaxBytes  int `json:"maxBytes"`
+
+	// OverflowPolicy is the policy applied to publishes which would exceed the
+	// limits of the topic, one of the overflow policies. Empty rejects them.
+	OverflowPolicy string `json:"overflowPolicy"`
+
+	// BlockTimeoutMs is the time in milliseconds a publish is blocked waiting
+	// for space under the block policy. Zero waits for the default timeout.
+	BlockTimeoutMs int64 `json:"blockTimeoutMs"`
+
+	// DedupWindowMs is the time in milliseconds the idempotency key of a
+	// published message is remembered. Zero remembers keys for the default
+	// window.
+	DedupWindowMs int64 `json:"dedupWindowMs"`
+}
+
+// defaultDedupWindow is the time idempotency keys are remembered for topics
+// without a configured dedup window.
+const defaultDedupWindow = 5 * time.Minute
+
+// dedupWindow returns the time idempotency keys are remembered on the topic.
+func (c *topicConfig) dedupWindow() time.Duration {
+	if c.DedupWindowMs <= 0 {
+		return defaultDedupWindow
+	}
+
+	return time.Duration(c.DedupWindowMs) * time.Millisecond
+}
+
+// The policies applied to publishes which would exceed the limits of a topic.
+const (
+	// overflowReject rejects the publish.
+	overflowReject = "reject"
+	// overflowDropOldest drops messages from the head of the topic until the
+	// published messages fit.
+	overflowDropOldest = "drop-oldest"
+	// overflowBlock blocks the publisher until the messages fit, rejecting the
+	// publish once the block timeout passes.
+	overflowBlock = "block"
+)
+
+// validOverflowPolicy reports whether the overflow policy is known.
+func validOverflowPolicy(policy string) bool {
+	switch policy {
+	case "", overflowReject, overflowDropOldest, overflowBlock:
+		return true
+	}
+
+	return false
+}
+
+// exceeds reports whether a topic with the given number of waiting messages
+// and total bytes would exceed its limits.
+func (c *topicConfig) exceeds(length, bytes int) bool {
+	return (c.MaxLength > 0 && length > c.MaxLength) || (c.MaxBytes > 0 && bytes > c.MaxBytes)
+}
+
+// ttl returns the default time to live of messages published to the topic.
+func (c *topicConfig) ttl() time.Duration {
+	return time.Duration(c.TTLMs) * time.Millisecond
+}
+
+// topicStats holds the statistics of a topic.
+type topicStats struct {
+	// Depth is the number of messages waiting to be consumed.
+	Depth int
+
+	// InFlight is the number of messages awaiting acknowledgement.
+	InFlight int
+
+	// Delayed is the number of messages waiting on the delay queue.
+	Delayed int
+
+	// Oldest is the time the message at the head of the topic was published,
+	// zero if the topic is empty or the message predates publish times.
+	Oldest time.Time
+
+	// Bytes is the total size of the bodies of the messages waiting to be
+	// consumed.
+	Bytes int
+
+	// Published and Acked are the total number of messages published to and
+	// acknowledged on the topic since it was created.
+	Published int
+	Acked     int
+
+	// Consumers is the number of consumers subscribed to the topic. It is set
+	// by the broker, as the store has no knowledge of consumers.
+	Consumers int
+}
+
+// dedupEntry records a message published with an idempotency key, in the dedup
+// index of its topic.
+type dedupEntry struct {
+	// ID and Offset are those of the message originally published with the key.
+	ID     string `json:"id"`
+	Offset int    `json:"offset"`
+
+	// ExpiresAt is the time after which the key is forgotten.
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// expired reports whether the entry has expired at the given time.
+func (e *dedupEntry) expired(now time.Time) bool {
+	return !now.Before(e.ExpiresAt)
+}
+
+// browsedValue is a value read from one of a topic's queues without consuming
+// it.
+type browsedValue struct {
+	*value
+
+	// Offset is the offset of the value within the main or ack queue, or its
+	// position within the delay queue.
+	Offset int
+
+	// DueAt is the time a delayed value is returned to the main queue, zero for
+	// values on the other queues.
+	DueAt time.Time
+}
+
 // storer should be safe for concurrent use.
 type storer interface {
-	// Insert inserts a new record for a given topic.
+	// Insert inserts a new record for a given topic, applying the overflow
+	// policy of the topic if it would exceed its limits.
 	Insert(topic string, val *value) error
 
+	// InsertBatch atomically inserts new records for a given topic in order,
+	// returning the offset of each within the topic.
+	InsertBatch(topic string, vals []*value) (offsets []int, err error)
+
+	// InsertIdempotent inserts a new record for a given topic as Insert does,
+	// unless a record was inserted with the same idempotency key within the
+	// dedup window of the topic. It returns the entry of the record inserted
+	// with the key, reporting whether it was a duplicate.
+	InsertIdempotent(topic, key string, val *value) (entry *dedupEntry, duplicate bool, err error)
+
+	// InsertDelayed inserts a new record for a given topic onto its delay queue,
+	// to be returned to the *front* of the consumption queue once due.
+	InsertDelayed(topic string, val *value, dueAt time.Time) error
+
 	// GetNext will retrieve the next value in the topic, as well as the AckKey
-	// allowing future acking/nacking of the value.
+	// allowing future acking/nacking of the value. Expired values are skipped.
 	GetNext(topic string) (val *value, ackOffset int, err error)
 
+	// GetNextBatch will retrieve up to n of the next values in the topic in a
+	// single transaction, along with their AckKeys.
+	GetNextBatch(topic string, n int) (vals []*value, ackOffsets []int, err error)
+
+	// Length returns the number of values waiting to be consumed on the topic.
+	Length(topic string) (int, error)
+
 	// Ack will acknowledge the processing of a message, removing it from the
 	// topic entirely.
 	Ack(topic string, ackOffset int) error
@@ -45,10 +208,25 @@ type storer interface {
 	// to the *back* of the consumption queue.
 	Back(topic string, ackOffset int) error
 
+	// AckBatch, NackBatch and BackBatch acknowledge many messages on a given
+	// topic in a single transaction, given in the order they were delivered.
+	AckBatch(topic string, ackOffsets []int) error
+	NackBatch(topic string, ackOffsets []int) error
+	BackBatch(topic string, ackOffsets []int) error
+
+	// Release returns messages awaiting acknowledgement to the *front* of the
+	// consumption queue in a single transaction, given in the order they were
+	// delivered, without counting a failure against them.
+	Release(topic string, ackOffsets []int) error
+
+	// Expire will return a message whose lease has expired to the *front* of the
+	// consumption queue, incrementing its expired count.
+	Expire(topic string, ackOffset int) error
+
 	// Dack will negatively acknowledge the message on a given topic, placing on
 	// the delay queue with a given timestamp as part of the key for later
 	// retrieval.
-	Dack(topic string, ackOffset int, delaySeconds int) error
+	Dack(topic string, ackOffset int, delay time.Duration) error
 
 	// GetDelayed returns an iterator and a closer function allowing the caller to
 	// iterate over the currently waiting messages for a given topic in
@@ -60,13 +238,60 @@ type storer interface {
 	// error.
 	ReturnDelayed(topic string, before time.Time) (count int, err error)
 
+	// ReleaseDelayed returns the delayed message with the given ID to the
+	// *front* of the consumption queue, regardless of its due time.
+	ReleaseDelayed(topic, id string) error
+
+	// RescheduleDelayed changes the time the delayed message with the given ID
+	// is due to be returned to the consumption queue.
+	RescheduleDelayed(topic, id string, dueAt time.Time) error
+
+	// DeleteDelayed deletes the delayed message with the given ID.
+	DeleteDelayed(topic, id string) error
+
+	// RemoveExpired removes the messages which have expired at the given time
+	// from the main and delay queues of a topic, returning the number of
+	// messages removed. Expired entries of the dedup index are also removed,
+	// and the remaining entries follow their messages to their new offsets.
+	RemoveExpired(topic string, now time.Time) (count int, err error)
+
+	// Recover returns every message on the topic which is awaiting
+	// acknowledgement to the *front* of the consumption queue, preserving the
+	// order in which they were originally consumed. It returns the number of
+	// messages recovered.
+	Recover(topic string) (count int, err error)
+
+	// Redrive moves every message waiting on the dead letter topic of a topic
+	// to the *back* of the topic's consumption queue, resetting their failure
+	// counts. It returns the number of messages redriven.
+	Redrive(topic string) (count int, err error)
+
+	// Config returns the configuration of a topic.
+	Config(topic string) (*topicConfig, error)
+
+	// SetConfig sets the configuration of a topic.
+	SetConfig(topic string, cfg *topicConfig) error
+
 	// Meta returns the metadata of the database.
 	Meta() (*metadata, error)
 
+	// Stats returns the statistics of a topic.
+	Stats(topic string) (*topicStats, error)
+
+	// Browse returns up to limit values on the main queue of a topic in
+	// delivery order, starting from the given offset of the highest priority
+	// level at or below the given priority, without consuming them.
+	Browse(topic string, priority, from, limit int) ([]*browsedValue, error)
+
+	// BrowseAcks returns up to limit values awaiting acknowledgement on a topic
+	// with offsets from the given offset, in offset order.
+	BrowseAcks(topic string, from, limit int) ([]*browsedValue, error)
+
 	// Close closes the store.
 	Close() error
 
-	// Purge deletes all data associated with a topic.
+	// Purge deletes all data associated with a topic, removing it from the
+	// metadata.
 	Purge(topic string) error
 
 	// Destroy removes the store from persistence. This is a destructive
@@ -75,11 +300,22 @@ type storer interface {
 }
 
 const (
-	errTopicEmpty      = storeError("topic is empty")
-	errTopicNotExist   = storeError("topic does not exist")
-	errNackMsgNotExist = storeError("msg to nack does not exist")
-	errBackMsgNotExist = storeError("msg to back does not exist")
-	errDackMsgNotExist = storeError("msg to dack does not exist")
+	errTopicEmpty         = storeError("topic is empty")
+	errTopicNotExist      = storeError("topic does not exist")
+	errNackMsgNotExist    = storeError("msg to nack does not exist")
+	errBackMsgNotExist    = storeError("msg to back does not exist")
+	errDackMsgNotExist    = storeError("msg to dack does not exist")
+	errExpireMsgNotExist  = storeError("msg to expire does not exist")
+	errDelayedMsgNotExist = storeError("delayed msg does not exist")
+	errTopicFull          = storeError("topic is full")
+)
+
+// The reasons recorded against a message when its delivery fails.
+const (
+	failureNack    = "NACK"
+	failureBack    = "BACK"
+	failureDack    = "DACK"
+	failureExpired = "lease expired"
 )
 
 type storeError string
@@ -92,6 +328,23 @@ const (
 	// metaTopics is a key which contains a JSON encoded slice
 	metaTopics = "m-topics"
 
+	// metaVersion is a key which contains the varint encoded schema version of
+	// the store, absent for stores which predate versioning.
+	metaVersion = "m-version"
+
+	// metaConfigFmt is a key which contains the JSON encoded topicConfig of a
+	// topic.
+	metaConfigFmt = "m-config-%s" // key: config-[topic]
+
+	// deadLetterTopicFmt is the name of the topic which messages are moved to
+	// once they have exceeded the max deliveries of their topic.
+	deadLetterTopicFmt = "%s.dlq" // topic: [topic].dlq
+
+	// Every key of a topic begins with the topic prefix. Topics are escaped
+	// within keys by escapeTopic so that they never contain a '-', making the
+	// prefix of each topic unambiguous.
+	topicPrefix = "t-%s-" // topic: [topic]-
+
 	// The topic queue is the primary queue containing the records to be
 	// processed. We need to keep track of the head and the tail offsets of the
 	// queue in their respective keys in order to quickly append/pop messages from
@@ -104,20 +357,102 @@ const (
 	// outstanding messages which are waiting on a consumer acknowledgement
 	// command. We only ever append to the end of this queue, delete records once
 	// they have been ACK'ed or moved back to the primary queue for reprocessing.
-	ackTopicFmt      = "t-%s-ack-%d"   // topic: [topic]-ack-[offset]
-	ackTailPosKeyFmt = "t-%s-ack-tail" // key: [topic]-ack-tail
+	ackTopicPrefix   = "t-%s-ack-"           // topic: [topic]-ack-
+	ackTopicFmt      = ackTopicPrefix + "%d" // topic: [topic]-ack-[offset]
+	ackTailPosKeyFmt = "t-%s-ack-tail"       // key: [topic]-ack-tail
 
 	// The delay topic contains messages in buckets with their designated return
-	// time as a unix timestamp. This provides strict ordering, allowing iteration
-	// over the items in prefixed byte-order.
-	delayTopicPrefix = "t-%s-delay-"              // topic: [topic]-delay-
-	delayTopicFmt    = delayTopicPrefix + "%d-%d" // topic: [topic]-delay-[until_unix_timestamp]-[local_index]
+	// time as a unix timestamp in milliseconds. Both the timestamp and the index
+	// within a bucket are zero padded to a fixed width, providing strict
+	// ordering when iterating over the items in prefixed byte-order.
+	delayTopicPrefix = "t-%s-delay-"                   // topic: [topic]-delay-
+	delayTopicFmt    = delayTopicPrefix + "%016d-%08d" // topic: [topic]-delay-[until_unix_millis]-[local_index]
+
+	// The total number of messages published to and acknowledged on a topic are
+	// counted in their respective keys.
+	publishedCountKeyFmt = "t-%s-published" // key: [topic]-published
+	ackedCountKeyFmt     = "t-%s-acked"     // key: [topic]-acked
+
+	// The total size of the bodies of the messages waiting on the main queue of
+	// a topic is counted in its key, to enforce the limits of the topic.
+	queuedBytesKeyFmt = "t-%s-bytes" // key: [topic]-bytes
+
+	// The dedup index contains the JSON encoded dedupEntry of each message
+	// published to a topic with an idempotency key, keyed by the idempotency
+	// key, until its dedup window passes.
+	dedupPrefix = "t-%s-dedup-"      // topic: [topic]-dedup-
+	dedupKeyFmt = dedupPrefix + "%s" // key: [topic]-dedup-[idempotency_key]
+
+	// Messages with a priority above zero wait on a separate queue for each
+	// priority level, with its own head and tail offsets, while the topic queue
+	// holds the messages of priority zero. The formats are completed with the
+	// priority to give the key formats of a level.
+	priorityTopicFmt      = "t-%%s-p%d-%%d"  // topic: [topic]-p[priority]-[offset]
+	priorityHeadPosKeyFmt = "t-%%s-p%d-head" // key: [topic]-p[priority]-head
+	priorityTailPosKeyFmt = "t-%%s-p%d-tail" // key: [topic]-p[priority]-tail
+
+	// The priority levels above zero created on a topic are recorded as a
+	// bitmask of their priorities in its key, so that only those levels are
+	// read when finding the next value.
+	levelsKeyFmt = "t-%s-levels" // key: [topic]-levels
 )
 
-// store handles the the underlying leveldb implementation.
+// maxPriority is the highest priority a message may be published with.
+const maxPriority = 9
+
+// queueKeys holds the key formats of one of the priority levels of a topic.
+type queueKeys struct {
+	valueFmt string
+	headFmt  string
+	tailFmt  string
+}
+
+// priorityKeys holds the key formats of each priority level, indexed by
+// priority.
+var priorityKeys = func() []queueKeys {
+	keys := []queueKeys{{topicFmt, headPosKeyFmt, tailPosKeyFmt}}
+	for p := 1; p <= maxPriority; p++ {
+		keys = append(keys, queueKeys{
+			valueFmt: fmt.Sprintf(priorityTopicFmt, p),
+			headFmt:  fmt.Sprintf(priorityHeadPosKeyFmt, p),
+			tailFmt:  fmt.Sprintf(priorityTailPosKeyFmt, p),
+		})
+	}
+
+	return keys
+}()
+
+// levelPriority returns the priority of the level a value waits on, clamping
+// priorities outside of the valid range.
+func levelPriority(priority int) int {
+	switch {
+	case priority < 0:
+		return 0
+	case priority > maxPriority:
+		return maxPriority
+	}
+
+	return priority
+}
+
+// levelKeys returns the key formats of the priority level of a value.
+func levelKeys(priority int) queueKeys {
+	return priorityKeys[levelPriority(priority)]
+}
+
+// topicEscaper escapes topics for use within keys, escaping the escape
+// character itself first.
+var topicEscaper = strings.NewReplacer("%", "%25", "-", "%2D")
+
+// escapeTopic escapes a topic for use within a key.
+func escapeTopic(topic string) string {
+	return topicEscaper.Replace(topic)
+}
+
+// store handles the the underlying database implementation.
 type store struct {
 	path string
-	db   *leveldb.DB
+	db   database
 	sync.Mutex
 }
 
@@ -127,8 +462,48 @@ func newStore(dbPath string) storer {
 		log.Fatal().Err(err).Msg("failed to open levelDB")
 	}
 
+	return initStore(dbPath, levelDB{db})
+}
+
+// newBoltStore returns a store persisted to a single bbolt file, which syncs
+// each transaction to disk as it is committed.
+func newBoltStore(dbPath string) storer {
+	db, err := openBoltDB(dbPath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open bbolt")
+	}
+
+	return initStore(dbPath, db)
+}
+
+// newMemStore returns a store which is held entirely in memory, with the same
+// semantics as one persisted to disk. Its contents are lost once closed.
+func newMemStore() storer {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open in-memory levelDB")
+	}
+
+	return initStore("", levelDB{db})
+}
+
+// initStore returns a store over an open database, first migrating the
+// database to the latest schema version.
+func initStore(path string, db database) *store {
+	from, to, err := migrateSchema(db)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to migrate store schema")
+	}
+
+	if from != to {
+		log.Info().
+			Int("from", from).
+			Int("to", to).
+			Msg("migrated store schema")
+	}
+
 	return &store{
-		path: dbPath,
+		path: path,
 		db:   db,
 	}
 }
@@ -136,86 +511,202 @@ func newStore(dbPath string) storer {
 // Ack will acknowledge the processing of a value, removing it from the topic
 // entirely.
 func (s *store) Ack(topic string, ackOffset int) error {
+	return s.AckBatch(topic, []int{ackOffset})
+}
+
+// AckBatch acknowledges the values at each of the offsets of the ack queue of a
+// topic in a single transaction, as Ack does.
+func (s *store) AckBatch(topic string, ackOffsets []int) error {
 	s.Lock()
 	defer s.Unlock()
 
+	tx, err := s.db.OpenBatch()
+	if err != nil {
+		return fmt.Errorf("opening batch: %v", err)
+	}
+
+	for _, ackOffset := range ackOffsets {
+		if err := ackValue(tx, topic, ackOffset); err != nil {
+			tx.Discard()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return fmt.Errorf("committing ack batch: %v", err)
+	}
+
+	return nil
+}
+
+// ackValue removes the value at an offset of the ack queue of a topic, counting
+// it as acknowledged.
+func ackValue(db leveldber, topic string, ackOffset int) error {
+	key := []byte(fmt.Sprintf(ackTopicFmt, escapeTopic(topic), ackOffset))
+
+	// Acknowledging a message which has already been removed has no effect.
+	exists, err := db.Has(key, nil)
+	if err != nil {
+		return fmt.Errorf("checking has %s: %v", key, err)
+	}
+	if !exists {
+		return nil
+	}
+
 	// Delete the used value
-	key := fmt.Sprintf(ackTopicFmt, topic, ackOffset)
-	if err := s.db.Delete([]byte(key), nil); err != nil {
+	if err := db.Delete(key, nil); err != nil {
 		return fmt.Errorf("deleting from ack topic: %v", err)
 	}
 
-	return nil
+	return addCount(db, ackedCountKeyFmt, topic, 1)
 }
 
 // Nack will negatively acknowledge the value, on a given topic, returning it
 // to the front of the consumption queue.
 func (s *store) Nack(topic string, ackOffset int) error {
+	return s.NackBatch(topic, []int{ackOffset})
+}
+
+// NackBatch negatively acknowledges the values at each of the offsets of the
+// ack queue of a topic in a single transaction, as Nack does. The values are
+// returned in reverse, so that given in the order they were delivered, they
+// keep that order at the front of the queue.
+func (s *store) NackBatch(topic string, ackOffsets []int) error {
 	s.Lock()
 	defer s.Unlock()
 
-	nackKey := []byte(fmt.Sprintf(ackTopicFmt, topic, ackOffset))
-
 	tx, err := s.db.OpenTransaction()
 	if err != nil {
 		return fmt.Errorf("opening transaction: %v", err)
 	}
 
-	exists, err := tx.Has(nackKey, nil)
-	if err != nil {
+	for i := len(ackOffsets) - 1; i >= 0; i-- {
+		if err := nackValue(tx, topic, ackOffsets[i]); err != nil {
+			tx.Discard()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		tx.Discard()
+		return fmt.Errorf("committing nack transaction: %v", err)
+	}
+
+	return nil
+}
+
+// nackValue returns the value at an offset of the ack queue of a topic to the
+// front of the topic, or to its dead letter topic once it has failed too many
+// times.
+func nackValue(db leveldber, topic string, ackOffset int) error {
+	nackKey := []byte(fmt.Sprintf(ackTopicFmt, escapeTopic(topic), ackOffset))
+
+	exists, err := db.Has(nackKey, nil)
+	if err != nil {
 		return fmt.Errorf("checking has %s: %v", nackKey, err)
 	}
 	if !exists {
-		tx.Discard()
 		return errNackMsgNotExist
 	}
 
-	val, err := getOffset(tx, ackTopicFmt, topic, ackOffset)
+	val, err := getOffset(db, ackTopicFmt, topic, ackOffset)
 	if err != nil {
-		tx.Discard()
 		return fmt.Errorf("getting ack msg from topic %s at offset %d: %v", topic, ackOffset, err)
 	}
 
-	if _, err := prependValue(tx, topicFmt, headPosKeyFmt, topic, val); err != nil {
-		tx.Discard()
-		return fmt.Errorf("prepending value to topic %s: %v", topic, err)
+	dead, err := failValue(db, topic, val, failureNack)
+	if err != nil {
+		return err
 	}
 
-	if err := tx.Delete(nackKey, nil); err != nil {
-		tx.Discard()
+	if !dead {
+		if _, err := returnValue(db, topic, val); err != nil {
+			return fmt.Errorf("prepending value to topic %s: %v", topic, err)
+		}
+	}
+
+	if err := db.Delete(nackKey, nil); err != nil {
 		return fmt.Errorf("deleting ackKey %s: %v", nackKey, err)
 	}
 
+	return nil
+}
+
+// Release returns the values at each of the offsets of the ack queue of a topic
+// to the front of the consumption queue in a single transaction, such as once
+// their consumer has disconnected. Unlike NackBatch, no failure is counted
+// against the values, so they are never moved to the dead letter topic. The
+// values are returned in reverse, so that given in the order they were
+// delivered, they keep that order at the front of the queue. Offsets no longer
+// awaiting acknowledgement are skipped.
+func (s *store) Release(topic string, ackOffsets []int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	tx, err := s.db.OpenTransaction()
+	if err != nil {
+		return fmt.Errorf("opening transaction: %v", err)
+	}
+
+	for i := len(ackOffsets) - 1; i >= 0; i-- {
+		ackKey := []byte(fmt.Sprintf(ackTopicFmt, escapeTopic(topic), ackOffsets[i]))
+
+		exists, err := tx.Has(ackKey, nil)
+		if err != nil {
+			tx.Discard()
+			return fmt.Errorf("checking has %s: %v", ackKey, err)
+		}
+		if !exists {
+			continue
+		}
+
+		val, err := getOffset(tx, ackTopicFmt, topic, ackOffsets[i])
+		if err != nil {
+			tx.Discard()
+			return fmt.Errorf("getting ack msg from topic %s at offset %d: %v", topic, ackOffsets[i], err)
+		}
+
+		if _, err := returnValue(tx, topic, val); err != nil {
+			tx.Discard()
+			return fmt.Errorf("prepending value to topic %s: %v", topic, err)
+		}
+
+		if err := tx.Delete(ackKey, nil); err != nil {
+			tx.Discard()
+			return fmt.Errorf("deleting ackKey %s: %v", ackKey, err)
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		tx.Discard()
-		return fmt.Errorf("committing nack transaction: %v", err)
+		return fmt.Errorf("committing release transaction: %v", err)
 	}
 
 	return nil
 }
 
-// Back will negatively acknowledge the value, on a given topic, returning it
-// to the back of the consumption queue.
-func (s *store) Back(topic string, ackOffset int) error {
+// Expire returns a value whose lease has expired, on a given topic, to the
+// front of the consumption queue, incrementing its expired count.
+func (s *store) Expire(topic string, ackOffset int) error {
 	s.Lock()
 	defer s.Unlock()
 
-	backKey := []byte(fmt.Sprintf(ackTopicFmt, topic, ackOffset))
+	expireKey := []byte(fmt.Sprintf(ackTopicFmt, escapeTopic(topic), ackOffset))
 
 	tx, err := s.db.OpenTransaction()
 	if err != nil {
 		return fmt.Errorf("opening transaction: %v", err)
 	}
 
-	exists, err := tx.Has(backKey, nil)
+	exists, err := tx.Has(expireKey, nil)
 	if err != nil {
 		tx.Discard()
-		return fmt.Errorf("checking has %s: %v", backKey, err)
+		return fmt.Errorf("checking has %s: %v", expireKey, err)
 	}
 	if !exists {
 		tx.Discard()
-		return errBackMsgNotExist
+		return errExpireMsgNotExist
 	}
 
 	val, err := getOffset(tx, ackTopicFmt, topic, ackOffset)
@@ -224,129 +715,451 @@ func (s *store) Back(topic string, ackOffset int) error {
 		return fmt.Errorf("getting ack msg from topic %s at offset %d: %v", topic, ackOffset, err)
 	}
 
-	if _, err := appendValue(tx, topicFmt, tailPosKeyFmt, topic, val); err != nil {
+	val.ExpiredCount++
+
+	dead, err := failValue(tx, topic, val, failureExpired)
+	if err != nil {
 		tx.Discard()
-		return fmt.Errorf("appending value to topic %s: %v", topic, err)
+		return err
 	}
 
-	if err := tx.Delete(backKey, nil); err != nil {
+	if !dead {
+		if _, err := returnValue(tx, topic, val); err != nil {
+			tx.Discard()
+			return fmt.Errorf("prepending value to topic %s: %v", topic, err)
+		}
+	}
+
+	if err := tx.Delete(expireKey, nil); err != nil {
 		tx.Discard()
-		return fmt.Errorf("deleting ackKey %s: %v", backKey, err)
+		return fmt.Errorf("deleting ackKey %s: %v", expireKey, err)
 	}
 
 	if err := tx.Commit(); err != nil {
 		tx.Discard()
-		return fmt.Errorf("committing back transaction: %v", err)
+		return fmt.Errorf("committing expire transaction: %v", err)
 	}
 
 	return nil
 }
 
-// Insert creates a new record for a given topic, creating the topic in the
-// store if it doesn't already exist. If it does, the record is placed at the
-// end of the queue.
-func (s *store) Insert(topic string, val *value) error {
+// Back will negatively acknowledge the value, on a given topic, returning it
+// to the back of the consumption queue.
+func (s *store) Back(topic string, ackOffset int) error {
+	return s.BackBatch(topic, []int{ackOffset})
+}
+
+// BackBatch negatively acknowledges the values at each of the offsets of the
+// ack queue of a topic in a single transaction, as Back does, appending them to
+// the back of the queue in the order given.
+func (s *store) BackBatch(topic string, ackOffsets []int) error {
 	s.Lock()
 	defer s.Unlock()
 
-	headPosKey := []byte(fmt.Sprintf(headPosKeyFmt, topic))
-	tailPosKey := []byte(fmt.Sprintf(tailPosKeyFmt, topic))
-	ackTailPosKey := []byte(fmt.Sprintf(ackTailPosKeyFmt, topic))
-
-	exists, err := s.db.Has(tailPosKey, nil)
+	tx, err := s.db.OpenTransaction()
 	if err != nil {
-		return fmt.Errorf("checking has %s: %v", tailPosKey, err)
+		return fmt.Errorf("opening transaction: %v", err)
 	}
 
-	// The key already exists
-	if exists {
-		if _, err := appendValue(s.db, topicFmt, tailPosKeyFmt, topic, val); err != nil {
+	for _, ackOffset := range ackOffsets {
+		if err := backValue(tx, topic, ackOffset); err != nil {
+			tx.Discard()
 			return err
 		}
-
-		return nil
 	}
 
-	// Add the topic to the list of topics
-	if err := addTopicMeta(s.db, topic); err != nil {
-		return fmt.Errorf("adding topic to meta: %v", err)
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return fmt.Errorf("committing back transaction: %v", err)
 	}
 
-	// Write initial head position
-	headPos := make([]byte, 8)
-	binary.PutVarint(headPos, 0)
-
-	if err := s.db.Put(headPosKey, headPos, nil); err != nil {
-		return fmt.Errorf("putting head position value: %v", err)
-	}
+	return nil
+}
 
-	// Write initial ack topic head position
-	ackTailPos := make([]byte, 8)
-	binary.PutVarint(ackTailPos, 0)
+// backValue returns the value at an offset of the ack queue of a topic to the
+// back of the topic, or to its dead letter topic once it has failed too many
+// times.
+func backValue(db leveldber, topic string, ackOffset int) error {
+	backKey := []byte(fmt.Sprintf(ackTopicFmt, escapeTopic(topic), ackOffset))
 
-	if err := s.db.Put(ackTailPosKey, ackTailPos, nil); err != nil {
-		return fmt.Errorf("putting ack head position value: %v", err)
+	exists, err := db.Has(backKey, nil)
+	if err != nil {
+		return fmt.Errorf("checking has %s: %v", backKey, err)
 	}
-
-	// Write initial tail position
-	tailPos := make([]byte, 8)
-	binary.PutVarint(tailPos, 1)
-
-	if err := s.db.Put(tailPosKey, tailPos, nil); err != nil {
-		return fmt.Errorf("putting tail position value: %v", err)
+	if !exists {
+		return errBackMsgNotExist
 	}
 
-	// Write new message to head
-	newKey := []byte(fmt.Sprintf(topicFmt, topic, 0))
+	val, err := getOffset(db, ackTopicFmt, topic, ackOffset)
+	if err != nil {
+		return fmt.Errorf("getting ack msg from topic %s at offset %d: %v", topic, ackOffset, err)
+	}
 
-	b, err := val.Encode()
+	dead, err := failValue(db, topic, val, failureBack)
 	if err != nil {
-		return fmt.Errorf("encoding value: %v", err)
+		return err
+	}
+
+	if !dead {
+		if _, err := insertValue(db, topic, val); err != nil {
+			return fmt.Errorf("appending value to topic %s: %v", topic, err)
+		}
 	}
 
-	if err := s.db.Put(newKey, b, nil); err != nil {
-		return fmt.Errorf("putting first value for topic: %v", err)
+	if err := db.Delete(backKey, nil); err != nil {
+		return fmt.Errorf("deleting ackKey %s: %v", backKey, err)
 	}
 
 	return nil
 }
 
-// GetNext retrieves the first record for a topic, incrementing the head
-// position of the main array and pushing the value onto the ack array.
-func (s *store) GetNext(topic string) (*value, int, error) {
+// Insert creates a new record for a given topic, creating the topic in the
+// store if it doesn't already exist. If it does, the record is placed at the
+// end of the queue.
+func (s *store) Insert(topic string, val *value) error {
 	s.Lock()
 	defer s.Unlock()
 
-	headOffset, err := getPos(s.db, headPosKeyFmt, topic)
+	tx, err := s.db.OpenBatch()
 	if err != nil {
-		return nil, 0, err
+		return fmt.Errorf("opening batch: %v", err)
 	}
 
-	val, err := getValue(s.db, topicFmt, topic, headOffset)
-	if err != nil {
-		return nil, 0, err
+	if err := applyDefaultTTL(tx, topic, val); err != nil {
+		tx.Discard()
+		return err
 	}
 
-	insertedOffset, err := appendValue(s.db, ackTopicFmt, ackTailPosKeyFmt, topic, val)
-	if err != nil {
-		return nil, 0, err
+	if err := makeRoom(tx, topic, val); err != nil {
+		tx.Discard()
+		return err
 	}
 
-	if _, _, err := addPos(s.db, headPosKeyFmt, topic, 1); err != nil {
-		return nil, 0, err
+	if _, err := insertValue(tx, topic, val); err != nil {
+		tx.Discard()
+		return err
+	}
+
+	if err := addCount(tx, publishedCountKeyFmt, topic, 1); err != nil {
+		tx.Discard()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return fmt.Errorf("committing insert batch: %v", err)
+	}
+
+	return nil
+}
+
+// InsertIdempotent creates a new record for a given topic as Insert does,
+// recording it in the dedup index of the topic under the idempotency key. If
+// the key is already recorded and has not expired, nothing is inserted and the
+// existing entry is returned as a duplicate.
+func (s *store) InsertIdempotent(topic, key string, val *value) (*dedupEntry, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+
+	tx, err := s.db.OpenBatch()
+	if err != nil {
+		return nil, false, fmt.Errorf("opening batch: %v", err)
+	}
+
+	entry, err := getDedupEntry(tx, topic, key)
+	if err != nil {
+		tx.Discard()
+		return nil, false, err
+	}
+
+	if entry != nil && !entry.expired(now) {
+		tx.Discard()
+		return entry, true, nil
+	}
+
+	cfg, err := getTopicConfig(tx, topic)
+	if err != nil {
+		tx.Discard()
+		return nil, false, err
+	}
+
+	if err := applyDefaultTTL(tx, topic, val); err != nil {
+		tx.Discard()
+		return nil, false, err
+	}
+
+	if err := makeRoom(tx, topic, val); err != nil {
+		tx.Discard()
+		return nil, false, err
+	}
+
+	offset, err := insertValue(tx, topic, val)
+	if err != nil {
+		tx.Discard()
+		return nil, false, err
+	}
+
+	if err := addCount(tx, publishedCountKeyFmt, topic, 1); err != nil {
+		tx.Discard()
+		return nil, false, err
+	}
+
+	entry = &dedupEntry{
+		ID:        val.ID,
+		Offset:    offset,
+		ExpiresAt: now.Add(cfg.dedupWindow()),
+	}
+
+	if err := putDedupEntry(tx, topic, key, entry); err != nil {
+		tx.Discard()
+		return nil, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return nil, false, fmt.Errorf("committing insert idempotent batch: %v", err)
+	}
+
+	return entry, false, nil
+}
+
+// InsertBatch creates new records for a given topic within a single
+// transaction, creating the topic in the store if it doesn't already exist.
+// The records are placed at the end of the queue in the order given.
+func (s *store) InsertBatch(topic string, vals []*value) ([]int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	tx, err := s.db.OpenBatch()
+	if err != nil {
+		return nil, fmt.Errorf("opening batch: %v", err)
+	}
+
+	if err := applyDefaultTTL(tx, topic, vals...); err != nil {
+		tx.Discard()
+		return nil, err
+	}
+
+	if err := makeRoom(tx, topic, vals...); err != nil {
+		tx.Discard()
+		return nil, err
+	}
+
+	offsets := make([]int, 0, len(vals))
+
+	for _, val := range vals {
+		offset, err := insertValue(tx, topic, val)
+		if err != nil {
+			tx.Discard()
+			return nil, err
+		}
+
+		offsets = append(offsets, offset)
+	}
+
+	if err := addCount(tx, publishedCountKeyFmt, topic, len(vals)); err != nil {
+		tx.Discard()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return nil, fmt.Errorf("committing insert batch: %v", err)
+	}
+
+	return offsets, nil
+}
+
+// InsertDelayed creates a new record for a given topic on its delay queue,
+// creating the topic in the store if it doesn't already exist. The record is
+// returned to the front of the main queue once due, by ReturnDelayed.
+func (s *store) InsertDelayed(topic string, val *value, dueAt time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+
+	tx, err := s.db.OpenBatch()
+	if err != nil {
+		return fmt.Errorf("opening batch: %v", err)
+	}
+
+	// The delay queue doesn't count towards the limits of the topic, and a due
+	// value is returned to the topic regardless of them. A value exceeding the
+	// limits by itself could never fit on the topic however, so is rejected.
+	cfg, err := getTopicConfig(tx, topic)
+	if err != nil {
+		tx.Discard()
+		return err
+	}
+
+	if cfg.exceeds(1, len(val.Raw)) {
+		tx.Discard()
+		return errTopicFull
+	}
+
+	if err := createTopic(tx, topic); err != nil {
+		tx.Discard()
+		return err
+	}
+
+	if err := applyDefaultTTL(tx, topic, val); err != nil {
+		tx.Discard()
+		return err
+	}
+
+	if err := insertDelay(tx, topic, val, dueAt); err != nil {
+		tx.Discard()
+		return fmt.Errorf("inserting msg into delay topic %s: %v", topic, err)
+	}
+
+	if err := addCount(tx, publishedCountKeyFmt, topic, 1); err != nil {
+		tx.Discard()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return fmt.Errorf("committing insert delayed batch: %v", err)
+	}
+
+	return nil
+}
+
+// GetNext retrieves the first record of the highest non-empty priority level of
+// a topic, incrementing the head position of the level and pushing the value
+// onto the ack array. The delivery of the value is recorded against it. Expired
+// records at the head are removed from the topic and skipped.
+func (s *store) GetNext(topic string) (*value, int, error) {
+	vals, ackOffsets, err := s.GetNextBatch(topic, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return vals[0], ackOffsets[0], nil
+}
+
+// GetNextBatch retrieves up to n of the next records of a topic as GetNext
+// does, moving the whole batch onto the ack array in a single transaction. It
+// returns errTopicEmpty if there are no records to deliver.
+func (s *store) GetNextBatch(topic string, n int) ([]*value, []int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	tx, err := s.db.OpenBatch()
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening batch: %v", err)
+	}
+
+	var (
+		now        = time.Now()
+		skipped    = 0
+		vals       []*value
+		ackOffsets []int
+	)
+
+	// The positions of the levels are read once, and their heads advanced as
+	// values are taken.
+	levels, err := queueLevels(tx, topic)
+	if err != nil {
+		tx.Discard()
+		return nil, nil, err
+	}
+
+	for len(vals) < n {
+		i, ok := firstLevel(levels)
+		if !ok {
+			break
+		}
+
+		level := &levels[i]
+
+		val, err := getValue(tx, level.valueFmt, topic, level.head)
+		if err != nil {
+			tx.Discard()
+			return nil, nil, err
+		}
+
+		if val.expired(now) {
+			if _, err := removeHead(tx, topic, level.queueKeys); err != nil {
+				tx.Discard()
+				return nil, nil, err
+			}
+
+			level.head++
+
+			if err := expireValue(tx, topic, val); err != nil {
+				tx.Discard()
+				return nil, nil, err
+			}
+
+			skipped++
+			continue
+		}
+
+		val.DeliveryCount++
+		if val.FirstDeliveredAt.IsZero() {
+			val.FirstDeliveredAt = time.Now().UTC()
+		}
+
+		insertedOffset, err := appendValue(tx, ackTopicFmt, ackTailPosKeyFmt, topic, val)
+		if err != nil {
+			tx.Discard()
+			return nil, nil, err
+		}
+
+		if _, _, err := addPos(tx, level.headFmt, topic, 1); err != nil {
+			tx.Discard()
+			return nil, nil, err
+		}
+
+		level.head++
+
+		if err := addCount(tx, queuedBytesKeyFmt, topic, -len(val.Raw)); err != nil {
+			tx.Discard()
+			return nil, nil, err
+		}
+
+		vals = append(vals, val)
+		ackOffsets = append(ackOffsets, insertedOffset)
+	}
+
+	if len(vals) == 0 && skipped == 0 {
+		tx.Discard()
+		return nil, nil, errTopicEmpty
+	}
+
+	// Keep the removal of any skipped records, even if there is nothing to
+	// deliver.
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return nil, nil, fmt.Errorf("committing get next batch: %v", err)
+	}
+
+	if len(vals) == 0 {
+		return nil, nil, errTopicEmpty
 	}
 
-	return val, insertedOffset, nil
+	return vals, ackOffsets, nil
+}
+
+// Length returns the number of records waiting to be consumed on a topic,
+// including any expired records which have not yet been removed.
+func (s *store) Length(topic string) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return queueLength(s.db, topic)
 }
 
 // Dack will negatively acknowledge the message on a given topic, placing on
 // the delay queue with a given timestamp as part of the key for later
 // retrieval.
-func (s *store) Dack(topic string, ackOffset int, delaySeconds int) error {
+func (s *store) Dack(topic string, ackOffset int, delay time.Duration) error {
 	s.Lock()
 	defer s.Unlock()
 
-	dackKey := []byte(fmt.Sprintf(ackTopicFmt, topic, ackOffset))
+	dackKey := []byte(fmt.Sprintf(ackTopicFmt, escapeTopic(topic), ackOffset))
 
 	tx, err := s.db.OpenTransaction()
 	if err != nil {
@@ -363,197 +1176,1291 @@ func (s *store) Dack(topic string, ackOffset int, delaySeconds int) error {
 		return errDackMsgNotExist
 	}
 
-	val, err := getOffset(tx, ackTopicFmt, topic, ackOffset)
-	if err != nil {
-		tx.Discard()
-		return fmt.Errorf("getting ack msg from topic %s at offset %d: %v", topic, ackOffset, err)
+	val, err := getOffset(tx, ackTopicFmt, topic, ackOffset)
+	if err != nil {
+		tx.Discard()
+		return fmt.Errorf("getting ack msg from topic %s at offset %d: %v", topic, ackOffset, err)
+	}
+
+	val.DackCount++
+
+	dead, err := failValue(tx, topic, val, failureDack)
+	if err != nil {
+		tx.Discard()
+		return err
+	}
+
+	if !dead {
+		if err := insertDelay(tx, topic, val, time.Now().Add(delay)); err != nil {
+			tx.Discard()
+			return fmt.Errorf("inserting ack msg into delay topic from topic %s at offset %d: %v", topic, ackOffset, err)
+		}
+	}
+
+	if err := tx.Delete(dackKey, nil); err != nil {
+		tx.Discard()
+		return fmt.Errorf("deleting ackKey %s: %v", dackKey, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return fmt.Errorf("committing dack transaction: %v", err)
+	}
+
+	return nil
+}
+
+// Requires version of mockgen with https://github.com/golang/mock/pull/405 due
+// to exposing a bug in previous versions. Unfortunately for now-
+// $ go get github.com/golang/mock/mockgen@HEAD
+// until a new release made.
+type delayedIterator interface {
+	iterator.Iterator
+}
+
+// GetDelayed returns an iterator and a closer function allowing the caller to
+// iterate over the currently waiting messages for a given topic in
+// chronological delay order (those with soonest "done" time first).
+func (s *store) GetDelayed(topic string) (iterator delayedIterator, closer func() error) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := fmt.Sprintf(delayTopicPrefix, escapeTopic(topic))
+	prefix := util.BytesPrefix([]byte(key))
+	iter := s.db.NewIterator(prefix, nil)
+
+	closer = func() error {
+		iter.Release()
+		return iter.Error()
+	}
+
+	return iter, closer
+}
+
+// ReturnDelayed returns delayed messages with done times before the given time
+// back to the front of the main queue, in the order they fell due. As with other messages returned to a topic, they are
+// returned regardless of the limits of the topic, having already been accepted.
+func (s *store) ReturnDelayed(topic string, before time.Time) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := fmt.Sprintf(delayTopicPrefix, escapeTopic(topic))
+	prefix := util.BytesPrefix([]byte(key))
+	iter := s.db.NewIterator(prefix, nil)
+	defer iter.Release() // In case we return early, it is safe to call multiple times.
+
+	tx, err := s.db.OpenTransaction()
+	if err != nil {
+		return 0, fmt.Errorf("opening transaction: %v", err)
+	}
+
+	// Collect the records with timestamps earlier than the given cutoff, which
+	// have passed the delay point so should be returned to the front of the
+	// main queue to be processed again.
+	var (
+		keys [][]byte
+		vals []*value
+	)
+
+	for iter.Next() {
+		key := iter.Key()
+		delayTime, err := timeFromDelayKey(string(key))
+		if err != nil {
+			tx.Discard()
+			return 0, err
+		}
+
+		if !delayTime.Before(before) {
+			// We've already reached a timestamp that is in the future, no need to
+			// continue.
+			break
+		}
+
+		v, err := decodeValue(iter.Value())
+		if err != nil {
+			tx.Discard()
+			return 0, err
+		}
+
+		// The key is only valid until the next iteration.
+		keys = append(keys, append([]byte{}, key...))
+		vals = append(vals, v)
+	}
+
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		tx.Discard()
+		return 0, fmt.Errorf("iterating over delayed messages for topic %s: %v", topic, err)
+	}
+
+	// Each record is prepended to the main queue, so return them from the latest
+	// to the earliest, leaving them in the order they fell due.
+	for i := len(vals) - 1; i >= 0; i-- {
+		if _, err := returnValue(tx, topic, vals[i]); err != nil {
+			tx.Discard()
+			return 0, err
+		}
+		if err := tx.Delete(keys[i], nil); err != nil {
+			tx.Discard()
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return 0, fmt.Errorf("committing nack transaction: %v", err)
+	}
+
+	return len(vals), nil
+}
+
+// ReleaseDelayed returns the delayed message with the given ID to the front of
+// the main queue, regardless of its due time.
+func (s *store) ReleaseDelayed(topic, id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	tx, err := s.db.OpenTransaction()
+	if err != nil {
+		return fmt.Errorf("opening transaction: %v", err)
+	}
+
+	key, val, err := findDelayed(tx, topic, id)
+	if err != nil {
+		tx.Discard()
+		return err
+	}
+
+	if _, err := returnValue(tx, topic, val); err != nil {
+		tx.Discard()
+		return err
+	}
+
+	if err := tx.Delete(key, nil); err != nil {
+		tx.Discard()
+		return fmt.Errorf("deleting delayed msg %s: %v", key, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return fmt.Errorf("committing release delayed transaction: %v", err)
+	}
+
+	return nil
+}
+
+// RescheduleDelayed changes the time the delayed message with the given ID is
+// due to be returned to the main queue.
+func (s *store) RescheduleDelayed(topic, id string, dueAt time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+
+	tx, err := s.db.OpenTransaction()
+	if err != nil {
+		return fmt.Errorf("opening transaction: %v", err)
+	}
+
+	key, val, err := findDelayed(tx, topic, id)
+	if err != nil {
+		tx.Discard()
+		return err
+	}
+
+	if err := tx.Delete(key, nil); err != nil {
+		tx.Discard()
+		return fmt.Errorf("deleting delayed msg %s: %v", key, err)
+	}
+
+	if err := insertDelay(tx, topic, val, dueAt); err != nil {
+		tx.Discard()
+		return fmt.Errorf("inserting rescheduled msg into delay topic %s: %v", topic, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return fmt.Errorf("committing reschedule delayed transaction: %v", err)
+	}
+
+	return nil
+}
+
+// DeleteDelayed deletes the delayed message with the given ID.
+func (s *store) DeleteDelayed(topic, id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	tx, err := s.db.OpenTransaction()
+	if err != nil {
+		return fmt.Errorf("opening transaction: %v", err)
+	}
+
+	key, _, err := findDelayed(tx, topic, id)
+	if err != nil {
+		tx.Discard()
+		return err
+	}
+
+	if err := tx.Delete(key, nil); err != nil {
+		tx.Discard()
+		return fmt.Errorf("deleting delayed msg %s: %v", key, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return fmt.Errorf("committing delete delayed transaction: %v", err)
+	}
+
+	return nil
+}
+
+// RemoveExpired removes the expired records waiting on the main and delay
+// queues of a topic, moving them to the expired topic of the topic if one is
+// configured. The remaining records of each priority level are shifted towards
+// its head to fill the gaps, preserving their order, and the entries of the
+// dedup index of those moved are updated with their new offsets. Offsets
+// previously read past an expired record, such as to browse from, are no
+// longer valid. Every waiting record is read, so this is expensive for deep
+// topics.
+func (s *store) RemoveExpired(topic string, now time.Time) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	levels, err := queueLevels(s.db, topic)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.OpenTransaction()
+	if err != nil {
+		return 0, fmt.Errorf("opening transaction: %v", err)
+	}
+
+	var (
+		count = 0
+		moved = map[string]int{}
+	)
+
+	for _, level := range levels {
+		removed, err := removeExpiredLevel(tx, topic, level, now, moved)
+		if err != nil {
+			tx.Discard()
+			return 0, err
+		}
+
+		count += removed
+	}
+
+	prefix := util.BytesPrefix([]byte(fmt.Sprintf(delayTopicPrefix, escapeTopic(topic))))
+	iter := s.db.NewIterator(prefix, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		val, err := decodeValue(iter.Value())
+		if err != nil {
+			tx.Discard()
+			return 0, err
+		}
+
+		if !val.expired(now) {
+			continue
+		}
+
+		if err := tx.Delete(iter.Key(), nil); err != nil {
+			tx.Discard()
+			return 0, fmt.Errorf("deleting delayed key %s: %v", iter.Key(), err)
+		}
+
+		if err := expireValue(tx, topic, val); err != nil {
+			tx.Discard()
+			return 0, err
+		}
+
+		count++
+	}
+
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		tx.Discard()
+		return 0, fmt.Errorf("iterating over delayed messages for topic %s: %v", topic, err)
+	}
+
+	pruned, err := removeExpiredDedup(s.db, tx, topic, now, moved)
+	if err != nil {
+		tx.Discard()
+		return 0, err
+	}
+
+	if count == 0 && pruned == 0 {
+		tx.Discard()
+		return 0, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return 0, fmt.Errorf("committing remove expired transaction: %v", err)
+	}
+
+	return count, nil
+}
+
+// removeExpiredLevel removes the expired values waiting on a priority level of
+// a topic, shifting the remaining values towards the head of the level. The new
+// offset of each value moved is recorded in moved by its ID. It returns the
+// number of values removed.
+func removeExpiredLevel(db leveldber, topic string, level queueLevel, now time.Time, moved map[string]int) (int, error) {
+	count := 0
+
+	// next is the offset the following unexpired value is moved to.
+	next := level.head
+	for offset := level.head; offset < level.tail; offset++ {
+		val, err := getValue(db, level.valueFmt, topic, offset)
+		if err != nil {
+			return 0, fmt.Errorf("getting value at offset %d: %v", offset, err)
+		}
+
+		if val.expired(now) {
+			if err := addCount(db, queuedBytesKeyFmt, topic, -len(val.Raw)); err != nil {
+				return 0, err
+			}
+
+			if err := expireValue(db, topic, val); err != nil {
+				return 0, err
+			}
+
+			count++
+			continue
+		}
+
+		if offset != next {
+			b, err := val.Encode()
+			if err != nil {
+				return 0, fmt.Errorf("encoding value: %v", err)
+			}
+
+			key := []byte(fmt.Sprintf(level.valueFmt, escapeTopic(topic), next))
+			if err := db.Put(key, b, nil); err != nil {
+				return 0, fmt.Errorf("putting value: %v", err)
+			}
+
+			if val.ID != "" {
+				moved[val.ID] = next
+			}
+		}
+
+		next++
+	}
+
+	for offset := next; offset < level.tail; offset++ {
+		key := []byte(fmt.Sprintf(level.valueFmt, escapeTopic(topic), offset))
+		if err := db.Delete(key, nil); err != nil {
+			return 0, fmt.Errorf("deleting key %s: %v", key, err)
+		}
+	}
+
+	if next != level.tail {
+		if _, _, err := addPos(db, level.tailFmt, topic, next-level.tail); err != nil {
+			return 0, err
+		}
+	}
+
+	return count, nil
+}
+
+// removeExpiredDedup deletes the entries of the dedup index of a topic which
+// have expired at the given time, iterating over db and deleting from tx. The
+// remaining entries of messages in moved are updated with their new offsets. It
+// returns the number of entries deleted.
+func removeExpiredDedup(db, tx leveldber, topic string, now time.Time, moved map[string]int) (int, error) {
+	prefix := util.BytesPrefix([]byte(fmt.Sprintf(dedupPrefix, escapeTopic(topic))))
+	iter := db.NewIterator(prefix, nil)
+	defer iter.Release()
+
+	count := 0
+	for iter.Next() {
+		var entry dedupEntry
+		if err := json.Unmarshal(iter.Value(), &entry); err != nil {
+			return 0, fmt.Errorf("unmarshalling dedup entry %s: %v", iter.Key(), err)
+		}
+
+		if !entry.expired(now) {
+			offset, ok := moved[entry.ID]
+			if !ok {
+				continue
+			}
+
+			entry.Offset = offset
+			if err := putDedupEntry(tx, topic, string(iter.Key()[len(prefix.Start):]), &entry); err != nil {
+				return 0, err
+			}
+
+			continue
+		}
+
+		if err := tx.Delete(iter.Key(), nil); err != nil {
+			return 0, fmt.Errorf("deleting dedup key %s: %v", iter.Key(), err)
+		}
+
+		count++
+	}
+
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, fmt.Errorf("iterating over dedup index for topic %s: %v", topic, err)
+	}
+
+	return count, nil
+}
+
+// Recover returns every message awaiting acknowledgement on a topic to the
+// front of the main queue, in the order they were originally consumed. This
+// should only be called when no consumers are active, such as on startup,
+// as any outstanding acknowledgements will no longer be valid.
+func (s *store) Recover(topic string) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := fmt.Sprintf(ackTopicPrefix, escapeTopic(topic))
+	prefix := util.BytesPrefix([]byte(key))
+	iter := s.db.NewIterator(prefix, nil)
+	defer iter.Release()
+
+	// Keys are ordered bytewise rather than numerically, so collect the offsets
+	// to be sorted before being returned.
+	var offsets []int
+	for iter.Next() {
+		offset, err := strconv.Atoi(string(iter.Key()[len(prefix.Start):]))
+		if err != nil {
+			// Not a message, i.e. the ack tail position.
+			continue
+		}
+
+		offsets = append(offsets, offset)
+	}
+
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, fmt.Errorf("iterating over ack topic %s: %v", topic, err)
+	}
+
+	if len(offsets) == 0 {
+		return 0, nil
+	}
+
+	sort.Ints(offsets)
+
+	tx, err := s.db.OpenTransaction()
+	if err != nil {
+		return 0, fmt.Errorf("opening transaction: %v", err)
+	}
+
+	// Prepend in reverse so that the earliest consumed message ends up at the
+	// front of the queue.
+	for i := len(offsets) - 1; i >= 0; i-- {
+		val, err := getOffset(tx, ackTopicFmt, topic, offsets[i])
+		if err != nil {
+			tx.Discard()
+			return 0, fmt.Errorf("getting ack msg from topic %s at offset %d: %v", topic, offsets[i], err)
+		}
+
+		if _, err := returnValue(tx, topic, val); err != nil {
+			tx.Discard()
+			return 0, fmt.Errorf("prepending value to topic %s: %v", topic, err)
+		}
+
+		ackKey := []byte(fmt.Sprintf(ackTopicFmt, escapeTopic(topic), offsets[i]))
+		if err := tx.Delete(ackKey, nil); err != nil {
+			tx.Discard()
+			return 0, fmt.Errorf("deleting ackKey %s: %v", ackKey, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return 0, fmt.Errorf("committing recover transaction: %v", err)
+	}
+
+	return len(offsets), nil
+}
+
+// Redrive moves every message waiting on the dead letter topic of a topic to
+// the back of the topic's main queue, resetting their failure counts so that
+// they may once again be delivered up to the topic's max deliveries.
+func (s *store) Redrive(topic string) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	dlq := fmt.Sprintf(deadLetterTopicFmt, topic)
+
+	tx, err := s.db.OpenTransaction()
+	if err != nil {
+		return 0, fmt.Errorf("opening transaction: %v", err)
+	}
+
+	levels, err := queueLevels(tx, dlq)
+	if errors.Is(err, errTopicNotExist) {
+		tx.Discard()
+		return 0, nil
+	}
+	if err != nil {
+		tx.Discard()
+		return 0, err
+	}
+
+	count := 0
+
+	for _, level := range levels {
+		for offset := level.head; offset < level.tail; offset++ {
+			val, err := getOffset(tx, level.valueFmt, dlq, offset)
+			if err != nil {
+				tx.Discard()
+				return 0, fmt.Errorf("getting msg from topic %s at offset %d: %v", dlq, offset, err)
+			}
+
+			val.FailureCount = 0
+			val.LastFailure = ""
+
+			if _, err := insertValue(tx, topic, val); err != nil {
+				tx.Discard()
+				return 0, fmt.Errorf("inserting value into topic %s: %v", topic, err)
+			}
+
+			if err := addCount(tx, queuedBytesKeyFmt, dlq, -len(val.Raw)); err != nil {
+				tx.Discard()
+				return 0, err
+			}
+
+			key := []byte(fmt.Sprintf(level.valueFmt, escapeTopic(dlq), offset))
+			if err := tx.Delete(key, nil); err != nil {
+				tx.Discard()
+				return 0, fmt.Errorf("deleting key %s: %v", key, err)
+			}
+
+			count++
+		}
+
+		if _, _, err := addPos(tx, level.headFmt, dlq, level.length()); err != nil {
+			tx.Discard()
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return 0, fmt.Errorf("committing redrive transaction: %v", err)
+	}
+
+	return count, nil
+}
+
+// Config returns the configuration of a topic. Topics which have not been
+// configured return the default configuration.
+func (s *store) Config(topic string) (*topicConfig, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return getTopicConfig(s.db, topic)
+}
+
+// SetConfig sets the configuration of a topic. The topic does not need to
+// exist for it to be configured.
+func (s *store) SetConfig(topic string, cfg *topicConfig) error {
+	s.Lock()
+	defer s.Unlock()
+
+	key := []byte(fmt.Sprintf(metaConfigFmt, topic))
+
+	val, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("marshalling topic config: %v", err)
+	}
+
+	if err := s.db.Put(key, val, nil); err != nil {
+		return fmt.Errorf("putting topic config %s: %v", key, err)
+	}
+
+	return nil
+}
+
+func (s *store) Meta() (*metadata, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	topics, err := getTopicMeta(s.db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &metadata{
+		topics: topics,
+	}, nil
+}
+
+// Stats returns the statistics of a topic. The ack and delay queues are
+// iterated in full, so this is more expensive for topics with many outstanding
+// or delayed messages.
+func (s *store) Stats(topic string) (*topicStats, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	levels, err := queueLevels(s.db, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	inFlight, err := countMessages(s.db, fmt.Sprintf(ackTopicPrefix, escapeTopic(topic)))
+	if err != nil {
+		return nil, fmt.Errorf("counting ack topic %s: %v", topic, err)
+	}
+
+	delayed, err := countMessages(s.db, fmt.Sprintf(delayTopicPrefix, escapeTopic(topic)))
+	if err != nil {
+		return nil, fmt.Errorf("counting delay topic %s: %v", topic, err)
+	}
+
+	published, err := getCount(s.db, publishedCountKeyFmt, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	acked, err := getCount(s.db, ackedCountKeyFmt, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	queuedBytes, err := getCount(s.db, queuedBytesKeyFmt, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &topicStats{
+		InFlight:  inFlight,
+		Delayed:   delayed,
+		Bytes:     queuedBytes,
+		Published: published,
+		Acked:     acked,
+	}
+
+	// The oldest message may be waiting on any of the priority levels.
+	for _, level := range levels {
+		if level.length() == 0 {
+			continue
+		}
+
+		stats.Depth += level.length()
+
+		val, err := getValue(s.db, level.valueFmt, topic, level.head)
+		if err != nil {
+			return nil, fmt.Errorf("getting head of topic %s: %v", topic, err)
+		}
+
+		if stats.Oldest.IsZero() || (!val.PublishedAt.IsZero() && val.PublishedAt.Before(stats.Oldest)) {
+			stats.Oldest = val.PublishedAt
+		}
+	}
+
+	return stats, nil
+}
+
+// Browse returns up to limit values on the main queue of a topic in delivery
+// order, without consuming them. Offsets are within the priority level of each
+// value, so values are returned from the given offset of the highest level at
+// or below the given priority, or its head if later, followed by the values of
+// each lower level from its head. The next values in delivery order are browsed
+// from the priority and the offset following that of the last value.
+func (s *store) Browse(topic string, priority, from, limit int) ([]*browsedValue, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	levels, err := queueLevels(s.db, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		vals  []*browsedValue
+		first = true
+	)
+
+	for _, level := range levels {
+		if level.priority > priority {
+			continue
+		}
+
+		start := level.head
+		if first && from > start {
+			start = from
+		}
+
+		first = false
+
+		for offset := start; offset < level.tail && len(vals) < limit; offset++ {
+			val, err := getValue(s.db, level.valueFmt, topic, offset)
+			if err != nil {
+				return nil, fmt.Errorf("getting value at offset %d: %v", offset, err)
+			}
+
+			vals = append(vals, &browsedValue{value: val, Offset: offset})
+		}
+	}
+
+	return vals, nil
+}
+
+// BrowseAcks returns up to limit values awaiting acknowledgement on a topic
+// with offsets from the given offset, in offset order.
+func (s *store) BrowseAcks(topic string, from, limit int) ([]*browsedValue, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, err := getPos(s.db, headPosKeyFmt, topic); err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf(ackTopicPrefix, escapeTopic(topic))
+	prefix := util.BytesPrefix([]byte(key))
+	iter := s.db.NewIterator(prefix, nil)
+	defer iter.Release()
+
+	// Keys are ordered bytewise rather than numerically, so collect the offsets
+	// to be sorted before reading the values.
+	var offsets []int
+	for iter.Next() {
+		offset, err := strconv.Atoi(string(iter.Key()[len(prefix.Start):]))
+		if err != nil {
+			// Not a message, i.e. the ack tail position.
+			continue
+		}
+
+		if offset >= from {
+			offsets = append(offsets, offset)
+		}
+	}
+
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("iterating over ack topic %s: %v", topic, err)
+	}
+
+	sort.Ints(offsets)
+	if len(offsets) > limit {
+		offsets = offsets[:limit]
+	}
+
+	vals := make([]*browsedValue, 0, len(offsets))
+	for _, offset := range offsets {
+		val, err := getOffset(s.db, ackTopicFmt, topic, offset)
+		if err != nil {
+			return nil, fmt.Errorf("getting ack msg at offset %d: %v", offset, err)
+		}
+
+		vals = append(vals, &browsedValue{value: val, Offset: offset})
+	}
+
+	return vals, nil
+}
+
+// Purge deletes all data associated with a topic, removing it from the topics
+// metadata. The configuration of the topic is kept.
+func (s *store) Purge(topic string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	prefix := util.BytesPrefix([]byte(fmt.Sprintf(topicPrefix, escapeTopic(topic))))
+	iter := s.db.NewIterator(prefix, nil)
+
+	var keys [][]byte
+	for iter.Next() {
+		// The key is only valid until the next iteration.
+		keys = append(keys, append([]byte{}, iter.Key()...))
+	}
+
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("iterating over purge prefix: %v", err)
+	}
+
+	tx, err := s.db.OpenBatch()
+	if err != nil {
+		return fmt.Errorf("opening batch: %v", err)
+	}
+
+	for _, key := range keys {
+		if err := tx.Delete(key, nil); err != nil {
+			tx.Discard()
+			return fmt.Errorf("deleting key %s: %v", key, err)
+		}
+	}
+
+	if err := removeTopicMeta(tx, topic); err != nil {
+		tx.Discard()
+		return fmt.Errorf("removing topic from meta: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Discard()
+		return fmt.Errorf("committing purge batch: %v", err)
+	}
+
+	// TODO measure performance impact of immediate compaction
+	// if err := s.db.CompactRange(*prefix); err != nil {
+	// return fmt.Errorf("compacting purged range: %v", err)
+	// }
+
+	return nil
+}
+
+// Close the store.
+func (s *store) Close() error {
+	return s.db.Close()
+}
+
+// Destroy the underlying store.
+func (s *store) Destroy() {
+	_ = s.Close()
+
+	// An in-memory store has nothing persisted to remove.
+	if s.path != "" {
+		_ = os.RemoveAll(s.path)
+	}
+}
+
+// leveldber describes methods available on both a leveldb.DB and a
+// leveldb.Transaction, which every database backend must provide. Missing keys
+// are reported with leveldb.ErrNotFound regardless of the backend.
+type leveldber interface {
+	Has(key []byte, ro *opt.ReadOptions) (ret bool, err error)
+	Put(key, value []byte, wo *opt.WriteOptions) error
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+	Delete(key []byte, wo *opt.WriteOptions) error
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
+}
+
+// database is a key value store backing a store.
+type database interface {
+	leveldber
+
+	// OpenTransaction opens an atomic transaction over the database. Only one
+	// transaction may be open at a time.
+	OpenTransaction() (transaction, error)
+
+	// OpenBatch opens a batch of writes over the database, written atomically
+	// when committed. A batch is cheaper than a transaction for the few writes
+	// of a single operation, but isolates its reads only while the store's
+	// lock is held.
+	OpenBatch() (transaction, error)
+
+	// Close closes the database.
+	Close() error
+}
+
+// transaction is an atomic transaction over a database, which must be either
+// committed or discarded.
+type transaction interface {
+	leveldber
+	Commit() error
+	Discard()
+}
+
+// levelDB is a database backed by LevelDB.
+type levelDB struct {
+	*leveldb.DB
+}
+
+func (db levelDB) OpenTransaction() (transaction, error) {
+	tx, err := db.DB.OpenTransaction()
+	if err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// insertValue appends a value to the end of its priority level of a topic,
+// creating the topic if it doesn't already exist. It returns the offset of the
+// inserted value within the level.
+func insertValue(db leveldber, topic string, val *value) (offset int, err error) {
+	if err := createTopic(db, topic); err != nil {
+		return 0, err
+	}
+
+	keys := levelKeys(val.Priority)
+	if err := createLevel(db, topic, levelPriority(val.Priority)); err != nil {
+		return 0, err
+	}
+
+	offset, err = appendValue(db, keys.valueFmt, keys.tailFmt, topic, val)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := addCount(db, queuedBytesKeyFmt, topic, len(val.Raw)); err != nil {
+		return 0, err
+	}
+
+	return offset, nil
+}
+
+// returnValue prepends a value to the head of its priority level of a topic,
+// returning the offset of the returned value within the level.
+func returnValue(db leveldber, topic string, val *value) (offset int, err error) {
+	keys := levelKeys(val.Priority)
+	if err := createLevel(db, topic, levelPriority(val.Priority)); err != nil {
+		return 0, err
+	}
+
+	offset, err = prependValue(db, keys.valueFmt, keys.headFmt, topic, val)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := addCount(db, queuedBytesKeyFmt, topic, len(val.Raw)); err != nil {
+		return 0, err
+	}
+
+	return offset, nil
+}
+
+// removeHead deletes the value at the head of a priority level of a topic,
+// returning it.
+func removeHead(db leveldber, topic string, keys queueKeys) (*value, error) {
+	head, err := getPos(db, keys.headFmt, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	val, err := getValue(db, keys.valueFmt, topic, head)
+	if err != nil {
+		return nil, err
+	}
+
+	key := []byte(fmt.Sprintf(keys.valueFmt, escapeTopic(topic), head))
+	if err := db.Delete(key, nil); err != nil {
+		return nil, fmt.Errorf("deleting key %s: %v", key, err)
+	}
+
+	if _, _, err := addPos(db, keys.headFmt, topic, 1); err != nil {
+		return nil, err
+	}
+
+	if err := addCount(db, queuedBytesKeyFmt, topic, -len(val.Raw)); err != nil {
+		return nil, err
+	}
+
+	return val, nil
+}
+
+// makeRoom ensures values fit within the limits of a topic once inserted,
+// dropping values from the head of the lowest non-empty priority level of the
+// topic if its overflow policy allows. Otherwise, errTopicFull is returned if
+// they don't fit.
+func makeRoom(db leveldber, topic string, vals ...*value) error {
+	cfg, err := getTopicConfig(db, topic)
+	if err != nil {
+		return err
+	}
+
+	if cfg.MaxLength <= 0 && cfg.MaxBytes <= 0 {
+		return nil
+	}
+
+	size := 0
+	for _, val := range vals {
+		size += len(val.Raw)
+	}
+
+	// Values which exceed the limits by themselves never fit.
+	if cfg.exceeds(len(vals), size) {
+		return errTopicFull
+	}
+
+	length, err := queueLength(db, topic)
+	if err != nil {
+		return err
+	}
+
+	queuedBytes, err := getCount(db, queuedBytesKeyFmt, topic)
+	if err != nil {
+		return err
+	}
+
+	for cfg.exceeds(length+len(vals), queuedBytes+size) {
+		if cfg.OverflowPolicy != overflowDropOldest {
+			return errTopicFull
+		}
+
+		levels, err := queueLevels(db, topic)
+		if err != nil {
+			return err
+		}
+
+		// Levels are ordered from the highest priority, so drop from the last
+		// level with values waiting.
+		var level queueLevel
+		for _, l := range levels {
+			if l.length() > 0 {
+				level = l
+			}
+		}
+
+		val, err := removeHead(db, topic, level.queueKeys)
+		if err != nil {
+			return fmt.Errorf("dropping head of topic %s: %v", topic, err)
+		}
+
+		length--
+		queuedBytes -= len(val.Raw)
+	}
+
+	return nil
+}
+
+// queueLength returns the number of values waiting on every priority level of
+// a topic, zero if the topic doesn't exist.
+func queueLength(db leveldber, topic string) (int, error) {
+	levels, err := queueLevels(db, topic)
+	if errors.Is(err, errTopicNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	length := 0
+	for _, level := range levels {
+		length += level.length()
+	}
+
+	return length, nil
+}
+
+// queueLevel is the position of one of the priority levels of a topic.
+type queueLevel struct {
+	queueKeys
+
+	priority int
+	head     int
+	tail     int
+}
+
+// length returns the number of values waiting on the level.
+func (l queueLevel) length() int {
+	return l.tail - l.head
+}
+
+// queueLevels returns the positions of the priority levels of a topic which
+// have been created, ordered from the highest priority.
+func queueLevels(db leveldber, topic string) ([]queueLevel, error) {
+	created, err := getCount(db, levelsKeyFmt, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	var levels []queueLevel
+	for priority := maxPriority; priority >= 0; priority-- {
+		// Priority zero is created along with the topic.
+		if priority > 0 && created&(1<<priority) == 0 {
+			continue
+		}
+
+		keys := priorityKeys[priority]
+
+		head, err := getPos(db, keys.headFmt, topic)
+		if err != nil {
+			return nil, err
+		}
+
+		tail, err := getPos(db, keys.tailFmt, topic)
+		if err != nil {
+			return nil, err
+		}
+
+		levels = append(levels, queueLevel{
+			queueKeys: keys,
+			priority:  priority,
+			head:      head,
+			tail:      tail,
+		})
 	}
 
-	val.DackCount++
+	return levels, nil
+}
 
-	if err := insertDelay(tx, topic, val, delaySeconds); err != nil {
-		tx.Discard()
-		return fmt.Errorf("inserting ack msg into delay topic from topic %s at offset %d: %v", topic, ackOffset, err)
+// firstLevel returns the index of the highest priority level with values
+// waiting, reporting false if every level is empty.
+func firstLevel(levels []queueLevel) (int, bool) {
+	for i, level := range levels {
+		if level.length() > 0 {
+			return i, true
+		}
 	}
 
-	if err := tx.Delete(dackKey, nil); err != nil {
-		tx.Discard()
-		return fmt.Errorf("deleting ackKey %s: %v", dackKey, err)
+	return 0, false
+}
+
+// createLevel writes the initial positions of a priority level of a topic, if
+// it doesn't already exist, recording it as created. The positions of priority
+// zero are written by createTopic.
+func createLevel(db leveldber, topic string, priority int) error {
+	if priority == 0 {
+		return nil
 	}
 
-	if err := tx.Commit(); err != nil {
-		tx.Discard()
-		return fmt.Errorf("committing dack transaction: %v", err)
+	created, err := getCount(db, levelsKeyFmt, topic)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
+	if created&(1<<priority) != 0 {
+		return nil
+	}
 
-// Requires version of mockgen with https://github.com/golang/mock/pull/405 due
-// to exposing a bug in previous versions. Unfortunately for now-
-// $ go get github.com/golang/mock/mockgen@HEAD
-// until a new release made.
-type delayedIterator interface {
-	iterator.Iterator
-}
+	keys := priorityKeys[priority]
 
-// GetDelayed returns an iterator and a closer function allowing the caller to
-// iterate over the currently waiting messages for a given topic in
-// chronological delay order (those with soonest "done" time first).
-func (s *store) GetDelayed(topic string) (iterator delayedIterator, closer func() error) {
-	s.Lock()
-	defer s.Unlock()
+	pos := make([]byte, 8)
+	binary.PutVarint(pos, 0)
 
-	key := fmt.Sprintf(delayTopicPrefix, topic)
-	prefix := util.BytesPrefix([]byte(key))
-	iter := s.db.NewIterator(prefix, nil)
+	headPosKey := []byte(fmt.Sprintf(keys.headFmt, escapeTopic(topic)))
+	if err := db.Put(headPosKey, pos, nil); err != nil {
+		return fmt.Errorf("putting head position value: %v", err)
+	}
 
-	closer = func() error {
-		iter.Release()
-		return iter.Error()
+	tailPosKey := []byte(fmt.Sprintf(keys.tailFmt, escapeTopic(topic)))
+	if err := db.Put(tailPosKey, pos, nil); err != nil {
+		return fmt.Errorf("putting tail position value: %v", err)
 	}
 
-	return iter, closer
+	return addCount(db, levelsKeyFmt, topic, 1<<priority)
 }
 
-// ReturnDelayed returns delayed messages with done times before the given time
-// back to the main queue.
-func (s *store) ReturnDelayed(topic string, before time.Time) (int, error) {
-	s.Lock()
-	defer s.Unlock()
-
-	key := fmt.Sprintf(delayTopicPrefix, topic)
-	prefix := util.BytesPrefix([]byte(key))
-	iter := s.db.NewIterator(prefix, nil)
-	defer iter.Release() // In case we return early, it is safe to call multiple times.
+// createTopic writes the initial positions of a topic and adds it to the list
+// of topics, if it doesn't already exist.
+func createTopic(db leveldber, topic string) error {
+	headPosKey := []byte(fmt.Sprintf(headPosKeyFmt, escapeTopic(topic)))
+	tailPosKey := []byte(fmt.Sprintf(tailPosKeyFmt, escapeTopic(topic)))
+	ackTailPosKey := []byte(fmt.Sprintf(ackTailPosKeyFmt, escapeTopic(topic)))
 
-	tx, err := s.db.OpenTransaction()
+	exists, err := db.Has(tailPosKey, nil)
 	if err != nil {
-		return 0, fmt.Errorf("opening transaction: %v", err)
+		return fmt.Errorf("checking has %s: %v", tailPosKey, err)
 	}
 
-	count := 0
-
-	// For each record, check if the timestamp is earlier than the given cutoff,
-	// returning the record to the front of the main queue if it is.
-	//
-	// TODO fix returned messages being in reverse chronological order if there
-	// are multiple being done at once
-	for iter.Next() {
-		key := iter.Key()
-		delayTime, err := timeFromDelayKey(string(key))
-		if err != nil {
-			tx.Discard()
-			return 0, err
-		}
+	// The key already exists
+	if exists {
+		return nil
+	}
 
-		// The message has passed the delay point so should be returned to the front
-		// of the main queue to be processed again.
-		if delayTime.Before(before) {
-			count++
-			val := iter.Value()
+	// Add the topic to the list of topics
+	if err := addTopicMeta(db, topic); err != nil {
+		return fmt.Errorf("adding topic to meta: %v", err)
+	}
 
-			v, err := decodeValue(val)
-			if err != nil {
-				return 0, err
-			}
+	// Write initial head position
+	headPos := make([]byte, 8)
+	binary.PutVarint(headPos, 0)
 
-			if _, err := prependValue(tx, topicFmt, headPosKeyFmt, topic, v); err != nil {
-				tx.Discard()
-				return 0, err
-			}
-			if err := tx.Delete(key, nil); err != nil {
-				tx.Discard()
-				return 0, err
-			}
-		} else {
-			// We've already reached a timestamp that is in the future, no need to
-			// continue.
-			break
-		}
+	if err := db.Put(headPosKey, headPos, nil); err != nil {
+		return fmt.Errorf("putting head position value: %v", err)
 	}
 
-	iter.Release()
-	if err := iter.Error(); err != nil {
-		tx.Discard()
-		return 0, fmt.Errorf("iterating over delayed messages for topic %s: %v", topic, err)
+	// Write initial ack topic head position
+	ackTailPos := make([]byte, 8)
+	binary.PutVarint(ackTailPos, 0)
+
+	if err := db.Put(ackTailPosKey, ackTailPos, nil); err != nil {
+		return fmt.Errorf("putting ack head position value: %v", err)
 	}
 
-	if err := tx.Commit(); err != nil {
-		tx.Discard()
-		return 0, fmt.Errorf("committing nack transaction: %v", err)
+	// Write initial tail position
+	tailPos := make([]byte, 8)
+	binary.PutVarint(tailPos, 0)
+
+	if err := db.Put(tailPosKey, tailPos, nil); err != nil {
+		return fmt.Errorf("putting tail position value: %v", err)
 	}
 
-	return count, nil
+	return nil
 }
 
-func (s *store) Meta() (*metadata, error) {
-	s.Lock()
-	defer s.Unlock()
+// failValue records a failed delivery of a value, moving it to the end of the
+// dead letter topic if it has reached the max deliveries of its topic. It
+// reports whether the value was moved, in which case it should not be returned
+// to the topic.
+func failValue(db leveldber, topic string, val *value, reason string) (bool, error) {
+	val.FailureCount++
+	val.LastFailure = reason
 
-	topics, err := getTopicMeta(s.db)
+	cfg, err := getTopicConfig(db, topic)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	return &metadata{
-		topics: topics,
-	}, nil
-}
+	if cfg.MaxDeliveries <= 0 || val.FailureCount < cfg.MaxDeliveries {
+		return false, nil
+	}
 
-// Purge deletes all data associated with a topic.
-func (s *store) Purge(topic string) error {
-	s.Lock()
-	defer s.Unlock()
+	// Dead lettered values are kept regardless of their time to live.
+	val.ExpiresAt = time.Time{}
 
-	batch := new(leveldb.Batch)
+	dlq := fmt.Sprintf(deadLetterTopicFmt, topic)
+	if _, err := insertValue(db, dlq, val); err != nil {
+		return false, fmt.Errorf("inserting value into dead letter topic %s: %v", dlq, err)
+	}
 
-	prefix := util.BytesPrefix([]byte(fmt.Sprintf("t-%s", topic)))
-	iter := s.db.NewIterator(prefix, nil)
+	return true, nil
+}
 
-	for iter.Next() {
-		key := iter.Key()
-		batch.Delete(key)
+// applyDefaultTTL sets values published without a time to live to expire after
+// the default of their topic, if it has one.
+func applyDefaultTTL(db leveldber, topic string, vals ...*value) error {
+	cfg, err := getTopicConfig(db, topic)
+	if err != nil {
+		return err
 	}
 
-	iter.Release()
-	if err := iter.Error(); err != nil {
-		return fmt.Errorf("iterating over purge prefix: %v", err)
+	if cfg.TTLMs <= 0 {
+		return nil
 	}
 
-	if err := s.db.Write(batch, nil); err != nil {
-		return fmt.Errorf("writing purge batch: %v", err)
+	for _, val := range vals {
+		if val.ExpiresAt.IsZero() {
+			val.setTTL(cfg.ttl())
+		}
 	}
 
-	// TODO measure performance impact of immediate compaction
-	// if err := s.db.CompactRange(*prefix); err != nil {
-	// return fmt.Errorf("compacting purged range: %v", err)
-	// }
-
 	return nil
 }
 
-// Close the store.
-func (s *store) Close() error {
-	return s.db.Close()
-}
+// expireValue moves a value which has expired, and already been removed from
+// its queue, to the end of the expired topic of its topic. The value is
+// discarded if the topic has no expired topic.
+func expireValue(db leveldber, topic string, val *value) error {
+	cfg, err := getTopicConfig(db, topic)
+	if err != nil {
+		return err
+	}
 
-// Destroy the underlying store.
-func (s *store) Destroy() {
-	_ = s.Close()
-	_ = os.RemoveAll(s.path)
-}
+	if cfg.ExpiredTopic == "" {
+		return nil
+	}
 
-// leveldber describes methods available on both a leveldb.DB and a
-// leveldb.Transaction.
-type leveldber interface {
-	Has(key []byte, ro *opt.ReadOptions) (ret bool, err error)
-	Put(key, value []byte, wo *opt.WriteOptions) error
-	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+	// Expired values are kept on the expired topic regardless of their time to
+	// live.
+	val.ExpiresAt = time.Time{}
+
+	if _, err := insertValue(db, cfg.ExpiredTopic, val); err != nil {
+		return fmt.Errorf("inserting value into expired topic %s: %v", cfg.ExpiredTopic, err)
+	}
+
+	return nil
 }
 
-func insertDelay(db leveldber, topic string, val *value, delaySeconds int) error {
-	delayTo := time.Now().Unix() + int64(delaySeconds)
+func insertDelay(db leveldber, topic string, val *value, dueAt time.Time) error {
+	// Times before the epoch are already due, but can't be represented in the
+	// key.
+	delayTo := dueAt.UnixMilli()
+	if delayTo < 0 {
+		delayTo = 0
+	}
 
 	var (
 		key string
@@ -562,7 +2469,7 @@ func insertDelay(db leveldber, topic string, val *value, delaySeconds int) error
 	)
 
 	for {
-		key = fmt.Sprintf(delayTopicFmt, topic, delayTo, localOffset)
+		key = fmt.Sprintf(delayTopicFmt, escapeTopic(topic), delayTo, localOffset)
 		exists, err := db.Has([]byte(key), nil)
 		if err != nil {
 			return fmt.Errorf("checking has %s: %v", key, err)
@@ -586,9 +2493,41 @@ func insertDelay(db leveldber, topic string, val *value, delaySeconds int) error
 	return nil
 }
 
+// findDelayed returns the key and value of the message with the given ID on the
+// delay queue of a topic. Messages published before IDs were assigned can't be
+// found.
+func findDelayed(db leveldber, topic, id string) ([]byte, *value, error) {
+	if id == "" {
+		return nil, nil, errDelayedMsgNotExist
+	}
+
+	prefix := util.BytesPrefix([]byte(fmt.Sprintf(delayTopicPrefix, escapeTopic(topic))))
+	iter := db.NewIterator(prefix, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		val, err := decodeValue(iter.Value())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if val.ID == id {
+			// The key is only valid until the next iteration.
+			return append([]byte{}, iter.Key()...), val, nil
+		}
+	}
+
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, nil, fmt.Errorf("iterating over delayed messages for topic %s: %v", topic, err)
+	}
+
+	return nil, nil, errDelayedMsgNotExist
+}
+
 // getOffset retrieves a record for a topic with a specific offset.
 func getOffset(db leveldber, topicFmt string, topic string, offset int) (*value, error) {
-	key := fmt.Sprintf(topicFmt, topic, offset)
+	key := fmt.Sprintf(topicFmt, escapeTopic(topic), offset)
 
 	val, err := db.Get([]byte(key), nil)
 	if err != nil {
@@ -605,7 +2544,7 @@ func getOffset(db leveldber, topicFmt string, topic string, offset int) (*value,
 
 // getPos gets the integer position value (aka offset) for topic and key format.
 func getPos(db leveldber, topicFmt string, topic string) (int, error) {
-	key := []byte(fmt.Sprintf(topicFmt, topic))
+	key := []byte(fmt.Sprintf(topicFmt, escapeTopic(topic)))
 
 	pos, err := db.Get(key, nil)
 	if errors.Is(err, leveldb.ErrNotFound) {
@@ -625,7 +2564,7 @@ func getPos(db leveldber, topicFmt string, topic string) (int, error) {
 
 // getValue returns the raw value stored given a key format, topic and offset.
 func getValue(db leveldber, topicFmt string, topic string, offset int) (*value, error) {
-	key := fmt.Sprintf(topicFmt, topic, offset)
+	key := fmt.Sprintf(topicFmt, escapeTopic(topic), offset)
 
 	val, err := db.Get([]byte(key), nil)
 	if errors.Is(err, leveldb.ErrNotFound) {
@@ -646,7 +2585,7 @@ func getValue(db leveldber, topicFmt string, topic string, offset int) (*value,
 // appendValue returns inserts a new value to the end of a topic given,
 // returning the inserted offset.
 func appendValue(db leveldber, topicFmt, tailPosKeyFmt, topic string, val *value) (offset int, err error) {
-	tailPosKey := []byte(fmt.Sprintf(tailPosKeyFmt, topic))
+	tailPosKey := []byte(fmt.Sprintf(tailPosKeyFmt, escapeTopic(topic)))
 
 	// Fetch the current tail position
 	tailPosVal, err := db.Get(tailPosKey, nil)
@@ -660,7 +2599,7 @@ func appendValue(db leveldber, topicFmt, tailPosKeyFmt, topic string, val *value
 	}
 
 	// Write new record to next tail position
-	newKey := []byte(fmt.Sprintf(topicFmt, topic, origOffset))
+	newKey := []byte(fmt.Sprintf(topicFmt, escapeTopic(topic), origOffset))
 
 	b, err := val.Encode()
 	if err != nil {
@@ -684,7 +2623,7 @@ func appendValue(db leveldber, topicFmt, tailPosKeyFmt, topic string, val *value
 // prependValue inserts a value to the head of a topic, decrementing the head
 // position and returning the offset of the prepended value.
 func prependValue(tx leveldber, topicFmt, headPosKeyFmt, topic string, val *value) (offset int, err error) {
-	headPosKey := []byte(fmt.Sprintf(headPosKeyFmt, topic))
+	headPosKey := []byte(fmt.Sprintf(headPosKeyFmt, escapeTopic(topic)))
 
 	// Fetch the current head position
 	headPosVal, err := tx.Get(headPosKey, nil)
@@ -699,7 +2638,7 @@ func prependValue(tx leveldber, topicFmt, headPosKeyFmt, topic string, val *valu
 
 	// Write new record to lower neighbouring position
 	newHeadOffset := headOffset - 1
-	newKey := []byte(fmt.Sprintf(topicFmt, topic, newHeadOffset))
+	newKey := []byte(fmt.Sprintf(topicFmt, escapeTopic(topic), newHeadOffset))
 
 	b, err := val.Encode()
 	if err != nil {
@@ -730,7 +2669,7 @@ func addPos(db leveldber, posKeyFmt string, topic string, sum int) (oldPosition,
 	newPosBytes := make([]byte, 8)
 	binary.PutVarint(newPosBytes, int64(newPos))
 
-	key := []byte(fmt.Sprintf(posKeyFmt, topic))
+	key := []byte(fmt.Sprintf(posKeyFmt, escapeTopic(topic)))
 
 	if err := db.Put(key, newPosBytes, nil); err != nil {
 		return 0, 0, fmt.Errorf("putting new increment position: %v", err)
@@ -739,22 +2678,137 @@ func addPos(db leveldber, posKeyFmt string, topic string, sum int) (oldPosition,
 	return oldPos, newPos, nil
 }
 
+// getCount returns the count stored in a key for a topic, zero if it has yet
+// to be counted.
+func getCount(db leveldber, countKeyFmt string, topic string) (int, error) {
+	key := []byte(fmt.Sprintf(countKeyFmt, escapeTopic(topic)))
+
+	val, err := db.Get(key, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("getting count %s: %v", key, err)
+	}
+
+	count, err := binary.ReadVarint(bytes.NewReader(val))
+	if err != nil {
+		return 0, fmt.Errorf("reading count varint: %v", err)
+	}
+
+	return int(count), nil
+}
+
+// addCount adds an integer to the count stored in a key for a topic.
+func addCount(db leveldber, countKeyFmt string, topic string, sum int) error {
+	count, err := getCount(db, countKeyFmt, topic)
+	if err != nil {
+		return err
+	}
+
+	key := []byte(fmt.Sprintf(countKeyFmt, escapeTopic(topic)))
+
+	if err := db.Put(key, binary.AppendVarint(nil, int64(count+sum)), nil); err != nil {
+		return fmt.Errorf("putting count %s: %v", key, err)
+	}
+
+	return nil
+}
+
+// countMessages returns the number of messages stored under a key prefix,
+// ignoring the tail position of the queue.
+func countMessages(db leveldber, prefix string) (int, error) {
+	iter := db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+
+	count := 0
+	for iter.Next() {
+		if string(iter.Key()[len(prefix):]) != "tail" {
+			count++
+		}
+	}
+
+	iter.Release()
+
+	return count, iter.Error()
+}
+
+// delayKey matches the keys of the delay queue, as laid out by delayTopicFmt,
+// capturing their timestamp. Topics are escaped, so contain no hyphens.
+var delayKey = regexp.MustCompile(`^t-[^-]*-delay-(\d+)-\d+$`)
+
 // timeFromDelayKey returns the "done" timestamp from the key of a message in a
 // delay queue.
 func timeFromDelayKey(key string) (time.Time, error) {
-	splitKey := strings.Split(key, "-")
-	if len(splitKey) < 3 {
+	match := delayKey.FindStringSubmatch(key)
+	if match == nil {
 		return time.Time{}, fmt.Errorf("invalid delay key format: %s", key)
 	}
 
-	timestampInt, err := strconv.Atoi(splitKey[3])
+	timestamp, err := strconv.ParseInt(match[1], 10, 64)
 	if err != nil {
 		return time.Time{}, fmt.Errorf("converting timestamp to int: %v", err)
 	}
 
-	timestampTime := time.Unix(int64(timestampInt), 0)
+	return time.UnixMilli(timestamp), nil
+}
+
+func getTopicConfig(db leveldber, topic string) (*topicConfig, error) {
+	var cfg topicConfig
+
+	key := []byte(fmt.Sprintf(metaConfigFmt, topic))
+
+	val, err := db.Get(key, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return &cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting topic config %s: %v", key, err)
+	}
+
+	if err := json.Unmarshal(val, &cfg); err != nil {
+		return nil, fmt.Errorf("unmarshalling topic config: %v", err)
+	}
+
+	return &cfg, nil
+}
+
+// getDedupEntry returns the entry of the dedup index of a topic for an
+// idempotency key, nil if the key isn't recorded.
+func getDedupEntry(db leveldber, topic, key string) (*dedupEntry, error) {
+	dedupKey := []byte(fmt.Sprintf(dedupKeyFmt, escapeTopic(topic), key))
+
+	b, err := db.Get(dedupKey, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting dedup entry %s: %v", dedupKey, err)
+	}
+
+	var entry dedupEntry
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return nil, fmt.Errorf("unmarshalling dedup entry %s: %v", dedupKey, err)
+	}
+
+	return &entry, nil
+}
+
+// putDedupEntry records the entry in the dedup index of a topic for an
+// idempotency key.
+func putDedupEntry(db leveldber, topic, key string, entry *dedupEntry) error {
+	dedupKey := []byte(fmt.Sprintf(dedupKeyFmt, escapeTopic(topic), key))
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("marshalling dedup entry: %v", err)
+	}
+
+	if err := db.Put(dedupKey, b, nil); err != nil {
+		return fmt.Errorf("putting dedup entry %s: %v", dedupKey, err)
+	}
 
-	return timestampTime, nil
+	return nil
 }
 
 func getTopicMeta(db leveldber) ([]string, error) {
@@ -814,3 +2868,29 @@ func addTopicMeta(db leveldber, topic string) error {
 
 	return nil
 }
+
+func removeTopicMeta(db leveldber, topic string) error {
+	topics, err := getTopicMeta(db)
+	if err != nil {
+		return err
+	}
+
+	remaining := make([]string, 0, len(topics))
+	for _, t := range topics {
+		if t != topic {
+			remaining = append(remaining, t)
+		}
+	}
+
+	val, err := json.Marshal(remaining)
+	if err != nil {
+		return fmt.Errorf("marshalling topics meta: %v", err)
+	}
+
+	key := []byte(metaTopics)
+	if err := db.Put(key, val, nil); err != nil {
+		return fmt.Errorf("putting topics meta %s: %v", key, err)
+	}
+
+	return nil
+}
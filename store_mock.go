@@ -9,6 +9,7 @@ import (
 	time "time"
 
 	gomock "github.com/golang/mock/gomock"
+	iterator "github.com/syndtr/goleveldb/leveldb/iterator"
 	opt "github.com/syndtr/goleveldb/leveldb/opt"
 	util "github.com/syndtr/goleveldb/leveldb/util"
 )
@@ -50,6 +51,20 @@ func (mr *MockstorerMockRecorder) Ack(topic, ackOffset interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ack", reflect.TypeOf((*Mockstorer)(nil).Ack), topic, ackOffset)
 }
 
+// AckBatch mocks base method.
+func (m *Mockstorer) AckBatch(topic string, ackOffsets []int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AckBatch", topic, ackOffsets)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AckBatch indicates an expected call of AckBatch.
+func (mr *MockstorerMockRecorder) AckBatch(topic, ackOffsets interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AckBatch", reflect.TypeOf((*Mockstorer)(nil).AckBatch), topic, ackOffsets)
+}
+
 // Back mocks base method.
 func (m *Mockstorer) Back(topic string, ackOffset int) error {
 	m.ctrl.T.Helper()
@@ -64,6 +79,50 @@ func (mr *MockstorerMockRecorder) Back(topic, ackOffset interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Back", reflect.TypeOf((*Mockstorer)(nil).Back), topic, ackOffset)
 }
 
+// BackBatch mocks base method.
+func (m *Mockstorer) BackBatch(topic string, ackOffsets []int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "BackBatch", topic, ackOffsets)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// BackBatch indicates an expected call of BackBatch.
+func (mr *MockstorerMockRecorder) BackBatch(topic, ackOffsets interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BackBatch", reflect.TypeOf((*Mockstorer)(nil).BackBatch), topic, ackOffsets)
+}
+
+// Browse mocks base method.
+func (m *Mockstorer) Browse(topic string, priority, from, limit int) ([]*browsedValue, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Browse", topic, priority, from, limit)
+	ret0, _ := ret[0].([]*browsedValue)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Browse indicates an expected call of Browse.
+func (mr *MockstorerMockRecorder) Browse(topic, priority, from, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Browse", reflect.TypeOf((*Mockstorer)(nil).Browse), topic, priority, from, limit)
+}
+
+// BrowseAcks mocks base method.
+func (m *Mockstorer) BrowseAcks(topic string, from, limit int) ([]*browsedValue, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "BrowseAcks", topic, from, limit)
+	ret0, _ := ret[0].([]*browsedValue)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// BrowseAcks indicates an expected call of BrowseAcks.
+func (mr *MockstorerMockRecorder) BrowseAcks(topic, from, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BrowseAcks", reflect.TypeOf((*Mockstorer)(nil).BrowseAcks), topic, from, limit)
+}
+
 // Close mocks base method.
 func (m *Mockstorer) Close() error {
 	m.ctrl.T.Helper()
@@ -78,18 +137,47 @@ func (mr *MockstorerMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*Mockstorer)(nil).Close))
 }
 
+// Config mocks base method.
+func (m *Mockstorer) Config(topic string) (*topicConfig, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Config", topic)
+	ret0, _ := ret[0].(*topicConfig)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Config indicates an expected call of Config.
+func (mr *MockstorerMockRecorder) Config(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Config", reflect.TypeOf((*Mockstorer)(nil).Config), topic)
+}
+
 // Dack mocks base method.
-func (m *Mockstorer) Dack(topic string, ackOffset, delaySeconds int) error {
+func (m *Mockstorer) Dack(topic string, ackOffset int, delay time.Duration) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Dack", topic, ackOffset, delaySeconds)
+	ret := m.ctrl.Call(m, "Dack", topic, ackOffset, delay)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Dack indicates an expected call of Dack.
-func (mr *MockstorerMockRecorder) Dack(topic, ackOffset, delaySeconds interface{}) *gomock.Call {
+func (mr *MockstorerMockRecorder) Dack(topic, ackOffset, delay interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Dack", reflect.TypeOf((*Mockstorer)(nil).Dack), topic, ackOffset, delaySeconds)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Dack", reflect.TypeOf((*Mockstorer)(nil).Dack), topic, ackOffset, delay)
+}
+
+// DeleteDelayed mocks base method.
+func (m *Mockstorer) DeleteDelayed(topic, id string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteDelayed", topic, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteDelayed indicates an expected call of DeleteDelayed.
+func (mr *MockstorerMockRecorder) DeleteDelayed(topic, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteDelayed", reflect.TypeOf((*Mockstorer)(nil).DeleteDelayed), topic, id)
 }
 
 // Destroy mocks base method.
@@ -104,6 +192,20 @@ func (mr *MockstorerMockRecorder) Destroy() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Destroy", reflect.TypeOf((*Mockstorer)(nil).Destroy))
 }
 
+// Expire mocks base method.
+func (m *Mockstorer) Expire(topic string, ackOffset int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Expire", topic, ackOffset)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Expire indicates an expected call of Expire.
+func (mr *MockstorerMockRecorder) Expire(topic, ackOffset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Expire", reflect.TypeOf((*Mockstorer)(nil).Expire), topic, ackOffset)
+}
+
 // GetDelayed mocks base method.
 func (m *Mockstorer) GetDelayed(topic string) (delayedIterator, func() error) {
 	m.ctrl.T.Helper()
@@ -135,6 +237,22 @@ func (mr *MockstorerMockRecorder) GetNext(topic interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNext", reflect.TypeOf((*Mockstorer)(nil).GetNext), topic)
 }
 
+// GetNextBatch mocks base method.
+func (m *Mockstorer) GetNextBatch(topic string, n int) ([]*value, []int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetNextBatch", topic, n)
+	ret0, _ := ret[0].([]*value)
+	ret1, _ := ret[1].([]int)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetNextBatch indicates an expected call of GetNextBatch.
+func (mr *MockstorerMockRecorder) GetNextBatch(topic, n interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNextBatch", reflect.TypeOf((*Mockstorer)(nil).GetNextBatch), topic, n)
+}
+
 // Insert mocks base method.
 func (m *Mockstorer) Insert(topic string, val *value) error {
 	m.ctrl.T.Helper()
@@ -149,6 +267,66 @@ func (mr *MockstorerMockRecorder) Insert(topic, val interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Insert", reflect.TypeOf((*Mockstorer)(nil).Insert), topic, val)
 }
 
+// InsertBatch mocks base method.
+func (m *Mockstorer) InsertBatch(topic string, vals []*value) ([]int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "InsertBatch", topic, vals)
+	ret0, _ := ret[0].([]int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// InsertBatch indicates an expected call of InsertBatch.
+func (mr *MockstorerMockRecorder) InsertBatch(topic, vals interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InsertBatch", reflect.TypeOf((*Mockstorer)(nil).InsertBatch), topic, vals)
+}
+
+// InsertDelayed mocks base method.
+func (m *Mockstorer) InsertDelayed(topic string, val *value, dueAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "InsertDelayed", topic, val, dueAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// InsertDelayed indicates an expected call of InsertDelayed.
+func (mr *MockstorerMockRecorder) InsertDelayed(topic, val, dueAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InsertDelayed", reflect.TypeOf((*Mockstorer)(nil).InsertDelayed), topic, val, dueAt)
+}
+
+// InsertIdempotent mocks base method.
+func (m *Mockstorer) InsertIdempotent(topic, key string, val *value) (*dedupEntry, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "InsertIdempotent", topic, key, val)
+	ret0, _ := ret[0].(*dedupEntry)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// InsertIdempotent indicates an expected call of InsertIdempotent.
+func (mr *MockstorerMockRecorder) InsertIdempotent(topic, key, val interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InsertIdempotent", reflect.TypeOf((*Mockstorer)(nil).InsertIdempotent), topic, key, val)
+}
+
+// Length mocks base method.
+func (m *Mockstorer) Length(topic string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Length", topic)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Length indicates an expected call of Length.
+func (mr *MockstorerMockRecorder) Length(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Length", reflect.TypeOf((*Mockstorer)(nil).Length), topic)
+}
+
 // Meta mocks base method.
 func (m *Mockstorer) Meta() (*metadata, error) {
 	m.ctrl.T.Helper()
@@ -178,6 +356,20 @@ func (mr *MockstorerMockRecorder) Nack(topic, ackOffset interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Nack", reflect.TypeOf((*Mockstorer)(nil).Nack), topic, ackOffset)
 }
 
+// NackBatch mocks base method.
+func (m *Mockstorer) NackBatch(topic string, ackOffsets []int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NackBatch", topic, ackOffsets)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// NackBatch indicates an expected call of NackBatch.
+func (mr *MockstorerMockRecorder) NackBatch(topic, ackOffsets interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NackBatch", reflect.TypeOf((*Mockstorer)(nil).NackBatch), topic, ackOffsets)
+}
+
 // Purge mocks base method.
 func (m *Mockstorer) Purge(topic string) error {
 	m.ctrl.T.Helper()
@@ -192,6 +384,93 @@ func (mr *MockstorerMockRecorder) Purge(topic interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Purge", reflect.TypeOf((*Mockstorer)(nil).Purge), topic)
 }
 
+// Recover mocks base method.
+func (m *Mockstorer) Recover(topic string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Recover", topic)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Recover indicates an expected call of Recover.
+func (mr *MockstorerMockRecorder) Recover(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Recover", reflect.TypeOf((*Mockstorer)(nil).Recover), topic)
+}
+
+// Redrive mocks base method.
+func (m *Mockstorer) Redrive(topic string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Redrive", topic)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Redrive indicates an expected call of Redrive.
+func (mr *MockstorerMockRecorder) Redrive(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Redrive", reflect.TypeOf((*Mockstorer)(nil).Redrive), topic)
+}
+
+// Release mocks base method.
+func (m *Mockstorer) Release(topic string, ackOffsets []int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Release", topic, ackOffsets)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Release indicates an expected call of Release.
+func (mr *MockstorerMockRecorder) Release(topic, ackOffsets interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Release", reflect.TypeOf((*Mockstorer)(nil).Release), topic, ackOffsets)
+}
+
+// ReleaseDelayed mocks base method.
+func (m *Mockstorer) ReleaseDelayed(topic, id string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseDelayed", topic, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseDelayed indicates an expected call of ReleaseDelayed.
+func (mr *MockstorerMockRecorder) ReleaseDelayed(topic, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseDelayed", reflect.TypeOf((*Mockstorer)(nil).ReleaseDelayed), topic, id)
+}
+
+// RemoveExpired mocks base method.
+func (m *Mockstorer) RemoveExpired(topic string, now time.Time) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveExpired", topic, now)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RemoveExpired indicates an expected call of RemoveExpired.
+func (mr *MockstorerMockRecorder) RemoveExpired(topic, now interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveExpired", reflect.TypeOf((*Mockstorer)(nil).RemoveExpired), topic, now)
+}
+
+// RescheduleDelayed mocks base method.
+func (m *Mockstorer) RescheduleDelayed(topic, id string, dueAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RescheduleDelayed", topic, id, dueAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RescheduleDelayed indicates an expected call of RescheduleDelayed.
+func (mr *MockstorerMockRecorder) RescheduleDelayed(topic, id, dueAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RescheduleDelayed", reflect.TypeOf((*Mockstorer)(nil).RescheduleDelayed), topic, id, dueAt)
+}
+
 // ReturnDelayed mocks base method.
 func (m *Mockstorer) ReturnDelayed(topic string, before time.Time) (int, error) {
 	m.ctrl.T.Helper()
@@ -207,6 +486,35 @@ func (mr *MockstorerMockRecorder) ReturnDelayed(topic, before interface{}) *gomo
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReturnDelayed", reflect.TypeOf((*Mockstorer)(nil).ReturnDelayed), topic, before)
 }
 
+// SetConfig mocks base method.
+func (m *Mockstorer) SetConfig(topic string, cfg *topicConfig) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetConfig", topic, cfg)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetConfig indicates an expected call of SetConfig.
+func (mr *MockstorerMockRecorder) SetConfig(topic, cfg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetConfig", reflect.TypeOf((*Mockstorer)(nil).SetConfig), topic, cfg)
+}
+
+// Stats mocks base method.
+func (m *Mockstorer) Stats(topic string) (*topicStats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Stats", topic)
+	ret0, _ := ret[0].(*topicStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Stats indicates an expected call of Stats.
+func (mr *MockstorerMockRecorder) Stats(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stats", reflect.TypeOf((*Mockstorer)(nil).Stats), topic)
+}
+
 // MockdelayedIterator is a mock of delayedIterator interface.
 type MockdelayedIterator struct {
 	ctrl     *gomock.Controller
@@ -403,6 +711,20 @@ func (m *Mockleveldber) EXPECT() *MockleveldberMockRecorder {
 	return m.recorder
 }
 
+// Delete mocks base method.
+func (m *Mockleveldber) Delete(key []byte, wo *opt.WriteOptions) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", key, wo)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockleveldberMockRecorder) Delete(key, wo interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*Mockleveldber)(nil).Delete), key, wo)
+}
+
 // Get mocks base method.
 func (m *Mockleveldber) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
 	m.ctrl.T.Helper()
@@ -433,6 +755,20 @@ func (mr *MockleveldberMockRecorder) Has(key, ro interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Has", reflect.TypeOf((*Mockleveldber)(nil).Has), key, ro)
 }
 
+// NewIterator mocks base method.
+func (m *Mockleveldber) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NewIterator", slice, ro)
+	ret0, _ := ret[0].(iterator.Iterator)
+	return ret0
+}
+
+// NewIterator indicates an expected call of NewIterator.
+func (mr *MockleveldberMockRecorder) NewIterator(slice, ro interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewIterator", reflect.TypeOf((*Mockleveldber)(nil).NewIterator), slice, ro)
+}
+
 // Put mocks base method.
 func (m *Mockleveldber) Put(key, value []byte, wo *opt.WriteOptions) error {
 	m.ctrl.T.Helper()
@@ -446,3 +782,263 @@ func (mr *MockleveldberMockRecorder) Put(key, value, wo interface{}) *gomock.Cal
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Put", reflect.TypeOf((*Mockleveldber)(nil).Put), key, value, wo)
 }
+
+// Mockdatabase is a mock of database interface.
+type Mockdatabase struct {
+	ctrl     *gomock.Controller
+	recorder *MockdatabaseMockRecorder
+}
+
+// MockdatabaseMockRecorder is the mock recorder for Mockdatabase.
+type MockdatabaseMockRecorder struct {
+	mock *Mockdatabase
+}
+
+// NewMockdatabase creates a new mock instance.
+func NewMockdatabase(ctrl *gomock.Controller) *Mockdatabase {
+	mock := &Mockdatabase{ctrl: ctrl}
+	mock.recorder = &MockdatabaseMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *Mockdatabase) EXPECT() *MockdatabaseMockRecorder {
+	return m.recorder
+}
+
+// Close mocks base method.
+func (m *Mockdatabase) Close() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockdatabaseMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*Mockdatabase)(nil).Close))
+}
+
+// Delete mocks base method.
+func (m *Mockdatabase) Delete(key []byte, wo *opt.WriteOptions) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", key, wo)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockdatabaseMockRecorder) Delete(key, wo interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*Mockdatabase)(nil).Delete), key, wo)
+}
+
+// Get mocks base method.
+func (m *Mockdatabase) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", key, ro)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockdatabaseMockRecorder) Get(key, ro interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*Mockdatabase)(nil).Get), key, ro)
+}
+
+// Has mocks base method.
+func (m *Mockdatabase) Has(key []byte, ro *opt.ReadOptions) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Has", key, ro)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Has indicates an expected call of Has.
+func (mr *MockdatabaseMockRecorder) Has(key, ro interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Has", reflect.TypeOf((*Mockdatabase)(nil).Has), key, ro)
+}
+
+// NewIterator mocks base method.
+func (m *Mockdatabase) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NewIterator", slice, ro)
+	ret0, _ := ret[0].(iterator.Iterator)
+	return ret0
+}
+
+// NewIterator indicates an expected call of NewIterator.
+func (mr *MockdatabaseMockRecorder) NewIterator(slice, ro interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewIterator", reflect.TypeOf((*Mockdatabase)(nil).NewIterator), slice, ro)
+}
+
+// OpenBatch mocks base method.
+func (m *Mockdatabase) OpenBatch() (transaction, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "OpenBatch")
+	ret0, _ := ret[0].(transaction)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// OpenBatch indicates an expected call of OpenBatch.
+func (mr *MockdatabaseMockRecorder) OpenBatch() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OpenBatch", reflect.TypeOf((*Mockdatabase)(nil).OpenBatch))
+}
+
+// OpenTransaction mocks base method.
+func (m *Mockdatabase) OpenTransaction() (transaction, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "OpenTransaction")
+	ret0, _ := ret[0].(transaction)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// OpenTransaction indicates an expected call of OpenTransaction.
+func (mr *MockdatabaseMockRecorder) OpenTransaction() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OpenTransaction", reflect.TypeOf((*Mockdatabase)(nil).OpenTransaction))
+}
+
+// Put mocks base method.
+func (m *Mockdatabase) Put(key, value []byte, wo *opt.WriteOptions) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Put", key, value, wo)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Put indicates an expected call of Put.
+func (mr *MockdatabaseMockRecorder) Put(key, value, wo interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Put", reflect.TypeOf((*Mockdatabase)(nil).Put), key, value, wo)
+}
+
+// Mocktransaction is a mock of transaction interface.
+type Mocktransaction struct {
+	ctrl     *gomock.Controller
+	recorder *MocktransactionMockRecorder
+}
+
+// MocktransactionMockRecorder is the mock recorder for Mocktransaction.
+type MocktransactionMockRecorder struct {
+	mock *Mocktransaction
+}
+
+// NewMocktransaction creates a new mock instance.
+func NewMocktransaction(ctrl *gomock.Controller) *Mocktransaction {
+	mock := &Mocktransaction{ctrl: ctrl}
+	mock.recorder = &MocktransactionMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *Mocktransaction) EXPECT() *MocktransactionMockRecorder {
+	return m.recorder
+}
+
+// Commit mocks base method.
+func (m *Mocktransaction) Commit() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Commit")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Commit indicates an expected call of Commit.
+func (mr *MocktransactionMockRecorder) Commit() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Commit", reflect.TypeOf((*Mocktransaction)(nil).Commit))
+}
+
+// Delete mocks base method.
+func (m *Mocktransaction) Delete(key []byte, wo *opt.WriteOptions) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", key, wo)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MocktransactionMockRecorder) Delete(key, wo interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*Mocktransaction)(nil).Delete), key, wo)
+}
+
+// Discard mocks base method.
+func (m *Mocktransaction) Discard() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Discard")
+}
+
+// Discard indicates an expected call of Discard.
+func (mr *MocktransactionMockRecorder) Discard() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Discard", reflect.TypeOf((*Mocktransaction)(nil).Discard))
+}
+
+// Get mocks base method.
+func (m *Mocktransaction) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", key, ro)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get.
+func (mr *MocktransactionMockRecorder) Get(key, ro interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*Mocktransaction)(nil).Get), key, ro)
+}
+
+// Has mocks base method.
+func (m *Mocktransaction) Has(key []byte, ro *opt.ReadOptions) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Has", key, ro)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Has indicates an expected call of Has.
+func (mr *MocktransactionMockRecorder) Has(key, ro interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Has", reflect.TypeOf((*Mocktransaction)(nil).Has), key, ro)
+}
+
+// NewIterator mocks base method.
+func (m *Mocktransaction) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NewIterator", slice, ro)
+	ret0, _ := ret[0].(iterator.Iterator)
+	return ret0
+}
+
+// NewIterator indicates an expected call of NewIterator.
+func (mr *MocktransactionMockRecorder) NewIterator(slice, ro interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewIterator", reflect.TypeOf((*Mocktransaction)(nil).NewIterator), slice, ro)
+}
+
+// Put mocks base method.
+func (m *Mocktransaction) Put(key, value []byte, wo *opt.WriteOptions) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Put", key, value, wo)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Put indicates an expected call of Put.
+func (mr *MocktransactionMockRecorder) Put(key, value, wo interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Put", reflect.TypeOf((*Mocktransaction)(nil).Put), key, value, wo)
+}
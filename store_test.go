@@ -3,21 +3,142 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
-const tmpDBPath = "/tmp/miniqueue_test_db"
+const (
+	tmpDBPath     = "/tmp/miniqueue_test_db"
+	tmpBoltDBPath = "/tmp/miniqueue_test_db.bolt"
+)
 
-// Insert
-func TestInsert_Single(t *testing.T) {
-	s := newStore(tmpDBPath)
-	t.Cleanup(s.Destroy)
+// storeBackends are the backends the store test suite is run against.
+var storeBackends = []struct {
+	name     string
+	newStore func() storer
+}{
+	{"leveldb", func() storer { return newStore(tmpDBPath) }},
+	{"bolt", func() storer { return newBoltStore(tmpBoltDBPath) }},
+	{"memory", newMemStore},
+}
+
+// assertDelivered asserts that a value returned by GetNext is the expected
+// value, having been delivered the given number of times.
+func assertDelivered(t *testing.T, expected *value, deliveries int, actual *value) {
+	t.Helper()
+
+	if !assert.NotNil(t, actual) {
+		return
+	}
+
+	assert.False(t, actual.FirstDeliveredAt.IsZero())
+
+	want := *expected
+	want.DeliveryCount = deliveries
+	want.FirstDeliveredAt = actual.FirstDeliveredAt
+
+	assert.Equal(t, &want, actual)
+}
+
+// storeTests are run by TestStore against a new, empty store of each backend.
+var storeTests = []struct {
+	name string
+	test func(t *testing.T, s *store)
+}{
+	{"Insert_Single", testInsert_Single},
+	{"Insert_TopicMeta", testInsert_TopicMeta},
+	{"Insert_TwoSameTopic", testInsert_TwoSameTopic},
+	{"Insert_ThreeSameTopic", testInsert_ThreeSameTopic},
+	{"InsertBatch", testInsertBatch},
+	{"InsertIdempotent", testInsertIdempotent},
+	{"InsertIdempotent_Window", testInsertIdempotent_Window},
+	{"InsertDelayed", testInsertDelayed},
+	{"GetNext", testGetNext},
+	{"GetNext_SkipsExpired", testGetNext_SkipsExpired},
+	{"GetNextBatch", testGetNextBatch},
+	{"GetNext_MovesExpired", testGetNext_MovesExpired},
+	{"Insert_DefaultTTL", testInsert_DefaultTTL},
+	{"RemoveExpired", testRemoveExpired},
+	{"RemoveExpired_Dedup", testRemoveExpired_Dedup},
+	{"GetNext_TopicNotInitialised", testGetNext_TopicNotInitialised},
+	{"Ack", testAck},
+	{"Ack_WithPos", testAck_WithPos},
+	{"Nack", testNack},
+	{"Nack_Twice", testNack_Twice},
+	{"Nack_AndGet", testNack_AndGet},
+	{"SettleBatch", testSettleBatch},
+	{"Back", testBack},
+	{"Back_Get", testBack_Get},
+	{"Expire", testExpire},
+	{"Expire_Twice", testExpire_Twice},
+	{"Dack", testDack},
+	{"Dack_SameTime", testDack_SameTime},
+	{"GetDelayed", testGetDelayed},
+	{"GetDelayed_SameTimestamp", testGetDelayed_SameTimestamp},
+	{"Dack_Milliseconds", testDack_Milliseconds},
+	{"ReturnDelayed", testReturnDelayed},
+	{"ReturnDelayed_ReturnToMainQueue", testReturnDelayed_ReturnToMainQueue},
+	{"ReturnDelayed_ReturnSameTimeToMainQueue", testReturnDelayed_ReturnSameTimeToMainQueue},
+	{"ReturnDelayed_ReturnedMultipleTimes", testReturnDelayed_ReturnedMultipleTimes},
+	{"ReturnDelayed_TopicWithHyphen", testReturnDelayed_TopicWithHyphen},
+	{"Nack_DeadLetter", testNack_DeadLetter},
+	{"Dack_DeadLetter", testDack_DeadLetter},
+	{"Redrive", testRedrive},
+	{"Redrive_NoDeadLetterTopic", testRedrive_NoDeadLetterTopic},
+	{"Config", testConfig},
+	{"Recover", testRecover},
+	{"Recover_NothingOutstanding", testRecover_NothingOutstanding},
+	{"Release", testRelease},
+	{"Purge", testPurge},
+	{"Purge_Exact", testPurge_Exact},
+	{"GetNext_RecordsDelivery", testGetNext_RecordsDelivery},
+	{"GetNext_Priority", testGetNext_Priority},
+	{"Stats", testStats},
+	{"Browse", testBrowse},
+	{"Browse_Priority", testBrowse_Priority},
+	{"ReleaseDelayed", testReleaseDelayed},
+	{"RescheduleDelayed", testRescheduleDelayed},
+	{"DeleteDelayed", testDeleteDelayed},
+	{"OpenBatch", testOpenBatch},
+}
+
+func TestStore(t *testing.T) {
+	for _, b := range storeBackends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			for _, tc := range storeTests {
+				tc := tc
+				t.Run(tc.name, func(t *testing.T) {
+					s := b.newStore().(*store)
+					t.Cleanup(s.Destroy)
+
+					tc.test(t, s)
+				})
+			}
+		})
+	}
+}
+
+// forEachStore runs the test against a new, empty store of each backend.
+func forEachStore(t *testing.T, test func(t *testing.T, s *store)) {
+	for _, b := range storeBackends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			s := b.newStore().(*store)
+			t.Cleanup(s.Destroy)
 
+			test(t, s)
+		})
+	}
+}
+
+// Insert
+func testInsert_Single(t *testing.T, s *store) {
 	assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("test_value"))))
 
 	val, _, err := s.GetNext(defaultTopic)
@@ -25,10 +146,7 @@ func TestInsert_Single(t *testing.T) {
 	assert.Equal(t, "test_value", string(val.Raw))
 }
 
-func TestInsert_TopicMeta(t *testing.T) {
-	s := newStore(tmpDBPath).(*store)
-	t.Cleanup(s.Destroy)
-
+func testInsert_TopicMeta(t *testing.T, s *store) {
 	assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("test_value_1"))))
 
 	var topics []string
@@ -44,10 +162,7 @@ func TestInsert_TopicMeta(t *testing.T) {
 	assert.Contains(t, topics, "other_topic")
 }
 
-func TestInsert_TwoSameTopic(t *testing.T) {
-	s := newStore(tmpDBPath).(*store)
-	t.Cleanup(s.Destroy)
-
+func testInsert_TwoSameTopic(t *testing.T, s *store) {
 	var (
 		msg1 = newValue([]byte("test_value_1"))
 		msg2 = newValue([]byte("test_value_2"))
@@ -65,10 +180,7 @@ func TestInsert_TwoSameTopic(t *testing.T) {
 	assert.Equal(t, msg2, val)
 }
 
-func TestInsert_ThreeSameTopic(t *testing.T) {
-	s := newStore(tmpDBPath).(*store)
-	t.Cleanup(s.Destroy)
-
+func testInsert_ThreeSameTopic(t *testing.T, s *store) {
 	var (
 		msg1 = newValue([]byte("test_value_1"))
 		msg2 = newValue([]byte("test_value_2"))
@@ -92,11 +204,241 @@ func TestInsert_ThreeSameTopic(t *testing.T) {
 	assert.Equal(t, msg3, val)
 }
 
-// GetNext
-func TestGetNext(t *testing.T) {
-	s := newStore(tmpDBPath)
-	t.Cleanup(s.Destroy)
+// InsertBatch
+func testInsertBatch(t *testing.T, s *store) {
+	var (
+		msg1 = newValue([]byte("test_value_1"))
+		msg2 = newValue([]byte("test_value_2"))
+		msg3 = newValue([]byte("test_value_3"))
+	)
+
+	offsets, err := s.InsertBatch(defaultTopic, []*value{msg1, msg2})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1}, offsets)
+
+	offsets, err = s.InsertBatch(defaultTopic, []*value{msg3})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2}, offsets)
+
+	meta, err := s.Meta()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{defaultTopic}, meta.topics)
+
+	for i, msg := range []*value{msg1, msg2, msg3} {
+		val, err := getOffset(s.db, topicFmt, defaultTopic, i)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, val)
+	}
+}
+
+func TestInsert_Limits(t *testing.T) {
+	t.Run("rejects messages once full", func(t *testing.T) {
+		forEachStore(t, func(t *testing.T, s *store) {
+			assert.NoError(t, s.SetConfig(defaultTopic, &topicConfig{MaxLength: 2}))
+
+			assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("test_value_1"))))
+			assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("test_value_2"))))
+			assert.Equal(t, errTopicFull, s.Insert(defaultTopic, newValue([]byte("test_value_3"))))
+
+			// Consuming a message makes space for another.
+			_, _, err := s.GetNext(defaultTopic)
+			assert.NoError(t, err)
+			assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("test_value_3"))))
+
+			_, err = s.InsertBatch(defaultTopic, []*value{newValue([]byte("test_value_4"))})
+			assert.Equal(t, errTopicFull, err)
+		})
+	})
+
+	t.Run("limits the bytes of waiting messages", func(t *testing.T) {
+		forEachStore(t, func(t *testing.T, s *store) {
+			assert.NoError(t, s.SetConfig(defaultTopic, &topicConfig{MaxBytes: 10}))
+
+			assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("12345"))))
+			assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("12345"))))
+			assert.Equal(t, errTopicFull, s.Insert(defaultTopic, newValue([]byte("1"))))
+
+			_, offset, err := s.GetNext(defaultTopic)
+			assert.NoError(t, err)
+
+			stats, err := s.Stats(defaultTopic)
+			assert.NoError(t, err)
+			assert.Equal(t, 5, stats.Bytes)
+
+			// Returned messages count towards the limit again.
+			assert.NoError(t, s.Nack(defaultTopic, offset))
+			assert.Equal(t, errTopicFull, s.Insert(defaultTopic, newValue([]byte("1"))))
+		})
+	})
+
+	t.Run("drops the oldest messages to make space", func(t *testing.T) {
+		forEachStore(t, func(t *testing.T, s *store) {
+			assert.NoError(t, s.SetConfig(defaultTopic, &topicConfig{MaxLength: 2, OverflowPolicy: overflowDropOldest}))
+
+			for i := 1; i <= 3; i++ {
+				assert.NoError(t, s.Insert(defaultTopic, newValue([]byte(fmt.Sprintf("test_value_%d", i)))))
+			}
+
+			_, err := s.InsertBatch(defaultTopic, []*value{newValue([]byte("test_value_4")), newValue([]byte("test_value_5"))})
+			assert.NoError(t, err)
+
+			for _, msg := range []string{"test_value_4", "test_value_5"} {
+				val, _, err := s.GetNext(defaultTopic)
+				assert.NoError(t, err)
+				assert.Equal(t, msg, string(val.Raw))
+			}
+
+			// A batch exceeding the limits by itself is never published.
+			vals := []*value{newValue([]byte("a")), newValue([]byte("b")), newValue([]byte("c"))}
+			_, err = s.InsertBatch(defaultTopic, vals)
+			assert.Equal(t, errTopicFull, err)
+		})
+	})
+
+	t.Run("drops the lowest priority messages first", func(t *testing.T) {
+		forEachStore(t, func(t *testing.T, s *store) {
+			assert.NoError(t, s.SetConfig(defaultTopic, &topicConfig{MaxLength: 2, OverflowPolicy: overflowDropOldest}))
+
+			urgent := newValue([]byte("urgent"))
+			urgent.Priority = 9
+
+			assert.NoError(t, s.Insert(defaultTopic, urgent))
+			assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("bulk_1"))))
+			assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("bulk_2"))))
+
+			for _, msg := range []string{"urgent", "bulk_2"} {
+				val, _, err := s.GetNext(defaultTopic)
+				assert.NoError(t, err)
+				assert.Equal(t, msg, string(val.Raw))
+			}
+		})
+	})
+
+	t.Run("delayed messages are limited only by their own size", func(t *testing.T) {
+		forEachStore(t, func(t *testing.T, s *store) {
+			assert.NoError(t, s.SetConfig(defaultTopic, &topicConfig{MaxLength: 1, MaxBytes: 10}))
+
+			dueAt := time.Now().Add(time.Minute)
+
+			assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("12345"))))
+			assert.NoError(t, s.InsertDelayed(defaultTopic, newValue([]byte("12345")), dueAt))
+			assert.Equal(t, errTopicFull, s.InsertDelayed(defaultTopic, newValue([]byte("12345678901")), dueAt))
+
+			// Due messages are returned to a full topic.
+			count, err := s.ReturnDelayed(defaultTopic, dueAt.Add(time.Second))
+			assert.NoError(t, err)
+			assert.Equal(t, 1, count)
+
+			stats, err := s.Stats(defaultTopic)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, stats.Depth)
+		})
+	})
+}
+
+// InsertIdempotent
+func testInsertIdempotent(t *testing.T, s *store) {
+	msg1 := newValue([]byte("test_value_1"))
+
+	entry, duplicate, err := s.InsertIdempotent(defaultTopic, "key_1", msg1)
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+	assert.Equal(t, msg1.ID, entry.ID)
+	assert.Equal(t, 0, entry.Offset)
+
+	// A repeat publish returns the original message without inserting.
+	entry, duplicate, err = s.InsertIdempotent(defaultTopic, "key_1", newValue([]byte("test_value_1")))
+	assert.NoError(t, err)
+	assert.True(t, duplicate)
+	assert.Equal(t, msg1.ID, entry.ID)
+	assert.Equal(t, 0, entry.Offset)
+
+	// Keys are independent of one another.
+	entry, duplicate, err = s.InsertIdempotent(defaultTopic, "key_2", newValue([]byte("test_value_2")))
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+	assert.Equal(t, 1, entry.Offset)
+
+	stats, err := s.Stats(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Depth)
+	assert.Equal(t, 2, stats.Published)
+}
+
+func testInsertIdempotent_Window(t *testing.T, s *store) {
+	assert.NoError(t, s.SetConfig(defaultTopic, &topicConfig{DedupWindowMs: 10}))
+
+	_, _, err := s.InsertIdempotent(defaultTopic, "key_1", newValue([]byte("test_value_1")))
+	assert.NoError(t, err)
+
+	time.Sleep(20 * time.Millisecond)
+
+	// The key is forgotten once the window passes.
+	_, duplicate, err := s.InsertIdempotent(defaultTopic, "key_1", newValue([]byte("test_value_1")))
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+
+	_, err = s.RemoveExpired(defaultTopic, time.Now().Add(time.Second))
+	assert.NoError(t, err)
+
+	has, err := s.db.Has([]byte(fmt.Sprintf(dedupKeyFmt, defaultTopic, "key_1")), nil)
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
+
+// InsertDelayed
+func testInsertDelayed(t *testing.T, s *store) {
+	msg1 := newValue([]byte("test_value_1"))
+	msg2 := newValue([]byte("test_value_2"))
+
+	assert.NoError(t, s.InsertDelayed(defaultTopic, msg1, time.Now().Add(time.Minute)))
+
+	// The topic is created without any messages to consume.
+	meta, err := s.Meta()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{defaultTopic}, meta.topics)
+
+	_, _, err = s.GetNext(defaultTopic)
+	assert.Equal(t, errTopicEmpty, err)
+
+	assert.NoError(t, s.Insert(defaultTopic, msg2))
+
+	stats, err := s.Stats(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Depth)
+	assert.Equal(t, 1, stats.Delayed)
+	assert.Equal(t, 2, stats.Published)
+
+	count, err := s.ReturnDelayed(defaultTopic, time.Now().Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	for _, msg := range []*value{msg1, msg2} {
+		val, _, err := s.GetNext(defaultTopic)
+		assert.NoError(t, err)
+		assert.Equal(t, msg.Raw, val.Raw)
+	}
+}
+
+func BenchmarkInsertBatch(b *testing.B) {
+	s := newStore(b.TempDir())
+	b.Cleanup(s.Destroy)
+
+	vals := make([]*value, 100)
+	for i := range vals {
+		vals[i] = newValue([]byte("hello world"))
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		_, err := s.InsertBatch(defaultTopic, vals)
+		assert.NoError(b, err)
+	}
+}
 
+// GetNext
+func testGetNext(t *testing.T, s *store) {
 	var (
 		msg1 = newValue([]byte("test_value_1"))
 		msg2 = newValue([]byte("test_value_2"))
@@ -110,41 +452,231 @@ func TestGetNext(t *testing.T) {
 
 	val, offset, err := s.GetNext(defaultTopic)
 	assert.NoError(t, err)
-	assert.Equal(t, msg1, val)
+	assertDelivered(t, msg1, 1, val)
 	assert.Equal(t, 0, offset)
 
 	val, offset, err = s.GetNext(defaultTopic)
 	assert.NoError(t, err)
-	assert.Equal(t, msg2, val)
+	assertDelivered(t, msg2, 1, val)
 	assert.Equal(t, 1, offset)
 
 	assert.NoError(t, s.Insert(defaultTopic, msg4))
 
 	val, offset, err = s.GetNext(defaultTopic)
 	assert.NoError(t, err)
-	assert.Equal(t, msg3, val)
+	assertDelivered(t, msg3, 1, val)
 	assert.Equal(t, 2, offset)
 
 	val, offset, err = s.GetNext(defaultTopic)
 	assert.NoError(t, err)
-	assert.Equal(t, msg4, val)
+	assertDelivered(t, msg4, 1, val)
 	assert.Equal(t, 3, offset)
 }
 
-func TestGetNext_TopicNotInitialised(t *testing.T) {
-	s := newStore(tmpDBPath)
-	t.Cleanup(s.Destroy)
+func testGetNext_SkipsExpired(t *testing.T, s *store) {
+	var (
+		msg1 = newValue([]byte("test_value_1"))
+		msg2 = newValue([]byte("test_value_2"))
+		msg3 = newValue([]byte("test_value_3"))
+	)
+
+	msg1.ExpiresAt = time.Now().Add(-time.Minute)
+	msg2.setTTL(time.Hour)
+	msg3.ExpiresAt = time.Now().Add(-time.Minute)
+
+	for _, msg := range []*value{msg1, msg2, msg3} {
+		assert.NoError(t, s.Insert(defaultTopic, msg))
+	}
+
+	val, _, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, msg2.Raw, val.Raw)
+
+	// The skipped messages are removed even if there is nothing to deliver.
+	_, _, err = s.GetNext(defaultTopic)
+	assert.Equal(t, errTopicEmpty, err)
+
+	stats, err := s.Stats(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.Depth)
+}
+
+func testGetNextBatch(t *testing.T, s *store) {
+	for i := 1; i <= 4; i++ {
+		val := newValue([]byte(fmt.Sprintf("test_value_%d", i)))
+		if i == 2 {
+			val.ExpiresAt = time.Now().Add(-time.Minute)
+		}
+
+		assert.NoError(t, s.Insert(defaultTopic, val))
+	}
+
+	length, err := s.Length(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, length)
+
+	// Expired messages are skipped while filling the batch.
+	vals, offsets, err := s.GetNextBatch(defaultTopic, 2)
+	assert.NoError(t, err)
+	assert.Len(t, vals, 2)
+	assert.Equal(t, "test_value_1", string(vals[0].Raw))
+	assert.Equal(t, "test_value_3", string(vals[1].Raw))
+	assert.Equal(t, []int{0, 1}, offsets)
+
+	// A batch larger than the topic returns what remains.
+	vals, offsets, err = s.GetNextBatch(defaultTopic, 10)
+	assert.NoError(t, err)
+	assert.Len(t, vals, 1)
+	assert.Equal(t, "test_value_4", string(vals[0].Raw))
+	assert.Equal(t, []int{2}, offsets)
+
+	stats, err := s.Stats(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.Depth)
+	assert.Equal(t, 3, stats.InFlight)
+
+	_, _, err = s.GetNextBatch(defaultTopic, 10)
+	assert.Equal(t, errTopicEmpty, err)
+}
+
+func testGetNext_MovesExpired(t *testing.T, s *store) {
+	const expiredTopic = "test_topic.expired"
+
+	assert.NoError(t, s.SetConfig(defaultTopic, &topicConfig{ExpiredTopic: expiredTopic}))
+
+	msg := newValue([]byte("test_value"))
+	msg.ExpiresAt = time.Now().Add(-time.Minute)
+	assert.NoError(t, s.Insert(defaultTopic, msg))
+
+	_, _, err := s.GetNext(defaultTopic)
+	assert.Equal(t, errTopicEmpty, err)
+
+	// The message is kept on the expired topic regardless of its time to live.
+	val, _, err := s.GetNext(expiredTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, msg.ID, val.ID)
+	assert.True(t, val.ExpiresAt.IsZero())
+}
+
+func testInsert_DefaultTTL(t *testing.T, s *store) {
+	assert.NoError(t, s.SetConfig(defaultTopic, &topicConfig{TTLMs: 60000}))
+
+	msg1 := newValue([]byte("test_value_1"))
+	msg2 := newValue([]byte("test_value_2"))
+	msg2.setTTL(time.Second)
+
+	assert.NoError(t, s.Insert(defaultTopic, msg1))
+	assert.NoError(t, s.Insert(defaultTopic, msg2))
+
+	val, err := getOffset(s.db, topicFmt, defaultTopic, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, msg1.PublishedAt.Add(time.Minute), val.ExpiresAt)
+
+	// Messages published with a time to live keep it.
+	val, err = getOffset(s.db, topicFmt, defaultTopic, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, msg2.PublishedAt.Add(time.Second), val.ExpiresAt)
+}
+
+func testRemoveExpired(t *testing.T, s *store) {
+	const expiredTopic = "test_topic.expired"
+
+	assert.NoError(t, s.SetConfig(defaultTopic, &topicConfig{ExpiredTopic: expiredTopic}))
+
+	now := time.Now()
+
+	msgs := make([]*value, 5)
+	for i := range msgs {
+		msgs[i] = newValue([]byte(fmt.Sprintf("test_value_%d", i)))
+		msgs[i].ExpiresAt = now.Add(time.Hour)
+	}
+
+	// Expire messages throughout the queue.
+	msgs[0].ExpiresAt = now.Add(-time.Minute)
+	msgs[2].ExpiresAt = now.Add(-time.Minute)
+	msgs[4].ExpiresAt = now.Add(-time.Minute)
+
+	for _, msg := range msgs {
+		assert.NoError(t, s.Insert(defaultTopic, msg))
+	}
+
+	delayed := newValue([]byte("test_value_delayed"))
+	delayed.ExpiresAt = now.Add(-time.Minute)
+	assert.NoError(t, s.InsertDelayed(defaultTopic, delayed, now.Add(time.Hour)))
+
+	count, err := s.RemoveExpired(defaultTopic, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+
+	stats, err := s.Stats(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Depth)
+	assert.Equal(t, 0, stats.Delayed)
+
+	// The remaining messages are consumed in order.
+	for _, msg := range []*value{msgs[1], msgs[3]} {
+		val, _, err := s.GetNext(defaultTopic)
+		assert.NoError(t, err)
+		assert.Equal(t, msg.ID, val.ID)
+	}
+
+	_, _, err = s.GetNext(defaultTopic)
+	assert.Equal(t, errTopicEmpty, err)
+
+	stats, err = s.Stats(expiredTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, stats.Depth)
+
+	count, err = s.RemoveExpired(defaultTopic, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func testRemoveExpired_Dedup(t *testing.T, s *store) {
+	now := time.Now()
+
+	first := newValue([]byte("test_value_1"))
+	_, _, err := s.InsertIdempotent(defaultTopic, "first", first)
+	assert.NoError(t, err)
+
+	expired := newValue([]byte("test_value_expired"))
+	expired.ExpiresAt = now.Add(-time.Minute)
+	assert.NoError(t, s.Insert(defaultTopic, expired))
+
+	second := newValue([]byte("test_value_2"))
+	entry, _, err := s.InsertIdempotent(defaultTopic, "second", second)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, entry.Offset)
+
+	count, err := s.RemoveExpired(defaultTopic, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// The dedup entry of the message moved into the gap follows it.
+	for _, msg := range []struct {
+		key string
+		val *value
+	}{{"first", first}, {"second", second}} {
+		entry, duplicate, err := s.InsertIdempotent(defaultTopic, msg.key, newValue([]byte("test_value_dup")))
+		assert.NoError(t, err)
+		assert.True(t, duplicate)
+		assert.Equal(t, msg.val.ID, entry.ID)
+
+		vals, err := s.Browse(defaultTopic, 0, entry.Offset, 1)
+		assert.NoError(t, err)
+		assert.Len(t, vals, 1)
+		assert.Equal(t, msg.val.ID, vals[0].ID)
+	}
+}
 
+func testGetNext_TopicNotInitialised(t *testing.T, s *store) {
 	val, _, err := s.GetNext(defaultTopic)
 	assert.Equal(t, errTopicNotExist, err)
 	assert.Nil(t, val)
 }
 
 // Ack
-func TestAck(t *testing.T) {
-	s := newStore(tmpDBPath).(*store)
-	t.Cleanup(s.Destroy)
-
+func testAck(t *testing.T, s *store) {
 	ackOffset := 1
 	key := []byte(fmt.Sprintf(ackTopicFmt, defaultTopic, ackOffset))
 	assert.NoError(t, s.db.Put(key, []byte("hello_world"), nil))
@@ -156,10 +688,7 @@ func TestAck(t *testing.T) {
 	assert.False(t, has)
 }
 
-func TestAck_WithPos(t *testing.T) {
-	s := newStore(tmpDBPath).(*store)
-	t.Cleanup(s.Destroy)
-
+func testAck_WithPos(t *testing.T, s *store) {
 	assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("test_value_1"))))
 
 	val, ackOffset, err := s.GetNext(defaultTopic)
@@ -177,10 +706,7 @@ func TestAck_WithPos(t *testing.T) {
 }
 
 // Nack
-func TestNack(t *testing.T) {
-	s := newStore(tmpDBPath)
-	t.Cleanup(s.Destroy)
-
+func testNack(t *testing.T, s *store) {
 	assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("test_value_1"))))
 
 	_, offset, err := s.GetNext(defaultTopic)
@@ -189,10 +715,7 @@ func TestNack(t *testing.T) {
 	assert.NoError(t, s.Nack(defaultTopic, offset))
 }
 
-func TestNack_Twice(t *testing.T) {
-	s := newStore(tmpDBPath)
-	t.Cleanup(s.Destroy)
-
+func testNack_Twice(t *testing.T, s *store) {
 	assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("test_value_1"))))
 
 	_, offset, err := s.GetNext(defaultTopic)
@@ -207,10 +730,7 @@ func TestNack_Twice(t *testing.T) {
 	assert.Equal(t, err, errNackMsgNotExist)
 }
 
-func TestNack_AndGet(t *testing.T) {
-	s := newStore(tmpDBPath)
-	t.Cleanup(s.Destroy)
-
+func testNack_AndGet(t *testing.T, s *store) {
 	var (
 		msg1 = newValue([]byte("test_value_1"))
 		msg2 = newValue([]byte("test_value_2"))
@@ -221,20 +741,49 @@ func TestNack_AndGet(t *testing.T) {
 
 	val, offset, err := s.GetNext(defaultTopic)
 	assert.NoError(t, err)
-	assert.Equal(t, msg1, val)
+	assertDelivered(t, msg1, 1, val)
 
 	assert.NoError(t, s.Nack(defaultTopic, offset))
 
 	val, _, err = s.GetNext(defaultTopic)
 	assert.NoError(t, err)
-	assert.Equal(t, msg1, val)
+	msg1.FailureCount = 1
+	msg1.LastFailure = failureNack
+	assertDelivered(t, msg1, 2, val)
 }
 
-// Back
-func TestBack(t *testing.T) {
-	s := newStore(tmpDBPath)
-	t.Cleanup(s.Destroy)
+func testSettleBatch(t *testing.T, s *store) {
+	for i := 1; i <= 5; i++ {
+		assert.NoError(t, s.Insert(defaultTopic, newValue([]byte(fmt.Sprintf("test_value_%d", i)))))
+	}
+
+	_, offsets, err := s.GetNextBatch(defaultTopic, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, offsets)
+
+	// A batch containing a missing message is rejected as a whole.
+	assert.Equal(t, errNackMsgNotExist, s.NackBatch(defaultTopic, []int{0, 10}))
+
+	assert.NoError(t, s.NackBatch(defaultTopic, []int{0, 1}))
+	assert.NoError(t, s.BackBatch(defaultTopic, []int{2, 3}))
+	assert.NoError(t, s.AckBatch(defaultTopic, []int{4}))
+
+	stats, err := s.Stats(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, stats.Depth)
+	assert.Equal(t, 0, stats.InFlight)
+	assert.Equal(t, 1, stats.Acked)
+
+	// Nacked messages keep their delivery order at the front of the queue.
+	for _, msg := range []string{"test_value_1", "test_value_2", "test_value_3", "test_value_4"} {
+		val, _, err := s.GetNext(defaultTopic)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, string(val.Raw))
+	}
+}
 
+// Back
+func testBack(t *testing.T, s *store) {
 	assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("test_value_1"))))
 
 	_, offset, err := s.GetNext(defaultTopic)
@@ -243,10 +792,7 @@ func TestBack(t *testing.T) {
 	assert.NoError(t, s.Back(defaultTopic, offset))
 }
 
-func TestBack_Get(t *testing.T) {
-	s := newStore(tmpDBPath)
-	t.Cleanup(s.Destroy)
-
+func testBack_Get(t *testing.T, s *store) {
 	var (
 		msg1 = newValue([]byte("test_value_1"))
 		msg2 = newValue([]byte("test_value_2"))
@@ -262,14 +808,45 @@ func TestBack_Get(t *testing.T) {
 
 	v, _, err := s.GetNext(defaultTopic)
 	assert.NoError(t, err)
-	assert.Equal(t, msg2, v)
+	assertDelivered(t, msg2, 1, v)
 }
 
-// Dack
-func TestDack(t *testing.T) {
-	s := newStore(tmpDBPath).(*store)
-	t.Cleanup(s.Destroy)
+// Expire
+func testExpire(t *testing.T, s *store) {
+	var (
+		msg1 = newValue([]byte("test_value_1"))
+		msg2 = newValue([]byte("test_value_2"))
+	)
+
+	assert.NoError(t, s.Insert(defaultTopic, msg1))
+	assert.NoError(t, s.Insert(defaultTopic, msg2))
+
+	_, offset, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
 
+	assert.NoError(t, s.Expire(defaultTopic, offset))
+
+	// Expect the message to have been returned to the front of the queue
+	val, _, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	msg1.ExpiredCount = 1
+	msg1.FailureCount = 1
+	msg1.LastFailure = failureExpired
+	assertDelivered(t, msg1, 2, val)
+}
+
+func testExpire_Twice(t *testing.T, s *store) {
+	assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("test_value_1"))))
+
+	_, offset, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Expire(defaultTopic, offset))
+	assert.Equal(t, errExpireMsgNotExist, s.Expire(defaultTopic, offset))
+}
+
+// Dack
+func testDack(t *testing.T, s *store) {
 	msg1 := newValue([]byte("test_value_1"))
 	msg2 := newValue([]byte("test_value_2"))
 
@@ -277,16 +854,13 @@ func TestDack(t *testing.T) {
 	assert.NoError(t, s.Insert(defaultTopic, msg2))
 
 	_, offset, _ := s.GetNext(defaultTopic)
-	assert.NoError(t, s.Dack(defaultTopic, offset, 1))
+	assert.NoError(t, s.Dack(defaultTopic, offset, 1*time.Second))
 
 	_, offset, _ = s.GetNext(defaultTopic)
-	assert.NoError(t, s.Dack(defaultTopic, offset, 3))
+	assert.NoError(t, s.Dack(defaultTopic, offset, 3*time.Second))
 }
 
-func TestDack_SameTime(t *testing.T) {
-	s := newStore(tmpDBPath).(*store)
-	t.Cleanup(s.Destroy)
-
+func testDack_SameTime(t *testing.T, s *store) {
 	msg1 := newValue([]byte("test_value_1"))
 	msg2 := newValue([]byte("test_value_2"))
 
@@ -295,99 +869,112 @@ func TestDack_SameTime(t *testing.T) {
 
 	_, offset1, _ := s.GetNext(defaultTopic)
 	_, offset2, _ := s.GetNext(defaultTopic)
-	assert.NoError(t, s.Dack(defaultTopic, offset1, 1))
-	assert.NoError(t, s.Dack(defaultTopic, offset2, 1))
+	assert.NoError(t, s.Dack(defaultTopic, offset1, 1*time.Second))
+	assert.NoError(t, s.Dack(defaultTopic, offset2, 1*time.Second))
 }
 
 // GetDelayed
-func TestGetDelayed(t *testing.T) {
-	s := newStore(tmpDBPath).(*store)
-	t.Cleanup(s.Destroy)
-
+func testGetDelayed(t *testing.T, s *store) {
 	startTime := time.Now()
 
 	msg1 := newValue([]byte("test_value_1"))
 	msg2 := newValue([]byte("test_value_2"))
 
-	assert.NoError(t, insertDelay(s.db, defaultTopic, msg1, 1))
-	assert.NoError(t, insertDelay(s.db, defaultTopic, msg2, 3))
+	assert.NoError(t, insertDelay(s.db, defaultTopic, msg1, startTime.Add(1*time.Second)))
+	assert.NoError(t, insertDelay(s.db, defaultTopic, msg2, startTime.Add(3*time.Second)))
 
 	iter, closer := s.GetDelayed(defaultTopic)
 
 	assert.True(t, iter.Next())
-	timestamp, _ := strconv.Atoi(strings.Split(string(iter.Key()), "-")[3])
-	delayToTime := time.Unix(int64(timestamp), 0)
+	delayToTime, err := timeFromDelayKey(string(iter.Key()))
+	assert.NoError(t, err)
 	assert.True(t, startTime.Before(delayToTime), "expected delay timestamp to be after now")
 
 	assert.True(t, iter.Next())
-	timestamp, _ = strconv.Atoi(strings.Split(string(iter.Key()), "-")[3])
-	delayToTime = time.Unix(int64(timestamp), 0)
+	delayToTime, err = timeFromDelayKey(string(iter.Key()))
+	assert.NoError(t, err)
 	assert.True(t, startTime.Before(delayToTime), "expected delay timestamp to be after now")
 
 	assert.NoError(t, closer())
 }
 
-func TestGetDelayed_SameTimestamp(t *testing.T) {
-	s := newStore(tmpDBPath).(*store)
-	t.Cleanup(s.Destroy)
-
-	startTime := time.Now()
-
-	msg1 := newValue([]byte("test_value_1"))
-	msg2 := newValue([]byte("test_value_2"))
-
-	assert.NoError(t, s.Insert(defaultTopic, msg1))
-	assert.NoError(t, s.Insert(defaultTopic, msg2))
+func testGetDelayed_SameTimestamp(t *testing.T, s *store) {
+	dueAt := time.Now().Add(time.Second)
 
-	_, offset1, _ := s.GetNext(defaultTopic)
-	_, offset2, _ := s.GetNext(defaultTopic)
-	assert.NoError(t, s.Dack(defaultTopic, offset1, 1))
-	assert.NoError(t, s.Dack(defaultTopic, offset2, 1))
+	// Enough messages due at the same time that the local offsets would be
+	// out of order if they weren't fixed width.
+	for i := 0; i < 12; i++ {
+		assert.NoError(t, insertDelay(s.db, defaultTopic, newValue([]byte(fmt.Sprintf("test_value_%d", i))), dueAt))
+	}
 
 	iter, closer := s.GetDelayed(defaultTopic)
 
-	assert.True(t, iter.Next())
-	localOffset := strings.Split(string(iter.Key()), "-")[4]
-	timestamp, _ := strconv.Atoi(strings.Split(string(iter.Key()), "-")[3])
-	delayToTime := time.Unix(int64(timestamp), 0)
-	assert.True(t, startTime.Before(delayToTime), "expected delay timestamp to be after now")
-	assert.Equal(t, "0", localOffset)
+	for i := 0; i < 12; i++ {
+		assert.True(t, iter.Next())
+		assert.Equal(t, fmt.Sprintf("%08d", i), strings.Split(string(iter.Key()), "-")[4])
 
-	assert.True(t, iter.Next())
-	localOffset = strings.Split(string(iter.Key()), "-")[4]
-	timestamp, _ = strconv.Atoi(strings.Split(string(iter.Key()), "-")[3])
-	delayToTime = time.Unix(int64(timestamp), 0)
-	assert.True(t, startTime.Before(delayToTime), "expected delay timestamp to be after now")
-	assert.Equal(t, "1", localOffset)
+		delayToTime, err := timeFromDelayKey(string(iter.Key()))
+		assert.NoError(t, err)
+		assert.Equal(t, dueAt.UnixMilli(), delayToTime.UnixMilli())
+
+		val, err := decodeValue(iter.Value())
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("test_value_%d", i), string(val.Raw))
+	}
 
 	assert.NoError(t, closer())
 }
 
-// ReturnDelayed
-func TestReturnDelayed(t *testing.T) {
-	s := newStore(tmpDBPath).(*store)
-	t.Cleanup(s.Destroy)
+func TestTimeFromDelayKey(t *testing.T) {
+	dueAt := time.UnixMilli(1700000000123)
 
-	msg1 := newValue([]byte("test_value_1"))
-	msg2 := newValue([]byte("test_value_2"))
+	got, err := timeFromDelayKey(fmt.Sprintf(delayTopicFmt, escapeTopic("a-b"), dueAt.UnixMilli(), 3))
+	assert.NoError(t, err)
+	assert.True(t, dueAt.Equal(got))
 
-	assert.NoError(t, s.Insert(defaultTopic, msg1))
-	assert.NoError(t, s.Insert(defaultTopic, msg2))
+	for _, key := range []string{"", "t-topic", "t-topic-delay", "t-topic-delay-soon-00000001", "t-topic-head"} {
+		_, err := timeFromDelayKey(key)
+		assert.Error(t, err, key)
+	}
+}
 
-	_, offset, _ := s.GetNext(defaultTopic)
-	assert.NoError(t, s.Dack(defaultTopic, offset, 1))
-	_, offset, _ = s.GetNext(defaultTopic)
-	assert.NoError(t, s.Dack(defaultTopic, offset, 3))
+func testDack_Milliseconds(t *testing.T, s *store) {
+	assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("test_value_1"))))
 
-	count, err := s.ReturnDelayed(defaultTopic, time.Now().Add(time.Minute))
+	_, offset, err := s.GetNext(defaultTopic)
 	assert.NoError(t, err)
-	assert.Equal(t, 2, count)
+
+	start := time.Now()
+	assert.NoError(t, s.Dack(defaultTopic, offset, 250*time.Millisecond))
+
+	count, err := s.ReturnDelayed(defaultTopic, start.Add(200*time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	count, err = s.ReturnDelayed(defaultTopic, time.Now().Add(300*time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
 }
 
-func TestReturnDelayed_ReturnToMainQueue(t *testing.T) {
-	s := newStore(tmpDBPath).(*store)
-	t.Cleanup(s.Destroy)
+// ReturnDelayed
+func testReturnDelayed(t *testing.T, s *store) {
+	msg1 := newValue([]byte("test_value_1"))
+	msg2 := newValue([]byte("test_value_2"))
 
+	assert.NoError(t, s.Insert(defaultTopic, msg1))
+	assert.NoError(t, s.Insert(defaultTopic, msg2))
+
+	_, offset, _ := s.GetNext(defaultTopic)
+	assert.NoError(t, s.Dack(defaultTopic, offset, 1*time.Second))
+	_, offset, _ = s.GetNext(defaultTopic)
+	assert.NoError(t, s.Dack(defaultTopic, offset, 3*time.Second))
+
+	count, err := s.ReturnDelayed(defaultTopic, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func testReturnDelayed_ReturnToMainQueue(t *testing.T, s *store) {
 	msg1 := newValue([]byte("test_value_1"))
 	msg2 := newValue([]byte("test_value_2"))
 
@@ -395,10 +982,10 @@ func TestReturnDelayed_ReturnToMainQueue(t *testing.T) {
 	assert.NoError(t, s.Insert(defaultTopic, msg2))
 
 	_, offset, _ := s.GetNext(defaultTopic)
-	assert.NoError(t, s.Dack(defaultTopic, offset, 1))
+	assert.NoError(t, s.Dack(defaultTopic, offset, 1*time.Second))
 
 	_, offset, _ = s.GetNext(defaultTopic)
-	assert.NoError(t, s.Dack(defaultTopic, offset, 3))
+	assert.NoError(t, s.Dack(defaultTopic, offset, 3*time.Second))
 
 	count, err := s.ReturnDelayed(defaultTopic, time.Now().Add(time.Minute))
 	assert.NoError(t, err)
@@ -406,19 +993,20 @@ func TestReturnDelayed_ReturnToMainQueue(t *testing.T) {
 
 	b, _, err := s.GetNext(defaultTopic)
 	assert.NoError(t, err)
-	msg2.DackCount = 1
-	assert.Equal(t, msg2, b)
+	msg1.DackCount = 1
+	msg1.FailureCount = 1
+	msg1.LastFailure = failureDack
+	assertDelivered(t, msg1, 2, b)
 
 	b, _, err = s.GetNext(defaultTopic)
 	assert.NoError(t, err)
-	msg1.DackCount = 1
-	assert.Equal(t, msg1, b)
+	msg2.DackCount = 1
+	msg2.FailureCount = 1
+	msg2.LastFailure = failureDack
+	assertDelivered(t, msg2, 2, b)
 }
 
-func TestReturnDelayed_ReturnSameTimeToMainQueue(t *testing.T) {
-	s := newStore(tmpDBPath).(*store)
-	t.Cleanup(s.Destroy)
-
+func testReturnDelayed_ReturnSameTimeToMainQueue(t *testing.T, s *store) {
 	msg1 := newValue([]byte("test_value_1"))
 	msg2 := newValue([]byte("test_value_2"))
 
@@ -427,8 +1015,8 @@ func TestReturnDelayed_ReturnSameTimeToMainQueue(t *testing.T) {
 
 	_, offset1, _ := s.GetNext(defaultTopic)
 	_, offset2, _ := s.GetNext(defaultTopic)
-	assert.NoError(t, s.Dack(defaultTopic, offset1, 1))
-	assert.NoError(t, s.Dack(defaultTopic, offset2, 1))
+	assert.NoError(t, s.Dack(defaultTopic, offset1, 1*time.Second))
+	assert.NoError(t, s.Dack(defaultTopic, offset2, 1*time.Second))
 
 	count, err := s.ReturnDelayed(defaultTopic, time.Now().Add(time.Minute))
 	assert.NoError(t, err)
@@ -436,25 +1024,26 @@ func TestReturnDelayed_ReturnSameTimeToMainQueue(t *testing.T) {
 
 	b, _, err := s.GetNext(defaultTopic)
 	assert.NoError(t, err)
-	msg2.DackCount = 1
-	assert.Equal(t, msg2, b)
+	msg1.DackCount = 1
+	msg1.FailureCount = 1
+	msg1.LastFailure = failureDack
+	assertDelivered(t, msg1, 2, b)
 
 	b, _, err = s.GetNext(defaultTopic)
 	assert.NoError(t, err)
-	msg1.DackCount = 1
-	assert.Equal(t, msg1, b)
+	msg2.DackCount = 1
+	msg2.FailureCount = 1
+	msg2.LastFailure = failureDack
+	assertDelivered(t, msg2, 2, b)
 }
 
-func TestReturnDelayed_ReturnedMultipleTimes(t *testing.T) {
-	s := newStore(tmpDBPath).(*store)
-	t.Cleanup(s.Destroy)
-
+func testReturnDelayed_ReturnedMultipleTimes(t *testing.T, s *store) {
 	msg1 := newValue([]byte("test_value_1"))
 
 	assert.NoError(t, s.Insert(defaultTopic, msg1))
 
 	_, offset, _ := s.GetNext(defaultTopic)
-	assert.NoError(t, s.Dack(defaultTopic, offset, 1))
+	assert.NoError(t, s.Dack(defaultTopic, offset, 1*time.Second))
 
 	// Return the message to the main queue
 	count, err := s.ReturnDelayed(defaultTopic, time.Now().Add(time.Minute))
@@ -464,10 +1053,12 @@ func TestReturnDelayed_ReturnedMultipleTimes(t *testing.T) {
 	b, offset, err := s.GetNext(defaultTopic)
 	assert.NoError(t, err)
 	msg1.DackCount = 1
-	assert.Equal(t, msg1, b)
+	msg1.FailureCount = 1
+	msg1.LastFailure = failureDack
+	assertDelivered(t, msg1, 2, b)
 
 	// DACK the same message again
-	assert.NoError(t, s.Dack(defaultTopic, offset, 1))
+	assert.NoError(t, s.Dack(defaultTopic, offset, 1*time.Second))
 
 	// Return it, again
 	count, err = s.ReturnDelayed(defaultTopic, time.Now().Add(time.Minute))
@@ -477,20 +1068,227 @@ func TestReturnDelayed_ReturnedMultipleTimes(t *testing.T) {
 	b, _, err = s.GetNext(defaultTopic)
 	assert.NoError(t, err)
 	msg1.DackCount = 2
-	assert.Equal(t, msg1, b)
+	msg1.FailureCount = 2
+	msg1.LastFailure = failureDack
+	assertDelivered(t, msg1, 3, b)
 }
 
-// Purge
-func TestPurge(t *testing.T) {
-	s := newStore(tmpDBPath)
-	t.Cleanup(s.Destroy)
+func testReturnDelayed_TopicWithHyphen(t *testing.T, s *store) {
+	const topic = "test-topic"
+
+	msg1 := newValue([]byte("test_value_1"))
+	assert.NoError(t, s.Insert(topic, msg1))
+
+	_, offset, err := s.GetNext(topic)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Dack(topic, offset, 1*time.Second))
+
+	count, err := s.ReturnDelayed(topic, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	val, _, err := s.GetNext(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, msg1.Raw, val.Raw)
+}
+
+// Dead lettering
+func testNack_DeadLetter(t *testing.T, s *store) {
+	dlq := fmt.Sprintf(deadLetterTopicFmt, defaultTopic)
+	assert.NoError(t, s.SetConfig(defaultTopic, &topicConfig{MaxDeliveries: 2}))
+
+	msg1 := newValue([]byte("test_value_1"))
+	assert.NoError(t, s.Insert(defaultTopic, msg1))
+
+	// The first failure returns the message to the topic
+	_, offset, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Nack(defaultTopic, offset))
+
+	// The second failure moves it to the dead letter topic
+	_, offset, err = s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Nack(defaultTopic, offset))
+
+	_, _, err = s.GetNext(defaultTopic)
+	assert.Equal(t, errTopicEmpty, err)
+
+	val, _, err := s.GetNext(dlq)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, val.FailureCount)
+	assert.Equal(t, failureNack, val.LastFailure)
+	assert.Equal(t, msg1.Raw, val.Raw)
+}
+
+func testDack_DeadLetter(t *testing.T, s *store) {
+	dlq := fmt.Sprintf(deadLetterTopicFmt, defaultTopic)
+	assert.NoError(t, s.SetConfig(defaultTopic, &topicConfig{MaxDeliveries: 1}))
+
+	assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("test_value_1"))))
+
+	_, offset, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Dack(defaultTopic, offset, 1*time.Second))
+
+	// Expect nothing to be waiting on the delay queue
+	count, err := s.ReturnDelayed(defaultTopic, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	val, _, err := s.GetNext(dlq)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, val.FailureCount)
+	assert.Equal(t, failureDack, val.LastFailure)
+}
+
+// Redrive
+func testRedrive(t *testing.T, s *store) {
+	assert.NoError(t, s.SetConfig(defaultTopic, &topicConfig{MaxDeliveries: 1}))
+
+	var (
+		msg1 = newValue([]byte("test_value_1"))
+		msg2 = newValue([]byte("test_value_2"))
+		msg3 = newValue([]byte("test_value_3"))
+	)
+
+	assert.NoError(t, s.Insert(defaultTopic, msg1))
+	assert.NoError(t, s.Insert(defaultTopic, msg2))
+
+	for i := 0; i < 2; i++ {
+		_, offset, err := s.GetNext(defaultTopic)
+		assert.NoError(t, err)
+		assert.NoError(t, s.Back(defaultTopic, offset))
+	}
+
+	assert.NoError(t, s.Insert(defaultTopic, msg3))
+
+	count, err := s.Redrive(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Expect the redriven messages to be placed after those already waiting,
+	// with their failures reset
+	for _, msg := range []*value{msg3, msg1, msg2} {
+		deliveries := 2
+		if msg == msg3 {
+			deliveries = 1
+		}
+
+		val, _, err := s.GetNext(defaultTopic)
+		assert.NoError(t, err)
+		assertDelivered(t, msg, deliveries, val)
+	}
+
+	// Nothing left to redrive
+	count, err = s.Redrive(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func testRedrive_NoDeadLetterTopic(t *testing.T, s *store) {
+	count, err := s.Redrive(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+// Config
+func testConfig(t *testing.T, s *store) {
+	cfg, err := s.Config(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, &topicConfig{}, cfg)
+
+	assert.NoError(t, s.SetConfig(defaultTopic, &topicConfig{MaxDeliveries: 3}))
+
+	cfg, err = s.Config(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, &topicConfig{MaxDeliveries: 3}, cfg)
+}
+
+// Recover
+func testRecover(t *testing.T, s *store) {
+	// Use enough messages that the offsets are not ordered bytewise
+	var msgs []*value
+	for i := 0; i < 12; i++ {
+		msg := newValue([]byte(fmt.Sprintf("test_value_%d", i)))
+		msgs = append(msgs, msg)
+		assert.NoError(t, s.Insert(defaultTopic, msg))
+	}
+
+	// Consume all but the last message, acking the first
+	for i := 0; i < 11; i++ {
+		_, offset, err := s.GetNext(defaultTopic)
+		assert.NoError(t, err)
+
+		if i == 0 {
+			assert.NoError(t, s.Ack(defaultTopic, offset))
+		}
+	}
+
+	count, err := s.Recover(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, count)
+
+	// Expect the recovered messages back in their original order, followed by
+	// the message which was never consumed
+	for i := 1; i < 12; i++ {
+		deliveries := 2
+		if i == 11 {
+			deliveries = 1
+		}
+
+		val, _, err := s.GetNext(defaultTopic)
+		assert.NoError(t, err)
+		assertDelivered(t, msgs[i], deliveries, val)
+	}
+
+	_, _, err = s.GetNext(defaultTopic)
+	assert.Equal(t, errTopicEmpty, err)
+}
 
+func testRecover_NothingOutstanding(t *testing.T, s *store) {
+	assert.NoError(t, s.Insert(defaultTopic, newValue([]byte("test_value_1"))))
+
+	count, err := s.Recover(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func testRelease(t *testing.T, s *store) {
+	assert.NoError(t, s.SetConfig(defaultTopic, &topicConfig{MaxDeliveries: 1}))
+
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, s.Insert(defaultTopic, newValue([]byte(fmt.Sprintf("test_value_%d", i)))))
+	}
+
+	_, offsets, err := s.GetNextBatch(defaultTopic, 2)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Ack(defaultTopic, offsets[0]))
+
+	// Offsets no longer awaiting acknowledgement are skipped.
+	assert.NoError(t, s.Release(defaultTopic, offsets))
+
+	stats, err := s.Stats(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Depth)
+	assert.Equal(t, 0, stats.InFlight)
+
+	// Released messages are returned to the front without counting a failure,
+	// so are not dead lettered.
+	val, _, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, "test_value_2", string(val.Raw))
+	assert.Equal(t, 0, val.FailureCount)
+	assert.Equal(t, 2, val.DeliveryCount)
+}
+
+// Purge
+func testPurge(t *testing.T, s *store) {
 	msg1 := newValue([]byte("test_value_1"))
 	assert.NoError(t, s.Insert(defaultTopic, msg1))
 
 	// Check the value was inserted successfully
 	val, offset, err := s.GetNext(defaultTopic)
-	assert.Equal(t, msg1, val)
+	assertDelivered(t, msg1, 1, val)
 	assert.Equal(t, 0, offset)
 	assert.NoError(t, err)
 
@@ -508,10 +1306,48 @@ func TestPurge(t *testing.T) {
 	// Check the correct value is read back
 	val, offset, err = s.GetNext(defaultTopic)
 	assert.NoError(t, err)
-	assert.Equal(t, msg2, val)
+	assertDelivered(t, msg2, 1, val)
 	assert.Equal(t, 0, offset)
 }
 
+func testPurge_Exact(t *testing.T, s *store) {
+	topics := []string{"foo", "foobar", "foo-ack", "foo-1", "f%2Doo"}
+	for _, topic := range topics {
+		assert.NoError(t, s.Insert(topic, newValue([]byte(topic))))
+	}
+
+	// Give foo outstanding and delayed messages
+	assert.NoError(t, s.Insert("foo", newValue([]byte("foo"))))
+	_, offset, err := s.GetNext("foo")
+	assert.NoError(t, err)
+	assert.NoError(t, s.Dack("foo", offset, 1*time.Second))
+	_, _, err = s.GetNext("foo")
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Purge("foo"))
+
+	meta, err := s.Meta()
+	assert.NoError(t, err)
+	assert.Equal(t, topics[1:], meta.topics)
+
+	_, _, err = s.GetNext("foo")
+	assert.Equal(t, errTopicNotExist, err)
+
+	// Expect every other topic to be untouched
+	for _, topic := range topics[1:] {
+		val, _, err := s.GetNext(topic)
+		assert.NoError(t, err)
+		assert.Equal(t, topic, string(val.Raw))
+	}
+
+	// Expect the topic to be added to the metadata again once recreated
+	assert.NoError(t, s.Insert("foo", newValue([]byte("foo"))))
+
+	meta, err = s.Meta()
+	assert.NoError(t, err)
+	assert.Equal(t, append(topics[1:], "foo"), meta.topics)
+}
+
 func BenchmarkPurge(b *testing.B) {
 	s := newStore(b.TempDir())
 	b.Cleanup(s.Destroy)
@@ -522,7 +1358,347 @@ func BenchmarkPurge(b *testing.B) {
 	}
 }
 
+// Delivery
+func testGetNext_RecordsDelivery(t *testing.T, s *store) {
+	msg1 := newValue([]byte("test_value_1"))
+	msg1.Headers = map[string]string{"trace": "abc"}
+	assert.NoError(t, s.Insert(defaultTopic, msg1))
+
+	before := time.Now()
+
+	val, offset, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, msg1.ID, val.ID)
+	assert.Equal(t, msg1.PublishedAt, val.PublishedAt)
+	assert.Equal(t, msg1.Headers, val.Headers)
+	assert.Equal(t, 1, val.DeliveryCount)
+	assert.False(t, val.FirstDeliveredAt.Before(before))
+
+	firstDeliveredAt := val.FirstDeliveredAt
+
+	// Redelivering the message keeps its first delivery time
+	assert.NoError(t, s.Nack(defaultTopic, offset))
+
+	val, _, err = s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, val.DeliveryCount)
+	assert.Equal(t, firstDeliveredAt, val.FirstDeliveredAt)
+}
+
+func testGetNext_Priority(t *testing.T, s *store) {
+	for i, priority := range []int{0, 5, 9, 5, 0} {
+		val := newValue([]byte(fmt.Sprintf("test_value_%d", i+1)))
+		val.Priority = priority
+		assert.NoError(t, s.Insert(defaultTopic, val))
+	}
+
+	stats, err := s.Stats(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, stats.Depth)
+
+	// The highest priority is delivered first, in order within a level.
+	val, offset, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, "test_value_3", string(val.Raw))
+	assert.Equal(t, 9, val.Priority)
+
+	val, offset, err = s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, "test_value_2", string(val.Raw))
+
+	// A returned message keeps its priority, ahead of its level.
+	assert.NoError(t, s.Nack(defaultTopic, offset))
+
+	for _, msg := range []string{"test_value_2", "test_value_4", "test_value_1", "test_value_5"} {
+		val, _, err := s.GetNext(defaultTopic)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, string(val.Raw))
+	}
+
+	_, _, err = s.GetNext(defaultTopic)
+	assert.Equal(t, errTopicEmpty, err)
+}
+
 // Close
 func TestClose(t *testing.T) {
 	// TODO
 }
+
+func testStats(t *testing.T, s *store) {
+	const topic = "test_topic"
+
+	_, err := s.Stats(topic)
+	assert.Equal(t, errTopicNotExist, err)
+
+	first := newValue([]byte("test_value"))
+	assert.NoError(t, s.Insert(topic, first))
+
+	_, err = s.InsertBatch(topic, []*value{
+		newValue([]byte("test_value")),
+		newValue([]byte("test_value")),
+		newValue([]byte("test_value")),
+		newValue([]byte("test_value")),
+	})
+	assert.NoError(t, err)
+
+	// Consume three messages, delaying one and leaving two in flight
+	for i := 0; i < 3; i++ {
+		_, _, err := s.GetNext(topic)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, s.Dack(topic, 0, 60*time.Second))
+
+	stats, err := s.Stats(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Depth)
+	assert.Equal(t, 2, stats.InFlight)
+	assert.Equal(t, 1, stats.Delayed)
+	assert.Equal(t, 5, stats.Published)
+	assert.Equal(t, 0, stats.Acked)
+	assert.False(t, stats.Oldest.IsZero())
+	assert.False(t, stats.Oldest.Before(first.PublishedAt))
+
+	// Expect NACK'ed messages to be counted back on the main queue, and
+	// repeated ACKs to be counted once.
+	assert.NoError(t, s.Nack(topic, 1))
+	assert.NoError(t, s.Ack(topic, 2))
+	assert.NoError(t, s.Ack(topic, 2))
+
+	stats, err = s.Stats(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stats.Depth)
+	assert.Equal(t, 0, stats.InFlight)
+	assert.Equal(t, 1, stats.Delayed)
+	assert.Equal(t, 5, stats.Published)
+	assert.Equal(t, 1, stats.Acked)
+
+	// Expect the counts to be reset once purged
+	assert.NoError(t, s.Purge(topic))
+	assert.NoError(t, s.Insert(topic, newValue([]byte("test_value"))))
+
+	stats, err = s.Stats(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Published)
+	assert.Equal(t, 0, stats.Acked)
+}
+
+func testBrowse(t *testing.T, s *store) {
+	const topic = "test_topic"
+
+	_, err := s.Browse(topic, maxPriority, 0, 10)
+	assert.Equal(t, errTopicNotExist, err)
+
+	_, err = s.BrowseAcks(topic, 0, 10)
+	assert.Equal(t, errTopicNotExist, err)
+
+	for i := 0; i < 12; i++ {
+		assert.NoError(t, s.Insert(topic, newValue([]byte(fmt.Sprintf("test_value_%d", i)))))
+	}
+
+	for i := 0; i < 11; i++ {
+		_, _, err := s.GetNext(topic)
+		assert.NoError(t, err)
+	}
+
+	// Return the first message to the head of the topic
+	assert.NoError(t, s.Nack(topic, 0))
+
+	vals, err := s.Browse(topic, maxPriority, 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, vals, 2)
+	assert.Equal(t, 10, vals[0].Offset)
+	assert.Equal(t, "test_value_0", string(vals[0].Raw))
+	assert.Equal(t, 11, vals[1].Offset)
+	assert.Equal(t, "test_value_11", string(vals[1].Raw))
+
+	// Expect offsets to be ordered numerically rather than bytewise
+	vals, err = s.BrowseAcks(topic, 2, 3)
+	assert.NoError(t, err)
+	assert.Len(t, vals, 3)
+	for i, val := range vals {
+		assert.Equal(t, i+2, val.Offset)
+		assert.Equal(t, fmt.Sprintf("test_value_%d", i+2), string(val.Raw))
+	}
+
+	vals, err = s.BrowseAcks(topic, 9, 10)
+	assert.NoError(t, err)
+	assert.Len(t, vals, 2)
+
+	// Expect browsing to leave the messages in place
+	stats, err := s.Stats(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Depth)
+	assert.Equal(t, 10, stats.InFlight)
+
+	val, _, err := s.GetNext(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, "test_value_0", string(val.Raw))
+}
+
+func testBrowse_Priority(t *testing.T, s *store) {
+	for i, priority := range []int{0, 5, 9, 5, 0} {
+		val := newValue([]byte(fmt.Sprintf("test_value_%d", i+1)))
+		val.Priority = priority
+		assert.NoError(t, s.Insert(defaultTopic, val))
+	}
+
+	// Expect paging from the priority and offset after the last message
+	// browsed to visit every message once, in delivery order.
+	var (
+		msgs           []string
+		priority, from = maxPriority, 0
+	)
+
+	for i := 0; i < 5; i++ {
+		vals, err := s.Browse(defaultTopic, priority, from, 2)
+		assert.NoError(t, err)
+
+		if len(vals) == 0 {
+			break
+		}
+
+		for _, val := range vals {
+			msgs = append(msgs, string(val.Raw))
+		}
+
+		last := vals[len(vals)-1]
+		priority, from = last.Priority, last.Offset+1
+	}
+
+	assert.Equal(t, []string{"test_value_3", "test_value_2", "test_value_4", "test_value_1", "test_value_5"}, msgs)
+
+	// Expect browsing from a lower priority to skip the levels above it.
+	vals, err := s.Browse(defaultTopic, 5, 1, 10)
+	assert.NoError(t, err)
+	assert.Len(t, vals, 3)
+	assert.Equal(t, "test_value_4", string(vals[0].Raw))
+	assert.Equal(t, "test_value_1", string(vals[1].Raw))
+	assert.Equal(t, 0, vals[1].Offset)
+}
+
+// helperDackAll consumes every message on a topic, delaying each in turn by
+// the given delays.
+func helperDackAll(t *testing.T, s *store, topic string, delays ...time.Duration) {
+	t.Helper()
+
+	for _, delay := range delays {
+		_, offset, err := s.GetNext(topic)
+		assert.NoError(t, err)
+		assert.NoError(t, s.Dack(topic, offset, delay))
+	}
+}
+
+func testReleaseDelayed(t *testing.T, s *store) {
+	var (
+		msg1 = newValue([]byte("test_value_1"))
+		msg2 = newValue([]byte("test_value_2"))
+	)
+
+	assert.NoError(t, s.Insert(defaultTopic, msg1))
+	assert.NoError(t, s.Insert(defaultTopic, msg2))
+	helperDackAll(t, s, defaultTopic, time.Minute, time.Minute)
+
+	assert.Equal(t, errDelayedMsgNotExist, s.ReleaseDelayed(defaultTopic, "unknown"))
+	assert.NoError(t, s.ReleaseDelayed(defaultTopic, msg2.ID))
+	assert.Equal(t, errDelayedMsgNotExist, s.ReleaseDelayed(defaultTopic, msg2.ID))
+
+	val, _, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, msg2.ID, val.ID)
+
+	_, _, err = s.GetNext(defaultTopic)
+	assert.Equal(t, errTopicEmpty, err)
+
+	stats, err := s.Stats(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Delayed)
+}
+
+func testRescheduleDelayed(t *testing.T, s *store) {
+	var (
+		msg1 = newValue([]byte("test_value_1"))
+		msg2 = newValue([]byte("test_value_2"))
+	)
+
+	assert.NoError(t, s.Insert(defaultTopic, msg1))
+	assert.NoError(t, s.Insert(defaultTopic, msg2))
+	helperDackAll(t, s, defaultTopic, time.Minute, 2*time.Minute)
+
+	now := time.Now()
+	assert.Equal(t, errDelayedMsgNotExist, s.RescheduleDelayed(defaultTopic, "unknown", now))
+
+	// Move the second message before the first, and the first to the past
+	assert.NoError(t, s.RescheduleDelayed(defaultTopic, msg2.ID, now.Add(30*time.Second)))
+	assert.NoError(t, s.RescheduleDelayed(defaultTopic, msg1.ID, now.Add(-time.Minute)))
+
+	count, err := s.ReturnDelayed(defaultTopic, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	val, _, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, msg1.ID, val.ID)
+
+	count, err = s.ReturnDelayed(defaultTopic, now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	val, _, err = s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, msg2.ID, val.ID)
+}
+
+func testDeleteDelayed(t *testing.T, s *store) {
+	msg1 := newValue([]byte("test_value_1"))
+
+	assert.NoError(t, s.Insert(defaultTopic, msg1))
+	helperDackAll(t, s, defaultTopic, time.Minute)
+
+	assert.Equal(t, errDelayedMsgNotExist, s.DeleteDelayed(defaultTopic, "unknown"))
+	assert.NoError(t, s.DeleteDelayed(defaultTopic, msg1.ID))
+	assert.Equal(t, errDelayedMsgNotExist, s.DeleteDelayed(defaultTopic, msg1.ID))
+
+	count, err := s.ReturnDelayed(defaultTopic, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+// Batch
+func testOpenBatch(t *testing.T, s *store) {
+	assert.NoError(t, s.db.Put([]byte("b-1"), []byte("one"), nil))
+	assert.NoError(t, s.db.Put([]byte("b-2"), []byte("two"), nil))
+
+	batch, err := s.db.OpenBatch()
+	assert.NoError(t, err)
+
+	// Writes pending in the batch are visible to its own reads
+	assert.NoError(t, batch.Put([]byte("b-3"), []byte("three"), nil))
+	assert.NoError(t, batch.Delete([]byte("b-1"), nil))
+
+	got, err := batch.Get([]byte("b-3"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("three"), got)
+
+	has, err := batch.Has([]byte("b-1"), nil)
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	iter := batch.NewIterator(&util.Range{Start: []byte("b-"), Limit: []byte("b-9")}, nil)
+	var keys []string
+	for iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Release()
+	assert.NoError(t, iter.Error())
+	assert.Equal(t, []string{"b-2", "b-3"}, keys)
+
+	assert.NoError(t, batch.Commit())
+	batch.Discard()
+
+	_, err = s.db.Get([]byte("b-1"), nil)
+	assert.Equal(t, leveldb.ErrNotFound, err)
+
+	got, err = s.db.Get([]byte("b-3"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("three"), got)
+}
@@ -2,32 +2,174 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// The version bytes prefixing values encoded in the versioned binary format.
+// Values without a known version byte were encoded by earlier releases using
+// gob, whose records never begin with these bytes.
+const (
+	valueVersion1 byte = 1
+	// valueVersion2 adds the expiry time of the value, following its raw bytes.
+	valueVersion2 byte = 2
+	// valueVersion3 adds the priority of the value, following its expiry time.
+	valueVersion3 byte = 3
 )
 
+var errValueTruncated = errors.New("value truncated")
+
 type value struct {
-	DackCount int
-	Raw       []byte
+	ID               string            // unique ID assigned on publish
+	PublishedAt      time.Time         // time the value was published
+	FirstDeliveredAt time.Time         // time the value was first delivered, zero if never
+	DeliveryCount    int               // number of times the value has been delivered
+	Headers          map[string]string // arbitrary headers set by the publisher
+
+	DackCount    int
+	ExpiredCount int    // number of times the lease on the value has expired
+	FailureCount int    // number of failed deliveries of the value
+	LastFailure  string // reason for the most recent failed delivery
+	Raw          []byte
+
+	ExpiresAt time.Time // time after which the value is no longer delivered, zero if never
+	Priority  int       // priority level of the value, higher levels are delivered first
 }
 
+// newValue returns a new value to be published, assigning it a unique ID.
 func newValue(b []byte) *value {
 	return &value{
-		DackCount: 0,
-		Raw:       b,
+		ID:          xid.New().String(),
+		PublishedAt: time.Now().UTC(),
+		DackCount:   0,
+		Raw:         b,
 	}
 }
 
+// Encode encodes the value in the version 3 binary format. Following the
+// version byte, each field is written in order, with integers as varints and
+// strings and bytes prefixed by their length. Times are written as unix
+// nanoseconds, 0 being the zero time. New fields must only be added along with
+// a new version.
 func (v *value) Encode() ([]byte, error) {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
-		return nil, fmt.Errorf("gob encoding value: %v", err)
+	b := make([]byte, 0, 64+len(v.ID)+len(v.LastFailure)+len(v.Raw))
+
+	b = append(b, valueVersion3)
+	b = appendBytes(b, []byte(v.ID))
+	b = binary.AppendVarint(b, unixNano(v.PublishedAt))
+	b = binary.AppendVarint(b, unixNano(v.FirstDeliveredAt))
+	b = binary.AppendVarint(b, int64(v.DeliveryCount))
+
+	names := make([]string, 0, len(v.Headers))
+	for name := range v.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b = binary.AppendUvarint(b, uint64(len(names)))
+	for _, name := range names {
+		b = appendBytes(b, []byte(name))
+		b = appendBytes(b, []byte(v.Headers[name]))
 	}
 
-	return buf.Bytes(), nil
+	b = binary.AppendVarint(b, int64(v.DackCount))
+	b = binary.AppendVarint(b, int64(v.ExpiredCount))
+	b = binary.AppendVarint(b, int64(v.FailureCount))
+	b = appendBytes(b, []byte(v.LastFailure))
+	b = appendBytes(b, v.Raw)
+	b = binary.AppendVarint(b, unixNano(v.ExpiresAt))
+	b = binary.AppendVarint(b, int64(v.Priority))
+
+	return b, nil
 }
 
+// setTTL sets the value to expire once the given duration has passed since it
+// was published.
+func (v *value) setTTL(ttl time.Duration) {
+	v.ExpiresAt = v.PublishedAt.Add(ttl)
+}
+
+// expired reports whether the value has expired at the given time.
+func (v *value) expired(now time.Time) bool {
+	return !v.ExpiresAt.IsZero() && !now.Before(v.ExpiresAt)
+}
+
+// decodeValue decodes a value encoded in any supported format.
 func decodeValue(b []byte) (*value, error) {
+	if isLegacyValue(b) {
+		return decodeGobValue(b)
+	}
+
+	v, err := decodeValueVersion(b[0], b[1:])
+	if err != nil {
+		return nil, fmt.Errorf("decoding v%d value: %v", b[0], err)
+	}
+
+	return v, nil
+}
+
+// isLegacyValue reports whether the encoded value predates the versioned
+// binary format, and should be re-encoded.
+func isLegacyValue(b []byte) bool {
+	return len(b) == 0 || b[0] < valueVersion1 || b[0] > valueVersion3
+}
+
+// decodeValueVersion decodes a value in the given version of the binary
+// format, each version adding fields following those of the previous.
+func decodeValueVersion(version byte, b []byte) (*value, error) {
+	var (
+		v = &value{}
+		r = valueReader{b: b}
+	)
+
+	v.ID = string(r.bytes())
+	v.PublishedAt = fromUnixNano(r.varint())
+	v.FirstDeliveredAt = fromUnixNano(r.varint())
+	v.DeliveryCount = int(r.varint())
+
+	if n := r.uvarint(); n > 0 && r.err == nil {
+		// Each header takes at least the two bytes of its length prefixes, so a
+		// larger count can only come from a corrupt value.
+		if n > uint64(len(r.b))/2 {
+			return nil, errValueTruncated
+		}
+
+		v.Headers = make(map[string]string, n)
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			name := string(r.bytes())
+			v.Headers[name] = string(r.bytes())
+		}
+	}
+
+	v.DackCount = int(r.varint())
+	v.ExpiredCount = int(r.varint())
+	v.FailureCount = int(r.varint())
+	v.LastFailure = string(r.bytes())
+	v.Raw = r.bytes()
+
+	if version >= valueVersion2 {
+		v.ExpiresAt = fromUnixNano(r.varint())
+	}
+
+	if version >= valueVersion3 {
+		v.Priority = int(r.varint())
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return v, nil
+}
+
+// decodeGobValue decodes a value encoded with gob by earlier releases.
+func decodeGobValue(b []byte) (*value, error) {
 	var v value
 	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v); err != nil {
 		return nil, fmt.Errorf("gob decoding value: %v", err)
@@ -35,3 +177,83 @@ func decodeValue(b []byte) (*value, error) {
 
 	return &v, nil
 }
+
+// valueReader reads the fields of an encoded value in order. Once an error is
+// encountered, all further reads return zero values and the error is held.
+type valueReader struct {
+	b   []byte
+	err error
+}
+
+func (r *valueReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+
+	i, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = errValueTruncated
+		return 0
+	}
+
+	r.b = r.b[n:]
+
+	return i
+}
+
+func (r *valueReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	i, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errValueTruncated
+		return 0
+	}
+
+	r.b = r.b[n:]
+
+	return i
+}
+
+// bytes reads a copy of a length prefixed byte slice, returning nil if empty.
+// The encoded value may be only be valid until the next iteration of a
+// database iterator.
+func (r *valueReader) bytes() []byte {
+	l := r.uvarint()
+	if r.err != nil || l == 0 {
+		return nil
+	}
+
+	if uint64(len(r.b)) < l {
+		r.err = errValueTruncated
+		return nil
+	}
+
+	b := append([]byte(nil), r.b[:l]...)
+	r.b = r.b[l:]
+
+	return b
+}
+
+func appendBytes(b, s []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, n).UTC()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// legacyValue is the shape of values encoded with gob by earlier releases.
+type legacyValue struct {
+	DackCount int
+	Raw       []byte
+}
+
+func helperEncodeLegacyValue(t *testing.T, v legacyValue) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&buf).Encode(v))
+
+	return buf.Bytes()
+}
+
+func TestValue_EncodeDecode(t *testing.T) {
+	t.Run("all fields", func(t *testing.T) {
+		val := newValue([]byte("test_value"))
+		val.FirstDeliveredAt = time.Now().UTC()
+		val.DeliveryCount = 3
+		val.Headers = map[string]string{"b": "2", "a": "1"}
+		val.DackCount = 1
+		val.ExpiredCount = 1
+		val.FailureCount = 2
+		val.LastFailure = failureNack
+		val.setTTL(time.Minute)
+		val.Priority = 5
+
+		b, err := val.Encode()
+		require.NoError(t, err)
+		assert.Equal(t, valueVersion3, b[0])
+
+		decoded, err := decodeValue(b)
+		require.NoError(t, err)
+		assert.Equal(t, val, decoded)
+	})
+
+	t.Run("zero value", func(t *testing.T) {
+		b, err := (&value{}).Encode()
+		require.NoError(t, err)
+
+		decoded, err := decodeValue(b)
+		require.NoError(t, err)
+		assert.Equal(t, &value{}, decoded)
+	})
+}
+
+func TestDecodeValue_Legacy(t *testing.T) {
+	b := helperEncodeLegacyValue(t, legacyValue{DackCount: 2, Raw: []byte("test_value")})
+	assert.True(t, isLegacyValue(b))
+
+	val, err := decodeValue(b)
+	require.NoError(t, err)
+	assert.Equal(t, &value{DackCount: 2, Raw: []byte("test_value")}, val)
+}
+
+func TestDecodeValue_Truncated(t *testing.T) {
+	b, err := newValue([]byte("test_value")).Encode()
+	require.NoError(t, err)
+
+	_, err = decodeValue(b[:len(b)-1])
+	assert.Error(t, err)
+}
+
+func TestDecodeValue_HeaderCountTruncated(t *testing.T) {
+	b := appendBytes(nil, []byte("id"))
+	b = binary.AppendVarint(b, 0)
+	b = binary.AppendVarint(b, 0)
+	b = binary.AppendVarint(b, 0)
+	// A header count far beyond the remaining bytes.
+	b = binary.AppendUvarint(b, math.MaxUint32)
+	b = appendBytes(b, []byte("name"))
+
+	_, err := decodeValueVersion(valueVersion3, b)
+	assert.Equal(t, errValueTruncated, err)
+}
+
+func TestDecodeValue_Version1(t *testing.T) {
+	val := newValue([]byte("test_value"))
+	val.DackCount = 1
+
+	b, err := val.Encode()
+	require.NoError(t, err)
+
+	// Version 1 values end before the zero expiry time and priority.
+	b = append([]byte{valueVersion1}, b[1:len(b)-2]...)
+	assert.False(t, isLegacyValue(b))
+
+	decoded, err := decodeValue(b)
+	require.NoError(t, err)
+	assert.Equal(t, val, decoded)
+}
+
+func TestDecodeValue_Version2(t *testing.T) {
+	val := newValue([]byte("test_value"))
+	val.setTTL(time.Minute)
+
+	b, err := val.Encode()
+	require.NoError(t, err)
+
+	// Version 2 values end before the zero priority.
+	b = append([]byte{valueVersion2}, b[1:len(b)-1]...)
+	assert.False(t, isLegacyValue(b))
+
+	decoded, err := decodeValue(b)
+	require.NoError(t, err)
+	assert.Equal(t, val, decoded)
+}